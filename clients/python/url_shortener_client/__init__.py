@@ -0,0 +1,7 @@
+"""Client of the URL Shortener API. Generated from openapi.yaml by using-redis/cmd/clientgen. Do not edit; run `make clients`."""
+
+from .client import ApiError, Client, Redirect
+from .models import *  # noqa: F403
+from .models import __all__ as _models
+
+__all__ = ["ApiError", "Client", "Redirect", *_models]
@@ -0,0 +1,594 @@
+"""Client of the URL Shortener API. Generated from openapi.yaml by using-redis/cmd/clientgen. Do not edit; run `make clients`."""
+
+from __future__ import annotations
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+from collections.abc import Iterable, Mapping
+from dataclasses import dataclass
+from typing import Any, Literal, cast
+
+from .models import (
+    Credentials,
+    UserToken,
+    WebhookRequest,
+    Webhook,
+    Quota,
+    ShortenRequest,
+    ShortenResponse,
+    LinkSummary,
+    LinkInfo,
+    LinkPatch,
+    LinkExtension,
+    EditedLink,
+    BlockedReferrers,
+    BlockedCountries,
+    StatsSummary,
+    CompareStats,
+    TopLink,
+    ClickBuckets,
+    LinkAnalytics,
+    VariantStats,
+    FreezeRequest,
+    FreezeResponse,
+    SetBlockedReferrersResponse,
+    SetBlockedCountriesResponse,
+)
+
+
+class ApiError(Exception):
+    """A response other than 2xx. body is the decoded JSON, or the text if it is not JSON."""
+
+    def __init__(self, status: int, body: Any, headers: Mapping[str, str]) -> None:
+        error = body.get("error") if isinstance(body, dict) else None
+        super().__init__(error if isinstance(error, str) else f"HTTP {status}")
+        self.status = status
+        self.body = body
+        self.headers = headers
+
+
+@dataclass
+class Redirect:
+    """A redirect the server answered with, returned instead of followed."""
+
+    status: int
+    location: str | None
+
+
+class _NoRedirect(urllib.request.HTTPRedirectHandler):
+    def redirect_request(self, req, fp, code, msg, headers, newurl):  # type: ignore[no-untyped-def]
+        return None
+
+
+def _query_value(value: Any) -> str:
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    return str(value)
+
+
+def _path_value(value: Any) -> str:
+    return urllib.parse.quote(str(value), safe="")
+
+
+class Client:
+    def __init__(self, base_url: str = "http://localhost:8080", *, api_key: str | None = None, user_token: str | None = None, timeout: float = 30) -> None:
+        self.base_url = base_url.rstrip("/")
+        self.api_key = api_key
+        self.user_token = user_token
+        self.timeout = timeout
+        self._follow = urllib.request.build_opener()
+        self._manual = urllib.request.build_opener(_NoRedirect)
+
+    def _request(
+        self,
+        method: str,
+        path: str,
+        *,
+        query: Mapping[str, Any] | None = None,
+        headers: Mapping[str, str | None] | None = None,
+        body: Any = None,
+        auth: Iterable[str] = (),
+        result: Literal["json", "text", "none"] = "none",
+        redirects: bool = False,
+    ) -> Any:
+        url = self.base_url + path
+        params = {name: _query_value(value) for name, value in (query or {}).items() if value is not None}
+        if params:
+            url += "?" + urllib.parse.urlencode(params)
+        sent = {name: value for name, value in (headers or {}).items() if value is not None}
+        auth = set(auth)
+        if "ApiKey" in auth and self.api_key is not None:
+            sent["X-API-Key"] = self.api_key
+        if "UserToken" in auth and self.user_token is not None:
+            sent["Authorization"] = "Bearer " + self.user_token
+        data = None
+        if body is not None:
+            sent["Content-Type"] = "application/json"
+            data = json.dumps(body).encode()
+
+        request = urllib.request.Request(url, data=data, headers=sent, method=method)
+        opener = self._manual if redirects else self._follow
+        try:
+            with opener.open(request, timeout=self.timeout) as response:
+                raw = response.read()
+        except urllib.error.HTTPError as err:
+            if redirects and 300 <= err.code < 400:
+                return Redirect(err.code, err.headers.get("Location"))
+            raw = err.read()
+            try:
+                decoded: Any = json.loads(raw)
+            except ValueError:
+                decoded = raw.decode(errors="replace")
+            raise ApiError(err.code, decoded, err.headers) from None
+        if result == "json":
+            return json.loads(raw)
+        if result == "text":
+            return raw.decode()
+        return None
+
+    def shorten(
+        self,
+        body: ShortenRequest,
+        *,
+        x_tenant: str | None = None,
+        idempotency_key: str | None = None,
+    ) -> ShortenResponse:
+        """Shorten a URL
+
+        x_tenant: Internal customer the link is created for. Set by a trusted gateway.
+        idempotency_key: Makes the request safe to retry. The first successful response for a key is replayed for 24 hours to requests with the same key and body.
+        """
+        return cast(
+            "ShortenResponse",
+            self._request(
+                "POST",
+                "/shorten",
+                headers={"X-Tenant": x_tenant, "Idempotency-Key": idempotency_key},
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def redirect(self, code: str) -> str | Redirect:
+        """Redirect to the destination of a short link"""
+        return cast(
+            "str | Redirect",
+            self._request(
+                "GET",
+                f"/{_path_value(code)}",
+                result="text",
+                redirects=True,
+            ),
+        )
+
+    def signup(self, body: Credentials) -> UserToken:
+        """Create an account
+
+        Needs an API key when the server runs with REQUIRE_API_KEY=true.
+        """
+        return cast(
+            "UserToken",
+            self._request(
+                "POST",
+                "/auth/signup",
+                body=body,
+                auth=("ApiKey",),
+                result="json",
+            ),
+        )
+
+    def login(self, body: Credentials) -> UserToken:
+        """Get a token for an account"""
+        return cast(
+            "UserToken",
+            self._request(
+                "POST",
+                "/auth/login",
+                body=body,
+                result="json",
+            ),
+        )
+
+    def oauth_start(self, provider: Literal["google", "github"]) -> Redirect:
+        """Start signing in with an OAuth2 provider
+
+        Meant for a browser. Redirects to the provider, which returns to the callback.
+        """
+        return cast(
+            "Redirect",
+            self._request(
+                "GET",
+                f"/auth/oauth/{_path_value(provider)}",
+                redirects=True,
+            ),
+        )
+
+    def oauth_callback(
+        self,
+        provider: Literal["google", "github"],
+        *,
+        code: str | None = None,
+        state: str,
+    ) -> UserToken | Redirect:
+        """Finish signing in with an OAuth2 provider
+
+        Called by the provider. Answers with a token, or with OAUTH_SUCCESS_URL set, redirects there with token, user and expires_at in the fragment.
+        """
+        return cast(
+            "UserToken | Redirect",
+            self._request(
+                "GET",
+                f"/auth/oauth/{_path_value(provider)}/callback",
+                query={"code": code, "state": state},
+                result="json",
+                redirects=True,
+            ),
+        )
+
+    def get_quota(self) -> Quota:
+        """The caller's active links and link quota"""
+        return cast(
+            "Quota",
+            self._request(
+                "GET",
+                "/quota",
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def get_info(self, code: str) -> LinkInfo:
+        """Details of a short link"""
+        return cast(
+            "LinkInfo",
+            self._request(
+                "GET",
+                f"/info/{_path_value(code)}",
+                result="json",
+            ),
+        )
+
+    def list_links(
+        self,
+        *,
+        channel: Literal["api", "form", "import", "seed"] | None = None,
+        client: str | None = None,
+        batch: str | None = None,
+        ip: str | None = None,
+        namespace: str | None = None,
+    ) -> list[LinkSummary]:
+        """List the caller's links, or all links for admins
+
+        channel: Only links created through this channel.
+        client: Only links created by the integration that sent this X-Client.
+        batch: Only links created by this import job.
+        ip: Only links created from this address or CIDR range. Needs the admin token.
+        namespace: Every link in this namespace, whoever created it. Needs the admin token or a user bound to the namespace.
+        """
+        return cast(
+            "list[LinkSummary]",
+            self._request(
+                "GET",
+                "/list",
+                query={"channel": channel, "client": client, "batch": batch, "ip": ip, "namespace": namespace},
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def top_links(self, *, limit: int | None = None) -> list[TopLink]:
+        """The most-clicked links
+
+        Needs the admin token or a user with the admin role.
+        """
+        return cast(
+            "list[TopLink]",
+            self._request(
+                "GET",
+                "/top",
+                query={"limit": limit},
+                auth=("UserToken",),
+                result="json",
+            ),
+        )
+
+    def delete_link(self, code: str) -> None:
+        """Delete a short link
+
+        Users may delete their own links, API keys the links created with them; admins may delete any.
+        """
+        self._request(
+            "DELETE",
+            f"/delete/{_path_value(code)}",
+            auth=("ApiKey", "UserToken"),
+        )
+
+    def update_link(self, code: str, body: LinkPatch) -> EditedLink:
+        """Change the destination or expiry of a short link
+
+        Keeps the code, clicks and stats. Users may edit their own links; admins may edit any.
+        """
+        return cast(
+            "EditedLink",
+            self._request(
+                "PATCH",
+                f"/links/{_path_value(code)}",
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def extend_link(self, code: str, body: LinkExtension) -> EditedLink:
+        """Push back the expiry of a short link
+
+        Counts from the current expiry, or from now if the link has expired. Who may extend is the same as who may edit.
+        """
+        return cast(
+            "EditedLink",
+            self._request(
+                "POST",
+                f"/links/{_path_value(code)}/extend",
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def set_blocked_referrers(
+        self,
+        code: str,
+        body: BlockedReferrers,
+    ) -> SetBlockedReferrersResponse:
+        """Replace the referrer patterns a link refuses to redirect from
+
+        Users may change their own links; admins may change any.
+        """
+        return cast(
+            "SetBlockedReferrersResponse",
+            self._request(
+                "PUT",
+                f"/blocked-referrers/{_path_value(code)}",
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def set_blocked_countries(
+        self,
+        code: str,
+        body: BlockedCountries,
+    ) -> SetBlockedCountriesResponse:
+        """Replace the countries a link is blocked in
+
+        Users may change their own links; admins may change any.
+        """
+        return cast(
+            "SetBlockedCountriesResponse",
+            self._request(
+                "PUT",
+                f"/blocked-countries/{_path_value(code)}",
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def get_stats_summary(self) -> StatsSummary:
+        """Global link and redirect totals"""
+        return cast(
+            "StatsSummary",
+            self._request(
+                "GET",
+                "/stats/summary",
+                result="json",
+            ),
+        )
+
+    def compare_stats(
+        self,
+        *,
+        codes: str,
+        from_: str | None = None,
+        to: str | None = None,
+    ) -> CompareStats:
+        """Daily clicks for several links side by side
+
+        codes: Up to 20 comma-separated codes.
+        from_: First UTC day (YYYY-MM-DD), default 30 days ago.
+        to: Last UTC day (YYYY-MM-DD), default today.
+        """
+        return cast(
+            "CompareStats",
+            self._request(
+                "GET",
+                "/stats/compare",
+                query={"codes": codes, "from": from_, "to": to},
+                result="json",
+            ),
+        )
+
+    def click_buckets(
+        self,
+        code: str,
+        *,
+        granularity: Literal["day", "hour"] | None = None,
+        from_: str | None = None,
+        to: str | None = None,
+    ) -> ClickBuckets:
+        """Clicks of one link per day or per hour
+
+        from_: First UTC day (YYYY-MM-DD), default 30 days ago, or today for hourly buckets.
+        to: Last UTC day (YYYY-MM-DD), default today.
+        """
+        return cast(
+            "ClickBuckets",
+            self._request(
+                "GET",
+                f"/stats/{_path_value(code)}",
+                query={"granularity": granularity, "from": from_, "to": to},
+                result="json",
+            ),
+        )
+
+    def link_analytics(
+        self,
+        code: str,
+        *,
+        from_: str | None = None,
+        to: str | None = None,
+    ) -> LinkAnalytics:
+        """Clicks, unique visitors, referrers, browsers, devices, countries and cities of one link
+
+        Users may read the analytics of their own links; admins may read any.
+
+        from_: First UTC day (YYYY-MM-DD), default 30 days ago.
+        to: Last UTC day (YYYY-MM-DD), default today.
+        """
+        return cast(
+            "LinkAnalytics",
+            self._request(
+                "GET",
+                f"/analytics/{_path_value(code)}",
+                query={"from": from_, "to": to},
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def export_link_analytics(
+        self,
+        code: str,
+        *,
+        data: Literal["daily", "events"] | None = None,
+        format: Literal["csv"] | None = None,
+        from_: str | None = None,
+        to: str | None = None,
+    ) -> str:
+        """One link's analytics as CSV
+
+        Users may export their own links; admins may export any. data=events needs the admin token or a user with the admin role.
+
+        data: daily rows per day, or events rows per raw click event (admin only).
+        from_: First UTC day (YYYY-MM-DD), default 30 days ago.
+        to: Last UTC day (YYYY-MM-DD), default today.
+        """
+        return cast(
+            "str",
+            self._request(
+                "GET",
+                f"/analytics/{_path_value(code)}/export",
+                query={"data": data, "format": format, "from": from_, "to": to},
+                auth=("ApiKey", "UserToken"),
+                result="text",
+            ),
+        )
+
+    def export_analytics(
+        self,
+        *,
+        data: Literal["daily", "events"] | None = None,
+        format: Literal["csv"] | None = None,
+        from_: str | None = None,
+        to: str | None = None,
+    ) -> str:
+        """Analytics of every link as CSV
+
+        Needs the admin token or a user with the admin role. Daily rows are only written for days with clicks.
+
+        data: daily rows per day, or events rows per raw click event (admin only).
+        from_: First UTC day (YYYY-MM-DD), default 30 days ago.
+        to: Last UTC day (YYYY-MM-DD), default today.
+        """
+        return cast(
+            "str",
+            self._request(
+                "GET",
+                "/analytics/export",
+                query={"data": data, "format": format, "from": from_, "to": to},
+                auth=("UserToken",),
+                result="text",
+            ),
+        )
+
+    def create_webhook(self, body: WebhookRequest) -> Webhook:
+        """Register a webhook for link lifecycle events
+
+        A signed-in user's webhooks hear about that user's links; the admin's hear about every link. Each delivery is a signed POST, retried with backoff when it fails. The secret is only returned here.
+        """
+        return cast(
+            "Webhook",
+            self._request(
+                "POST",
+                "/webhooks",
+                body=body,
+                auth=("UserToken",),
+                result="json",
+            ),
+        )
+
+    def list_webhooks(self) -> list[Webhook]:
+        """The caller's webhooks without their secrets, oldest first"""
+        return cast(
+            "list[Webhook]",
+            self._request(
+                "GET",
+                "/webhooks",
+                auth=("UserToken",),
+                result="json",
+            ),
+        )
+
+    def delete_webhook(self, id: str) -> None:
+        """Delete a webhook; its pending deliveries are dropped"""
+        self._request(
+            "DELETE",
+            f"/webhooks/{_path_value(id)}",
+            auth=("UserToken",),
+        )
+
+    def get_variants(self, code: str) -> VariantStats:
+        """Per-variant visits and conversions of a split link"""
+        return cast(
+            "VariantStats",
+            self._request(
+                "GET",
+                f"/variants/{_path_value(code)}",
+                result="json",
+            ),
+        )
+
+    def freeze_variant(self, code: str, body: FreezeRequest | None = None) -> FreezeResponse:
+        """Send all traffic of a split link to one variant
+
+        Users may freeze their own links; admins may freeze any.
+        """
+        return cast(
+            "FreezeResponse",
+            self._request(
+                "POST",
+                f"/variants/{_path_value(code)}/freeze",
+                body=body,
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
+
+    def unfreeze_variant(self, code: str) -> FreezeResponse:
+        """Resume splitting traffic
+
+        Users may unfreeze their own links; admins may unfreeze any.
+        """
+        return cast(
+            "FreezeResponse",
+            self._request(
+                "DELETE",
+                f"/variants/{_path_value(code)}/freeze",
+                auth=("ApiKey", "UserToken"),
+                result="json",
+            ),
+        )
@@ -0,0 +1,349 @@
+"""Types of the URL Shortener API. Generated from openapi.yaml by using-redis/cmd/clientgen. Do not edit; run `make clients`."""
+
+from __future__ import annotations
+
+from typing import Any, Literal, NotRequired, TypedDict
+
+__all__ = ["Credentials", "UserToken", "WebhookRequest", "Webhook", "FieldError", "QuotaExceeded", "Error", "QuotaNamespace", "Quota", "ShortenRequest", "ShortenResponse", "LinkSource", "LinkSummary", "LinkInfo", "LinkPatch", "LinkExtension", "EditedLink", "BlockedReferrers", "BlockedCountries", "StatsSummarySinceBoot", "StatsSummary", "CompareStatsSeriesItem", "CompareStats", "TopLink", "ClickBucketsBucketsItem", "ClickBuckets", "LinkAnalyticsDaysItem", "LinkAnalyticsReferrersItem", "LinkAnalyticsCitiesItem", "LinkAnalytics", "VariantStatsVariantsItem", "VariantStats", "FreezeRequest", "FreezeResponse", "SetBlockedReferrersResponse", "SetBlockedCountriesResponse"]
+
+
+class Credentials(TypedDict):
+    user: str
+    password: str
+
+
+class UserToken(TypedDict):
+    user: str
+    token: str
+    # Present for admins.
+    role: NotRequired[Literal["admin"]]
+    expires_at: str
+
+
+class WebhookRequest(TypedDict):
+    url: str
+    events: list[Literal["link.created", "link.updated", "link.deleted", "link.expired", "link.clicks"]]
+    # Required with link.clicks, which fires once a link's clicks reach it.
+    click_threshold: NotRequired[int]
+
+
+class Webhook(TypedDict):
+    id: str
+    url: str
+    events: list[str]
+    click_threshold: NotRequired[int]
+    # Absent on the admin's webhooks, which hear about every link.
+    owner: NotRequired[str]
+    # Only returned on creation. Deliveries carry X-Webhook-Signature, sha256= and the hex HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>" keyed with it.
+    secret: NotRequired[str]
+    created_at: str
+
+
+class FieldError(TypedDict):
+    field: str
+    constraint: str
+    message: str
+
+
+class QuotaExceeded(TypedDict):
+    limit: int
+    active: int
+    # Links the request would have created, the link and its aliases.
+    requested: int
+    # Set when the quota of this namespace, not LINK_QUOTA, was exceeded.
+    namespace: NotRequired[str]
+
+
+class Error(TypedDict):
+    error: str
+    fields: NotRequired[list[FieldError]]
+    quota: NotRequired[QuotaExceeded]
+
+
+class QuotaNamespace(TypedDict):
+    """The namespace the caller is bound to; absent when there is none."""
+    name: str
+    active: int
+    # The namespace's quota; absent when there is none.
+    limit: NotRequired[int]
+    remaining: NotRequired[int]
+
+
+class Quota(TypedDict):
+    # Stored, unexpired links that count against the caller.
+    active: int
+    # LINK_QUOTA; absent when there is none.
+    limit: NotRequired[int]
+    remaining: NotRequired[int]
+    # The namespace the caller is bound to; absent when there is none.
+    namespace: NotRequired[QuotaNamespace]
+
+
+class ShortenRequest(TypedDict):
+    url: str
+    # Letters and digits. Route names such as list or shorten, and the words in reserved_codes, are rejected in any case.
+    custom_code: NotRequired[str]
+    # Seconds until the link expires. 0 or absent for default_expiry, -1 or "never" for no expiry.
+    expiry_seconds: NotRequired[int | Literal["never"]]
+    stateless: NotRequired[bool]
+    verify: NotRequired[bool]
+    # Lua routing script (Redis mode).
+    script: NotRequired[str]
+    tags: NotRequired[list[str]]
+    on_conflict: NotRequired[Literal["error", "return_existing", "suffix"]]
+    fallbacks: NotRequired[list[str]]
+    sample_rate: NotRequired[int]
+    variants: NotRequired[list[str]]
+    bandit: NotRequired[bool]
+    # Hosts, optionally followed by a path prefix, whose visitors get 403 instead of a redirect.
+    block_referrers: NotRequired[list[str]]
+    # ISO country codes whose visitors get 451 instead of a redirect, besides GEO_BLOCK.
+    block_countries: NotRequired[list[str]]
+    # Visitors confirm they are at least this old before they are redirected.
+    min_age: NotRequired[int]
+    # Redirects before the link answers 410, e.g. 1 for a one-time link. Not with sample_rate or aliases.
+    max_clicks: NotRequired[int]
+    # More codes created for the same destination, all together with the link or not at all.
+    aliases: NotRequired[list[str]]
+    # Namespace to create the link in, for admins. Others create links in the namespace of their API key or account; the code, custom_code and aliases get the prefix "<namespace>.".
+    namespace: NotRequired[str]
+
+
+class ShortenResponse(TypedDict):
+    code: str
+    short_url: str
+    # -1 if the link never expires.
+    expiry_seconds: int
+    existing: NotRequired[bool]
+    aliases: NotRequired[list[str]]
+
+
+class LinkSource(TypedDict):
+    """How the link was created. ip and user_agent are only returned to admins."""
+    channel: NotRequired[str]
+    client: NotRequired[str]
+    impersonation: NotRequired[str]
+    # ID of the API key the link was created with.
+    api_key: NotRequired[str]
+    batch: NotRequired[str]
+    row: NotRequired[int]
+    ip: NotRequired[str]
+    user_agent: NotRequired[str]
+
+
+class LinkSummary(TypedDict):
+    code: str
+    long_url: str
+    clicks: int
+    created_at: str
+    # Null if the link never expires.
+    expires_at: str | None
+    is_expired: bool
+    tags: NotRequired[list[str] | None]
+    owner: NotRequired[str]
+    namespace: NotRequired[str]
+    disabled: NotRequired[bool]
+    source: NotRequired[LinkSource | None]
+
+
+class LinkInfo(LinkSummary):
+    short_url: NotRequired[str]
+    # Estimated distinct visitors over the link's lifetime.
+    unique_clicks: NotRequired[int]
+    fallbacks: NotRequired[list[str] | None]
+    sample_rate: NotRequired[int]
+    variants: NotRequired[list[str] | None]
+    bandit: NotRequired[bool]
+    blocked_referrers: NotRequired[list[str] | None]
+    blocked_hits: NotRequired[int]
+    blocked_countries: NotRequired[list[str] | None]
+    min_age: NotRequired[int]
+    aliases: NotRequired[list[str] | None]
+    alias_of: NotRequired[str]
+    # Edits since creation; pass it to PATCH /links/{code}.
+    version: NotRequired[int]
+    # 0 for no limit.
+    max_clicks: NotRequired[int]
+    # Redirects left before max_clicks; null for no limit.
+    clicks_left: NotRequired[int | None]
+
+
+class LinkPatch(TypedDict):
+    url: NotRequired[str]
+    # Counted from now. -1 or "never" removes the expiry.
+    expiry_seconds: NotRequired[int | Literal["never"]]
+    # The link's current version. The edit fails with 409 if the link has changed since.
+    version: NotRequired[int]
+    # Check that the new url answers before saving it, as for /shorten.
+    verify: NotRequired[bool]
+
+
+class LinkExtension(TypedDict):
+    """Exactly one of duration and seconds."""
+    # A Go duration of at least 1s.
+    duration: NotRequired[str]
+    seconds: NotRequired[int]
+    # The link's current version. The extension fails with 409 if the link has changed since.
+    version: NotRequired[int]
+
+
+class EditedLink(TypedDict):
+    code: NotRequired[str]
+    short_url: NotRequired[str]
+    long_url: NotRequired[str]
+    expires_at: NotRequired[str | None]
+    version: NotRequired[int]
+
+
+class BlockedReferrers(TypedDict):
+    # An empty list lifts the block.
+    patterns: list[str]
+    # The link's current version; the change fails with 409 if it was edited since.
+    version: NotRequired[int]
+
+
+class BlockedCountries(TypedDict):
+    # ISO country codes. An empty list lifts the link's own block.
+    countries: list[str]
+    # The link's current version; the change fails with 409 if it was edited since.
+    version: NotRequired[int]
+
+
+class StatsSummarySinceBoot(TypedDict):
+    links_created: NotRequired[int]
+    redirects: NotRequired[int]
+    referrer_blocked: NotRequired[int]
+    uptime_seconds: NotRequired[int]
+
+
+class StatsSummary(TypedDict):
+    since_boot: NotRequired[StatsSummarySinceBoot]
+    all_time: NotRequired[dict[str, int]]
+
+
+class CompareStatsSeriesItem(TypedDict):
+    code: NotRequired[str]
+    total: NotRequired[int]
+    clicks: NotRequired[list[int]]
+    uniques: NotRequired[list[int]]
+
+
+CompareStats = TypedDict(
+    "CompareStats",
+    {
+        "from": NotRequired[str],
+        "to": NotRequired[str],
+        "days": NotRequired[list[str]],
+        "series": NotRequired[list[CompareStatsSeriesItem]],
+    },
+)
+
+
+class TopLink(TypedDict):
+    rank: NotRequired[int]
+    code: NotRequired[str]
+    short_url: NotRequired[str]
+    long_url: NotRequired[str]
+    clicks: NotRequired[int]
+    disabled: NotRequired[bool]
+
+
+class ClickBucketsBucketsItem(TypedDict):
+    start: NotRequired[str]
+    clicks: NotRequired[int]
+
+
+ClickBuckets = TypedDict(
+    "ClickBuckets",
+    {
+        "code": NotRequired[str],
+        "granularity": NotRequired[Literal["day", "hour"]],
+        "from": NotRequired[str],
+        "to": NotRequired[str],
+        "total": NotRequired[int],
+        "buckets": NotRequired[list[ClickBucketsBucketsItem]],
+    },
+)
+
+
+class LinkAnalyticsDaysItem(TypedDict):
+    day: NotRequired[str]
+    clicks: NotRequired[int]
+    uniques: NotRequired[int]
+
+
+class LinkAnalyticsReferrersItem(TypedDict):
+    hash: NotRequired[str]
+    count: NotRequired[int]
+
+
+class LinkAnalyticsCitiesItem(TypedDict):
+    city: NotRequired[str]
+    count: NotRequired[int]
+
+
+LinkAnalytics = TypedDict(
+    "LinkAnalytics",
+    {
+        "code": NotRequired[str],
+        "from": NotRequired[str],
+        "to": NotRequired[str],
+        "clicks": NotRequired[int],
+        # Sum of the daily unique visitors.
+        "uniques": NotRequired[int],
+        "days": NotRequired[list[LinkAnalyticsDaysItem]],
+        # Top referrer hosts as keyed hashes.
+        "referrers": NotRequired[list[LinkAnalyticsReferrersItem]],
+        # Clicks per browser family (edge, opera, firefox, chrome, safari, other, bot, unknown).
+        "browsers": NotRequired[dict[str, int]],
+        # Clicks per device type (desktop, mobile, tablet, bot, unknown).
+        "devices": NotRequired[dict[str, int]],
+        # Clicks per ISO country code, XX for visitors that could not be placed. Empty unless GEOIP_HEADER or GEOIP_DB is set.
+        "countries": NotRequired[dict[str, int]],
+        # Top cities, such as "Berlin, DE" (Redis mode). Empty unless GEOIP_DB is a MaxMind City database.
+        "cities": NotRequired[list[LinkAnalyticsCitiesItem]],
+    },
+)
+
+
+class VariantStatsVariantsItem(TypedDict):
+    variant: NotRequired[int]
+    url: NotRequired[str]
+    visits: NotRequired[int]
+    conversions: NotRequired[int]
+    conversion_rate: NotRequired[float]
+    frozen: NotRequired[bool]
+
+
+class VariantStats(TypedDict):
+    code: NotRequired[str]
+    bandit: NotRequired[bool]
+    frozen: NotRequired[bool]
+    variants: NotRequired[list[VariantStatsVariantsItem]]
+
+
+class FreezeRequest(TypedDict):
+    # Variant to freeze on; the current best when omitted.
+    variant: NotRequired[int]
+    # The link's current version; the change fails with 409 if it was edited since.
+    version: NotRequired[int]
+
+
+class FreezeResponse(TypedDict):
+    code: NotRequired[str]
+    frozen: NotRequired[bool]
+    variant: NotRequired[int]
+    url: NotRequired[str]
+    version: NotRequired[int]
+
+
+class SetBlockedReferrersResponse(TypedDict):
+    code: NotRequired[str]
+    blocked_referrers: NotRequired[list[str]]
+    version: NotRequired[int]
+
+
+class SetBlockedCountriesResponse(TypedDict):
+    code: NotRequired[str]
+    blocked_countries: NotRequired[list[str]]
+    version: NotRequired[int]
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// User accounts let people sign up and manage their own links. Setting
+// JWT_SECRET turns them on: /auth/signup and /auth/login answer with a
+// JWT, sent back as "Authorization: Bearer", that acts as the user the
+// same way the auth proxy header does.
+var (
+	jwtSecret = config.Accounts.JWTSecret
+	jwtTTL    = config.Accounts.JWTTTL
+)
+
+const minJWTSecretLen = 32
+
+// usersKey maps each user name to its account JSON.
+const usersKey = "url_users"
+
+const (
+	minPasswordLen  = 8
+	maxPasswordLen  = 256
+	passwordRounds  = 600_000
+	passwordSaltLen = 16
+)
+
+var (
+	errUserTaken = errors.New("user name is taken")
+	errUserToken = errors.New("invalid or expired token")
+	jwtHeader    = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	// dummyPasswordHash is what logins of unknown users are checked
+	// against, so the response time does not tell which user names exist.
+	dummyPasswordHash = sync.OnceValue(func() string {
+		hash, _ := hashPassword("not a password")
+		return hash
+	})
+)
+
+type account struct {
+	User         string `json:"user"`
+	PasswordHash string `json:"password_hash"`       // pbkdf2-sha256$rounds$salt$key, "" for OAuth accounts
+	Role         string `json:"role,omitempty"`      // roleAdmin or ""
+	Provider     string `json:"provider,omitempty"`  // OAuth provider the account was created with
+	Namespace    string `json:"namespace,omitempty"` // namespace the user's links go into
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// roleAdmin gives a user's token the powers of ADMIN_TOKEN.
+const roleAdmin = "admin"
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordRounds, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordRounds,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, rounds, len(want))
+	return err == nil && hmac.Equal(got, want)
+}
+
+// CreateAccount stores a new account, or returns errUserTaken.
+func CreateAccount(acct account) error {
+	raw, err := json.Marshal(acct)
+	if err != nil {
+		return err
+	}
+	created, err := Rdb.HSetNX(Ctx, usersKey, acct.User, raw).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return errUserTaken
+	}
+	return nil
+}
+
+// GetAccount returns a user's account, or ErrNotFound.
+func GetAccount(user string) (account, error) {
+	var acct account
+	raw, err := Rdb.HGet(Ctx, usersKey, user).Result()
+	if errors.Is(err, redis.Nil) {
+		return acct, ErrNotFound
+	}
+	if err != nil {
+		return acct, err
+	}
+	err = json.Unmarshal([]byte(raw), &acct)
+	return acct, err
+}
+
+type userClaims struct {
+	Subject  string `json:"sub"`
+	Role     string `json:"role,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+func jwtMAC(signingInput string) []byte {
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// signUserToken returns an HS256 JWT for an account. The role is read
+// when the token is issued, so a changed role applies from the next login.
+func signUserToken(acct account) (string, userClaims, error) {
+	now := time.Now()
+	claims := userClaims{Subject: acct.User, Role: acct.Role, IssuedAt: now.Unix(), Expires: now.Add(jwtTTL).Unix()}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+	input := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(raw)
+	return input + "." + base64.RawURLEncoding.EncodeToString(jwtMAC(input)), claims, nil
+}
+
+// verifyUserToken checks the signature and expiry of a JWT. Only the
+// header signUserToken writes is accepted, so a token cannot pick its own
+// algorithm.
+func verifyUserToken(token string) (userClaims, error) {
+	var claims userClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader || jwtSecret == "" {
+		return claims, errUserToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, jwtMAC(parts[0]+"."+parts[1])) {
+		return claims, errUserToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil || claims.Subject == "" {
+		return claims, errUserToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return claims, errUserToken
+	}
+	return claims, nil
+}
+
+// userTokenGuard records the user of a JWT in the Authorization header.
+// The admin token and requests without a bearer token are untouched; a
+// bearer token that is neither is refused, so an expired session is not
+// mistaken for an anonymous request.
+func userTokenGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || jwtSecret == "" || isAdminToken(c.Request) {
+			c.Next()
+			return
+		}
+		claims, err := verifyUserToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		if deleted, err := OwnerDeleted(claims.Subject); err != nil {
+			storeError(c, err)
+			c.Abort()
+			return
+		} else if deleted {
+			c.AbortWithStatusJSON(403, gin.H{"error": "User " + claims.Subject + " is deleted"})
+			return
+		}
+		c.Set("user", claims.Subject)
+		c.Next()
+	}
+}
+
+// isAdmin reports whether the request carries ADMIN_TOKEN or the token of
+// a user with the admin role who has not been deleted since.
+func isAdmin(r *http.Request) bool {
+	if isAdminToken(r) {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	claims, err := verifyUserToken(token)
+	if err != nil || claims.Role != roleAdmin {
+		return false
+	}
+	deleted, err := OwnerDeleted(claims.Subject)
+	return err == nil && !deleted
+}
+
+// accountsGuard answers 503 while JWT_SECRET is unset.
+func accountsGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jwtSecret == "" {
+			c.AbortWithStatusJSON(503, gin.H{"error": "Accounts disabled: JWT_SECRET is not set"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+func (req credentials) validate() []fieldError {
+	var errs []fieldError
+	if !validUserRegex.MatchString(req.User) {
+		errs = append(errs, fieldError{"user", "format", "User must be 1-64 letters, numbers or _.@-"})
+	}
+	if len(req.Password) < minPasswordLen || len(req.Password) > maxPasswordLen {
+		errs = append(errs, fieldError{"password", "length", fmt.Sprintf("Password must be %d-%d characters", minPasswordLen, maxPasswordLen)})
+	}
+	return errs
+}
+
+// respondWithToken answers a signup or login with a fresh token.
+func respondWithToken(c *gin.Context, status int, acct account) {
+	token, claims, err := signUserToken(acct)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	resp := gin.H{"user": acct.User, "token": token, "expires_at": formatUnix(claims.Expires)}
+	if acct.Role != "" {
+		resp["role"] = acct.Role
+	}
+	c.JSON(status, resp)
+}
+
+func signupHandle(c *gin.Context) {
+	var req credentials
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+	// A deleted user's name stays taken, so their links are not handed to
+	// whoever signs up with it next.
+	if deleted, err := OwnerDeleted(req.User); err != nil {
+		storeError(c, err)
+		return
+	} else if deleted {
+		c.JSON(409, gin.H{"error": "User name is taken"})
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create account"})
+		return
+	}
+	acct := account{User: req.User, PasswordHash: hash, CreatedAt: time.Now().Unix()}
+	if err := CreateAccount(acct); errors.Is(err, errUserTaken) {
+		c.JSON(409, gin.H{"error": "User name is taken"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	respondWithToken(c, http.StatusCreated, acct)
+}
+
+func loginHandle(c *gin.Context) {
+	var req credentials
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	acct, err := GetAccount(req.User)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		storeError(c, err)
+		return
+	}
+	if err != nil {
+		checkPassword(dummyPasswordHash(), req.Password)
+		c.JSON(401, gin.H{"error": "Wrong user name or password"})
+		return
+	}
+	if !checkPassword(acct.PasswordHash, req.Password) {
+		c.JSON(401, gin.H{"error": "Wrong user name or password"})
+		return
+	}
+	if deleted, err := OwnerDeleted(acct.User); err != nil {
+		storeError(c, err)
+		return
+	} else if deleted {
+		c.JSON(403, gin.H{"error": "User " + acct.User + " is deleted"})
+		return
+	}
+	respondWithToken(c, 200, acct)
+}
+
+// UpdateAccount applies update to an account, or returns ErrNotFound.
+func UpdateAccount(user string, update func(*account)) error {
+	return Rdb.Watch(Ctx, func(tx *redis.Tx) error {
+		raw, err := tx.HGet(Ctx, usersKey, user).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var acct account
+		if err := json.Unmarshal([]byte(raw), &acct); err != nil {
+			return err
+		}
+		update(&acct)
+		updated, err := json.Marshal(acct)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(Ctx, usersKey, user, updated)
+			return nil
+		})
+		return err
+	}, usersKey)
+}
+
+func setRoleHandle(c *gin.Context) {
+	user := c.Param("user")
+	if err := validateUserParam(user); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Role != "" && req.Role != roleAdmin {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": []fieldError{
+			{"role", "enum", `Role must be "admin" or "" for a regular user`},
+		}})
+		return
+	}
+
+	if err := UpdateAccount(user, func(acct *account) { acct.Role = req.Role }); errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "User " + user + " has no account"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", OnBehalfOf: user, Action: "user.role",
+		Detail: cmp.Or(req.Role, "user")}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.JSON(200, gin.H{"user": user, "role": req.Role})
+}
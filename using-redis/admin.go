@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// linkFilter selects links for bulk admin operations. Empty fields match
+// everything; timestamps are unix seconds.
+type linkFilter struct {
+	Tag           string `json:"tag,omitempty"`
+	Domain        string `json:"domain,omitempty"`
+	Owner         string `json:"owner,omitempty"`
+	CreatedBefore int64  `json:"created_before,omitempty"`
+	CreatedAfter  int64  `json:"created_after,omitempty"`
+}
+
+func (f linkFilter) matches(data URLData) bool {
+	if f.Tag != "" && !slices.Contains(data.Tags, f.Tag) {
+		return false
+	}
+	if f.Domain != "" && !strings.EqualFold(hostOf(data.LongURL), f.Domain) {
+		return false
+	}
+	if f.Owner != "" && data.Owner != f.Owner {
+		return false
+	}
+	if f.CreatedBefore != 0 && data.CreatedAt >= f.CreatedBefore {
+		return false
+	}
+	if f.CreatedAfter != 0 && data.CreatedAt <= f.CreatedAfter {
+		return false
+	}
+	return true
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+type bulkExpiryRequest struct {
+	Filter       linkFilter `json:"filter"`
+	ShiftSeconds int64      `json:"shift_seconds,omitempty"`
+	SetExpiresAt int64      `json:"set_expires_at,omitempty"`
+	DryRun       bool       `json:"dry_run,omitempty"`
+}
+
+type expiryChange struct {
+	Code         string `json:"code"`
+	OldExpiresAt any    `json:"old_expires_at"` // null for a link that never expired
+	NewExpiresAt string `json:"new_expires_at"`
+}
+
+var errFilterMismatch = errors.New("link no longer matches filter")
+
+// bulkExpiryHandle shifts or sets the expiry of every link matching the
+// filter, e.g. "extend everything tagged q4 by 30 days".
+func bulkExpiryHandle(c *gin.Context) {
+	var req bulkExpiryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if (req.ShiftSeconds == 0) == (req.SetExpiresAt == 0) {
+		c.JSON(400, gin.H{"error": "Provide exactly one of shift_seconds or set_expires_at"})
+		return
+	}
+
+	// An expiry of 0 means the link never expires, so one at or before
+	// the link's creation expires it now instead.
+	newExpiry := func(data URLData) int64 {
+		expiry := data.Expiry + req.ShiftSeconds
+		if req.SetExpiresAt != 0 {
+			expiry = req.SetExpiresAt - data.CreatedAt
+		}
+		if expiry <= 0 {
+			return max(time.Now().Unix()-data.CreatedAt, 1)
+		}
+		return expiry
+	}
+
+	// Shifting leaves links that never expire alone; setting makes them
+	// expire too.
+	affected := func(data URLData) bool {
+		return req.Filter.matches(data) && (req.SetExpiresAt != 0 || data.Expiry != 0)
+	}
+
+	var matched []string
+	err := ForEachURL(func(code string, data URLData) error {
+		if affected(data) {
+			matched = append(matched, code)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list URLs"})
+		return
+	}
+
+	changes := []expiryChange{}
+	for _, code := range matched {
+		var change expiryChange
+		apply := func(data *URLData) error {
+			if !affected(*data) {
+				return errFilterMismatch
+			}
+			expiry := newExpiry(*data)
+			change = expiryChange{
+				Code:         code,
+				OldExpiresAt: data.expiresAt(),
+				NewExpiresAt: formatUnix(data.CreatedAt + expiry),
+			}
+			data.Expiry = expiry
+			if req.DryRun {
+				return errDryRun
+			}
+			return nil
+		}
+
+		var data URLData
+		if req.DryRun {
+			data, err = GetURL(code)
+			if err == nil {
+				err = apply(&data)
+			}
+		} else {
+			err = UpdateURL(code, apply)
+		}
+
+		switch {
+		case err == nil, errors.Is(err, errDryRun):
+			changes = append(changes, change)
+		case errors.Is(err, ErrNotFound), errors.Is(err, errFilterMismatch):
+			// Deleted or edited since the scan; leave it alone.
+		default:
+			storeError(c, err)
+			return
+		}
+	}
+
+	updated := len(changes)
+	if req.DryRun {
+		updated = 0
+	}
+	c.JSON(200, gin.H{
+		"dry_run": req.DryRun,
+		"matched": len(changes),
+		"updated": updated,
+		"links":   changes,
+	})
+}
+
+var errDryRun = errors.New("dry run")
+
+func formatUnix(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
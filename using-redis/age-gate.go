@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Age-gated links ask visitors to confirm their age before redirecting,
+// for alcohol or gaming campaigns. The answer is kept in a signed cookie
+// for every link on the domain, so a visitor confirms once per
+// ageCookieTTL and only again for a link with a higher minimum age.
+
+const (
+	minAgeGate = 13
+	maxAgeGate = 99
+)
+
+const (
+	ageCookie    = "age_confirmed"
+	ageCookieTTL = 30 * 24 * time.Hour
+)
+
+// confirmedAge returns the age the visitor confirmed, 0 without a valid
+// cookie.
+func confirmedAge(r *http.Request) int {
+	payload, ok := signedCookie(r, ageCookie)
+	if !ok {
+		return 0
+	}
+	age, _ := strconv.Atoi(payload)
+	return age
+}
+
+func setAgeCookie(w http.ResponseWriter, age int) {
+	setSignedCookie(w, ageCookie, strconv.Itoa(age), ageCookieTTL)
+}
+
+// ageGatePending reports whether the visitor still has to confirm their
+// age for data.
+func ageGatePending(r *http.Request, data URLData) bool {
+	return data.MinAge > 0 && confirmedAge(r) < data.MinAge
+}
+
+// Outcomes of the age gate on /metrics.
+const (
+	ageGateShown     = "shown"
+	ageGateConfirmed = "confirmed"
+	ageGateDeclined  = "declined"
+)
+
+var ageGateResults = []string{ageGateShown, ageGateConfirmed, ageGateDeclined}
+
+var ageGateCounts = map[string]*atomic.Int64{
+	ageGateShown:     {},
+	ageGateConfirmed: {},
+	ageGateDeclined:  {},
+}
+
+func writeAgeGateMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP urlshortener_age_gate_total Age gate pages shown and answers given since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_age_gate_total counter\n")
+	for _, result := range ageGateResults {
+		fmt.Fprintf(w, "urlshortener_age_gate_total{result=%q} %d\n", result, ageGateCounts[result].Load())
+	}
+}
+
+type ageGatePage struct {
+	Brand    string
+	Code     string
+	MinAge   int
+	Query    string // of the visit, passed on to the redirect
+	Declined bool
+	Snippet  string // tenant whose snippet frame is embedded
+}
+
+var ageGateTemplate = template.Must(template.New("age").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Age confirmation - {{.Brand}}</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+button { font-size: 1rem; padding: 0.4rem 1rem; margin-right: 0.5rem; }
+</style>
+</head>
+<body>
+{{if .Declined}}
+<h1>Sorry, this link is not for you</h1>
+<p>The content behind this link is only for visitors aged {{.MinAge}} or older.</p>
+{{else}}
+<h1>Are you {{.MinAge}} or older?</h1>
+<p>The content behind this link is only for visitors aged {{.MinAge}} or older.</p>
+<form method="post" action="/age/{{.Code}}">
+	<input type="hidden" name="query" value="{{.Query}}">
+	<button name="confirm" value="yes">Yes, I am {{.MinAge}} or older</button>
+	<button name="confirm" value="no">No</button>
+</form>
+{{end}}
+<p><small>{{.Brand}}</small></p>
+{{if .Snippet}}<iframe src="/snippet/{{.Snippet}}/frame" sandbox="allow-scripts" title="" hidden></iframe>{{end}}
+</body>
+</html>
+`))
+
+// interstitialReturn is where a visitor goes after answering a page shown
+// instead of a redirect: the link again, with the original query string.
+func interstitialReturn(code, rawQuery string) string {
+	target := "/" + url.PathEscape(code)
+	if query, err := url.ParseQuery(rawQuery); err == nil && len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
+func renderAgeGate(w http.ResponseWriter, status int, page ageGatePage) {
+	var buf bytes.Buffer
+	if err := ageGateTemplate.Execute(&buf, page); err != nil {
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	setPageHeaders(w.Header())
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// showAgeGate serves the age gate instead of redirecting when the visitor
+// has not confirmed the link's minimum age, and reports whether it did.
+func showAgeGate(c *gin.Context, code string, data URLData) bool {
+	if !ageGatePending(c.Request, data) {
+		return false
+	}
+	ageGateCounts[ageGateShown].Add(1)
+	renderAgeGate(c.Writer, http.StatusOK, ageGatePage{Brand: brandName, Code: code, MinAge: data.MinAge, Query: c.Request.URL.RawQuery, Snippet: snippetFor(data.Tenant)})
+	return true
+}
+
+// ageGateHandle takes the answer from the age gate. Yes sets the cookie
+// and sends the visitor back to the link, which then redirects.
+func ageGateHandle(c *gin.Context) {
+	code := c.Param("code")
+	data, err := GetActiveURL(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	query := c.PostForm("query")
+	if data.MinAge == 0 {
+		c.Redirect(http.StatusSeeOther, interstitialReturn(code, query))
+		return
+	}
+
+	if c.PostForm("confirm") != "yes" {
+		ageGateCounts[ageGateDeclined].Add(1)
+		renderAgeGate(c.Writer, http.StatusForbidden, ageGatePage{Brand: brandName, Code: code, MinAge: data.MinAge, Declined: true, Snippet: snippetFor(data.Tenant)})
+		return
+	}
+	ageGateCounts[ageGateConfirmed].Add(1)
+	setAgeCookie(c.Writer, max(data.MinAge, confirmedAge(c.Request)))
+	c.Redirect(http.StatusSeeOther, interstitialReturn(code, query))
+}
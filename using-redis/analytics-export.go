@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Analytics exports write CSV for spreadsheets. data=daily (the default)
+// has a row per link and UTC day with clicks and unique visitors;
+// data=events has a row per raw click event still kept, with its referrer
+// and user agent, so it needs the admin token.
+
+var dailyCSVHeader = []string{"day", "code", "clicks", "uniques"}
+
+var eventsCSVHeader = []string{"time", "code", "ip_hash", "referrer", "user_agent", "country", "city", "weight"}
+
+// csvCell keeps a spreadsheet from running a value as a formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func eventCSVRow(ev clickEvent) []string {
+	return []string{
+		time.Unix(ev.Timestamp, 0).UTC().Format(time.RFC3339),
+		ev.Code,
+		ev.IP,
+		csvCell(ev.Referrer),
+		csvCell(ev.UserAgent),
+		ev.Country,
+		csvCell(ev.City),
+		strconv.FormatInt(ev.weight(), 10),
+	}
+}
+
+// parseExportRequest reads the query of both exports and answers 400 for
+// a bad one.
+func parseExportRequest(c *gin.Context) (data string, from, to time.Time, ok bool) {
+	if format := c.DefaultQuery("format", "csv"); format != "csv" {
+		c.JSON(400, gin.H{"error": "format must be csv"})
+		return "", from, to, false
+	}
+	data = c.DefaultQuery("data", "daily")
+	if data != "daily" && data != "events" {
+		c.JSON(400, gin.H{"error": "data must be daily or events"})
+		return "", from, to, false
+	}
+	from, to, err := parseCompareRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return "", from, to, false
+	}
+	return data, from, to, true
+}
+
+func startCSV(c *gin.Context, name string, from, to time.Time, header []string) *csv.Writer {
+	filename := fmt.Sprintf("%s-%s-%s.csv", name, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(200)
+	w := csv.NewWriter(c.Writer)
+	w.Write(header)
+	return w
+}
+
+// writeEventsCSV streams the raw events of [from, to] from every region,
+// only those of code unless it is "". The status is sent by then, so a
+// failure only cuts the file short.
+func writeEventsCSV(c *gin.Context, name, code string, from, to time.Time) {
+	w := startCSV(c, name, from, to, eventsCSVHeader)
+	for _, rdb := range allClients() {
+		err := eachClickIn(rdb, clickEventsKey, from, to.AddDate(0, 0, 1), func(ev clickEvent) error {
+			if code == "" || ev.Code == code {
+				w.Write(eventCSVRow(ev))
+			}
+			return w.Error()
+		})
+		if err != nil {
+			log.Println("Error exporting click events:", err)
+			break
+		}
+	}
+	w.Flush()
+}
+
+// writeDailyCSV writes a row per day and code of series. Days without
+// clicks are only written with keepEmpty.
+func writeDailyCSV(c *gin.Context, name string, from, to time.Time, days []string, series []clickSeries, keepEmpty bool) {
+	w := startCSV(c, name, from, to, dailyCSVHeader)
+	for i, day := range days {
+		for _, s := range series {
+			if s.Clicks[i] > 0 || keepEmpty {
+				w.Write([]string{day, s.Code, strconv.FormatInt(s.Clicks[i], 10), strconv.FormatInt(s.Uniques[i], 10)})
+			}
+		}
+	}
+	w.Flush()
+}
+
+// exportAnalyticsHandle exports one link's analytics, with a row for every
+// day of the range.
+func exportAnalyticsHandle(c *gin.Context) {
+	code := c.Param("code")
+	data, from, to, ok := parseExportRequest(c)
+	if !ok {
+		return
+	}
+	if _, ok := readableLink(c, code); !ok {
+		return
+	}
+	name := "analytics-" + strings.ReplaceAll(code, ".", "-") + "-" + data
+
+	if data == "events" {
+		if !isAdmin(c.Request) {
+			c.JSON(401, gin.H{"error": "Admin token required to export click events"})
+			return
+		}
+		writeEventsCSV(c, name, code, from, to)
+		return
+	}
+
+	daily, err := DailyClicks(code)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	raw, err := PendingClicksOf([]string{code}, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	days, series := buildClickSeries([]string{code}, from, to, map[string]map[string]dailyClicks{code: daily}, raw)
+	writeDailyCSV(c, name, from, to, days, series, true)
+}
+
+// exportAllAnalyticsHandle exports the analytics of every link, deleted
+// ones included. Daily rows are only written for days with clicks.
+func exportAllAnalyticsHandle(c *gin.Context) {
+	data, from, to, ok := parseExportRequest(c)
+	if !ok {
+		return
+	}
+	name := "analytics-" + data
+	if data == "events" {
+		writeEventsCSV(c, name, "", from, to)
+		return
+	}
+
+	daily, err := AllDailyClicks()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	raw, err := PendingClicksBetween(from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	clicked := make(map[string]bool, len(daily))
+	for code := range daily {
+		clicked[code] = true
+	}
+	for _, ev := range raw {
+		clicked[ev.Code] = true
+	}
+	codes := slices.Sorted(maps.Keys(clicked))
+	days, series := buildClickSeries(codes, from, to, daily, raw)
+	writeDailyCSV(c, name, from, to, days, series, false)
+}
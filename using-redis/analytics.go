@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// topAnalyticsReferrers and topAnalyticsCities bound the lists /analytics
+// returns. Rollups keep each day's top 5 referrers and top 10 cities, so
+// over several days the lists are approximate.
+const (
+	topAnalyticsReferrers = 10
+	topAnalyticsCities    = 10
+)
+
+// linkAnalytics aggregates a link's clicks over a range of UTC days.
+// Uniques are counted per day, so a visitor who comes back on another day
+// counts again in the total.
+type linkAnalytics struct {
+	Code      string           `json:"code"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Clicks    int64            `json:"clicks"`
+	Uniques   int64            `json:"uniques"`
+	Days      []analyticsDay   `json:"days"`
+	Referrers []referrerCount  `json:"referrers"`
+	Browsers  map[string]int64 `json:"browsers"`
+	Devices   map[string]int64 `json:"devices"`
+	Countries map[string]int64 `json:"countries"`
+	Cities    []cityCount      `json:"cities"`
+}
+
+type analyticsDay struct {
+	Day     string `json:"day"`
+	Clicks  int64  `json:"clicks"`
+	Uniques int64  `json:"uniques"`
+}
+
+// buildAnalytics merges a link's rolled-up days with the raw events of the
+// days that are not rolled up yet.
+func buildAnalytics(code string, from, to time.Time, daily map[string]dailyClicks, raw []clickEvent) linkAnalytics {
+	rawByDay := make(map[string][]clickEvent)
+	for _, ev := range raw {
+		if ev.Code == code {
+			day := clickDay(ev.Timestamp)
+			rawByDay[day] = append(rawByDay[day], ev)
+		}
+	}
+
+	a := linkAnalytics{
+		Code:      code,
+		From:      from.Format(time.DateOnly),
+		To:        to.Format(time.DateOnly),
+		Days:      []analyticsDay{},
+		Browsers:  make(map[string]int64),
+		Devices:   make(map[string]int64),
+		Countries: make(map[string]int64),
+	}
+	referrers := make(map[string]int64)
+	cities := make(map[string]int64)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := d.Format(time.DateOnly)
+		agg, ok := daily[day]
+		if !ok {
+			agg = aggregateClicks(rawByDay[day])[code]
+		}
+		a.Days = append(a.Days, analyticsDay{Day: day, Clicks: agg.Count, Uniques: agg.Uniques})
+		a.Clicks += agg.Count
+		a.Uniques += agg.Uniques
+		for _, ref := range agg.TopReferrers {
+			referrers[ref.Hash] += ref.Count
+		}
+		for browser, n := range agg.Browsers {
+			a.Browsers[browser] += n
+		}
+		for device, n := range agg.Devices {
+			a.Devices[device] += n
+		}
+		for country, n := range agg.Countries {
+			a.Countries[country] += n
+		}
+		for _, city := range agg.TopCities {
+			cities[city.City] += city.Count
+		}
+	}
+
+	a.Referrers = []referrerCount{}
+	for hash, count := range referrers {
+		a.Referrers = append(a.Referrers, referrerCount{hash, count})
+	}
+	slices.SortFunc(a.Referrers, func(x, y referrerCount) int {
+		return cmp.Or(cmp.Compare(y.Count, x.Count), cmp.Compare(x.Hash, y.Hash))
+	})
+	a.Referrers = a.Referrers[:min(len(a.Referrers), topAnalyticsReferrers)]
+	a.Cities = topCities(cities, topAnalyticsCities)
+	if a.Cities == nil {
+		a.Cities = []cityCount{}
+	}
+	return a
+}
+
+// readableLink returns the link of code if the request may read it, or
+// answers the request and returns false.
+func readableLink(c *gin.Context, code string) (URLData, bool) {
+	data, err := GetURL(code)
+	if err != nil {
+		storeError(c, err)
+		return data, false
+	}
+	if !mayManage(c, &data) {
+		c.JSON(403, gin.H{"error": "Link belongs to another user"})
+		return data, false
+	}
+	return data, true
+}
+
+// analyticsHandle returns a link's clicks, unique visitors, top referrers
+// (as keyed hashes of their hosts), browsers, devices, countries and top
+// cities between from and to, which default to the last 30 days.
+func analyticsHandle(c *gin.Context) {
+	code := c.Param("code")
+	if _, ok := readableLink(c, code); !ok {
+		return
+	}
+	from, to, err := parseCompareRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	daily, err := DailyClicks(code)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	raw, err := PendingClicksOf([]string{code}, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	c.JSON(200, buildAnalytics(code, from, to, daily, raw))
+}
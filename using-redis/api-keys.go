@@ -0,0 +1,351 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// With REQUIRE_API_KEY=true, /shorten and POST /new need an API key in
+// this header. Admins mint and revoke keys under /admin/api-keys. Admins,
+// signed-in users and impersonation tokens are accepted instead of a key.
+const apiKeyHeader = "X-API-Key"
+
+var requireAPIKey = config.Accounts.RequireAPIKey
+
+// apiKeyContextKey holds the ID of the request's API key, so links and
+// quotas can be attributed to it.
+const apiKeyContextKey = "api_key"
+
+// apiKeyRateLimitContextKey holds the rate limit of the request's API key,
+// which replaces the client IP's.
+const apiKeyRateLimitContextKey = "api_key_rate_limit"
+
+// apiKeysKey maps each key ID to its apiKey JSON. Only a hash of the
+// secret is kept, so the full key is shown once, when it is created.
+const apiKeysKey = "url_api_keys"
+
+var errAPIKey = errors.New("invalid or revoked API key")
+
+type apiKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`                 // hex SHA-256 of the secret
+	Namespace string `json:"namespace,omitempty"`  // namespace the key's links go into
+	RateLimit int    `json:"rate_limit,omitempty"` // requests per rate limit window, 0 for rate_limit.key_requests
+	CreatedAt int64  `json:"created_at"`
+}
+
+// rateLimit is the number of requests the key may make in each rate
+// limit window.
+func (k apiKey) rateLimit() int {
+	return cmp.Or(k.RateLimit, config.RateLimit.KeyRequests)
+}
+
+// view leaves out the hash, which is of no use to anyone reading it.
+func (k apiKey) view() gin.H {
+	view := gin.H{"id": k.ID, "name": k.Name, "created_at": formatUnix(k.CreatedAt)}
+	if k.Namespace != "" {
+		view["namespace"] = k.Namespace
+	}
+	view["rate_limit"] = k.rateLimit()
+	return view
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a key and the usk_<id>_<secret> string that
+// authenticates as it. The ID in the string finds the key without
+// comparing against every hash.
+func newAPIKey(name, namespace string) (apiKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return apiKey{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return apiKey{}, "", err
+	}
+	key := apiKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Namespace: namespace,
+		CreatedAt: time.Now().Unix(),
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashAPISecret(encoded)
+	return key, "usk_" + key.ID + "_" + encoded, nil
+}
+
+func SaveAPIKey(key apiKey) error {
+	raw, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return Rdb.HSet(Ctx, apiKeysKey, key.ID, raw).Err()
+}
+
+// UpdateAPIKey applies update to a key, or returns ErrNotFound.
+func UpdateAPIKey(id string, update func(*apiKey)) error {
+	return Rdb.Watch(Ctx, func(tx *redis.Tx) error {
+		raw, err := tx.HGet(Ctx, apiKeysKey, id).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var key apiKey
+		if err := json.Unmarshal([]byte(raw), &key); err != nil {
+			return err
+		}
+		update(&key)
+		updated, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(Ctx, apiKeysKey, id, updated)
+			return nil
+		})
+		return err
+	}, apiKeysKey)
+}
+
+// RevokeAPIKey deletes a key, or returns ErrNotFound.
+func RevokeAPIKey(id string) error {
+	n, err := Rdb.HDel(Ctx, apiKeysKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// APIKeys returns every key, oldest first.
+func APIKeys() ([]apiKey, error) {
+	raw, err := Rdb.HGetAll(Ctx, apiKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]apiKey, 0, len(raw))
+	for _, value := range raw {
+		var key apiKey
+		if err := json.Unmarshal([]byte(value), &key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b apiKey) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return keys, nil
+}
+
+// VerifyAPIKey returns the key a usk_<id>_<secret> string authenticates
+// as, or errAPIKey.
+func VerifyAPIKey(presented string) (apiKey, error) {
+	var key apiKey
+	rest, prefixed := strings.CutPrefix(presented, "usk_")
+	id, secret, ok := strings.Cut(rest, "_")
+	if !prefixed || !ok {
+		return key, errAPIKey
+	}
+	raw, err := Rdb.HGet(Ctx, apiKeysKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return key, errAPIKey
+	}
+	if err != nil {
+		return key, err
+	}
+	if err := json.Unmarshal([]byte(raw), &key); err != nil {
+		return key, err
+	}
+	if !hmac.Equal([]byte(hashAPISecret(secret)), []byte(key.Hash)) {
+		return apiKey{}, errAPIKey
+	}
+	return key, nil
+}
+
+// apiKeyGuard refuses requests without a valid API key while
+// REQUIRE_API_KEY is on, and records the key of requests that send a
+// valid one. It runs after authProxyGuard and impersonationGuard, whose
+// users need no key.
+func apiKeyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented := c.GetHeader(apiKeyHeader)
+		if (!requireAPIKey && presented == "") || isAdmin(c.Request) || requestUser(c) != "" {
+			c.Next()
+			return
+		}
+		if _, ok := impersonation(c); ok {
+			c.Next()
+			return
+		}
+		if presented == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "API key required in " + apiKeyHeader})
+			return
+		}
+		key, err := VerifyAPIKey(presented)
+		switch {
+		case errors.Is(err, errAPIKey):
+			// Without REQUIRE_API_KEY the request could have left the
+			// key out, so a bad one is ignored rather than refused.
+			if requireAPIKey {
+				c.AbortWithStatusJSON(401, gin.H{"error": "Invalid or revoked API key"})
+				return
+			}
+		case err != nil:
+			storeError(c, err)
+			c.Abort()
+			return
+		default:
+			c.Set(apiKeyContextKey, key.ID)
+			c.Set(apiKeyRateLimitContextKey, key.rateLimit())
+			c.Set(namespaceContextKey, key.Namespace)
+		}
+		c.Next()
+	}
+}
+
+func createAPIKeyHandle(c *gin.Context) {
+	var req struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		RateLimit int    `json:"rate_limit"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	var errs []fieldError
+	if req.Name == "" || len(req.Name) > 100 {
+		errs = append(errs, fieldError{"name", "required", "A name of 1-100 characters is required, e.g. the integration using the key"})
+	}
+	if req.RateLimit < 0 {
+		errs = append(errs, rateLimitFieldError())
+	}
+	if len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+	if req.Namespace != "" {
+		if _, err := GetNamespace(req.Namespace); errors.Is(err, ErrNotFound) {
+			c.JSON(400, gin.H{"error": "Validation failed", "fields": []fieldError{
+				{"namespace", "exists", "Namespace " + req.Namespace + " does not exist"},
+			}})
+			return
+		} else if err != nil {
+			storeError(c, err)
+			return
+		}
+	}
+
+	key, secret, err := newAPIKey(req.Name, req.Namespace)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create key"})
+		return
+	}
+	key.RateLimit = req.RateLimit
+	if err := SaveAPIKey(key); err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: key.CreatedAt, Actor: "admin", Action: "api_key.create", Detail: key.ID + " (" + key.Name + ")"}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+
+	view := key.view()
+	view["key"] = secret
+	c.JSON(http.StatusCreated, view)
+}
+
+func listAPIKeysHandle(c *gin.Context) {
+	keys, err := APIKeys()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	views := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		views = append(views, key.view())
+	}
+	c.JSON(200, views)
+}
+
+func rateLimitFieldError() fieldError {
+	return fieldError{"rate_limit", "min", fmt.Sprintf("Rate limit must be 0 (the default of %d) or more requests per %s", config.RateLimit.KeyRequests, config.RateLimit.Window)}
+}
+
+// setAPIKeyRateLimitHandle moves a key to another tier, e.g. a partner
+// integration that needs more than the default. The new limit applies to
+// the key's next request.
+func setAPIKeyRateLimitHandle(c *gin.Context) {
+	id := c.Param("id")
+	var req struct {
+		RateLimit int `json:"rate_limit"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.RateLimit < 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": []fieldError{rateLimitFieldError()}})
+		return
+	}
+
+	var key apiKey
+	err := UpdateAPIKey(id, func(k *apiKey) {
+		k.RateLimit = req.RateLimit
+		key = *k
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "API key not found"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", Action: "api_key.rate_limit",
+		Detail: fmt.Sprintf("%s (%d per %s)", id, key.rateLimit(), config.RateLimit.Window)}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.JSON(200, key.view())
+}
+
+func revokeAPIKeyHandle(c *gin.Context) {
+	id := c.Param("id")
+	if err := RevokeAPIKey(id); errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "API key not found"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", Action: "api_key.revoke", Detail: id}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deployments behind an SSO gateway such as oauth2-proxy can leave login
+// to it. With AUTH_PROXY_HEADER set, e.g. to X-Auth-Request-Email, a
+// request whose direct peer is in AUTH_PROXY_TRUSTED acts as the user the
+// header names: links it creates are owned by that user, and it may only
+// delete that user's links. The header is ignored on requests from
+// anywhere else, so a client that reaches the server directly cannot
+// claim to be someone.
+var (
+	authProxyHeader  = config.AuthProxy.Header
+	authProxyTrusted = parsePrefixes(config.AuthProxy.Trusted)
+)
+
+// parsePrefixes reads a list loadConfig has checked.
+func parsePrefixes(list []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range list {
+		if prefix, ok := parsePrefix(item); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// parsePrefix reads a CIDR, or an IP as the prefix of just that address.
+func parsePrefix(s string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), true
+	}
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// proxyUser returns the user named by the auth proxy header, or "" when
+// the header is missing or the request did not come from a trusted proxy.
+func proxyUser(r *http.Request) string {
+	if authProxyHeader == "" {
+		return ""
+	}
+	user := strings.TrimSpace(r.Header.Get(authProxyHeader))
+	if user == "" {
+		return ""
+	}
+	if !peerIn(r, authProxyTrusted) {
+		return ""
+	}
+	return user
+}
+
+// peerIn reports whether the direct peer of r, not the client named by
+// any forwarding header, is in prefixes.
+func peerIn(r *http.Request, prefixes []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// authProxyGuard records the user a trusted auth proxy vouched for, and
+// refuses names that cannot own links and users that were deleted.
+// Requests without one are untouched.
+func authProxyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := proxyUser(c.Request)
+		if user == "" {
+			c.Next()
+			return
+		}
+		if !validUserRegex.MatchString(user) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "User from " + authProxyHeader + " must be 1-64 letters, numbers or _.@-"})
+			return
+		}
+		if deleted, err := OwnerDeleted(user); err != nil {
+			storeError(c, err)
+			c.Abort()
+			return
+		} else if deleted {
+			c.AbortWithStatusJSON(403, gin.H{"error": "User " + user + " is deleted"})
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// requestUser returns the user authProxyGuard or userTokenGuard let
+// through, or "".
+func requestUser(c *gin.Context) string {
+	return c.GetString("user")
+}
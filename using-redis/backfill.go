@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// backfillMode is set when the binary runs as `backfill`, which rebuilds
+// the daily click rollups from raw click events, e.g. after a release
+// that aggregated them wrongly.
+var backfillMode = len(os.Args) > 1 && os.Args[1] == "backfill"
+
+type backfillOptions struct {
+	from, to time.Time // UTC days, both included; zero for open ends
+}
+
+func parseBackfillArgs(args []string) (backfillOptions, error) {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := fs.String("from", "", "first day to rebuild, YYYY-MM-DD (default: oldest raw click)")
+	to := fs.String("to", "", "last day to rebuild, YYYY-MM-DD (default: yesterday)")
+	if err := fs.Parse(args); err != nil {
+		return backfillOptions{}, err
+	}
+
+	var opts backfillOptions
+	var err error
+	if *from != "" {
+		if opts.from, err = time.Parse(time.DateOnly, *from); err != nil {
+			return backfillOptions{}, fmt.Errorf("-from must be a date like 2026-01-31")
+		}
+	}
+	if *to != "" {
+		if opts.to, err = time.Parse(time.DateOnly, *to); err != nil {
+			return backfillOptions{}, fmt.Errorf("-to must be a date like 2026-01-31")
+		}
+	}
+	if !opts.from.IsZero() && !opts.to.IsZero() && opts.to.Before(opts.from) {
+		return backfillOptions{}, fmt.Errorf("-to is before -from")
+	}
+	return opts, nil
+}
+
+// backfillPlan is the range of days one backend rebuilds.
+type backfillPlan struct {
+	backend  string
+	rdb      *redis.Client
+	from, to time.Time
+}
+
+// planBackfill clamps the requested range to the days a backend still has
+// every raw event of: from its oldest raw event, and never before the
+// retention cutoff, whose days the server may trim at any time, to
+// yesterday. Rollups of earlier days are left as they are.
+func planBackfill(backend string, rdb *redis.Client, opts backfillOptions, now time.Time) (backfillPlan, bool, error) {
+	plan := backfillPlan{backend: backend, rdb: rdb, from: opts.from, to: opts.to}
+
+	first, err := rdb.XRangeN(Ctx, clickEventsKey, "-", "+", 1).Result()
+	if err != nil || len(first) == 0 {
+		return plan, false, err
+	}
+	oldest := time.Unix(parseClick(first[0]).Timestamp, 0).UTC().Truncate(24 * time.Hour)
+	if cutoff := clickCutoff(now); cutoff.After(oldest) {
+		oldest = cutoff
+	}
+	if plan.from.Before(oldest) {
+		if !plan.from.IsZero() {
+			fmt.Printf("%s: raw clicks start on %s; rollups before it are kept.\n", backend, clickDay(oldest.Unix()))
+		}
+		plan.from = oldest
+	}
+
+	yesterday := now.Add(-clickRollupGrace).UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if plan.to.IsZero() || plan.to.After(yesterday) {
+		plan.to = yesterday
+	}
+	return plan, !plan.to.Before(plan.from), nil
+}
+
+func (p backfillPlan) days() int {
+	return int(p.to.Sub(p.from)/(24*time.Hour)) + 1
+}
+
+// runBackfill rebuilds the rollups day by day while the server keeps
+// running: every day is rewritten in one transaction, and rebuilding a day
+// twice gives the same result.
+func runBackfill(args []string) int {
+	opts, err := parseBackfillArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	names := []string{"home"}
+	for name := range regionClients {
+		names = append(names, name)
+	}
+	slices.Sort(names[1:])
+
+	now := time.Now()
+	var plans []backfillPlan
+	total := 0
+	for _, name := range names {
+		rdb := Rdb
+		if name != "home" {
+			rdb = regionClients[name]
+		}
+		plan, ok, err := planBackfill(name, rdb, opts, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error reading raw clicks: %v\n", name, err)
+			return 1
+		}
+		if ok {
+			plans = append(plans, plan)
+			total += plan.days()
+		}
+	}
+	if total == 0 {
+		fmt.Println("No raw clicks to rebuild rollups from.")
+		return 0
+	}
+
+	start := time.Now()
+	done := 0
+	var clicks int64
+	for _, plan := range plans {
+		for day := plan.from; !day.After(plan.to); day = day.AddDate(0, 0, 1) {
+			n, err := rollUpDay(plan.rdb, day, true)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: error rebuilding %s: %v\n", plan.backend, clickDay(day.Unix()), err)
+				return 1
+			}
+			done++
+			clicks += n
+
+			elapsed := time.Since(start)
+			left := elapsed / time.Duration(done) * time.Duration(total-done)
+			fmt.Printf("%s: rebuilt %s, %d clicks (day %d of %d, %d%%, about %s left)\n",
+				plan.backend, clickDay(day.Unix()), n, done, total, done*100/total, left.Round(time.Second))
+		}
+	}
+	fmt.Printf("Rebuilt %d days with %d clicks in %s.\n", total, clicks, time.Since(start).Round(time.Millisecond))
+	return 0
+}
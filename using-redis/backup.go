@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var backupKey = config.BackupKey
+
+type backupManifest struct {
+	Algorithm string `json:"algorithm"`
+	SHA256    string `json:"sha256"`
+	Entries   int    `json:"entries"`
+	IDCounter int64  `json:"id_counter"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type backupArtifact struct {
+	Manifest   json.RawMessage `json:"manifest"`
+	Nonce      []byte          `json:"nonce"`
+	Ciphertext []byte          `json:"ciphertext"`
+}
+
+func backupCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(backupKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBackup encrypts a snapshot with the operator key. The manifest is
+// passed as additional data, so it is covered by the GCM tag and cannot be
+// swapped between artifacts.
+func sealBackup(snapshot Store) (backupArtifact, error) {
+	plaintext, err := json.Marshal(snapshot)
+	if err != nil {
+		return backupArtifact{}, err
+	}
+	return sealBackupBytes(plaintext, len(snapshot.URLStore), snapshot.IDCounter)
+}
+
+// sealBackupBytes encrypts an export of entries links and the counter.
+func sealBackupBytes(plaintext []byte, entries int, counter int64) (backupArtifact, error) {
+	sum := sha256.Sum256(plaintext)
+
+	manifest, err := json.Marshal(backupManifest{
+		Algorithm: "AES-256-GCM",
+		SHA256:    hex.EncodeToString(sum[:]),
+		Entries:   entries,
+		IDCounter: counter,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return backupArtifact{}, err
+	}
+
+	aead, err := backupCipher()
+	if err != nil {
+		return backupArtifact{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return backupArtifact{}, err
+	}
+
+	return backupArtifact{
+		Manifest:   manifest,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, manifest),
+	}, nil
+}
+
+func openBackupBytes(artifact backupArtifact) ([]byte, backupManifest, error) {
+	var manifest backupManifest
+	if err := json.Unmarshal(artifact.Manifest, &manifest); err != nil {
+		return nil, manifest, errors.New("invalid backup manifest")
+	}
+
+	aead, err := backupCipher()
+	if err != nil {
+		return nil, manifest, err
+	}
+	if len(artifact.Nonce) != aead.NonceSize() {
+		return nil, manifest, errors.New("invalid backup nonce")
+	}
+	plaintext, err := aead.Open(nil, artifact.Nonce, artifact.Ciphertext, artifact.Manifest)
+	if err != nil {
+		return nil, manifest, errors.New("backup failed authentication (wrong key or tampered file)")
+	}
+
+	sum := sha256.Sum256(plaintext)
+	if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return nil, manifest, errors.New("backup checksum does not match manifest")
+	}
+	return plaintext, manifest, nil
+}
+
+func openBackup(artifact backupArtifact) (Store, backupManifest, error) {
+	plaintext, manifest, err := openBackupBytes(artifact)
+	if err != nil {
+		return Store{}, manifest, err
+	}
+
+	var snapshot Store
+	if err := json.Unmarshal(plaintext, &snapshot); err != nil {
+		return Store{}, manifest, err
+	}
+	return snapshot, manifest, nil
+}
+
+func verifyBackupHandle(c *gin.Context) {
+	if backupKey == "" {
+		c.JSON(400, gin.H{"error": "BACKUP_KEY is not configured"})
+		return
+	}
+
+	var artifact backupArtifact
+	if err := c.BindJSON(&artifact); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid backup artifact"})
+		return
+	}
+
+	_, manifest, err := openBackup(artifact)
+	if err != nil {
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"valid": true, "manifest": manifest})
+}
+
+// fullBackup is what /admin/export writes and /admin/import restores: the
+// links and ID counter of a store.json, with the counters Redis keeps next
+// to a link as fields of the link, so a backup of either variant restores
+// into the other.
+type fullBackup struct {
+	IDCounter int64                    `json:"idCounter"`
+	URLStore  map[string]jsonStoreLink `json:"urlStore"`
+}
+
+// Restore modes of /admin/import.
+const (
+	restoreMerge   = "merge"   // links in the backup replace those with their code; the rest stay
+	restoreReplace = "replace" // links not in the backup are deleted
+)
+
+// writeBackup writes snapshot as a fullBackup one link at a time, in code
+// order, so a large store is never held encoded in memory.
+func writeBackup(w io.Writer, snapshot Store) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `{"idCounter":%d,"urlStore":{`, snapshot.IDCounter)
+	for i, code := range slices.Sorted(maps.Keys(snapshot.URLStore)) {
+		link, err := backendLink(code, snapshot.URLStore[code])
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", code, err)
+		}
+		key, err := json.Marshal(code)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(link)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(key)
+		bw.WriteByte(':')
+		bw.Write(value)
+	}
+	bw.WriteString("}}\n")
+	return bw.Flush()
+}
+
+// adminExportHandle streams the whole store as a fullBackup. With
+// BACKUP_KEY it is sealed like /export instead, which needs it in memory.
+func adminExportHandle(c *gin.Context) {
+	snapshot, err := SnapshotStore()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	if backupKey != "" {
+		var plaintext bytes.Buffer
+		if err := writeBackup(&plaintext, snapshot); err != nil {
+			storeError(c, err)
+			return
+		}
+		artifact, err := sealBackupBytes(plaintext.Bytes(), len(snapshot.URLStore), snapshot.IDCounter)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to encrypt export"})
+			return
+		}
+		c.JSON(200, artifact)
+		return
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="backup-%s.json"`, time.Now().UTC().Format("20060102-150405")))
+	c.Status(200)
+	// The status is sent by the time a link fails to read. The body is
+	// cut short, and JSON that does not parse cannot be restored by
+	// mistake.
+	if err := writeBackup(c.Writer, snapshot); err != nil {
+		log.Println("Error exporting store:", err)
+	}
+}
+
+// readBackup reads a fullBackup, opening it first if it was sealed.
+func readBackup(body io.Reader) (fullBackup, error) {
+	var upload struct {
+		fullBackup
+		backupArtifact
+	}
+	if err := json.NewDecoder(body).Decode(&upload); err != nil {
+		return fullBackup{}, err
+	}
+	backup := upload.fullBackup
+	if upload.Ciphertext != nil {
+		if backupKey == "" {
+			return backup, errors.New("the backup is encrypted and BACKUP_KEY is not configured")
+		}
+		plaintext, _, err := openBackupBytes(upload.backupArtifact)
+		if err != nil {
+			return backup, err
+		}
+		if err := json.Unmarshal(plaintext, &backup); err != nil {
+			return backup, err
+		}
+	}
+	if backup.URLStore == nil {
+		return backup, errors.New("not a backup: urlStore is missing")
+	}
+	for code, link := range backup.URLStore {
+		if code == "" || link.LongURL == "" {
+			return backup, fmt.Errorf("link %q has no long_url", code)
+		}
+	}
+	return backup, nil
+}
+
+// restoreBackup writes every link of backup, deleting the others first in
+// replace mode, and raises the counter to the backup's. The counter is
+// never lowered, so codes handed out since the backup are not handed out
+// again. Every step overwrites, so a restore that failed half way can
+// simply be run again.
+func restoreBackup(backup fullBackup, mode string) (restored, deleted int, err error) {
+	if mode == restoreReplace {
+		var stale []string
+		err := ForEachURL(func(code string, _ URLData) error {
+			if _, ok := backup.URLStore[code]; !ok {
+				stale = append(stale, code)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, code := range stale {
+			if err := DeleteURL(code); err != nil && !errors.Is(err, ErrNotFound) {
+				return 0, deleted, fmt.Errorf("deleting %s: %w", code, err)
+			}
+			deleted++
+		}
+	}
+
+	for _, code := range slices.Sorted(maps.Keys(backup.URLStore)) {
+		link := backup.URLStore[code]
+		if err := SaveURL(code, link.URLData); err != nil {
+			return restored, deleted, fmt.Errorf("restoring %s: %w", code, err)
+		}
+		if err := saveBackendCounters(code, link); err != nil {
+			return restored, deleted, fmt.Errorf("restoring the counters of %s: %w", code, err)
+		}
+		if config.DedupeURLs {
+			region, _ := regionOf(code)
+			indexURL(Ctx, code, link.URLData, region)
+		}
+		restored++
+	}
+	return restored, deleted, EnsureCounterFloor(backup.IDCounter)
+}
+
+func adminImportHandle(c *gin.Context) {
+	mode := c.DefaultQuery("mode", restoreMerge)
+	if mode != restoreMerge && mode != restoreReplace {
+		c.JSON(400, gin.H{"error": "mode must be merge or replace"})
+		return
+	}
+	backup, err := readBackup(http.MaxBytesReader(c.Writer, c.Request.Body, config.Import.MaxBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("Backup is larger than %d bytes", tooLarge.Limit)})
+		return
+	} else if err != nil {
+		c.JSON(422, gin.H{"error": "Invalid backup: " + err.Error()})
+		return
+	}
+
+	restored, deleted, err := restoreBackup(backup, mode)
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", Action: "store.restore",
+		Detail: fmt.Sprintf("%s: %d links restored, %d deleted", mode, restored, deleted)}
+	if auditErr := AppendAudit(entry); auditErr != nil {
+		log.Println("Error writing audit log:", auditErr)
+	}
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	counter, err := links.Counter()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"mode": mode, "restored": restored, "deleted": deleted, "id_counter": counter})
+}
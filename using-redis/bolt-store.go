@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps links in a bbolt file (STORE_BACKEND=bolt), one bucket
+// per concern:
+//
+//	urls      code -> link JSON
+//	stats     code -> click count, so a click does not rewrite the link
+//	counters  "id" -> the ID counter
+//	expiry    expiry time + code -> nothing, in expiry order for cleanup
+//
+// Every write is one transaction that is synced to disk before it
+// returns, so a crash neither loses an acknowledged write nor leaves part
+// of one behind. bbolt locks the file, so only one process can use it.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltURLs     = []byte("urls")
+	boltStats    = []byte("stats")
+	boltCounters = []byte("counters")
+	boltExpiry   = []byte("expiry")
+	boltIDKey    = []byte("id")
+)
+
+func newBoltStore() (LinkStore, error) {
+	path := config.BoltPath
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("BOLT_PATH %s: %w (is another process using it?)", path, err)
+	}
+	return boltStore{db: db}, nil
+}
+
+func (s boltStore) Prepare() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltURLs, boltStats, boltCounters, boltExpiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltUint(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func boltBytes(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n))
+}
+
+// boltExpiryKey sorts by expiry time first, so cleanup reads the expired
+// links from the front of the bucket.
+func boltExpiryKey(code string, data URLData) []byte {
+	return append(boltBytes(data.CreatedAt+data.Expiry), code...)
+}
+
+// boltGet reads a link with its clicks. A nil link is not stored.
+func boltGet(tx *bolt.Tx, code string) (*URLData, error) {
+	raw := tx.Bucket(boltURLs).Get([]byte(code))
+	if raw == nil {
+		return nil, nil
+	}
+	var data URLData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	data.Clicks = int(boltUint(tx.Bucket(boltStats).Get([]byte(code))))
+	return &data, nil
+}
+
+// boltPut writes a link to every bucket it belongs in, replacing old.
+func boltPut(tx *bolt.Tx, code string, old *URLData, data URLData) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	expiry := tx.Bucket(boltExpiry)
+	if old != nil && old.Expiry != 0 {
+		if err := expiry.Delete(boltExpiryKey(code, *old)); err != nil {
+			return err
+		}
+	}
+	if data.Expiry != 0 {
+		if err := expiry.Put(boltExpiryKey(code, data), nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltStats).Put([]byte(code), boltBytes(int64(data.Clicks))); err != nil {
+		return err
+	}
+	return tx.Bucket(boltURLs).Put([]byte(code), jsonData)
+}
+
+func (s boltStore) GetURL(ctx context.Context, code string) (URLData, error) {
+	var data *URLData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		data, err = boltGet(tx, code)
+		return err
+	})
+	if err != nil {
+		return URLData{}, err
+	}
+	if data == nil {
+		return URLData{}, ErrNotFound
+	}
+	return *data, nil
+}
+
+func (s boltStore) SaveURL(code string, data URLData) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := boltGet(tx, code)
+		if err != nil {
+			return err
+		}
+		return boltPut(tx, code, old, data)
+	})
+}
+
+// CreateURLs writes every code in one transaction, which a taken code
+// rolls back.
+func (s boltStore) CreateURLs(ctx context.Context, region string, codes []string, data []URLData) error {
+	if region != "" {
+		return errors.New("regions need STORE_BACKEND=redis")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for i, code := range codes {
+			if tx.Bucket(boltURLs).Get([]byte(code)) != nil {
+				return codeTakenError{code}
+			}
+			if err := boltPut(tx, code, nil, data[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateURL needs no retries: bbolt runs one write transaction at a time.
+func (s boltStore) UpdateURL(code string, fn func(*URLData) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := boltGet(tx, code)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return ErrNotFound
+		}
+		data := *old
+		if err := fn(&data); err != nil {
+			return err
+		}
+		return boltPut(tx, code, old, data)
+	})
+}
+
+func (s boltStore) DeleteURL(code string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := boltGet(tx, code)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return ErrNotFound
+		}
+		if old.Expiry != 0 {
+			if err := tx.Bucket(boltExpiry).Delete(boltExpiryKey(code, *old)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltStats).Delete([]byte(code)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltURLs).Delete([]byte(code))
+	})
+}
+
+// IncrementClicks goes through Batch, which commits the clicks of
+// concurrent redirects together instead of syncing the file for each.
+func (s boltStore) IncrementClicks(ctx context.Context, code string, n, limit int) (int, error) {
+	var clicks int64
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLs).Get([]byte(code)) == nil {
+			return ErrNotFound
+		}
+		stats := tx.Bucket(boltStats)
+		clicks = boltUint(stats.Get([]byte(code))) + int64(n)
+		if limit > 0 && clicks > int64(limit) {
+			return ErrClickLimit
+		}
+		return stats.Put([]byte(code), boltBytes(clicks))
+	})
+	return int(clicks), err
+}
+
+// boltPageSize is how many links ForEachURL reads per transaction.
+const boltPageSize = 1000
+
+// ForEachURL reads a page at a time in code order and calls fn between
+// transactions, so fn may write to the store itself.
+func (s boltStore) ForEachURL(fn func(code string, data URLData) error) error {
+	var after []byte
+	for {
+		var codes []string
+		var page []URLData
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltURLs).Cursor()
+			k, _ := c.First()
+			if after != nil {
+				k, _ = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, _ = c.Next()
+				}
+			}
+			for ; k != nil && len(codes) < boltPageSize; k, _ = c.Next() {
+				data, err := boltGet(tx, string(k))
+				if err != nil {
+					return err
+				}
+				codes = append(codes, string(k))
+				page = append(page, *data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, code := range codes {
+			if err := fn(code, page[i]); err != nil {
+				return err
+			}
+		}
+		if len(codes) < boltPageSize {
+			return nil
+		}
+		after = []byte(codes[len(codes)-1])
+	}
+}
+
+// Snapshot reads everything in one read transaction. bbolt keeps no op
+// log, so the revision is empty.
+func (s boltStore) Snapshot() (Store, error) {
+	snapshot := Store{URLStore: make(map[string]URLData)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		snapshot.IDCounter = boltUint(tx.Bucket(boltCounters).Get(boltIDKey))
+		return tx.Bucket(boltURLs).ForEach(func(k, _ []byte) error {
+			data, err := boltGet(tx, string(k))
+			if err != nil {
+				return err
+			}
+			snapshot.URLStore[string(k)] = *data
+			return nil
+		})
+	})
+	return snapshot, err
+}
+
+func (s boltStore) Counter() (int64, error) {
+	var counter int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		counter = boltUint(tx.Bucket(boltCounters).Get(boltIDKey))
+		return nil
+	})
+	return counter, err
+}
+
+// updateCounter sets the counter to next(current).
+func (s boltStore) updateCounter(next func(int64) int64) (int64, error) {
+	var counter int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(boltCounters)
+		counter = next(boltUint(counters.Get(boltIDKey)))
+		return counters.Put(boltIDKey, boltBytes(counter))
+	})
+	return counter, err
+}
+
+func (s boltStore) GetNextID() (int64, error) {
+	return s.updateCounter(func(n int64) int64 { return n + 1 })
+}
+
+func (s boltStore) EnsureCounterFloor(floor int64) error {
+	_, err := s.updateCounter(func(n int64) int64 { return max(n, floor) })
+	return err
+}
+
+func (s boltStore) SetCounter(n int64) error {
+	_, err := s.updateCounter(func(int64) int64 { return n })
+	return err
+}
+
+// DeleteExpired reads expired codes from the front of the expiry bucket.
+func (s boltStore) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	return deleteExpiredPages(ctx, func(skip int64) ([]string, error) {
+		var codes []string
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltExpiry).Cursor()
+			for k, _ := c.First(); k != nil && boltUint(k[:8]) < now && len(codes) < cleanupPageSize; k, _ = c.Next() {
+				if skip > 0 {
+					skip--
+					continue
+				}
+				codes = append(codes, string(k[8:]))
+			}
+			return nil
+		})
+		return codes, err
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Calendar feeds list upcoming link expirations as iCalendar events, so
+// campaign owners see them next to their other deadlines and renew in time.
+
+// calendarFeed scopes a calendar subscription to one owner's links or to
+// one tag. Exactly one is set.
+type calendarFeed struct {
+	Owner string `json:"owner,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+func (f calendarFeed) validate() []fieldError {
+	if (f.Owner == "") == (f.Tag == "") {
+		return []fieldError{{"owner", "one_of", "Provide exactly one of owner or tag"}}
+	}
+	if f.Tag != "" && !validTagRegex.MatchString(f.Tag) {
+		return []fieldError{{"tag", "format", "Tags must be 1-32 letters, numbers, '-' or '_'"}}
+	}
+	return nil
+}
+
+func (f calendarFeed) matches(data URLData) bool {
+	if f.Owner != "" {
+		return data.Owner == f.Owner
+	}
+	return slices.Contains(data.Tags, f.Tag)
+}
+
+func calendarMAC(payload string) []byte {
+	key := sha256.Sum256([]byte("calendar:" + adminToken))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signCalendarFeed returns a token for ?token=. Calendar apps cannot send
+// headers, so the feed is authorized by the token alone. It does not
+// expire; rotating ADMIN_TOKEN revokes every feed.
+func signCalendarFeed(feed calendarFeed) (string, error) {
+	raw, err := json.Marshal(feed)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(calendarMAC(payload)), nil
+}
+
+var errCalendarToken = errors.New("invalid calendar token")
+
+func verifyCalendarFeed(token string) (calendarFeed, error) {
+	var feed calendarFeed
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || adminToken == "" {
+		return feed, errCalendarToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, calendarMAC(payload)) {
+		return feed, errCalendarToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(raw, &feed) != nil {
+		return feed, errCalendarToken
+	}
+	return feed, nil
+}
+
+// calendarEvent is one upcoming expiration.
+type calendarEvent struct {
+	Code      string
+	LongURL   string
+	ExpiresAt int64
+}
+
+// calendarReminder is how long before an expiration calendar apps alert.
+const calendarReminder = "-P3D"
+
+// icsEscape escapes a TEXT value (RFC 5545 section 3.3.11).
+var icsEscape = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsLine writes one content line, folded so that no line is over 75
+// octets, the leading space of continuation lines included, without
+// splitting a UTF-8 sequence.
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// renderCalendar builds an iCalendar feed with one event per expiration
+// and a reminder calendarReminder before it.
+func renderCalendar(name string, events []calendarEvent) string {
+	host := "url-shortener"
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	var b strings.Builder
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//url-shortener//link expirations//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "X-WR-CALNAME:"+icsEscape.Replace(name))
+	for _, ev := range events {
+		start := time.Unix(ev.ExpiresAt, 0).UTC()
+		icsLine(&b, "BEGIN:VEVENT")
+		icsLine(&b, "UID:"+ev.Code+"-expiry@"+host)
+		icsLine(&b, "DTSTAMP:"+stamp)
+		icsLine(&b, "DTSTART:"+start.Format("20060102T150405Z"))
+		icsLine(&b, "DTEND:"+start.Add(30*time.Minute).Format("20060102T150405Z"))
+		icsLine(&b, "SUMMARY:"+icsEscape.Replace("Short link "+ev.Code+" expires"))
+		icsLine(&b, "DESCRIPTION:"+icsEscape.Replace(baseURL+ev.Code+" -> "+ev.LongURL))
+		icsLine(&b, "URL:"+baseURL+"info/"+ev.Code)
+		icsLine(&b, "BEGIN:VALARM")
+		icsLine(&b, "ACTION:DISPLAY")
+		icsLine(&b, "DESCRIPTION:"+icsEscape.Replace("Short link "+ev.Code+" expires soon"))
+		icsLine(&b, "TRIGGER:"+calendarReminder)
+		icsLine(&b, "END:VALARM")
+		icsLine(&b, "END:VEVENT")
+	}
+	icsLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// name titles the feed in calendar apps.
+func (f calendarFeed) name() string {
+	if f.Owner != "" {
+		return "Short links of " + f.Owner
+	}
+	return "Short links tagged " + f.Tag
+}
+
+// calendarTokenHandle issues the subscription URL for an owner or a tag.
+// Signed-in users may only subscribe to their own links, which is what
+// they get without a body; tag feeds span everyone's links and stay with
+// admins.
+func calendarTokenHandle(c *gin.Context) {
+	if adminToken == "" {
+		c.JSON(503, gin.H{"error": "Calendar feeds disabled: ADMIN_TOKEN is not set"})
+		return
+	}
+	var feed calendarFeed
+	if err := c.ShouldBindJSON(&feed); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	user := linkScope(c)
+	if user != "" && feed == (calendarFeed{}) {
+		feed.Owner = user
+	}
+	if errs := feed.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+	if user != "" && feed.Owner != user {
+		c.JSON(403, gin.H{"error": "You may only subscribe to your own links"})
+		return
+	}
+
+	token, err := signCalendarFeed(feed)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": token, "url": baseURL + "calendar.ics?token=" + url.QueryEscape(token)})
+}
+
+func calendarHandle(c *gin.Context) {
+	feed, err := verifyCalendarFeed(c.Query("token"))
+	if err != nil {
+		c.JSON(403, gin.H{"error": "Invalid calendar token"})
+		return
+	}
+
+	now := time.Now().Unix()
+	var events []calendarEvent
+	err = ForEachURL(func(code string, data URLData) error {
+		if expiresAt := data.CreatedAt + data.Expiry; data.Expiry > 0 && expiresAt > now && feed.matches(data) {
+			events = append(events, calendarEvent{Code: code, LongURL: data.LongURL, ExpiresAt: expiresAt})
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list URLs"})
+		return
+	}
+	slices.SortFunc(events, func(a, b calendarEvent) int {
+		return cmp.Compare(a.ExpiresAt, b.ExpiresAt)
+	})
+
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(200, "text/calendar; charset=utf-8", []byte(renderCalendar(feed.name(), events)))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const cleanupPageSize = 500
+
+// Cleanup progress, exported on /metrics.
+var (
+	cleanupRunning  atomic.Bool
+	cleanupChecked  atomic.Int64 // links examined by the current or last run
+	cleanupDeleted  atomic.Int64 // links expired since the process started
+	cleanupDuration atomic.Int64 // milliseconds taken by the last run
+)
+
+var errCleanupRunning = errors.New("a cleanup is already running")
+
+// cleanUpExpiredLinks deletes expired links from the store and returns how
+// many it deleted. It stops between pages once ctx is cancelled, and
+// returns errCleanupRunning if another run has not finished.
+func cleanUpExpiredLinks(ctx context.Context) (int64, error) {
+	if !cleanupRunning.CompareAndSwap(false, true) {
+		return 0, errCleanupRunning
+	}
+	defer cleanupRunning.Store(false)
+
+	start := time.Now()
+	cleanupChecked.Store(0)
+
+	deleted, err := links.DeleteExpired(ctx, start.Unix())
+	if err != nil {
+		log.Printf("Cleanup stopped after deleting %d links: %v", deleted, err)
+		return deleted, err
+	}
+
+	cleanupDuration.Store(time.Since(start).Milliseconds())
+	lastCleanup.Store(start.Unix())
+	log.Printf("Expired links cleaned up: %d deleted, %d checked in %s.", deleted, cleanupChecked.Load(), time.Since(start).Round(time.Millisecond))
+	return deleted, nil
+}
+
+// cleanupHandle runs a cleanup now instead of waiting for the daily one.
+// It stops if the client goes away.
+func cleanupHandle(c *gin.Context) {
+	start := time.Now()
+	deleted, err := cleanUpExpiredLinks(c.Request.Context())
+	if errors.Is(err, errCleanupRunning) {
+		c.JSON(409, gin.H{"error": "A cleanup is already running"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"deleted":     deleted,
+		"checked":     cleanupChecked.Load(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// DeleteExpired walks the expiry index of every region, so only expired
+// links are read, and deletes them with a bounded pool of workers.
+func (redisStore) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	var deleted int64
+	for _, rdb := range allClients() {
+		n, err := cleanUpBackend(ctx, rdb, now)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func cleanUpBackend(ctx context.Context, rdb *redis.Client, now int64) (int64, error) {
+	jobs := make(chan string)
+	var page sync.WaitGroup
+	var deleted, failed atomic.Int64
+
+	var workers sync.WaitGroup
+	for range config.CleanupWorkers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for code := range jobs {
+				expired, err := expireLink(rdb, code, now)
+				switch {
+				case err != nil:
+					failed.Add(1)
+					log.Printf("Error expiring %s: %v", code, err)
+				case expired:
+					deleted.Add(1)
+					cleanupDeleted.Add(1)
+				}
+				cleanupChecked.Add(1)
+				page.Done()
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(jobs)
+
+	// Handled entries leave the index, so every page starts at the front,
+	// skipping only the entries that failed.
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted.Load(), err
+		}
+
+		codes, err := rdb.ZRangeArgs(Ctx, redis.ZRangeArgs{
+			Key:     expiryIndexKey,
+			Start:   "-inf",
+			Stop:    "(" + strconv.FormatInt(now, 10),
+			ByScore: true,
+			Offset:  failed.Load(),
+			Count:   cleanupPageSize,
+		}).Result()
+		if err != nil {
+			return deleted.Load(), err
+		}
+		if len(codes) == 0 {
+			return deleted.Load(), nil
+		}
+
+		page.Add(len(codes))
+		for _, code := range codes {
+			jobs <- code
+		}
+		page.Wait()
+		log.Printf("Cleanup progress: %d checked, %d deleted.", cleanupChecked.Load(), deleted.Load())
+	}
+}
+
+// deleteExpiredPages deletes expired links for backends that list them
+// with a query: expiredPage returns the first expired codes after skipping
+// skip of them. Deleted links leave the list, so every page starts at the
+// front, skipping only the links that failed.
+func deleteExpiredPages(ctx context.Context, expiredPage func(skip int64) ([]string, error)) (int64, error) {
+	var deleted, failed int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		codes, err := expiredPage(failed)
+		if err != nil {
+			return deleted, err
+		}
+		if len(codes) == 0 {
+			return deleted, nil
+		}
+
+		for _, code := range codes {
+			data, _ := GetURL(code) // for webhooks
+			err := DeleteURL(code)
+			switch {
+			case errors.Is(err, ErrNotFound):
+			case err != nil:
+				failed++
+				log.Printf("Error expiring %s: %v", code, err)
+			default:
+				runExpireHooks(ctx, code)
+				notifyWebhooks(eventLinkExpired, code, data, nil)
+				deleted++
+				cleanupDeleted.Add(1)
+			}
+			cleanupChecked.Add(1)
+		}
+		log.Printf("Cleanup progress: %d checked, %d deleted.", cleanupChecked.Load(), deleted)
+	}
+}
+
+// expireLink deletes code if it really has expired. Index entries that no
+// longer match the stored link are corrected instead.
+func expireLink(rdb *redis.Client, code string, now int64) (bool, error) {
+	data, err := getURLFrom(Ctx, rdb, code)
+	if errors.Is(err, ErrNotFound) {
+		return false, rdb.ZRem(Ctx, expiryIndexKey, code).Err()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if data.Expiry == 0 || now <= data.CreatedAt+data.Expiry {
+		_, err := rdb.Pipelined(Ctx, func(pipe redis.Pipeliner) error {
+			indexExpiry(pipe, code, data)
+			return nil
+		})
+		return false, err
+	}
+
+	if err := DeleteURL(code); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	runExpireHooks(Ctx, code)
+	notifyWebhooks(eventLinkExpired, code, data, nil)
+	return true, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Click buckets count every counted redirect per UTC day and hour. Unlike
+// the rollups in click_daily they do not depend on raw events, so they
+// also cover visitors whose events are not recorded (consent mode,
+// CLICK_EVENTS=false). Daily buckets are kept for good, hourly ones for
+// CLICK_HOURLY_DAYS.
+const (
+	clickDaysPrefix  = "click_days:"  // hash of "YYYY-MM-DD" -> clicks
+	clickHoursPrefix = "click_hours:" // click_hours:<code>:<day>, hash of "HH" -> clicks
+)
+
+// recordClickBuckets counts n clicks on code in the buckets of now. Like
+// recordClick it only logs failures, since the redirect is served anyway.
+func recordClickBuckets(code string, n int, now time.Time) {
+	if !config.usesRedis() {
+		return
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		log.Println("Error counting click buckets:", err)
+		return
+	}
+	now = now.UTC()
+	day := now.Format(time.DateOnly)
+	hours := clickHoursPrefix + code + ":" + day
+	_, err = rdb.Pipelined(Ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(Ctx, clickDaysPrefix+code, day, int64(n))
+		pipe.HIncrBy(Ctx, hours, now.Format("15"), int64(n))
+		pipe.ExpireAt(Ctx, hours, now.Truncate(24*time.Hour).AddDate(0, 0, config.Clicks.HourlyDays))
+		return nil
+	})
+	if err != nil {
+		log.Println("Error counting click buckets:", err)
+	}
+}
+
+// clickBucket is the number of clicks in the day or hour starting at
+// Start.
+type clickBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// ClickBuckets returns a link's clicks per day or per hour over the UTC
+// days from and to, both inclusive, with a bucket for every day or hour.
+func ClickBuckets(code, granularity string, from, to time.Time) ([]clickBucket, error) {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(time.DateOnly))
+	}
+
+	var buckets []clickBucket
+	if granularity == "day" {
+		counts, err := rdb.HMGet(Ctx, clickDaysPrefix+code, days...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, day := range days {
+			start, _ := time.Parse(time.DateOnly, day)
+			buckets = append(buckets, clickBucket{Start: start, Clicks: bucketCount(counts[i])})
+		}
+		return buckets, nil
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(days))
+	_, err = rdb.Pipelined(Ctx, func(pipe redis.Pipeliner) error {
+		for i, day := range days {
+			cmds[i] = pipe.HGetAll(Ctx, clickHoursPrefix+code+":"+day)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, day := range days {
+		start, _ := time.Parse(time.DateOnly, day)
+		for hour := range 24 {
+			n, _ := strconv.ParseInt(cmds[i].Val()[fmt.Sprintf("%02d", hour)], 10, 64)
+			buckets = append(buckets, clickBucket{Start: start.Add(time.Duration(hour) * time.Hour), Clicks: n})
+		}
+	}
+	return buckets, nil
+}
+
+func bucketCount(value any) int64 {
+	s, _ := value.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// parseBucketRange reads from/to like parseCompareRange. Hourly buckets
+// default to today and may not reach further back than they are kept.
+func parseBucketRange(granularity, fromParam, toParam string, now time.Time) (time.Time, time.Time, error) {
+	if granularity == "day" {
+		return parseCompareRange(fromParam, toParam, now)
+	}
+	if fromParam == "" {
+		fromParam = cmp.Or(toParam, now.UTC().Format(time.DateOnly))
+	}
+	from, to, err := parseCompareRange(fromParam, toParam, now)
+	if err != nil {
+		return from, to, err
+	}
+	if from.Before(now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-config.Clicks.HourlyDays)) {
+		return from, to, fmt.Errorf("Hourly clicks are kept for %d days", config.Clicks.HourlyDays)
+	}
+	return from, to, nil
+}
+
+// clickBucketsHandle charts a link's traffic: its clicks per day (the
+// default) or per hour between from and to.
+func clickBucketsHandle(c *gin.Context) {
+	code := c.Param("code")
+	granularity := cmp.Or(c.Query("granularity"), "day")
+	if granularity != "day" && granularity != "hour" {
+		c.JSON(400, gin.H{"error": "granularity must be day or hour"})
+		return
+	}
+	from, to, err := parseBucketRange(granularity, c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := GetURL(code); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	buckets, err := ClickBuckets(code, granularity, from, to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+	var total int64
+	for _, b := range buckets {
+		total += b.Clicks
+	}
+	c.JSON(200, gin.H{
+		"code":        code,
+		"granularity": granularity,
+		"from":        from.Format(time.DateOnly),
+		"to":          to.Format(time.DateOnly),
+		"total":       total,
+		"buckets":     buckets,
+	})
+}
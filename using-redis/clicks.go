@@ -0,0 +1,541 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand/v2"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	clickEventsKey   = "url_clicks"
+	clickLinkPrefix  = "url_clicks:" // a link's own events not yet rolled up
+	clickDailyPrefix = "click_daily:"
+	clickRollupKey   = "url_click_rollup" // last UTC day written to click_daily
+	clickPageSize    = 1000
+)
+
+// clickEvent is one raw redirect. It carries the hashed client IP, the
+// referrer, the user agent and the visitor's location, so it is only kept
+// for CLICK_RETENTION_DAYS; its day is rolled up into click_daily as soon
+// as the day is over.
+type clickEvent struct {
+	Code      string `json:"code"`
+	Timestamp int64  `json:"timestamp"`
+	IP        string `json:"ip"` // hashIP of the client IP; raw in events recorded before hashing
+	Referrer  string `json:"referrer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Country   string `json:"country,omitempty"` // only when visitors can be located
+	City      string `json:"city,omitempty"`
+	Weight    int    `json:"weight,omitempty"` // clicks this event stands for on sampled links
+}
+
+func (ev clickEvent) weight() int64 {
+	if ev.Weight > 1 {
+		return int64(ev.Weight)
+	}
+	return 1
+}
+
+// sampleClick decides whether a click on a link with the given sample rate
+// is recorded.
+func sampleClick(rate int) bool {
+	return rate <= 1 || mathrand.IntN(rate) == 0
+}
+
+// dailyClicks is the anonymized per-link rollup of one UTC day.
+type dailyClicks struct {
+	Count        int64            `json:"count"`
+	Uniques      int64            `json:"uniques"`
+	TopReferrers []referrerCount  `json:"top_referrers,omitempty"`
+	Browsers     map[string]int64 `json:"browsers,omitempty"`
+	Devices      map[string]int64 `json:"devices,omitempty"`
+	Countries    map[string]int64 `json:"countries,omitempty"`
+	TopCities    []cityCount      `json:"top_cities,omitempty"`
+}
+
+type referrerCount struct {
+	Hash  string `json:"hash"`
+	Count int64  `json:"count"`
+}
+
+type cityCount struct {
+	City  string `json:"city"`
+	Count int64  `json:"count"`
+}
+
+const (
+	topReferrerLimit = 5
+	topCityLimit     = 10
+)
+
+var clickHashKey = []byte(config.Clicks.HashKey)
+
+// clickCutoff is the UTC midnight before which raw events are rolled up, so
+// only complete days are ever aggregated.
+func clickCutoff(now time.Time) time.Time {
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -config.Clicks.RetentionDays)
+}
+
+func clickDay(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.DateOnly)
+}
+
+// hashReferrer keeps referrers comparable across days without storing them.
+// Set CLICK_HASH_KEY so the hashes can't be reversed by guessing hosts.
+func hashReferrer(referrer string) string {
+	host := referrer
+	if u, err := url.Parse(referrer); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	mac := hmac.New(sha256.New, clickHashKey)
+	mac.Write([]byte(strings.ToLower(host)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// hashIP keeps visitors countable without storing their addresses. The
+// "ip:" prefix keeps its hashes apart from referrer hashes.
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, clickHashKey)
+	mac.Write([]byte("ip:" + ip))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// maxUserAgentLen bounds the user agent kept per raw event.
+const maxUserAgentLen = 256
+
+var botMarkers = []string{"bot", "crawler", "spider", "preview", "curl/", "wget/", "python-", "go-http-client", "headless"}
+
+// classifyUserAgent sorts a user agent into a browser family and a device
+// type. Rollups keep only these, since full user agents are close to
+// unique per visitor.
+func classifyUserAgent(ua string) (browser, device string) {
+	ua = strings.ToLower(ua)
+	if ua == "" {
+		return "unknown", "unknown"
+	}
+	if slices.ContainsFunc(botMarkers, func(marker string) bool { return strings.Contains(ua, marker) }) {
+		return "bot", "bot"
+	}
+
+	switch {
+	case strings.Contains(ua, "edg/"), strings.Contains(ua, "edga/"), strings.Contains(ua, "edgios/"):
+		browser = "edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		browser = "opera"
+	case strings.Contains(ua, "firefox/"), strings.Contains(ua, "fxios/"):
+		browser = "firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		browser = "chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "safari"
+	default:
+		browser = "other"
+	}
+
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		device = "tablet"
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "android"):
+		device = "mobile"
+	default:
+		device = "desktop"
+	}
+	return browser, device
+}
+
+// aggregateClicks rolls events of a single day up per link.
+func aggregateClicks(events []clickEvent) map[string]dailyClicks {
+	type tally struct {
+		count     int64
+		ips       map[string]int64
+		referrers map[string]int64
+		browsers  map[string]int64
+		devices   map[string]int64
+		countries map[string]int64
+		cities    map[string]int64
+	}
+
+	// Sampled events are scaled by their weight, uniques included: each
+	// sampled visitor stands for weight visitors.
+	tallies := make(map[string]*tally)
+	for _, ev := range events {
+		t, ok := tallies[ev.Code]
+		if !ok {
+			t = &tally{ips: make(map[string]int64), referrers: make(map[string]int64),
+				browsers: make(map[string]int64), devices: make(map[string]int64),
+				countries: make(map[string]int64), cities: make(map[string]int64)}
+			tallies[ev.Code] = t
+		}
+		t.count += ev.weight()
+		t.ips[ev.IP] = max(t.ips[ev.IP], ev.weight())
+		if ev.Referrer != "" {
+			t.referrers[hashReferrer(ev.Referrer)] += ev.weight()
+		}
+		browser, device := classifyUserAgent(ev.UserAgent)
+		t.browsers[browser] += ev.weight()
+		t.devices[device] += ev.weight()
+		if ev.Country != "" {
+			t.countries[ev.Country] += ev.weight()
+		}
+		if ev.City != "" {
+			t.cities[ev.City] += ev.weight()
+		}
+	}
+
+	result := make(map[string]dailyClicks, len(tallies))
+	for code, t := range tallies {
+		var top []referrerCount
+		for hash, count := range t.referrers {
+			top = append(top, referrerCount{hash, count})
+		}
+		sort.Slice(top, func(i, j int) bool {
+			if top[i].Count != top[j].Count {
+				return top[i].Count > top[j].Count
+			}
+			return top[i].Hash < top[j].Hash
+		})
+		if len(top) > topReferrerLimit {
+			top = top[:topReferrerLimit]
+		}
+		var uniques int64
+		for _, w := range t.ips {
+			uniques += w
+		}
+		var countries map[string]int64
+		if len(t.countries) > 0 {
+			countries = t.countries
+		}
+		result[code] = dailyClicks{Count: t.count, Uniques: uniques, TopReferrers: top, Browsers: t.browsers, Devices: t.devices,
+			Countries: countries, TopCities: topCities(t.cities, topCityLimit)}
+	}
+	return result
+}
+
+// topCities returns the limit cities with the most clicks, or nil for
+// none.
+func topCities(cities map[string]int64, limit int) []cityCount {
+	var top []cityCount
+	for city, count := range cities {
+		top = append(top, cityCount{city, count})
+	}
+	slices.SortFunc(top, func(a, b cityCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.City, b.City))
+	})
+	return top[:min(len(top), limit)]
+}
+
+// recordClick appends a raw event to the url_clicks stream, and to the
+// link's own stream, which lets the analytics of one link read its events
+// without scanning everyone's. The stream ID doubles as the timestamp,
+// which lets the rollup trim whole days by ID.
+func recordClick(code, ip, referrer, userAgent string, loc geoLocation, weight int) {
+	if !config.usesRedis() {
+		return
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		log.Println("Error recording click:", err)
+		return
+	}
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = userAgent[:maxUserAgentLen]
+	}
+	values := map[string]any{"code": code, "ip": hashIP(ip), "referrer": referrer, "ua": userAgent}
+	if loc.Country != "" {
+		values["country"] = loc.Country
+	}
+	if loc.City != "" {
+		values["city"] = loc.City
+	}
+	if weight > 1 {
+		values["weight"] = weight
+	}
+	_, err = rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(Ctx, &redis.XAddArgs{Stream: clickEventsKey, Values: values})
+		// The rollup trims the link's stream; the expiry drops the streams
+		// of links nobody clicks any more.
+		pipe.XAdd(Ctx, &redis.XAddArgs{Stream: clickLinkPrefix + code, Values: values})
+		pipe.Expire(Ctx, clickLinkPrefix+code, time.Duration(config.Clicks.RetentionDays)*24*time.Hour)
+		return nil
+	})
+	if err != nil {
+		log.Println("Error recording click:", err)
+	}
+}
+
+func parseClick(msg redis.XMessage) clickEvent {
+	ms, _ := strconv.ParseInt(strings.SplitN(msg.ID, "-", 2)[0], 10, 64)
+	code, _ := msg.Values["code"].(string)
+	ip, _ := msg.Values["ip"].(string)
+	referrer, _ := msg.Values["referrer"].(string)
+	userAgent, _ := msg.Values["ua"].(string)
+	country, _ := msg.Values["country"].(string)
+	city, _ := msg.Values["city"].(string)
+	weight, _ := strconv.Atoi(fmt.Sprint(msg.Values["weight"]))
+	return clickEvent{Code: code, Timestamp: ms / 1000, IP: ip, Referrer: referrer, UserAgent: userAgent,
+		Country: country, City: city, Weight: weight}
+}
+
+// clickRollupGrace keeps a day open for a little while after midnight, in
+// case the clocks of this host and Redis disagree about when it ended.
+const clickRollupGrace = time.Minute
+
+// rollUpClicks writes the aggregates of every complete day to click_daily,
+// so stats read one hash field per link and day instead of raw events, and
+// trims raw events older than the retention window. Each day's aggregates
+// and the marker of the last rolled-up day are written in one transaction,
+// so a crash never loses a day. Every region rolls up its own events.
+func rollUpClicks(now time.Time) error {
+	for _, rdb := range allClients() {
+		if err := rollUpClicksIn(rdb, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollUpClicksIn(rdb *redis.Client, now time.Time) error {
+	day, err := nextRollupDay(rdb)
+	if err != nil {
+		return err
+	}
+	complete := now.Add(-clickRollupGrace).UTC().Truncate(24 * time.Hour)
+	for ; !day.IsZero() && day.Before(complete); day = day.AddDate(0, 0, 1) {
+		n, err := rollUpDay(rdb, day, false)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Rolled up %d clicks from %s.", n, clickDay(day.Unix()))
+		}
+	}
+
+	cutoff := clickCutoff(now)
+	if day.IsZero() || cutoff.After(day) {
+		// Never trim events that are not rolled up yet.
+		cutoff = day
+	}
+	if cutoff.IsZero() {
+		return nil
+	}
+	return rdb.XTrimMinID(Ctx, clickEventsKey, strconv.FormatInt(cutoff.UnixMilli(), 10)).Err()
+}
+
+// nextRollupDay returns the first day that is not rolled up yet: the day
+// after the marker, or the day of the oldest raw event on a store that has
+// never been rolled up. It is zero while there is nothing to roll up.
+func nextRollupDay(rdb *redis.Client) (time.Time, error) {
+	through, err := rdb.Get(Ctx, clickRollupKey).Result()
+	if err == nil {
+		day, err := time.Parse(time.DateOnly, through)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: %w", clickRollupKey, err)
+		}
+		return day.AddDate(0, 0, 1), nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return time.Time{}, err
+	}
+	first, err := rdb.XRangeN(Ctx, clickEventsKey, "-", "+", 1).Result()
+	if err != nil || len(first) == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(parseClick(first[0]).Timestamp, 0).UTC().Truncate(24 * time.Hour), nil
+}
+
+// rollUpDay aggregates the raw events of one UTC day and returns how many
+// clicks they stand for. With rebuild, rollups of the day left over from
+// links that have no events, such as those written by a buggy release,
+// are removed as well; that scans every click_daily key, so only the
+// backfill command does it.
+func rollUpDay(rdb *redis.Client, dayStart time.Time, rebuild bool) (int64, error) {
+	events, err := clicksBetweenIn(rdb, clickEventsKey, dayStart, dayStart.Add(24*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	day := clickDay(dayStart.Unix())
+	aggregates := aggregateClicks(events)
+
+	var stale []string
+	if rebuild {
+		iter := rdb.Scan(Ctx, 0, clickDailyPrefix+"*", 1000).Iterator()
+		for iter.Next(Ctx) {
+			code := strings.TrimPrefix(iter.Val(), clickDailyPrefix)
+			if _, ok := aggregates[code]; ok {
+				continue
+			}
+			if exists, err := rdb.HExists(Ctx, iter.Val(), day).Result(); err != nil {
+				return 0, err
+			} else if exists {
+				stale = append(stale, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	var clicks int64
+	_, err = rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		for code, agg := range aggregates {
+			jsonData, err := json.Marshal(agg)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(Ctx, clickDailyPrefix+code, day, jsonData)
+			pipe.XTrimMinID(Ctx, clickLinkPrefix+code, strconv.FormatInt(dayStart.Add(24*time.Hour).UnixMilli(), 10))
+			clicks += agg.Count
+		}
+		for _, key := range stale {
+			pipe.HDel(Ctx, key, day)
+		}
+		if !rebuild {
+			pipe.Set(Ctx, clickRollupKey, day, 0)
+		}
+		return nil
+	})
+	return clicks, err
+}
+
+// DailyClicks returns the rolled-up history of a link keyed by UTC day.
+func DailyClicks(code string) (map[string]dailyClicks, error) {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return nil, err
+	}
+	return dailyClicksIn(rdb, code)
+}
+
+func dailyClicksIn(rdb *redis.Client, code string) (map[string]dailyClicks, error) {
+	raw, err := rdb.HGetAll(Ctx, clickDailyPrefix+code).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]dailyClicks, len(raw))
+	for day, value := range raw {
+		var agg dailyClicks
+		if err := json.Unmarshal([]byte(value), &agg); err != nil {
+			return nil, err
+		}
+		days[day] = agg
+	}
+	return days, nil
+}
+
+// PendingClicksBetween returns raw events recorded in [from, to) in every
+// region, skipping days that are already rolled up. It reads the events of
+// every link, so only admin routes use it; PendingClicksOf reads those of
+// a few links.
+func PendingClicksBetween(from, to time.Time) ([]clickEvent, error) {
+	var events []clickEvent
+	for _, rdb := range allClients() {
+		regional, err := pendingClicksIn(rdb, clickEventsKey, from, to)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, regional...)
+	}
+	return events, nil
+}
+
+// PendingClicksOf is PendingClicksBetween for the given links only, read
+// from their own streams.
+func PendingClicksOf(codes []string, from, to time.Time) ([]clickEvent, error) {
+	var events []clickEvent
+	for _, code := range codes {
+		rdb, err := clientForCode(code)
+		if err != nil {
+			return nil, err
+		}
+		link, err := pendingClicksIn(rdb, clickLinkPrefix+code, from, to)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, link...)
+	}
+	return events, nil
+}
+
+// pendingClicksIn reads the events of a stream of rdb recorded in [from,
+// to) on days that are not rolled up yet.
+func pendingClicksIn(rdb *redis.Client, stream string, from, to time.Time) ([]clickEvent, error) {
+	next, err := nextRollupDay(rdb)
+	if err != nil {
+		return nil, err
+	}
+	if next.After(from) {
+		from = next
+	}
+	if !from.Before(to) {
+		return nil, nil
+	}
+	return clicksBetweenIn(rdb, stream, from, to)
+}
+
+func clicksBetweenIn(rdb *redis.Client, stream string, from, to time.Time) ([]clickEvent, error) {
+	var events []clickEvent
+	err := eachClickIn(rdb, stream, from, to, func(ev clickEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	return events, err
+}
+
+// eachClickIn calls fn with the raw events of a stream recorded in [from,
+// to), oldest first, reading them a page at a time.
+func eachClickIn(rdb *redis.Client, stream string, from, to time.Time, fn func(clickEvent) error) error {
+	start := strconv.FormatInt(from.UnixMilli(), 10)
+	end := strconv.FormatInt(to.UnixMilli()-1, 10)
+	for {
+		msgs, err := rdb.XRangeN(Ctx, stream, start, end, clickPageSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := fn(parseClick(msg)); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < clickPageSize {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// AllDailyClicks returns the rolled-up history of every link in every
+// region, keyed by code and UTC day.
+func AllDailyClicks() (map[string]map[string]dailyClicks, error) {
+	all := make(map[string]map[string]dailyClicks)
+	for _, rdb := range allClients() {
+		iter := rdb.Scan(Ctx, 0, clickDailyPrefix+"*", 1000).Iterator()
+		for iter.Next(Ctx) {
+			code := strings.TrimPrefix(iter.Val(), clickDailyPrefix)
+			days, err := dailyClicksIn(rdb, code)
+			if err != nil {
+				return nil, err
+			}
+			all[code] = days
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
@@ -0,0 +1,258 @@
+// Package client is a Go client for the URL shortener API.
+//
+// Requests the server rejected without acting on them (429, or any
+// response with Retry-After) are retried with jittered exponential
+// backoff, waiting at least as long as Retry-After asks. A 5xx or a
+// network error may come after the link was created, so Shorten does not
+// retry those; CreateIdempotent does, because its Idempotency-Key makes
+// the server replay the first link instead of creating another.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one URL shortener. The zero values of its optional
+// fields give the defaults described on each.
+type Client struct {
+	BaseURL string // e.g. "http://localhost:8080"
+	Token   string // sent as "Authorization: Bearer" when set
+	APIKey  string // sent as X-API-Key when set
+	Tenant  string // sent as X-Tenant when set
+
+	HTTPClient *http.Client // http.DefaultClient when nil
+
+	// MaxRetries is the number of retries after the first attempt,
+	// 3 when 0. Set it negative to disable retries.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the wait before a retry, 200ms and
+	// 10s when 0. A longer Retry-After from the server wins.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// NeverExpires is the ExpirySeconds of a link that never expires.
+const NeverExpires = -1
+
+// ShortenRequest is the body of POST /shorten. See the README for the
+// fields the server accepts beyond these.
+type ShortenRequest struct {
+	URL           string   `json:"url"`
+	CustomCode    string   `json:"custom_code,omitempty"`
+	ExpirySeconds int64    `json:"expiry_seconds,omitempty"` // NeverExpires for no expiry
+	Tags          []string `json:"tags,omitempty"`
+	OnConflict    string   `json:"on_conflict,omitempty"`
+	Fallbacks     []string `json:"fallbacks,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+	MaxClicks     int      `json:"max_clicks,omitempty"` // 1 for a one-time link
+}
+
+// ShortenResponse is the reply of POST /shorten.
+type ShortenResponse struct {
+	Code          string   `json:"code"`
+	ShortURL      string   `json:"short_url"`
+	ExpirySeconds int64    `json:"expiry_seconds"`
+	Existing      bool     `json:"existing,omitempty"`
+	Aliases       []string `json:"aliases,omitempty"`
+
+	// Replayed is set when the server answered an Idempotency-Key it had
+	// already seen with the link it created then.
+	Replayed bool `json:"-"`
+}
+
+// Error is a response the server answered with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("url shortener: %d %s", e.StatusCode, e.Message)
+}
+
+// Shorten creates a short link.
+func (c *Client) Shorten(ctx context.Context, req ShortenRequest) (*ShortenResponse, error) {
+	return c.shorten(ctx, "", req)
+}
+
+// CreateIdempotent creates a short link under an Idempotency-Key, so it
+// is safe to retry after timeouts and 5xx: every call with the same key
+// and request returns the same link for 24 hours. An empty key is
+// replaced with a random one, which covers the retries of this call only.
+func (c *Client) CreateIdempotent(ctx context.Context, key string, req ShortenRequest) (*ShortenResponse, error) {
+	if key == "" {
+		key = NewIdempotencyKey()
+	}
+	return c.shorten(ctx, key, req)
+}
+
+// NewIdempotencyKey returns a random key for CreateIdempotent. Store it
+// with the work it belongs to to retry across restarts.
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *Client) shorten(ctx context.Context, key string, req ShortenRequest) (*ShortenResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if key != "" {
+		header.Set("Idempotency-Key", key)
+	}
+	resp, respBody, err := c.do(ctx, http.MethodPost, "/shorten", header, body, key != "")
+	if err != nil {
+		return nil, err
+	}
+	var out ShortenResponse
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return nil, fmt.Errorf("url shortener: decoding response: %w", err)
+	}
+	out.Replayed = resp.Header.Get("Idempotent-Replayed") == "true"
+	return &out, nil
+}
+
+// Info returns the details of a link, as GET /info/:code reports them.
+func (c *Client) Info(ctx context.Context, code string) (map[string]any, error) {
+	_, respBody, err := c.do(ctx, http.MethodGet, "/info/"+url.PathEscape(code), nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return nil, fmt.Errorf("url shortener: decoding response: %w", err)
+	}
+	return out, nil
+}
+
+// do sends a request until it succeeds, fails for good or runs out of
+// retries. idempotent requests are also retried on 5xx and network
+// errors. The returned body is that of a 2xx response.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, idempotent bool) (*http.Response, []byte, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		if c.Tenant != "" {
+			req.Header.Set("X-Tenant", c.Tenant)
+		}
+		if c.APIKey != "" {
+			req.Header.Set("X-API-Key", c.APIKey)
+		}
+
+		resp, err := httpClient.Do(req)
+		var respBody []byte
+		if err == nil {
+			respBody, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return resp, respBody, nil
+		}
+
+		var retryAfter time.Duration
+		retry := idempotent && ctx.Err() == nil
+		if err == nil {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			retry = resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "" ||
+				idempotent && resp.StatusCode >= 500
+			err = &Error{StatusCode: resp.StatusCode, Message: errorMessage(respBody)}
+		}
+		if !retry || maxRetries < 0 || attempt >= maxRetries {
+			return nil, nil, err
+		}
+
+		timer := time.NewTimer(max(c.backoff(attempt), retryAfter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is a random wait of up to MinBackoff doubled attempt times,
+// capped at MaxBackoff ("full jitter"), so clients that failed together
+// do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	minBackoff := c.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = 200 * time.Millisecond
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	ceiling := maxBackoff
+	if attempt < 30 && minBackoff<<attempt < maxBackoff {
+		ceiling = minBackoff << attempt
+	}
+	return rand.N(ceiling) + 1
+}
+
+// parseRetryAfter reads Retry-After in seconds or as an HTTP date, and
+// returns 0 when it is missing or unreadable.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// errorMessage pulls the message out of a JSON {"error": ...} body, which
+// the server sends, or returns a plain-text body, such as a proxy's, as it
+// is.
+func errorMessage(body []byte) string {
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		return payload.Error
+	}
+	return strings.TrimSpace(string(body))
+}
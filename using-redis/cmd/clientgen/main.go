@@ -0,0 +1,717 @@
+// Command clientgen writes the typed API clients in /clients from
+// openapi.yaml. `make clients` runs it for both languages:
+//
+//	go run ./cmd/clientgen -lang typescript -spec ../openapi.yaml -o ../clients/typescript
+//	go run ./cmd/clientgen -lang python -spec ../openapi.yaml -o ../clients/python
+//
+// The TypeScript client only needs fetch and the Python one only the
+// standard library. The generator covers what the spec uses: component
+// schemas with allOf, oneOf, enums and maps, JSON and text responses,
+// redirects, path, query and header parameters, and the API key and bearer
+// schemes. Anything else is an error rather than a quietly wrong client.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	lang := flag.String("lang", "", "typescript or python")
+	specPath := flag.String("spec", "../openapi.yaml", "OpenAPI file to read")
+	out := flag.String("o", "", "directory to write the client to")
+	flag.Parse()
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-o is required")
+		os.Exit(2)
+	}
+
+	api, err := load(*specPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var files map[string]string
+	switch *lang {
+	case "typescript":
+		files = typescriptClient(api)
+	case "python":
+		files = pythonClient(api)
+	default:
+		fmt.Fprintf(os.Stderr, "-lang %q is not typescript or python\n", *lang)
+		os.Exit(2)
+	}
+	for name, content := range files {
+		path := filepath.Join(*out, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// ordered decodes a YAML mapping keeping its order, so the clients list
+// types and operations as the spec does.
+type ordered[T any] []entry[T]
+
+type entry[T any] struct {
+	key   string
+	value T
+}
+
+func (o *ordered[T]) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping", node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		var value T
+		if err := node.Content[i+1].Decode(&value); err != nil {
+			return err
+		}
+		*o = append(*o, entry[T]{node.Content[i].Value, value})
+	}
+	return nil
+}
+
+type spec struct {
+	Info struct {
+		Title   string `yaml:"title"`
+		Version string `yaml:"version"`
+	} `yaml:"info"`
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      ordered[ordered[yaml.Node]] `yaml:"paths"`
+	Components struct {
+		Parameters      map[string]parameter    `yaml:"parameters"`
+		Responses       map[string]response     `yaml:"responses"`
+		SecuritySchemes ordered[securityScheme] `yaml:"securitySchemes"`
+		Schemas         ordered[*schema]        `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type schema struct {
+	Ref                  string           `yaml:"$ref"`
+	Type                 string           `yaml:"type"`
+	Description          string           `yaml:"description"`
+	Enum                 []string         `yaml:"enum"`
+	Nullable             bool             `yaml:"nullable"`
+	Required             []string         `yaml:"required"`
+	Properties           ordered[*schema] `yaml:"properties"`
+	Items                *schema          `yaml:"items"`
+	AdditionalProperties *schema          `yaml:"additionalProperties"`
+	OneOf                []*schema        `yaml:"oneOf"`
+	AllOf                []*schema        `yaml:"allOf"`
+}
+
+type operation struct {
+	OperationID string      `yaml:"operationId"`
+	Summary     string      `yaml:"summary"`
+	Description string      `yaml:"description"`
+	Parameters  []parameter `yaml:"parameters"`
+	RequestBody *struct {
+		Required bool               `yaml:"required"`
+		Content  ordered[mediaType] `yaml:"content"`
+	} `yaml:"requestBody"`
+	Responses ordered[response]     `yaml:"responses"`
+	Security  []map[string][]string `yaml:"security"`
+}
+
+type parameter struct {
+	Ref         string  `yaml:"$ref"`
+	Name        string  `yaml:"name"`
+	In          string  `yaml:"in"`
+	Description string  `yaml:"description"`
+	Required    bool    `yaml:"required"`
+	Schema      *schema `yaml:"schema"`
+}
+
+type response struct {
+	Ref     string             `yaml:"$ref"`
+	Content ordered[mediaType] `yaml:"content"`
+}
+
+type mediaType struct {
+	Schema *schema `yaml:"schema"`
+}
+
+type securityScheme struct {
+	Type   string `yaml:"type"`
+	Scheme string `yaml:"scheme"`
+	In     string `yaml:"in"`
+	Name   string `yaml:"name"`
+}
+
+// api is the spec reduced to what the emitters write.
+type api struct {
+	title, version, server string
+	types                  []*namedType // dependencies first
+	ops                    []*op
+	auth                   []auth
+}
+
+type kind int
+
+const (
+	kindAny kind = iota
+	kindString
+	kindInteger
+	kindNumber
+	kindBoolean
+	kindEnum
+	kindArray
+	kindMap
+	kindNamed
+	kindUnion
+)
+
+type typeRef struct {
+	kind     kind
+	name     string     // kindNamed
+	enum     []string   // kindEnum
+	elem     *typeRef   // kindArray and kindMap
+	union    []*typeRef // kindUnion
+	nullable bool
+}
+
+// namedType is an object type, or an alias when alias is set.
+type namedType struct {
+	name   string
+	doc    string
+	bases  []string
+	fields []field
+	alias  *typeRef
+}
+
+type field struct {
+	name, doc string
+	typ       *typeRef
+	required  bool
+}
+
+type op struct {
+	id, summary, doc string
+	method, path     string
+	pathParams       []param // in path order
+	options          []param // query and header parameters
+	body             *typeRef
+	bodyRequired     bool
+	result           *typeRef // nil without a body
+	text             bool     // the result is text, not JSON
+	redirects        bool     // 3xx responses are results, not followed
+	auth             []string // security scheme names
+}
+
+type param struct {
+	name, in, doc string
+	typ           *typeRef
+	required      bool
+}
+
+// auth is a security scheme: a header set from a client setting.
+type auth struct {
+	scheme string // name in the spec
+	header string
+	bearer bool
+}
+
+var httpMethods = []string{"get", "put", "post", "delete", "patch"}
+
+func load(path string) (*api, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s spec
+	if err := yaml.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	b := &builder{spec: &s, declared: make(map[string]*namedType), nullable: make(map[string]bool)}
+	a := &api{title: s.Info.Title, version: s.Info.Version, server: "http://localhost:8080"}
+	if len(s.Servers) > 0 {
+		a.server = strings.TrimSuffix(s.Servers[0].URL, "/")
+	}
+	for _, e := range s.Components.SecuritySchemes {
+		switch {
+		case e.value.Type == "apiKey" && e.value.In == "header":
+			a.auth = append(a.auth, auth{scheme: e.key, header: e.value.Name})
+		case e.value.Type == "http" && strings.EqualFold(e.value.Scheme, "bearer"):
+			a.auth = append(a.auth, auth{scheme: e.key, header: "Authorization", bearer: true})
+		default:
+			return nil, fmt.Errorf("security scheme %s: only header API keys and bearer tokens are supported", e.key)
+		}
+	}
+
+	for _, e := range s.Components.Schemas {
+		b.nullable[e.key] = e.value.Nullable
+	}
+	for _, e := range s.Components.Schemas {
+		if err := b.component(e.key, e.value); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", e.key, err)
+		}
+	}
+	for _, p := range s.Paths {
+		for _, m := range p.value {
+			if m.key == "parameters" || !slices.Contains(httpMethods, m.key) {
+				return nil, fmt.Errorf("%s: %s is not supported", p.key, m.key)
+			}
+			var o operation
+			if err := m.value.Decode(&o); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", m.key, p.key, err)
+			}
+			converted, err := b.operation(strings.ToUpper(m.key), p.key, &o)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", m.key, p.key, err)
+			}
+			a.ops = append(a.ops, converted)
+		}
+	}
+	if err := b.checkRefs(); err != nil {
+		return nil, err
+	}
+	a.types = b.sorted()
+	return a, nil
+}
+
+type builder struct {
+	spec     *spec
+	order    []*namedType
+	declared map[string]*namedType
+	nullable map[string]bool // components that are nullable wherever used
+	refs     []string
+}
+
+func (b *builder) declare(t *namedType) error {
+	if _, taken := b.declared[t.name]; taken {
+		return fmt.Errorf("type name %s is used twice", t.name)
+	}
+	b.declared[t.name] = t
+	b.order = append(b.order, t)
+	return nil
+}
+
+func (b *builder) component(name string, s *schema) error {
+	if s.Ref == "" && len(s.OneOf) == 0 && len(s.Enum) == 0 && (s.Type == "object" || len(s.AllOf) > 0) {
+		_, err := b.object(name, s)
+		return err
+	}
+	t, err := b.typeOf(s, name)
+	if err != nil {
+		return err
+	}
+	t.nullable = false // said where it is used
+	return b.declare(&namedType{name: name, doc: s.Description, alias: t})
+}
+
+// object declares an object schema, or an allOf of object schemas, as a
+// type called name.
+func (b *builder) object(name string, s *schema) (*typeRef, error) {
+	t := &namedType{name: name, doc: s.Description}
+	parts := []*schema{s}
+	for _, part := range s.AllOf {
+		if part.Ref != "" {
+			base, err := b.refName(part.Ref)
+			if err != nil {
+				return nil, err
+			}
+			t.bases = append(t.bases, base)
+			continue
+		}
+		if t.doc == "" {
+			t.doc = part.Description
+		}
+		parts = append(parts, part)
+	}
+	for _, part := range parts {
+		if part.Type != "" && part.Type != "object" {
+			return nil, fmt.Errorf("allOf part of type %s is not supported", part.Type)
+		}
+		for _, p := range part.Properties {
+			ft, err := b.typeOf(p.value, name+pascal(p.key))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.key, err)
+			}
+			t.fields = append(t.fields, field{
+				name:     p.key,
+				doc:      p.value.Description,
+				typ:      ft,
+				required: slices.Contains(part.Required, p.key),
+			})
+		}
+	}
+	if err := b.declare(t); err != nil {
+		return nil, err
+	}
+	return &typeRef{kind: kindNamed, name: name, nullable: s.Nullable}, nil
+}
+
+// typeOf converts a schema. Inline objects become types called name.
+func (b *builder) typeOf(s *schema, name string) (*typeRef, error) {
+	if s == nil {
+		return &typeRef{kind: kindAny}, nil
+	}
+	if s.Ref != "" {
+		ref, err := b.refName(s.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return &typeRef{kind: kindNamed, name: ref, nullable: b.nullable[ref] || s.Nullable}, nil
+	}
+
+	var t *typeRef
+	switch {
+	case len(s.OneOf) > 0:
+		t = &typeRef{kind: kindUnion}
+		for i, option := range s.OneOf {
+			ot, err := b.typeOf(option, fmt.Sprintf("%sOption%d", name, i+1))
+			if err != nil {
+				return nil, err
+			}
+			t.union = append(t.union, ot)
+		}
+	case len(s.AllOf) > 0:
+		return b.object(name, s)
+	case len(s.Enum) > 0:
+		if s.Type != "string" {
+			return nil, errors.New("only string enums are supported")
+		}
+		t = &typeRef{kind: kindEnum, enum: s.Enum}
+	case s.Type == "string":
+		t = &typeRef{kind: kindString}
+	case s.Type == "integer":
+		t = &typeRef{kind: kindInteger}
+	case s.Type == "number":
+		t = &typeRef{kind: kindNumber}
+	case s.Type == "boolean":
+		t = &typeRef{kind: kindBoolean}
+	case s.Type == "array":
+		elem, err := b.typeOf(s.Items, name+"Item")
+		if err != nil {
+			return nil, err
+		}
+		t = &typeRef{kind: kindArray, elem: elem}
+	case s.Type == "object" || s.Type == "":
+		if len(s.Properties) > 0 {
+			return b.object(name, s)
+		}
+		elem := &typeRef{kind: kindAny}
+		if s.AdditionalProperties != nil {
+			var err error
+			if elem, err = b.typeOf(s.AdditionalProperties, name+"Value"); err != nil {
+				return nil, err
+			}
+		}
+		t = &typeRef{kind: kindMap, elem: elem}
+	default:
+		return nil, fmt.Errorf("type %s is not supported", s.Type)
+	}
+	t.nullable = s.Nullable
+	return t, nil
+}
+
+func (b *builder) refName(ref string) (string, error) {
+	name, ok := strings.CutPrefix(ref, "#/components/schemas/")
+	if !ok {
+		return "", fmt.Errorf("$ref %s is not a component schema", ref)
+	}
+	b.refs = append(b.refs, name)
+	return name, nil
+}
+
+func (b *builder) checkRefs() error {
+	for _, name := range b.refs {
+		if b.declared[name] == nil {
+			return fmt.Errorf("$ref to unknown schema %s", name)
+		}
+	}
+	return nil
+}
+
+func (b *builder) operation(method, path string, o *operation) (*op, error) {
+	if o.OperationID == "" {
+		return nil, errors.New("operationId is required")
+	}
+	converted := &op{id: o.OperationID, summary: o.Summary, doc: o.Description, method: method, path: path}
+	typeName := pascal(o.OperationID)
+
+	for _, p := range o.Parameters {
+		if p.Ref != "" {
+			name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+			resolved, found := b.spec.Components.Parameters[name]
+			if !ok || !found {
+				return nil, fmt.Errorf("$ref %s is not a component parameter", p.Ref)
+			}
+			p = resolved
+		}
+		t, err := b.typeOf(p.Schema, typeName+pascal(p.Name))
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		pa := param{name: p.Name, in: p.In, doc: p.Description, typ: t, required: p.Required}
+		switch p.In {
+		case "path":
+			if !strings.Contains(path, "{"+p.Name+"}") {
+				return nil, fmt.Errorf("path parameter %s is not in the path", p.Name)
+			}
+			pa.required = true
+			converted.pathParams = append(converted.pathParams, pa)
+		case "query", "header":
+			converted.options = append(converted.options, pa)
+		default:
+			return nil, fmt.Errorf("parameter %s: %s parameters are not supported", p.Name, p.In)
+		}
+	}
+	slices.SortStableFunc(converted.pathParams, func(x, y param) int {
+		return strings.Index(path, "{"+x.name+"}") - strings.Index(path, "{"+y.name+"}")
+	})
+	if strings.Count(path, "{") != len(converted.pathParams) {
+		return nil, errors.New("every path parameter needs a definition")
+	}
+
+	if body := o.RequestBody; body != nil {
+		media, ok := lookup(body.Content, "application/json")
+		if !ok {
+			return nil, errors.New("only JSON request bodies are supported")
+		}
+		t, err := b.typeOf(media.Schema, typeName+"Request")
+		if err != nil {
+			return nil, fmt.Errorf("request body: %w", err)
+		}
+		converted.body, converted.bodyRequired = t, body.Required
+	}
+
+	// The first 2xx response is the result.
+	for _, r := range o.Responses {
+		if strings.HasPrefix(r.key, "3") {
+			converted.redirects = true
+		}
+		if !strings.HasPrefix(r.key, "2") || converted.result != nil || converted.text {
+			continue
+		}
+		resp := r.value
+		if resp.Ref != "" {
+			name, _ := strings.CutPrefix(resp.Ref, "#/components/responses/")
+			resolved, found := b.spec.Components.Responses[name]
+			if !found {
+				return nil, fmt.Errorf("$ref %s is not a component response", resp.Ref)
+			}
+			resp = resolved
+		}
+		if media, ok := lookup(resp.Content, "application/json"); ok {
+			t, err := b.typeOf(media.Schema, typeName+"Response")
+			if err != nil {
+				return nil, fmt.Errorf("response %s: %w", r.key, err)
+			}
+			converted.result = t
+		} else if len(resp.Content) > 0 {
+			if !strings.HasPrefix(resp.Content[0].key, "text/") {
+				return nil, fmt.Errorf("response %s: %s is not supported", r.key, resp.Content[0].key)
+			}
+			converted.text = true
+		}
+	}
+
+	for _, requirement := range o.Security {
+		for name := range requirement {
+			if !slices.Contains(converted.auth, name) {
+				converted.auth = append(converted.auth, name)
+			}
+		}
+	}
+	slices.Sort(converted.auth)
+	return converted, nil
+}
+
+func lookup[T any](o ordered[T], key string) (T, bool) {
+	for _, e := range o {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// sorted returns the declared types with every type after those it uses,
+// keeping the spec's order otherwise.
+func (b *builder) sorted() []*namedType {
+	var out []*namedType
+	done := make(map[string]bool)
+	var visit func(t *namedType)
+	visit = func(t *namedType) {
+		if done[t.name] {
+			return
+		}
+		done[t.name] = true
+		for _, dep := range t.uses() {
+			visit(b.declared[dep])
+		}
+		out = append(out, t)
+	}
+	for _, t := range b.order {
+		visit(t)
+	}
+	return out
+}
+
+func (t *namedType) uses() []string {
+	names := slices.Clone(t.bases)
+	var walk func(r *typeRef)
+	walk = func(r *typeRef) {
+		switch r.kind {
+		case kindNamed:
+			names = append(names, r.name)
+		case kindArray, kindMap:
+			walk(r.elem)
+		case kindUnion:
+			for _, u := range r.union {
+				walk(u)
+			}
+		}
+	}
+	if t.alias != nil {
+		walk(t.alias)
+	}
+	for _, f := range t.fields {
+		walk(f.typ)
+	}
+	return names
+}
+
+// opTypes returns the named types the operations use, in declaration
+// order.
+func (a *api) opTypes() []string {
+	used := make(map[string]bool)
+	var walk func(r *typeRef)
+	walk = func(r *typeRef) {
+		if r == nil {
+			return
+		}
+		switch r.kind {
+		case kindNamed:
+			used[r.name] = true
+		case kindArray, kindMap:
+			walk(r.elem)
+		case kindUnion:
+			for _, u := range r.union {
+				walk(u)
+			}
+		}
+	}
+	for _, o := range a.ops {
+		walk(o.body)
+		walk(o.result)
+		for _, p := range append(slices.Clone(o.pathParams), o.options...) {
+			walk(p.typ)
+		}
+	}
+	var names []string
+	for _, t := range a.types {
+		if used[t.name] {
+			names = append(names, t.name)
+		}
+	}
+	return names
+}
+
+// fieldsWithBases returns the fields of t and of the types it extends.
+func (a *api) fieldsWithBases(t *namedType) []field {
+	var fields []field
+	for _, base := range t.bases {
+		for _, other := range a.types {
+			if other.name == base {
+				fields = append(fields, a.fieldsWithBases(other)...)
+			}
+		}
+	}
+	return append(fields, t.fields...)
+}
+
+// words splits a name such as getInfo, since_boot or X-Tenant into words.
+func words(name string) []string {
+	var out []string
+	var current []rune
+	runes := []rune(name)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(current) > 0 {
+				out = append(out, string(current))
+				current = nil
+			}
+			continue
+		}
+		if unicode.IsUpper(r) && len(current) > 0 && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			out = append(out, string(current))
+			current = nil
+		}
+		current = append(current, r)
+	}
+	if len(current) > 0 {
+		out = append(out, string(current))
+	}
+	return out
+}
+
+func pascal(name string) string {
+	var sb strings.Builder
+	for _, w := range words(name) {
+		sb.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	return sb.String()
+}
+
+func camel(name string) string {
+	var sb strings.Builder
+	for i, w := range words(name) {
+		if i == 0 {
+			sb.WriteString(strings.ToLower(w))
+		} else {
+			sb.WriteString(strings.ToUpper(w[:1]) + strings.ToLower(w[1:]))
+		}
+	}
+	return sb.String()
+}
+
+func snake(name string) string {
+	ws := words(name)
+	for i, w := range ws {
+		ws[i] = strings.ToLower(w)
+	}
+	return strings.Join(ws, "_")
+}
+
+// lines splits a description into trimmed lines without trailing blanks.
+func lines(text string) []string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	out := strings.Split(text, "\n")
+	for i, l := range out {
+		out[i] = strings.TrimRight(l, " ")
+	}
+	return out
+}
+
+// writer builds a source file line by line.
+type writer struct {
+	strings.Builder
+}
+
+func (w *writer) line(format string, args ...any) {
+	fmt.Fprintf(w, format, args...)
+	w.WriteByte('\n')
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	pyIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	pyKeywords   = []string{
+		"False", "None", "True", "and", "as", "assert", "async", "await", "break", "class", "continue",
+		"def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import", "in",
+		"is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield",
+	}
+)
+
+func pythonClient(a *api) map[string]string {
+	return map[string]string{
+		"pyproject.toml":                   pyProject(a),
+		"README.md":                        pyReadme(a),
+		"url_shortener_client/__init__.py": pyInit(a),
+		"url_shortener_client/py.typed":    "",
+		"url_shortener_client/models.py":   pyModels(a),
+		"url_shortener_client/client.py":   pyClient(a),
+	}
+}
+
+func pyProject(a *api) string {
+	return fmt.Sprintf(`[build-system]
+requires = ["setuptools>=61"]
+build-backend = "setuptools.build_meta"
+
+[project]
+name = "url-shortener-client"
+version = %q
+description = "Typed client of the %s API, generated from openapi.yaml."
+requires-python = ">=3.11"
+dependencies = []
+
+[tool.setuptools]
+packages = ["url_shortener_client"]
+
+[tool.setuptools.package-data]
+url_shortener_client = ["py.typed"]
+`, a.version, a.title)
+}
+
+func pyReadme(a *api) string {
+	var w writer
+	w.line("# url-shortener-client")
+	w.line("")
+	w.line("Python client of the %s API. %s", a.title, generatedNote)
+	w.line("")
+	w.line("It needs Python 3.11 or later and only the standard library.")
+	w.line("")
+	w.line("```python")
+	w.line("import os")
+	w.line("")
+	w.line("from url_shortener_client import ApiError, Client")
+	w.line("")
+	w.line("client = Client(%q, user_token=os.environ.get(\"TOKEN\"))", a.server)
+	w.line("link = client.shorten({\"url\": \"https://example.com\"})")
+	w.line("print(link[\"short_url\"])")
+	w.line("")
+	w.line("try:")
+	w.line("    client.get_info(\"missing\")")
+	w.line("except ApiError as err:")
+	w.line("    if err.status == 404:")
+	w.line("        pass  # not found")
+	w.line("```")
+	w.line("")
+	w.line("Every operation of the spec is a method named after its `operationId` in snake case. Path parameters come first, then the request body, then the query and header parameters as keyword arguments. Bodies and results are plain dicts typed with `TypedDict`. Responses other than 2xx raise `ApiError` with the status and the decoded body. Operations that answer with a redirect return a `Redirect` instead of following it.")
+	return w.String()
+}
+
+func pyInit(a *api) string {
+	var w writer
+	w.line(`"""Client of the %s API. %s"""`, a.title, generatedNote)
+	w.line("")
+	w.line("from .client import ApiError, Client, Redirect")
+	w.line("from .models import *  # noqa: F403")
+	w.line("from .models import __all__ as _models")
+	w.line("")
+	w.line(`__all__ = ["ApiError", "Client", "Redirect", *_models]`)
+	return w.String()
+}
+
+// pyName makes name usable as a Python identifier.
+func pyName(name string) string {
+	name = snake(name)
+	if slices.Contains(pyKeywords, name) {
+		name += "_"
+	}
+	return name
+}
+
+func pyDocstring(w *writer, indent string, paragraphs ...string) {
+	var all []string
+	for _, p := range paragraphs {
+		if ls := lines(p); len(ls) > 0 {
+			if len(all) > 0 {
+				all = append(all, "")
+			}
+			all = append(all, ls...)
+		}
+	}
+	if len(all) == 0 {
+		return
+	}
+	for i, l := range all {
+		all[i] = strings.ReplaceAll(strings.ReplaceAll(l, `\`, `\\`), `"""`, `\"\"\"`)
+	}
+	if len(all) == 1 {
+		w.line(`%s"""%s"""`, indent, all[0])
+		return
+	}
+	w.line(`%s"""%s`, indent, all[0])
+	for _, l := range all[1:] {
+		w.line("%s", strings.TrimRight(indent+l, " "))
+	}
+	w.line(`%s"""`, indent)
+}
+
+func pyComment(w *writer, indent, text string) {
+	for _, l := range lines(text) {
+		w.line("%s# %s", indent, l)
+	}
+}
+
+func pyType(t *typeRef) string {
+	var s string
+	switch t.kind {
+	case kindString:
+		s = "str"
+	case kindInteger:
+		s = "int"
+	case kindNumber:
+		s = "float"
+	case kindBoolean:
+		s = "bool"
+	case kindEnum:
+		values := make([]string, len(t.enum))
+		for i, v := range t.enum {
+			values[i] = strconv.Quote(v)
+		}
+		s = "Literal[" + strings.Join(values, ", ") + "]"
+	case kindArray:
+		s = "list[" + pyType(t.elem) + "]"
+	case kindMap:
+		s = "dict[str, " + pyType(t.elem) + "]"
+	case kindNamed:
+		s = t.name
+	case kindUnion:
+		parts := make([]string, len(t.union))
+		for i, u := range t.union {
+			parts[i] = pyType(u)
+		}
+		s = strings.Join(parts, " | ")
+	default:
+		s = "Any"
+	}
+	if t.nullable {
+		s += " | None"
+	}
+	return s
+}
+
+func pyField(f field) string {
+	if f.required {
+		return pyType(f.typ)
+	}
+	return "NotRequired[" + pyType(f.typ) + "]"
+}
+
+func pyModels(a *api) string {
+	var w writer
+	w.line(`"""Types of the %s API. %s"""`, a.title, generatedNote)
+	w.line("")
+	w.line("from __future__ import annotations")
+	w.line("")
+	w.line("from typing import Any, Literal, NotRequired, TypedDict")
+	w.line("")
+	var names []string
+	for _, t := range a.types {
+		names = append(names, strconv.Quote(t.name))
+	}
+	w.line("__all__ = [%s]", strings.Join(names, ", "))
+	for _, t := range a.types {
+		w.line("")
+		w.line("")
+		if t.alias != nil {
+			pyComment(&w, "", t.doc)
+			w.line("%s = %s", t.name, pyType(t.alias))
+			continue
+		}
+
+		// Keys that are not identifiers, such as from, need the functional
+		// syntax, which cannot extend other types.
+		functional := false
+		for _, f := range a.fieldsWithBases(t) {
+			if !pyIdentifier.MatchString(f.name) || slices.Contains(pyKeywords, f.name) {
+				functional = true
+			}
+		}
+		if functional {
+			pyComment(&w, "", t.doc)
+			w.line("%s = TypedDict(", t.name)
+			w.line("    %q,", t.name)
+			w.line("    {")
+			for _, f := range a.fieldsWithBases(t) {
+				pyComment(&w, "        ", f.doc)
+				w.line("        %q: %s,", f.name, pyField(f))
+			}
+			w.line("    },")
+			w.line(")")
+			continue
+		}
+
+		bases := "TypedDict"
+		if len(t.bases) > 0 {
+			bases = strings.Join(t.bases, ", ")
+		}
+		w.line("class %s(%s):", t.name, bases)
+		pyDocstring(&w, "    ", t.doc)
+		if len(t.fields) == 0 && t.doc == "" {
+			w.line("    pass")
+		}
+		for _, f := range t.fields {
+			pyComment(&w, "    ", f.doc)
+			w.line("    %s: %s", f.name, pyField(f))
+		}
+	}
+	return w.String()
+}
+
+// pyResult is the type an operation returns.
+func pyResult(o *op) string {
+	result := "None"
+	switch {
+	case o.result != nil:
+		result = pyType(o.result)
+	case o.text:
+		result = "str"
+	}
+	switch {
+	case o.redirects && result == "None":
+		result = "Redirect"
+	case o.redirects:
+		result += " | Redirect"
+	}
+	return result
+}
+
+func pyClient(a *api) string {
+	var w writer
+	w.line(`"""Client of the %s API. %s"""`, a.title, generatedNote)
+	w.line("")
+	w.line("from __future__ import annotations")
+	w.line("")
+	w.line("import json")
+	w.line("import urllib.error")
+	w.line("import urllib.parse")
+	w.line("import urllib.request")
+	w.line("from collections.abc import Iterable, Mapping")
+	w.line("from dataclasses import dataclass")
+	w.line("from typing import Any, Literal, cast")
+	w.line("")
+	w.line("from .models import (")
+	for _, name := range a.opTypes() {
+		w.line("    %s,", name)
+	}
+	w.line(")")
+	w.line("")
+	w.line("")
+	w.line("class ApiError(Exception):")
+	w.line(`    """A response other than 2xx. body is the decoded JSON, or the text if it is not JSON."""`)
+	w.line("")
+	w.line("    def __init__(self, status: int, body: Any, headers: Mapping[str, str]) -> None:")
+	w.line("        error = body.get(\"error\") if isinstance(body, dict) else None")
+	w.line("        super().__init__(error if isinstance(error, str) else f\"HTTP {status}\")")
+	w.line("        self.status = status")
+	w.line("        self.body = body")
+	w.line("        self.headers = headers")
+	w.line("")
+	w.line("")
+	w.line("@dataclass")
+	w.line("class Redirect:")
+	w.line(`    """A redirect the server answered with, returned instead of followed."""`)
+	w.line("")
+	w.line("    status: int")
+	w.line("    location: str | None")
+	w.line("")
+	w.line("")
+	w.line("class _NoRedirect(urllib.request.HTTPRedirectHandler):")
+	w.line("    def redirect_request(self, req, fp, code, msg, headers, newurl):  # type: ignore[no-untyped-def]")
+	w.line("        return None")
+	w.line("")
+	w.line("")
+	w.line("def _query_value(value: Any) -> str:")
+	w.line("    if isinstance(value, bool):")
+	w.line("        return \"true\" if value else \"false\"")
+	w.line("    return str(value)")
+	w.line("")
+	w.line("")
+	w.line("def _path_value(value: Any) -> str:")
+	w.line("    return urllib.parse.quote(str(value), safe=\"\")")
+	w.line("")
+	w.line("")
+	w.line("class Client:")
+	var settings []string
+	for _, au := range a.auth {
+		settings = append(settings, pyName(au.scheme)+": str | None = None")
+	}
+	w.line("    def __init__(self, base_url: str = %q, *, %s, timeout: float = 30) -> None:", a.server, strings.Join(settings, ", "))
+	w.line("        self.base_url = base_url.rstrip(\"/\")")
+	for _, au := range a.auth {
+		w.line("        self.%s = %s", pyName(au.scheme), pyName(au.scheme))
+	}
+	w.line("        self.timeout = timeout")
+	w.line("        self._follow = urllib.request.build_opener()")
+	w.line("        self._manual = urllib.request.build_opener(_NoRedirect)")
+	w.line("")
+	w.line("    def _request(")
+	w.line("        self,")
+	w.line("        method: str,")
+	w.line("        path: str,")
+	w.line("        *,")
+	w.line("        query: Mapping[str, Any] | None = None,")
+	w.line("        headers: Mapping[str, str | None] | None = None,")
+	w.line("        body: Any = None,")
+	w.line("        auth: Iterable[str] = (),")
+	w.line("        result: Literal[\"json\", \"text\", \"none\"] = \"none\",")
+	w.line("        redirects: bool = False,")
+	w.line("    ) -> Any:")
+	w.line("        url = self.base_url + path")
+	w.line("        params = {name: _query_value(value) for name, value in (query or {}).items() if value is not None}")
+	w.line("        if params:")
+	w.line("            url += \"?\" + urllib.parse.urlencode(params)")
+	w.line("        sent = {name: value for name, value in (headers or {}).items() if value is not None}")
+	w.line("        auth = set(auth)")
+	for _, au := range a.auth {
+		value := "self." + pyName(au.scheme)
+		w.line("        if %q in auth and %s is not None:", au.scheme, value)
+		if au.bearer {
+			w.line("            sent[%q] = \"Bearer \" + %s", au.header, value)
+		} else {
+			w.line("            sent[%q] = %s", au.header, value)
+		}
+	}
+	w.line("        data = None")
+	w.line("        if body is not None:")
+	w.line("            sent[\"Content-Type\"] = \"application/json\"")
+	w.line("            data = json.dumps(body).encode()")
+	w.line("")
+	w.line("        request = urllib.request.Request(url, data=data, headers=sent, method=method)")
+	w.line("        opener = self._manual if redirects else self._follow")
+	w.line("        try:")
+	w.line("            with opener.open(request, timeout=self.timeout) as response:")
+	w.line("                raw = response.read()")
+	w.line("        except urllib.error.HTTPError as err:")
+	w.line("            if redirects and 300 <= err.code < 400:")
+	w.line("                return Redirect(err.code, err.headers.get(\"Location\"))")
+	w.line("            raw = err.read()")
+	w.line("            try:")
+	w.line("                decoded: Any = json.loads(raw)")
+	w.line("            except ValueError:")
+	w.line("                decoded = raw.decode(errors=\"replace\")")
+	w.line("            raise ApiError(err.code, decoded, err.headers) from None")
+	w.line("        if result == \"json\":")
+	w.line("            return json.loads(raw)")
+	w.line("        if result == \"text\":")
+	w.line("            return raw.decode()")
+	w.line("        return None")
+	for _, o := range a.ops {
+		w.line("")
+		pyOperation(&w, o)
+	}
+	return w.String()
+}
+
+func pyOperation(w *writer, o *op) {
+	args := []string{"self"}
+	path := strings.ReplaceAll(strings.ReplaceAll(o.path, "{", "{{"), "}", "}}")
+	for _, p := range o.pathParams {
+		name := pyName(p.name)
+		args = append(args, name+": "+pyType(p.typ))
+		path = strings.ReplaceAll(path, "{{"+p.name+"}}", "{_path_value("+name+")}")
+	}
+	if o.body != nil {
+		if o.bodyRequired {
+			args = append(args, "body: "+pyType(o.body))
+		} else {
+			args = append(args, "body: "+pyType(o.body)+" | None = None")
+		}
+	}
+	var paramDocs []string
+	if len(o.options) > 0 {
+		args = append(args, "*")
+		for _, p := range o.options {
+			if p.required {
+				args = append(args, pyName(p.name)+": "+pyType(p.typ))
+			} else {
+				args = append(args, pyName(p.name)+": "+pyType(p.typ)+" | None = None")
+			}
+			if p.doc != "" {
+				paramDocs = append(paramDocs, pyName(p.name)+": "+strings.Join(lines(p.doc), " "))
+			}
+		}
+	}
+
+	signature := fmt.Sprintf("    def %s(%s) -> %s:", pyName(o.id), strings.Join(args, ", "), pyResult(o))
+	if len(signature) > 100 {
+		w.line("    def %s(", pyName(o.id))
+		for _, arg := range args {
+			w.line("        %s,", arg)
+		}
+		w.line("    ) -> %s:", pyResult(o))
+	} else {
+		w.line("%s", signature)
+	}
+	pyDocstring(w, "        ", o.summary, o.doc, strings.Join(paramDocs, "\n"))
+
+	var kwargs []string
+	for _, in := range []string{"query", "header"} {
+		var entries []string
+		for _, p := range o.options {
+			if p.in == in {
+				entries = append(entries, fmt.Sprintf("%q: %s", p.name, pyName(p.name)))
+			}
+		}
+		if len(entries) > 0 {
+			key := in
+			if in == "header" {
+				key = "headers"
+			}
+			kwargs = append(kwargs, key+"={"+strings.Join(entries, ", ")+"}")
+		}
+	}
+	if o.body != nil {
+		kwargs = append(kwargs, "body=body")
+	}
+	if len(o.auth) > 0 {
+		auth := make([]string, len(o.auth))
+		for i, name := range o.auth {
+			auth[i] = strconv.Quote(name)
+		}
+		tuple := strings.Join(auth, ", ")
+		if len(auth) == 1 {
+			tuple += ","
+		}
+		kwargs = append(kwargs, "auth=("+tuple+")")
+	}
+	result := "none"
+	switch {
+	case o.result != nil:
+		result = "json"
+	case o.text:
+		result = "text"
+	}
+	if result != "none" {
+		kwargs = append(kwargs, fmt.Sprintf("result=%q", result))
+	}
+	if o.redirects {
+		kwargs = append(kwargs, "redirects=True")
+	}
+
+	pathArg := strconv.Quote(o.path)
+	if len(o.pathParams) > 0 {
+		pathArg = "f" + strconv.Quote(path)
+	}
+	args = append([]string{strconv.Quote(o.method), pathArg}, kwargs...)
+	if result == "none" && !o.redirects {
+		w.line("        self._request(")
+		for _, arg := range args {
+			w.line("            %s,", arg)
+		}
+		w.line("        )")
+		return
+	}
+	w.line("        return cast(")
+	w.line("            %q,", pyResult(o))
+	w.line("            self._request(")
+	for _, arg := range args {
+		w.line("                %s,", arg)
+	}
+	w.line("            ),")
+	w.line("        )")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const generatedNote = "Generated from openapi.yaml by using-redis/cmd/clientgen. Do not edit; run `make clients`."
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+func typescriptClient(a *api) map[string]string {
+	return map[string]string{
+		"package.json":  tsPackage(a),
+		"tsconfig.json": tsConfig,
+		"README.md":     tsReadme(a),
+		"src/index.ts":  "// " + generatedNote + "\nexport * from \"./client.js\";\nexport * from \"./models.js\";\n",
+		"src/models.ts": tsModels(a),
+		"src/client.ts": tsClient(a),
+	}
+}
+
+func tsPackage(a *api) string {
+	return fmt.Sprintf(`{
+  "name": "url-shortener-client",
+  "version": %q,
+  "description": "Typed client of the %s API, generated from openapi.yaml.",
+  "type": "module",
+  "main": "dist/index.js",
+  "types": "dist/index.d.ts",
+  "files": ["dist"],
+  "scripts": {
+    "build": "tsc",
+    "prepare": "tsc"
+  },
+  "devDependencies": {
+    "typescript": "^5.4.0"
+  }
+}
+`, a.version, a.title)
+}
+
+const tsConfig = `{
+  "compilerOptions": {
+    "target": "ES2020",
+    "module": "NodeNext",
+    "moduleResolution": "NodeNext",
+    "lib": ["ES2020", "DOM"],
+    "declaration": true,
+    "strict": true,
+    "outDir": "dist",
+    "rootDir": "src"
+  },
+  "include": ["src"]
+}
+`
+
+func tsReadme(a *api) string {
+	var w writer
+	w.line("# url-shortener-client")
+	w.line("")
+	w.line("TypeScript client of the %s API. %s", a.title, generatedNote)
+	w.line("")
+	w.line("It uses the global `fetch` (Node 18 and later, and browsers) and has no dependencies.")
+	w.line("")
+	w.line("```ts")
+	w.line("import { ApiError, Client } from \"url-shortener-client\";")
+	w.line("")
+	w.line("const client = new Client({ baseUrl: %q, userToken: process.env.TOKEN });", a.server)
+	w.line("const link = await client.shorten({ url: \"https://example.com\" });")
+	w.line("console.log(link.short_url);")
+	w.line("")
+	w.line("try {")
+	w.line("  await client.getInfo(\"missing\");")
+	w.line("} catch (err) {")
+	w.line("  if (err instanceof ApiError && err.status === 404) {")
+	w.line("    // not found")
+	w.line("  }")
+	w.line("}")
+	w.line("```")
+	w.line("")
+	w.line("Every operation of the spec is a method named after its `operationId`. Path parameters come first, then the request body, then an object with the query and header parameters. Responses other than 2xx throw `ApiError` with the status and the decoded body. Operations that answer with a redirect return a `Redirect` instead of following it. Browsers hide redirects from `fetch`, so those methods are for servers.")
+	return w.String()
+}
+
+func tsDoc(w *writer, indent string, paragraphs ...string) {
+	var all []string
+	for _, p := range paragraphs {
+		if ls := lines(p); len(ls) > 0 {
+			if len(all) > 0 {
+				all = append(all, "")
+			}
+			all = append(all, ls...)
+		}
+	}
+	if len(all) == 0 {
+		return
+	}
+	for i, l := range all {
+		all[i] = strings.ReplaceAll(l, "*/", "*\\/")
+	}
+	if len(all) == 1 {
+		w.line("%s/** %s */", indent, all[0])
+		return
+	}
+	w.line("%s/**", indent)
+	for _, l := range all {
+		w.line("%s%s", indent, strings.TrimRight(" * "+l, " "))
+	}
+	w.line("%s */", indent)
+}
+
+func tsType(t *typeRef) string {
+	var s string
+	switch t.kind {
+	case kindString:
+		s = "string"
+	case kindInteger, kindNumber:
+		s = "number"
+	case kindBoolean:
+		s = "boolean"
+	case kindEnum:
+		values := make([]string, len(t.enum))
+		for i, v := range t.enum {
+			values[i] = strconv.Quote(v)
+		}
+		s = strings.Join(values, " | ")
+	case kindArray:
+		s = tsType(t.elem)
+		if t.elem.kind == kindEnum || t.elem.kind == kindUnion || t.elem.nullable {
+			s = "(" + s + ")"
+		}
+		s += "[]"
+	case kindMap:
+		s = "Record<string, " + tsType(t.elem) + ">"
+	case kindNamed:
+		s = t.name
+	case kindUnion:
+		parts := make([]string, len(t.union))
+		for i, u := range t.union {
+			parts[i] = tsType(u)
+		}
+		s = strings.Join(parts, " | ")
+	default:
+		s = "unknown"
+	}
+	if t.nullable {
+		s += " | null"
+	}
+	return s
+}
+
+func tsKey(name string) string {
+	if tsIdentifier.MatchString(name) {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+func tsModels(a *api) string {
+	var w writer
+	w.line("// %s", generatedNote)
+	for _, t := range a.types {
+		w.line("")
+		tsDoc(&w, "", t.doc)
+		if t.alias != nil {
+			w.line("export type %s = %s;", t.name, tsType(t.alias))
+			continue
+		}
+		extends := ""
+		if len(t.bases) > 0 {
+			extends = " extends " + strings.Join(t.bases, ", ")
+		}
+		w.line("export interface %s%s {", t.name, extends)
+		for _, f := range t.fields {
+			tsDoc(&w, "  ", f.doc)
+			optional := "?"
+			if f.required {
+				optional = ""
+			}
+			w.line("  %s%s: %s;", tsKey(f.name), optional, tsType(f.typ))
+		}
+		w.line("}")
+	}
+	return w.String()
+}
+
+// tsResult is the type an operation's promise resolves to.
+func tsResult(o *op) string {
+	result := "void"
+	switch {
+	case o.result != nil:
+		result = tsType(o.result)
+	case o.text:
+		result = "string"
+	}
+	switch {
+	case o.redirects && result == "void":
+		result = "Redirect"
+	case o.redirects:
+		result += " | Redirect"
+	}
+	return result
+}
+
+func tsClient(a *api) string {
+	var w writer
+	w.line("// %s", generatedNote)
+	w.line("")
+	w.line("import type { %s } from \"./models.js\";", strings.Join(a.opTypes(), ", "))
+	w.line("")
+	w.line("export interface ClientOptions {")
+	w.line("  /** Server URL, %s by default. */", a.server)
+	w.line("  baseUrl?: string;")
+	for _, au := range a.auth {
+		if au.bearer {
+			w.line("  /** Sent as a bearer token to operations that accept %s. */", au.scheme)
+		} else {
+			w.line("  /** Sent as %s to operations that accept %s. */", au.header, au.scheme)
+		}
+		w.line("  %s?: string;", camel(au.scheme))
+	}
+	w.line("  /** fetch to send requests with, the global one by default. */")
+	w.line("  fetch?: typeof fetch;")
+	w.line("}")
+	w.line("")
+	w.line("/** A response other than 2xx. body is the decoded JSON, or the text if it is not JSON. */")
+	w.line("export class ApiError extends Error {")
+	w.line("  constructor(")
+	w.line("    readonly status: number,")
+	w.line("    readonly body: unknown,")
+	w.line("    readonly headers: Headers,")
+	w.line("  ) {")
+	w.line("    const error = typeof body === \"object\" && body !== null ? (body as { error?: unknown }).error : undefined;")
+	w.line("    super(typeof error === \"string\" ? error : `HTTP ${status}`);")
+	w.line("    this.name = \"ApiError\";")
+	w.line("  }")
+	w.line("}")
+	w.line("")
+	w.line("/** A redirect the server answered with, returned instead of followed. */")
+	w.line("export interface Redirect {")
+	w.line("  status: number;")
+	w.line("  location: string | null;")
+	w.line("}")
+	w.line("")
+	w.line("interface Request {")
+	w.line("  method: string;")
+	w.line("  path: string;")
+	w.line("  query?: Record<string, string | number | boolean | undefined>;")
+	w.line("  headers?: Record<string, string | undefined>;")
+	w.line("  body?: unknown;")
+	w.line("  auth: string[];")
+	w.line("  result: \"json\" | \"text\" | \"none\";")
+	w.line("  redirects?: boolean;")
+	w.line("}")
+	w.line("")
+	w.line("export class Client {")
+	w.line("  private readonly baseUrl: string;")
+	w.line("")
+	w.line("  constructor(private readonly options: ClientOptions = {}) {")
+	w.line("    this.baseUrl = (options.baseUrl ?? %q).replace(/\\/+$/, \"\");", a.server)
+	w.line("  }")
+	w.line("")
+	w.line("  private async request(req: Request): Promise<unknown> {")
+	w.line("    const url = new URL(this.baseUrl + req.path);")
+	w.line("    for (const [name, value] of Object.entries(req.query ?? {})) {")
+	w.line("      if (value !== undefined) {")
+	w.line("        url.searchParams.set(name, String(value));")
+	w.line("      }")
+	w.line("    }")
+	w.line("    const headers: Record<string, string> = {};")
+	w.line("    for (const [name, value] of Object.entries(req.headers ?? {})) {")
+	w.line("      if (value !== undefined) {")
+	w.line("        headers[name] = value;")
+	w.line("      }")
+	w.line("    }")
+	for _, au := range a.auth {
+		value := "this.options." + camel(au.scheme)
+		w.line("    if (req.auth.includes(%q) && %s !== undefined) {", au.scheme, value)
+		if au.bearer {
+			w.line("      headers[%q] = `Bearer ${%s}`;", au.header, value)
+		} else {
+			w.line("      headers[%q] = %s;", au.header, value)
+		}
+		w.line("    }")
+	}
+	w.line("    let body: string | undefined;")
+	w.line("    if (req.body !== undefined) {")
+	w.line("      headers[\"Content-Type\"] = \"application/json\";")
+	w.line("      body = JSON.stringify(req.body);")
+	w.line("    }")
+	w.line("")
+	w.line("    const send = this.options.fetch ?? fetch;")
+	w.line("    const res = await send(url, { method: req.method, headers, body, redirect: req.redirects ? \"manual\" : \"follow\" });")
+	w.line("    if (req.redirects && res.status >= 300 && res.status < 400) {")
+	w.line("      return { status: res.status, location: res.headers.get(\"Location\") } satisfies Redirect;")
+	w.line("    }")
+	w.line("    if (!res.ok) {")
+	w.line("      const text = await res.text();")
+	w.line("      let decoded: unknown = text;")
+	w.line("      try {")
+	w.line("        decoded = JSON.parse(text);")
+	w.line("      } catch {")
+	w.line("        // not JSON")
+	w.line("      }")
+	w.line("      throw new ApiError(res.status, decoded, res.headers);")
+	w.line("    }")
+	w.line("    switch (req.result) {")
+	w.line("      case \"json\":")
+	w.line("        return res.json();")
+	w.line("      case \"text\":")
+	w.line("        return res.text();")
+	w.line("      default:")
+	w.line("        return undefined;")
+	w.line("    }")
+	w.line("  }")
+	for _, o := range a.ops {
+		w.line("")
+		tsOperation(&w, o)
+	}
+	w.line("}")
+	return w.String()
+}
+
+func tsOperation(w *writer, o *op) {
+	var args []string
+	path := o.path
+	for _, p := range o.pathParams {
+		name := camel(p.name)
+		args = append(args, name+": "+tsType(p.typ))
+		path = strings.ReplaceAll(path, "{"+p.name+"}", "${encodeURIComponent("+name+")}")
+	}
+	if o.body != nil {
+		if o.bodyRequired {
+			args = append(args, "body: "+tsType(o.body))
+		} else {
+			args = append(args, "body?: "+tsType(o.body))
+		}
+	}
+	var paramDocs []string
+	if len(o.options) > 0 {
+		var fields []string
+		allOptional := true
+		for _, p := range o.options {
+			optional := "?"
+			if p.required {
+				optional, allOptional = "", false
+			}
+			fields = append(fields, fmt.Sprintf("%s%s: %s", camel(p.name), optional, tsType(p.typ)))
+			if p.doc != "" {
+				paramDocs = append(paramDocs, fmt.Sprintf("@param params.%s %s", camel(p.name), strings.Join(lines(p.doc), " ")))
+			}
+		}
+		arg := "params: { " + strings.Join(fields, "; ") + " }"
+		if allOptional {
+			arg += " = {}"
+		}
+		args = append(args, arg)
+	}
+
+	tsDoc(w, "  ", o.summary, o.doc, strings.Join(paramDocs, "\n"))
+	w.line("  async %s(%s): Promise<%s> {", o.id, strings.Join(args, ", "), tsResult(o))
+
+	var fields []string
+	fields = append(fields, fmt.Sprintf("method: %q", o.method))
+	if len(o.pathParams) > 0 {
+		fields = append(fields, "path: `"+path+"`")
+	} else {
+		fields = append(fields, "path: "+strconv.Quote(path))
+	}
+	for _, in := range []string{"query", "header"} {
+		var entries []string
+		for _, p := range o.options {
+			if p.in == in {
+				entries = append(entries, fmt.Sprintf("%s: params.%s", tsKey(p.name), camel(p.name)))
+			}
+		}
+		if len(entries) > 0 {
+			key := in
+			if in == "header" {
+				key = "headers"
+			}
+			fields = append(fields, key+": { "+strings.Join(entries, ", ")+" }")
+		}
+	}
+	if o.body != nil {
+		fields = append(fields, "body")
+	}
+	auth := make([]string, len(o.auth))
+	for i, name := range o.auth {
+		auth[i] = strconv.Quote(name)
+	}
+	fields = append(fields, "auth: ["+strings.Join(auth, ", ")+"]")
+	result := "none"
+	switch {
+	case o.result != nil:
+		result = "json"
+	case o.text:
+		result = "text"
+	}
+	fields = append(fields, fmt.Sprintf("result: %q", result))
+	if o.redirects {
+		fields = append(fields, "redirects: true")
+	}
+	if result == "none" && !o.redirects {
+		w.line("    await this.request({")
+	} else {
+		w.line("    const result = await this.request({")
+	}
+	for _, f := range fields {
+		w.line("      %s,", f)
+	}
+	w.line("    });")
+	if result != "none" || o.redirects {
+		w.line("    return result as %s;", tsResult(o))
+	}
+	w.line("  }")
+}
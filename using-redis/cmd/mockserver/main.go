@@ -0,0 +1,200 @@
+// Command mockserver serves the API offline, for developing clients and
+// SDKs. It starts an in-process Redis, runs the server against it with
+// STORE_BACKEND=memory, and answers on PORT through a proxy that can add
+// canned latency and failures:
+//
+//	go build -o url-shortener . && go run ./cmd/mockserver -latency 150ms -fail-every 3 -fail-status 503
+//
+// Each run starts empty and hands out codes in order (1, 2, 3, ...).
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type options struct {
+	server     string
+	latency    time.Duration
+	failEvery  int64
+	failStatus int
+	failPath   string
+	retryAfter int
+
+	requests atomic.Int64
+}
+
+func parseArgs(args []string) (*options, error) {
+	fs := flag.NewFlagSet("mockserver", flag.ContinueOnError)
+	server := fs.String("server", "./url-shortener", "server binary to run")
+	latency := fs.Duration("latency", 0, "delay added to every response")
+	failEvery := fs.Int64("fail-every", 0, "answer every Nth request with -fail-status instead (0 = never)")
+	failStatus := fs.Int("fail-status", http.StatusServiceUnavailable, "status of injected failures")
+	failPath := fs.String("fail-path", "", "only inject failures into paths with this prefix")
+	retryAfter := fs.Int("retry-after", 1, "Retry-After seconds sent with injected 429 and 503")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *latency < 0 || *failEvery < 0 || *retryAfter < 0 {
+		return nil, errors.New("-latency, -fail-every and -retry-after must not be negative")
+	}
+	if *failStatus < 400 || *failStatus > 599 {
+		return nil, errors.New("-fail-status must be an HTTP error status")
+	}
+	return &options{
+		server:     *server,
+		latency:    *latency,
+		failEvery:  *failEvery,
+		failStatus: *failStatus,
+		failPath:   *failPath,
+		retryAfter: *retryAfter,
+	}, nil
+}
+
+// inject applies the latency and failure flags. An injected failure is
+// answered by the proxy, so it never reaches the server or its store.
+func (o *options) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(o.latency)
+		n := o.requests.Add(1)
+		if o.failEvery <= 0 || n%o.failEvery != 0 || !strings.HasPrefix(r.URL.Path, o.failPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if o.failStatus == http.StatusTooManyRequests || o.failStatus == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(o.retryAfter))
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(o.failStatus)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Injected failure (request %d)", n)})
+	})
+}
+
+// freePort returns a loopback port nothing listens on, for the server
+// behind the proxy.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitListening waits until addr accepts connections, or the server
+// exits.
+func waitListening(addr string, exited <-chan error) error {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("server exited: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("server did not listen on %s within 30s", addr)
+}
+
+func run(args []string) int {
+	opts, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	port := 8080
+	if raw := os.Getenv("PORT"); raw != "" {
+		if port, err = strconv.Atoi(raw); err != nil {
+			fmt.Fprintf(os.Stderr, "PORT %q is not a number\n", raw)
+			return 2
+		}
+	}
+
+	redis, err := miniredis.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start in-memory Redis:", err)
+		return 1
+	}
+	defer redis.Close()
+	backendPort, err := freePort()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	backend := net.JoinHostPort("127.0.0.1", strconv.Itoa(backendPort))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The other settings apply as usual, e.g. JWT_SECRET for accounts.
+	// Short links point at the proxy, which the server believes about
+	// the client's address.
+	cmd := exec.CommandContext(ctx, opts.server)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"STORE_BACKEND=memory",
+		"REDIS_ADDR="+redis.Addr(), "REDIS_USER=", "REDIS_PASSWORD=", "REDIS_DB=0", "REDIS_REGIONS=",
+		"PORT="+strconv.Itoa(backendPort),
+		"BASE_URL="+cmp.Or(os.Getenv("BASE_URL"), fmt.Sprintf("http://localhost:%d/", port)),
+		"TRUSTED_PROXIES=127.0.0.1",
+	)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v (build it with go build -o url-shortener .)\n", opts.server, err)
+		return 1
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	if err := waitListening(backend, exited); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		cmd.Cancel()
+		return 1
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: backend})
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: opts.inject(proxy), ReadHeaderTimeout: 5 * time.Second}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	log.Println("Mock server is running at", srv.Addr)
+
+	select {
+	case err := <-served:
+		fmt.Fprintln(os.Stderr, err)
+		cmd.Cancel()
+		<-exited
+		return 1
+	case err := <-exited:
+		fmt.Fprintln(os.Stderr, "server exited:", err)
+		return 1
+	case <-ctx.Done():
+		srv.Shutdown(context.Background())
+		<-exited
+		return 0
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
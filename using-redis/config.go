@@ -0,0 +1,908 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the core settings of the server. Each one is read, lowest
+// precedence first, from its default, the YAML file named by --config or
+// CONFIG_FILE, the environment (and .env) and the command line, so a file
+// can hold a deployment's settings and a flag can still override one of
+// them for a single run:
+//
+//	port: 8080
+//	base_url: https://sho.rt/
+//	default_expiry: 168h
+//	cleanup_interval: 24h
+//	max_body_bytes: 1048576
+//	timeouts:
+//	  read_header: 5s
+//	  read: 30s
+//	  write: 1m
+//	  idle: 2m
+//	rate_limit:
+//	  requests: 5
+//	  key_requests: 60
+//	  redirects: 600
+//	  window: 1m
+//	codes:
+//	  generator: random
+//	  random_length: 8
+//	  alphabet: base58
+//	  min_length: 4
+//	  custom_min_length: 4
+//	  custom_max_length: 32
+//	  case_insensitive: true
+//	dedupe_urls: true
+//	reserved_codes: [promo, careers]
+//	trusted_proxies: [10.0.0.0/8]
+//	ip_access_file: /etc/shortener/ip-access
+//	redis:
+//	  addr: localhost:6379
+//	  db: 0
+//	store_backend: redis
+//	bolt_path: links.bolt
+//	sqlite_path: links.db
+//	tls:
+//	  domains: [sho.rt]
+//	  redirect_port: 80
+//	clicks:
+//	  retention_days: 30
+//	link_cache:
+//	  max: 10000
+//	log:
+//	  level: info
+//	replica:
+//	  of: https://primary.sho.rt
+//
+// Secrets, such as the Redis password, the admin token and the keys that
+// sign tokens and cookies, can come from the file or the environment but
+// have no flag, since the command line is visible to other users of the
+// machine.
+type Config struct {
+	Port            int             `yaml:"port"`
+	BaseURL         string          `yaml:"base_url"`
+	DefaultExpiry   time.Duration   `yaml:"default_expiry"`
+	CleanupInterval time.Duration   `yaml:"cleanup_interval"`
+	MaxBodyBytes    int64           `yaml:"max_body_bytes"`
+	Timeouts        TimeoutConfig   `yaml:"timeouts"`
+	RateLimit       RateLimitConfig `yaml:"rate_limit"`
+	Codes           CodeConfig      `yaml:"codes"`
+	DedupeURLs      bool            `yaml:"dedupe_urls"`
+	ReservedCodes   []string        `yaml:"reserved_codes"`
+	TrustedProxies  []string        `yaml:"trusted_proxies"`
+	IPAccessFile    string          `yaml:"ip_access_file"`
+	Redis           RedisConfig     `yaml:"redis"`
+	StoreBackend    string          `yaml:"store_backend"` // redis, postgres, sqlite, bolt, json or memory
+	DatabaseURL     string          `yaml:"database_url"`
+	BoltPath        string          `yaml:"bolt_path"`
+	SQLitePath      string          `yaml:"sqlite_path"`
+	StoreFile       string          `yaml:"store_file"`
+	StoreFsync      FsyncConfig     `yaml:"store_fsync"`
+	TLS             TLSConfig       `yaml:"tls"`
+
+	TenantRegions  map[string]string `yaml:"tenant_regions"` // tenant or namespace -> region of redis.regions
+	AdminToken     string            `yaml:"admin_token"`
+	BackupKey      string            `yaml:"backup_key"`
+	CookieKey      string            `yaml:"cookie_key"`
+	StatelessKey   string            `yaml:"stateless_key"`
+	BrandName      string            `yaml:"brand_name"`
+	DebugAddr      string            `yaml:"debug_addr"`
+	CleanupWorkers int               `yaml:"cleanup_workers"`
+	HealthCheck    time.Duration     `yaml:"health_check_interval"` // 0 turns the checker off
+	LinkQuota      int64             `yaml:"link_quota"`            // 0 for no quota
+	MetricsTenants []string          `yaml:"metrics_tenants"`
+	TenantSnippets string            `yaml:"tenant_snippets"`
+	EventStream    string            `yaml:"event_stream"`
+	Accounts       AccountConfig     `yaml:"accounts"`
+	AuthProxy      AuthProxyConfig   `yaml:"auth_proxy"`
+	OAuth          OAuthConfig       `yaml:"oauth"`
+	Clicks         ClickConfig       `yaml:"clicks"`
+	Egress         EgressConfig      `yaml:"egress"`
+	Geo            GeoConfig         `yaml:"geo"`
+	Import         ImportConfig      `yaml:"import"`
+	KV             KVConfig          `yaml:"cloudflare_kv"`
+	Latency        LatencyConfig     `yaml:"latency"`
+	LinkCache      LinkCacheConfig   `yaml:"link_cache"`
+	Log            LogConfig         `yaml:"log"`
+	Orphans        OrphanConfig      `yaml:"orphans"`
+	Replica        ReplicaConfig     `yaml:"replica"`
+	Verify         VerifyConfig      `yaml:"verify"`
+
+	dotenv bool // whether a .env file was loaded
+}
+
+// TimeoutConfig bounds the time a client may take to send a request and
+// read the answer, and how long an idle keep-alive connection stays open,
+// so slow clients cannot hold connections open forever.
+type TimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+// FsyncConfig is when store.json reaches the disk. always syncs every
+// write before it is answered; interval syncs every Interval, so a power
+// loss can cost that much; off leaves it to the system.
+type FsyncConfig struct {
+	Mode     string        `yaml:"mode"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+const (
+	fsyncAlways   = "always"
+	fsyncInterval = "interval"
+	fsyncOff      = "off"
+)
+
+// RateLimitConfig is the number of requests a client IP may make to the
+// shortening routes in each window. Requests with an API key are limited
+// by the key instead, to its own rate limit or KeyRequests. Redirects
+// have a limit of their own, 0 for none.
+type RateLimitConfig struct {
+	Requests    int           `yaml:"requests"`
+	KeyRequests int           `yaml:"key_requests"`
+	Redirects   int           `yaml:"redirects"`
+	Window      time.Duration `yaml:"window"`
+}
+
+// CodeConfig picks how the codes of links created without a custom code
+// are made: from the shared counter, blocks of BlockSize reserved from
+// it, random draws of RandomLength characters, or snowflake IDs.
+// Counter codes are short but tell anyone how to find the next link.
+// The IDs are written in the digits of Alphabet and padded to MinLength.
+// Custom codes and aliases must be CustomMinLength to CustomMaxLength
+// characters long, and with CaseInsensitive are stored in lowercase.
+// CounterStart is the smallest ID the counter hands out, Node the
+// snowflake node ID, which must differ between instances (-1 for none),
+// and Matching
+// how forgiving redirects are with mangled codes.
+type CodeConfig struct {
+	Generator       string `yaml:"generator"`
+	RandomLength    int    `yaml:"random_length"` // up to 10, the most an int64 holds
+	BlockSize       int64  `yaml:"block_size"`
+	Alphabet        string `yaml:"alphabet"` // base62, base58 or unambiguous
+	MinLength       int    `yaml:"min_length"`
+	CustomMinLength int    `yaml:"custom_min_length"`
+	CustomMaxLength int    `yaml:"custom_max_length"` // 0 for no limit
+	CaseInsensitive bool   `yaml:"case_insensitive"`
+	CounterStart    int64  `yaml:"counter_start"`
+	Node            int64  `yaml:"node"`
+	Matching        string `yaml:"matching"` // strict, trim or lenient
+}
+
+type RedisConfig struct {
+	Addr     string            `yaml:"addr"`
+	User     string            `yaml:"user"`
+	Password string            `yaml:"password"`
+	DB       int               `yaml:"db"`
+	Regions  map[string]string `yaml:"regions"` // region -> redis:// URL
+}
+
+// AccountConfig turns on user accounts when JWTSecret is set.
+type AccountConfig struct {
+	JWTSecret     string        `yaml:"jwt_secret"`
+	JWTTTL        time.Duration `yaml:"jwt_ttl"`
+	RequireAPIKey bool          `yaml:"require_api_key"`
+}
+
+// AuthProxyConfig names the header an SSO gateway puts the user in, and
+// the peers it is believed from.
+type AuthProxyConfig struct {
+	Header  string   `yaml:"header"`
+	Trusted []string `yaml:"trusted"`
+}
+
+// OAuthConfig sets up sign-in with Google and GitHub. Allowed lists the
+// emails and @domains that may sign in, all when empty.
+type OAuthConfig struct {
+	Allowed      []string    `yaml:"allowed"`
+	SuccessURL   string      `yaml:"success_url"`
+	RedirectBase string      `yaml:"redirect_base"` // base_url when empty
+	Google       OAuthClient `yaml:"google"`
+	GitHub       OAuthClient `yaml:"github"`
+}
+
+type OAuthClient struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+// ClickConfig controls the raw click events kept for analytics, and the
+// consent EU-facing deployments ask before recording them.
+type ClickConfig struct {
+	Events              bool   `yaml:"events"`
+	RetentionDays       int    `yaml:"retention_days"`
+	HourlyDays          int    `yaml:"hourly_days"`
+	HashKey             string `yaml:"hash_key"`
+	EUFacing            bool   `yaml:"eu_facing"`
+	ConsentInterstitial bool   `yaml:"consent_interstitial"`
+}
+
+// EgressConfig bounds outgoing requests: Allow lists the private hosts,
+// IPs and CIDRs they may reach, and Rate the requests per second.
+type EgressConfig struct {
+	Allow []string `yaml:"allow"`
+	Rate  float64  `yaml:"rate"`
+}
+
+// GeoConfig locates visitors, by a CDN's header or a database, and blocks
+// countries for every link.
+type GeoConfig struct {
+	Header    string   `yaml:"header"`
+	DB        string   `yaml:"db"`
+	Block     []string `yaml:"block"`
+	BlockPage string   `yaml:"block_page"`
+}
+
+type ImportConfig struct {
+	Dir      string `yaml:"dir"`
+	MaxBytes int64  `yaml:"max_bytes"`
+}
+
+// KVConfig pushes links to Cloudflare Workers KV, every PushInterval
+// unless it is 0.
+type KVConfig struct {
+	AccountID    string        `yaml:"account_id"`
+	NamespaceID  string        `yaml:"namespace_id"`
+	APIToken     string        `yaml:"api_token"`
+	APIURL       string        `yaml:"api_url"`
+	PushInterval time.Duration `yaml:"push_interval"`
+}
+
+// LatencyConfig alerts AlertWebhook when the p99 of redirects stays over
+// BudgetMS for AlertMinutes. A budget of 0 turns it off.
+type LatencyConfig struct {
+	BudgetMS     int    `yaml:"budget_ms"`
+	AlertMinutes int    `yaml:"alert_minutes"`
+	AlertWebhook string `yaml:"alert_webhook"`
+}
+
+// LinkCacheConfig keeps up to Max links in memory for redirects, 0 for
+// no cache. Min is where it starts, max/16 when 0.
+type LinkCacheConfig struct {
+	Max      int           `yaml:"max"`
+	Min      int           `yaml:"min"`
+	MaxBytes int64         `yaml:"max_bytes"`
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+// LogConfig writes logs at Level to stdout, or to File, rotated at
+// MaxSizeMB.
+type LogConfig struct {
+	Level      string `yaml:"level"`
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"` // 0 keeps them all
+	MaxAgeDays int    `yaml:"max_age_days"`
+}
+
+// OrphanConfig decides what becomes of the links of deleted users once
+// Grace has passed.
+type OrphanConfig struct {
+	Policy        string        `yaml:"policy"` // disable, reassign or delete
+	ReassignTo    string        `yaml:"reassign_to"`
+	Grace         time.Duration `yaml:"grace"`
+	SweepInterval time.Duration `yaml:"sweep_interval"` // 0 turns the sweep off
+}
+
+// ReplicaConfig makes the server a read-only replica of Of. Token is the
+// replication token, sent by replicas and accepted by the primary.
+type ReplicaConfig struct {
+	Of           string        `yaml:"of"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	Token        string        `yaml:"token"`
+}
+
+// VerifyConfig samples Sample links every Interval, 0 for never, to catch
+// drift between the store and its indexes, and repairs it with Heal.
+type VerifyConfig struct {
+	Heal     bool          `yaml:"heal"`
+	Interval time.Duration `yaml:"interval"`
+	Sample   int           `yaml:"sample"`
+}
+
+// TLSConfig makes the server terminate TLS itself, with a certificate
+// from files or one autocert obtains from Let's Encrypt for Domains.
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	Domains      []string `yaml:"domains"`
+	CacheDir     string   `yaml:"cache_dir"`     // where autocert keeps its account and certificates
+	Email        string   `yaml:"email"`         // contact for expiry notices from Let's Encrypt
+	RedirectPort int      `yaml:"redirect_port"` // plain HTTP port that redirects to HTTPS, 0 for none
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || len(t.Domains) > 0
+}
+
+// config is loaded while the package initializes, because the Redis
+// client and the store backend are set up before main runs.
+var config, configErr = loadConfig(serverArgs())
+
+// serverArgs returns the flags the server was started with. Subcommands
+// such as seed parse their own.
+func serverArgs() []string {
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") {
+		return os.Args[1:]
+	}
+	return nil
+}
+
+// configEnv maps environment variables to the flags that set the same
+// field.
+var configEnv = []struct{ env, flag string }{
+	{"PORT", "port"},
+	{"BASE_URL", "base-url"},
+	{"DEFAULT_EXPIRY", "default-expiry"},
+	{"CLEANUP_INTERVAL", "cleanup-interval"},
+	{"MAX_BODY_BYTES", "max-body-bytes"},
+	{"READ_HEADER_TIMEOUT", "read-header-timeout"},
+	{"READ_TIMEOUT", "read-timeout"},
+	{"WRITE_TIMEOUT", "write-timeout"},
+	{"IDLE_TIMEOUT", "idle-timeout"},
+	{"RATE_LIMIT_REQUESTS", "rate-limit-requests"},
+	{"RATE_LIMIT_KEY_REQUESTS", "rate-limit-key-requests"},
+	{"RATE_LIMIT_REDIRECTS", "rate-limit-redirects"},
+	{"RATE_LIMIT_WINDOW", "rate-limit-window"},
+	{"ID_GENERATOR", "code-generator"},
+	{"ID_RANDOM_LENGTH", "code-random-length"},
+	{"ID_BLOCK_SIZE", "code-block-size"},
+	{"CODE_ALPHABET", "code-alphabet"},
+	{"MIN_CODE_LENGTH", "code-min-length"},
+	{"CUSTOM_CODE_MIN_LENGTH", "custom-code-min-length"},
+	{"CUSTOM_CODE_MAX_LENGTH", "custom-code-max-length"},
+	{"CASE_INSENSITIVE_CODES", "case-insensitive-codes"},
+	{"DEDUPE_URLS", "dedupe-urls"},
+	{"RESERVED_CODES", "reserved-codes"},
+	{"TRUSTED_PROXIES", "trusted-proxies"},
+	{"IP_ACCESS_FILE", "ip-access-file"},
+	{"REDIS_ADDR", "redis-addr"},
+	{"REDIS_USER", "redis-user"},
+	{"REDIS_DB", "redis-db"},
+	{"STORE_BACKEND", "store-backend"},
+	{"BOLT_PATH", "bolt-path"},
+	{"SQLITE_PATH", "sqlite-path"},
+	{"STORE_FILE", "store-file"},
+	{"STORE_FSYNC", "store-fsync"},
+	{"STORE_FSYNC_INTERVAL", "store-fsync-interval"},
+	{"TLS_CERT_FILE", "tls-cert"},
+	{"TLS_KEY_FILE", "tls-key"},
+	{"TLS_DOMAINS", "tls-domains"},
+	{"TLS_CACHE_DIR", "tls-cache-dir"},
+	{"TLS_EMAIL", "tls-email"},
+	{"TLS_REDIRECT_PORT", "tls-redirect-port"},
+	{"ID_COUNTER_START", "code-counter-start"},
+	{"ID_NODE", "code-node"},
+	{"CODE_MATCHING", "code-matching"},
+	{"TENANT_REGIONS", "tenant-regions"},
+	{"BRAND_NAME", "brand-name"},
+	{"DEBUG_ADDR", "debug-addr"},
+	{"CLEANUP_WORKERS", "cleanup-workers"},
+	{"HEALTH_CHECK_INTERVAL", "health-check-interval"},
+	{"LINK_QUOTA", "link-quota"},
+	{"METRICS_TENANTS", "metrics-tenants"},
+	{"TENANT_SNIPPETS", "tenant-snippets"},
+	{"JWT_TTL", "jwt-ttl"},
+	{"REQUIRE_API_KEY", "require-api-key"},
+	{"AUTH_PROXY_HEADER", "auth-proxy-header"},
+	{"AUTH_PROXY_TRUSTED", "auth-proxy-trusted"},
+	{"OAUTH_ALLOWED", "oauth-allowed"},
+	{"OAUTH_SUCCESS_URL", "oauth-success-url"},
+	{"OAUTH_REDIRECT_BASE", "oauth-redirect-base"},
+	{"OAUTH_GOOGLE_CLIENT_ID", "oauth-google-client-id"},
+	{"OAUTH_GITHUB_CLIENT_ID", "oauth-github-client-id"},
+	{"CLICK_EVENTS", "click-events"},
+	{"CLICK_RETENTION_DAYS", "click-retention-days"},
+	{"CLICK_HOURLY_DAYS", "click-hourly-days"},
+	{"EU_FACING", "eu-facing"},
+	{"CONSENT_INTERSTITIAL", "consent-interstitial"},
+	{"EGRESS_ALLOW", "egress-allow"},
+	{"EGRESS_RATE", "egress-rate"},
+	{"GEOIP_HEADER", "geoip-header"},
+	{"GEOIP_DB", "geoip-db"},
+	{"GEO_BLOCK", "geo-block"},
+	{"GEO_BLOCK_PAGE", "geo-block-page"},
+	{"IMPORT_DIR", "import-dir"},
+	{"IMPORT_MAX_BYTES", "import-max-bytes"},
+	{"CF_ACCOUNT_ID", "cf-account-id"},
+	{"CF_KV_NAMESPACE_ID", "cf-kv-namespace-id"},
+	{"CF_API_URL", "cf-api-url"},
+	{"CF_KV_PUSH_INTERVAL", "cf-kv-push-interval"},
+	{"LATENCY_BUDGET_MS", "latency-budget-ms"},
+	{"LATENCY_ALERT_MINUTES", "latency-alert-minutes"},
+	{"LATENCY_ALERT_WEBHOOK", "latency-alert-webhook"},
+	{"LINK_CACHE_MAX", "link-cache-max"},
+	{"LINK_CACHE_MIN", "link-cache-min"},
+	{"LINK_CACHE_MAX_BYTES", "link-cache-max-bytes"},
+	{"LINK_CACHE_TTL", "link-cache-ttl"},
+	{"LOG_LEVEL", "log-level"},
+	{"LOG_FILE", "log-file"},
+	{"LOG_MAX_SIZE_MB", "log-max-size-mb"},
+	{"LOG_MAX_BACKUPS", "log-max-backups"},
+	{"LOG_MAX_AGE_DAYS", "log-max-age-days"},
+	{"ORPHAN_POLICY", "orphan-policy"},
+	{"ORPHAN_REASSIGN_TO", "orphan-reassign-to"},
+	{"ORPHAN_GRACE", "orphan-grace"},
+	{"ORPHAN_SWEEP_INTERVAL", "orphan-sweep-interval"},
+	{"REPLICA_OF", "replica-of"},
+	{"REPLICA_POLL_INTERVAL", "replica-poll-interval"},
+	{"VERIFY_HEAL", "verify-heal"},
+	{"VERIFY_INTERVAL", "verify-interval"},
+	{"VERIFY_SAMPLE", "verify-sample"},
+}
+
+// secrets maps environment variables to the settings that have no flag.
+func (c *Config) secrets() []struct {
+	env   string
+	value *string
+} {
+	return []struct {
+		env   string
+		value *string
+	}{
+		{"REDIS_PASSWORD", &c.Redis.Password},
+		{"DATABASE_URL", &c.DatabaseURL},
+		{"ADMIN_TOKEN", &c.AdminToken},
+		{"BACKUP_KEY", &c.BackupKey},
+		{"COOKIE_KEY", &c.CookieKey},
+		{"STATELESS_KEY", &c.StatelessKey},
+		{"EVENT_STREAM", &c.EventStream}, // may hold a NATS password
+		{"JWT_SECRET", &c.Accounts.JWTSecret},
+		{"OAUTH_GOOGLE_CLIENT_SECRET", &c.OAuth.Google.ClientSecret},
+		{"OAUTH_GITHUB_CLIENT_SECRET", &c.OAuth.GitHub.ClientSecret},
+		{"CLICK_HASH_KEY", &c.Clicks.HashKey},
+		{"CF_API_TOKEN", &c.KV.APIToken},
+		{"REPLICATION_TOKEN", &c.Replica.Token},
+	}
+}
+
+func loadConfig(args []string) (Config, error) {
+	c := Config{
+		Port:            8080,
+		DefaultExpiry:   7 * 24 * time.Hour,
+		CleanupInterval: 24 * time.Hour,
+		MaxBodyBytes:    1 << 20,
+		Timeouts: TimeoutConfig{
+			ReadHeader: 5 * time.Second,
+			Read:       30 * time.Second,
+			Write:      time.Minute,
+			Idle:       2 * time.Minute,
+		},
+		RateLimit:      RateLimitConfig{Requests: 5, KeyRequests: 60, Redirects: 600, Window: time.Minute},
+		Codes:          CodeConfig{Generator: idGenCounter, RandomLength: 7, BlockSize: 100, Alphabet: alphabetBase62, CustomMinLength: 1, Node: -1},
+		StoreBackend:   "redis",
+		BoltPath:       "links.bolt",
+		SQLitePath:     "links.db",
+		StoreFile:      "store.json",
+		StoreFsync:     FsyncConfig{Mode: fsyncAlways, Interval: time.Second},
+		TLS:            TLSConfig{CacheDir: "autocert-cache"},
+		BrandName:      "URL Shortener",
+		CleanupWorkers: 8,
+		HealthCheck:    5 * time.Minute,
+		Accounts:       AccountConfig{JWTTTL: 24 * time.Hour},
+		Clicks:         ClickConfig{Events: true, RetentionDays: 30, HourlyDays: 7},
+		Egress:         EgressConfig{Rate: 10},
+		Import:         ImportConfig{Dir: "imports", MaxBytes: 100 << 20},
+		KV:             KVConfig{APIURL: "https://api.cloudflare.com/client/v4"},
+		Latency:        LatencyConfig{AlertMinutes: 5},
+		LinkCache:      LinkCacheConfig{MaxBytes: 64 << 20, TTL: 5 * time.Second},
+		Log:            LogConfig{Level: "info", MaxSizeMB: 100, MaxBackups: 5},
+		Orphans:        OrphanConfig{Policy: orphanDisable, Grace: 7 * 24 * time.Hour, SweepInterval: time.Hour},
+		Replica:        ReplicaConfig{PollInterval: time.Second},
+		Verify:         VerifyConfig{Heal: true, Interval: 5 * time.Minute, Sample: 100},
+	}
+	c.dotenv = godotenv.Load() == nil
+
+	// Bad flags are reported with the other config errors, by main or
+	// --check, rather than while the package initializes.
+	fs := flag.NewFlagSet("url-shortener", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	file := fs.String("config", "", "YAML file with settings (env CONFIG_FILE)")
+	fs.Bool("check", false, "validate the deployment and exit")
+	fs.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	fs.StringVar(&c.BaseURL, "base-url", "", "prefix of short links (default http://localhost:<port>/)")
+	fs.DurationVar(&c.DefaultExpiry, "default-expiry", c.DefaultExpiry, "lifetime of links created without expiry_seconds")
+	fs.DurationVar(&c.CleanupInterval, "cleanup-interval", c.CleanupInterval, "how often expired links are deleted")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "largest body accepted by /shorten and /new")
+	fs.DurationVar(&c.Timeouts.ReadHeader, "read-header-timeout", c.Timeouts.ReadHeader, "time to read the request headers")
+	fs.DurationVar(&c.Timeouts.Read, "read-timeout", c.Timeouts.Read, "time to read the whole request")
+	fs.DurationVar(&c.Timeouts.Write, "write-timeout", c.Timeouts.Write, "time from the end of the request headers to the end of the answer")
+	fs.DurationVar(&c.Timeouts.Idle, "idle-timeout", c.Timeouts.Idle, "how long idle keep-alive connections stay open")
+	fs.IntVar(&c.RateLimit.Requests, "rate-limit-requests", c.RateLimit.Requests, "shortening requests allowed per client IP and window")
+	fs.IntVar(&c.RateLimit.KeyRequests, "rate-limit-key-requests", c.RateLimit.KeyRequests, "requests allowed per API key and window, unless the key has its own limit")
+	fs.IntVar(&c.RateLimit.Redirects, "rate-limit-redirects", c.RateLimit.Redirects, "redirects allowed per client IP and window (0: no limit)")
+	fs.DurationVar(&c.RateLimit.Window, "rate-limit-window", c.RateLimit.Window, "rate limit window")
+	fs.StringVar(&c.Codes.Generator, "code-generator", c.Codes.Generator, "how generated codes are made: counter, block, random or snowflake")
+	fs.IntVar(&c.Codes.RandomLength, "code-random-length", c.Codes.RandomLength, "length of the codes of the random generator")
+	fs.Int64Var(&c.Codes.BlockSize, "code-block-size", c.Codes.BlockSize, "IDs the block generator reserves at once")
+	fs.StringVar(&c.Codes.Alphabet, "code-alphabet", c.Codes.Alphabet, "digits of generated codes: base62, base58 or unambiguous")
+	fs.IntVar(&c.Codes.MinLength, "code-min-length", 0, "length generated codes are padded to")
+	fs.IntVar(&c.Codes.CustomMinLength, "custom-code-min-length", c.Codes.CustomMinLength, "shortest custom code or alias accepted")
+	fs.IntVar(&c.Codes.CustomMaxLength, "custom-code-max-length", 0, "longest custom code or alias accepted (0: no limit)")
+	fs.BoolVar(&c.Codes.CaseInsensitive, "case-insensitive-codes", false, "store custom codes in lowercase and find links whatever the case of the code")
+	fs.BoolVar(&c.DedupeURLs, "dedupe-urls", false, "return the existing link when the same URL is shortened again")
+	fs.Var((*listFlag)(&c.ReservedCodes), "reserved-codes", "comma-separated words custom codes may not be, on top of the route names")
+	fs.Var((*listFlag)(&c.TrustedProxies), "trusted-proxies", "comma-separated IPs and CIDRs of proxies whose X-Forwarded-For and X-Real-IP are believed")
+	fs.StringVar(&c.IPAccessFile, "ip-access-file", "", "file of allow and deny rules for client IPs, reloaded on change")
+	fs.StringVar(&c.Redis.Addr, "redis-addr", "", "Redis address, host:port")
+	fs.StringVar(&c.Redis.User, "redis-user", "", "Redis username")
+	fs.IntVar(&c.Redis.DB, "redis-db", 0, "Redis database number")
+	fs.StringVar(&c.StoreBackend, "store-backend", c.StoreBackend, "where links are kept: redis, postgres, sqlite, bolt, json or memory")
+	fs.StringVar(&c.BoltPath, "bolt-path", c.BoltPath, "bbolt file of STORE_BACKEND=bolt")
+	fs.StringVar(&c.SQLitePath, "sqlite-path", c.SQLitePath, "SQLite file of STORE_BACKEND=sqlite")
+	fs.StringVar(&c.StoreFile, "store-file", c.StoreFile, "store.json of STORE_BACKEND=json")
+	fs.StringVar(&c.StoreFsync.Mode, "store-fsync", c.StoreFsync.Mode, "when store.json is synced to disk: always, interval or off")
+	fs.DurationVar(&c.StoreFsync.Interval, "store-fsync-interval", c.StoreFsync.Interval, "how often store.json is synced with -store-fsync interval")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", "", "PEM certificate chain to serve HTTPS with")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", "", "PEM private key of -tls-cert")
+	fs.Var((*listFlag)(&c.TLS.Domains), "tls-domains", "comma-separated domains to get Let's Encrypt certificates for")
+	fs.StringVar(&c.TLS.CacheDir, "tls-cache-dir", c.TLS.CacheDir, "directory autocert keeps certificates in")
+	fs.StringVar(&c.TLS.Email, "tls-email", "", "contact address for Let's Encrypt")
+	fs.IntVar(&c.TLS.RedirectPort, "tls-redirect-port", 0, "plain HTTP port redirecting to HTTPS (0: none)")
+	fs.Int64Var(&c.Codes.CounterStart, "code-counter-start", 0, "smallest ID the counter hands out")
+	fs.Int64Var(&c.Codes.Node, "code-node", c.Codes.Node, "snowflake node ID, different on every instance")
+	fs.StringVar(&c.Codes.Matching, "code-matching", "", "how forgiving redirects are with mangled codes: strict, trim or lenient (default)")
+	fs.Var((*assignmentsFlag)(&c.TenantRegions), "tenant-regions", "comma-separated tenant=region or namespace=region pairs")
+	fs.StringVar(&c.BrandName, "brand-name", c.BrandName, "name of the service on the pages shown to visitors")
+	fs.StringVar(&c.DebugAddr, "debug-addr", "", "address to serve pprof and expvar on, e.g. 127.0.0.1:6060")
+	fs.IntVar(&c.CleanupWorkers, "cleanup-workers", c.CleanupWorkers, "concurrent deletions of a cleanup")
+	fs.DurationVar(&c.HealthCheck, "health-check-interval", c.HealthCheck, "how often fallback destinations are probed (0: never)")
+	fs.Int64Var(&c.LinkQuota, "link-quota", 0, "active links each user and API key may have (0: no quota)")
+	fs.Var((*listFlag)(&c.MetricsTenants), "metrics-tenants", "comma-separated tenants with metrics of their own")
+	fs.StringVar(&c.TenantSnippets, "tenant-snippets", "", "JSON file of the snippets each tenant's pages embed")
+	fs.DurationVar(&c.Accounts.JWTTTL, "jwt-ttl", c.Accounts.JWTTTL, "lifetime of user tokens")
+	fs.BoolVar(&c.Accounts.RequireAPIKey, "require-api-key", false, "refuse to shorten without an API key or sign-in")
+	fs.StringVar(&c.AuthProxy.Header, "auth-proxy-header", "", "header an SSO gateway puts the user in")
+	fs.Var((*listFlag)(&c.AuthProxy.Trusted), "auth-proxy-trusted", "comma-separated IPs and CIDRs of the auth proxy")
+	fs.Var((*listFlag)(&c.OAuth.Allowed), "oauth-allowed", "comma-separated emails and @domains that may sign in with OAuth")
+	fs.StringVar(&c.OAuth.SuccessURL, "oauth-success-url", "", "page OAuth sign-in sends the token to")
+	fs.StringVar(&c.OAuth.RedirectBase, "oauth-redirect-base", "", "base of the OAuth callback URLs (default base-url)")
+	fs.StringVar(&c.OAuth.Google.ClientID, "oauth-google-client-id", "", "Google OAuth client ID")
+	fs.StringVar(&c.OAuth.GitHub.ClientID, "oauth-github-client-id", "", "GitHub OAuth client ID")
+	fs.BoolVar(&c.Clicks.Events, "click-events", c.Clicks.Events, "record raw click events with the visitor's IP and referrer")
+	fs.IntVar(&c.Clicks.RetentionDays, "click-retention-days", c.Clicks.RetentionDays, "days raw click events are kept")
+	fs.IntVar(&c.Clicks.HourlyDays, "click-hourly-days", c.Clicks.HourlyDays, "days hourly click counts are kept")
+	fs.BoolVar(&c.Clicks.EUFacing, "eu-facing", false, "record click events only for visitors who consented")
+	fs.BoolVar(&c.Clicks.ConsentInterstitial, "consent-interstitial", false, "ask visitors for consent before their first redirect")
+	fs.Var((*listFlag)(&c.Egress.Allow), "egress-allow", "comma-separated private hosts, IPs and CIDRs outgoing requests may reach")
+	fs.Float64Var(&c.Egress.Rate, "egress-rate", c.Egress.Rate, "outgoing requests per second")
+	fs.StringVar(&c.Geo.Header, "geoip-header", "", "header a CDN puts the visitor's country in")
+	fs.StringVar(&c.Geo.DB, "geoip-db", "", "CSV or MaxMind database of countries by address")
+	fs.Var((*listFlag)(&c.Geo.Block), "geo-block", "comma-separated countries every link is blocked in")
+	fs.StringVar(&c.Geo.BlockPage, "geo-block-page", "", "HTML file shown to blocked visitors")
+	fs.StringVar(&c.Import.Dir, "import-dir", c.Import.Dir, "directory CSV imports are kept in")
+	fs.Int64Var(&c.Import.MaxBytes, "import-max-bytes", c.Import.MaxBytes, "largest import or backup accepted")
+	fs.StringVar(&c.KV.AccountID, "cf-account-id", "", "Cloudflare account to push links to")
+	fs.StringVar(&c.KV.NamespaceID, "cf-kv-namespace-id", "", "Workers KV namespace to push links to")
+	fs.StringVar(&c.KV.APIURL, "cf-api-url", c.KV.APIURL, "Cloudflare API")
+	fs.DurationVar(&c.KV.PushInterval, "cf-kv-push-interval", 0, "how often links are pushed to Workers KV (0: on request only)")
+	fs.IntVar(&c.Latency.BudgetMS, "latency-budget-ms", 0, "p99 redirect latency to alert over (0: no alerts)")
+	fs.IntVar(&c.Latency.AlertMinutes, "latency-alert-minutes", c.Latency.AlertMinutes, "minutes over budget before alerting")
+	fs.StringVar(&c.Latency.AlertWebhook, "latency-alert-webhook", "", "URL latency alerts are posted to")
+	fs.IntVar(&c.LinkCache.Max, "link-cache-max", 0, "links kept in memory for redirects (0: no cache)")
+	fs.IntVar(&c.LinkCache.Min, "link-cache-min", 0, "links the cache starts with (default link-cache-max/16)")
+	fs.Int64Var(&c.LinkCache.MaxBytes, "link-cache-max-bytes", c.LinkCache.MaxBytes, "memory the link cache may use")
+	fs.DurationVar(&c.LinkCache.TTL, "link-cache-ttl", c.LinkCache.TTL, "how long a cached link is served")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&c.Log.File, "log-file", "", "file to log to instead of stdout, rotated")
+	fs.IntVar(&c.Log.MaxSizeMB, "log-max-size-mb", c.Log.MaxSizeMB, "size a log file is rotated at")
+	fs.IntVar(&c.Log.MaxBackups, "log-max-backups", c.Log.MaxBackups, "rotated log files kept (0: all)")
+	fs.IntVar(&c.Log.MaxAgeDays, "log-max-age-days", 0, "days rotated log files are kept (0: no limit)")
+	fs.StringVar(&c.Orphans.Policy, "orphan-policy", c.Orphans.Policy, "what becomes of deleted users' links: disable, reassign or delete")
+	fs.StringVar(&c.Orphans.ReassignTo, "orphan-reassign-to", "", "user that orphan-policy reassign gives the links to")
+	fs.DurationVar(&c.Orphans.Grace, "orphan-grace", c.Orphans.Grace, "how long a deleted user can be restored")
+	fs.DurationVar(&c.Orphans.SweepInterval, "orphan-sweep-interval", c.Orphans.SweepInterval, "how often the orphan policy is applied (0: never)")
+	fs.StringVar(&c.Replica.Of, "replica-of", "", "URL of the primary to run as a read-only replica of")
+	fs.DurationVar(&c.Replica.PollInterval, "replica-poll-interval", c.Replica.PollInterval, "how often a replica asks the primary for changes")
+	fs.BoolVar(&c.Verify.Heal, "verify-heal", c.Verify.Heal, "repair the drift the verifier finds")
+	fs.DurationVar(&c.Verify.Interval, "verify-interval", c.Verify.Interval, "how often the store is verified (0: never)")
+	fs.IntVar(&c.Verify.Sample, "verify-sample", c.Verify.Sample, "links each verification looks at")
+	parseErr := fs.Parse(args)
+	if errors.Is(parseErr, flag.ErrHelp) {
+		fs.SetOutput(os.Stderr)
+		fs.Usage()
+		os.Exit(0)
+	}
+	if parseErr != nil {
+		parseErr = fmt.Errorf("%w (see -h)", parseErr)
+	}
+
+	// The file is read after the flags, which name it, so the flags given
+	// are set again once the file and the environment were applied.
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+
+	err := errors.Join(parseErr, applyConfigSources(fs, &c, *file))
+	for name, v := range given {
+		fs.Set(name, v)
+	}
+
+	if c.BaseURL == "" {
+		switch {
+		case len(c.TLS.Domains) > 0:
+			c.BaseURL = "https://" + c.TLS.Domains[0] + "/"
+		case c.TLS.enabled():
+			c.BaseURL = fmt.Sprintf("https://localhost:%d/", c.Port)
+		default:
+			c.BaseURL = fmt.Sprintf("http://localhost:%d/", c.Port)
+		}
+	}
+	if !strings.HasSuffix(c.BaseURL, "/") {
+		c.BaseURL += "/"
+	}
+	c.Replica.Of = strings.TrimSuffix(c.Replica.Of, "/")
+	c.KV.APIURL = strings.TrimSuffix(c.KV.APIURL, "/")
+	c.OAuth.RedirectBase = strings.TrimSuffix(cmp.Or(c.OAuth.RedirectBase, c.BaseURL), "/")
+	if err != nil {
+		return c, err
+	}
+	switch {
+	case c.Port < 1 || c.Port > 65535:
+		return c, fmt.Errorf("port %d must be between 1 and 65535", c.Port)
+	case !isValidURL(c.BaseURL):
+		return c, fmt.Errorf("base URL %q must start with http:// or https://", c.BaseURL)
+	case c.DefaultExpiry < time.Second:
+		return c, fmt.Errorf("default expiry %s must be at least 1s", c.DefaultExpiry)
+	case c.CleanupInterval <= 0:
+		return c, fmt.Errorf("cleanup interval %s must be positive", c.CleanupInterval)
+	case c.MaxBodyBytes < 1:
+		return c, fmt.Errorf("max body bytes %d must be positive", c.MaxBodyBytes)
+	case c.Timeouts.ReadHeader <= 0 || c.Timeouts.Read <= 0 || c.Timeouts.Write <= 0 || c.Timeouts.Idle <= 0:
+		return c, errors.New("read header, read, write and idle timeouts must be positive")
+	case c.RateLimit.Requests < 1 || c.RateLimit.Window <= 0:
+		return c, fmt.Errorf("rate limit of %d requests per %s must be positive", c.RateLimit.Requests, c.RateLimit.Window)
+	case c.RateLimit.KeyRequests < 1:
+		return c, fmt.Errorf("API key rate limit of %d requests per %s must be positive", c.RateLimit.KeyRequests, c.RateLimit.Window)
+	case c.RateLimit.Redirects < 0:
+		return c, fmt.Errorf("redirect rate limit of %d per %s must be 0 (no limit) or more", c.RateLimit.Redirects, c.RateLimit.Window)
+	case !slices.Contains([]string{idGenCounter, idGenBlock, idGenRandom, idGenSnowflake}, c.Codes.Generator):
+		return c, fmt.Errorf("code generator %q must be counter, block, random or snowflake", c.Codes.Generator)
+	case c.Codes.RandomLength < 4 || c.Codes.RandomLength > 10:
+		return c, fmt.Errorf("random code length %d must be between 4 and 10", c.Codes.RandomLength)
+	case c.Codes.BlockSize < 1:
+		return c, fmt.Errorf("code block size %d must be positive", c.Codes.BlockSize)
+	case codeAlphabets[c.Codes.Alphabet] == "":
+		return c, fmt.Errorf("code alphabet %q must be base62, base58 or unambiguous", c.Codes.Alphabet)
+	case c.Codes.MinLength < 0 || c.Codes.MinLength > 16:
+		return c, fmt.Errorf("minimum code length %d must be between 0 and 16", c.Codes.MinLength)
+	case c.Codes.CustomMinLength < 1:
+		return c, fmt.Errorf("minimum custom code length %d must be positive", c.Codes.CustomMinLength)
+	case c.Codes.CustomMaxLength != 0 && c.Codes.CustomMaxLength < c.Codes.CustomMinLength:
+		return c, fmt.Errorf("maximum custom code length %d must be 0 (no limit) or at least the minimum, %d", c.Codes.CustomMaxLength, c.Codes.CustomMinLength)
+	case (c.TLS.CertFile == "") != (c.TLS.KeyFile == ""):
+		return c, errors.New("TLS needs both a certificate and a key file")
+	case c.TLS.CertFile != "" && len(c.TLS.Domains) > 0:
+		return c, errors.New("TLS takes either certificate files or domains for autocert, not both")
+	case c.TLS.RedirectPort < 0 || c.TLS.RedirectPort > 65535 || c.TLS.RedirectPort == c.Port:
+		return c, fmt.Errorf("TLS redirect port %d must be between 1 and 65535 and differ from port %d", c.TLS.RedirectPort, c.Port)
+	case c.TLS.RedirectPort != 0 && !c.TLS.enabled():
+		return c, errors.New("a TLS redirect port needs TLS certificate files or domains")
+	case !slices.Contains([]string{"redis", "postgres", "sqlite", "bolt", "json", "memory"}, c.StoreBackend):
+		return c, fmt.Errorf("store backend %q must be redis, postgres, sqlite, bolt, json or memory", c.StoreBackend)
+	case !slices.Contains([]string{fsyncAlways, fsyncInterval, fsyncOff}, c.StoreFsync.Mode):
+		return c, fmt.Errorf("store fsync %q must be always, interval or off", c.StoreFsync.Mode)
+	case c.StoreFsync.Interval <= 0:
+		return c, fmt.Errorf("store fsync interval %s must be positive", c.StoreFsync.Interval)
+	case len(c.Redis.Regions) > 0 && c.StoreBackend != "redis":
+		return c, errors.New("Redis regions need store backend redis")
+	case c.Codes.Generator == idGenBlock && c.StoreBackend != "redis":
+		return c, errors.New("code generator block needs store backend redis")
+	case c.Accounts.RequireAPIKey && !c.usesRedis():
+		return c, errors.New("requiring API keys needs Redis (REDIS_ADDR), which keeps the keys")
+	case c.DedupeURLs && !c.usesRedis() && c.StoreBackend == "bolt":
+		return c, fmt.Errorf("dedupe_urls with store backend %s needs Redis (REDIS_ADDR), which keeps the URL index", c.StoreBackend)
+	case c.Codes.CounterStart < 0:
+		return c, fmt.Errorf("counter start %d must not be negative", c.Codes.CounterStart)
+	case c.Codes.Node < -1 || c.Codes.Node > snowflakeMaxNode:
+		return c, fmt.Errorf("snowflake node %d must be between 0 and %d", c.Codes.Node, snowflakeMaxNode)
+	case c.Codes.Generator == idGenSnowflake && c.Codes.Node < 0:
+		return c, fmt.Errorf("code generator snowflake needs a node ID between 0 and %d (ID_NODE)", snowflakeMaxNode)
+	case !slices.Contains([]string{"", "strict", "trim", "lenient"}, c.Codes.Matching):
+		return c, fmt.Errorf("code matching %q must be strict, trim or lenient", c.Codes.Matching)
+	case c.CleanupWorkers < 1:
+		return c, fmt.Errorf("cleanup workers %d must be positive", c.CleanupWorkers)
+	case c.HealthCheck < 0:
+		return c, fmt.Errorf("health check interval %s must be 0 (never) or more", c.HealthCheck)
+	case c.LinkQuota < 0:
+		return c, fmt.Errorf("link quota %d must be 0 (no quota) or more", c.LinkQuota)
+	case c.Accounts.JWTSecret != "" && len(c.Accounts.JWTSecret) < minJWTSecretLen:
+		return c, fmt.Errorf("JWT secret must be at least %d characters", minJWTSecretLen)
+	case c.Accounts.JWTTTL <= 0:
+		return c, fmt.Errorf("JWT lifetime %s must be positive", c.Accounts.JWTTTL)
+	case c.Accounts.RequireAPIKey && c.AdminToken == "":
+		return c, errors.New("requiring API keys needs the admin token (ADMIN_TOKEN), which is used to create the keys")
+	case c.AuthProxy.Header == "" && len(c.AuthProxy.Trusted) > 0:
+		return c, errors.New("auth proxy peers are set but the auth proxy header is not")
+	case c.AuthProxy.Header != "" && len(c.AuthProxy.Trusted) == 0:
+		return c, errors.New("the auth proxy header needs the IPs or CIDRs of the auth proxy")
+	case (c.OAuth.Google.ClientID == "") != (c.OAuth.Google.ClientSecret == ""):
+		return c, errors.New("Google OAuth needs both a client ID and a client secret")
+	case (c.OAuth.GitHub.ClientID == "") != (c.OAuth.GitHub.ClientSecret == ""):
+		return c, errors.New("GitHub OAuth needs both a client ID and a client secret")
+	case (c.OAuth.Google.ClientID != "" || c.OAuth.GitHub.ClientID != "") && c.Accounts.JWTSecret == "":
+		return c, errors.New("OAuth sign-in needs the JWT secret, which signs the tokens it issues")
+	case c.OAuth.SuccessURL != "" && !isValidURL(c.OAuth.SuccessURL):
+		return c, fmt.Errorf("OAuth success URL %q must start with http:// or https://", c.OAuth.SuccessURL)
+	case !isValidURL(c.OAuth.RedirectBase):
+		return c, fmt.Errorf("OAuth redirect base %q must start with http:// or https://", c.OAuth.RedirectBase)
+	case c.Clicks.RetentionDays < 1 || c.Clicks.HourlyDays < 1:
+		return c, fmt.Errorf("click retention of %d days and hourly clicks of %d days must be positive", c.Clicks.RetentionDays, c.Clicks.HourlyDays)
+	case c.Clicks.ConsentInterstitial && (!c.Clicks.EUFacing || !c.Clicks.Events):
+		return c, errors.New("the consent interstitial needs EU-facing mode and click events on")
+	case c.Egress.Rate <= 0:
+		return c, fmt.Errorf("egress rate %g must be positive", c.Egress.Rate)
+	case c.Import.MaxBytes < 1:
+		return c, fmt.Errorf("import max bytes %d must be positive", c.Import.MaxBytes)
+	case !isValidURL(c.KV.APIURL):
+		return c, fmt.Errorf("Cloudflare API URL %q must start with http:// or https://", c.KV.APIURL)
+	case c.KV.PushInterval < 0:
+		return c, fmt.Errorf("Workers KV push interval %s must be 0 (on request only) or more", c.KV.PushInterval)
+	case c.Latency.BudgetMS < 0 || c.Latency.AlertMinutes < 1:
+		return c, fmt.Errorf("latency budget of %dms for %d minutes must be 0 (no alerts) or more, for at least a minute", c.Latency.BudgetMS, c.Latency.AlertMinutes)
+	case c.Latency.AlertWebhook != "" && !isValidURL(c.Latency.AlertWebhook):
+		return c, fmt.Errorf("latency alert webhook %q must start with http:// or https://", c.Latency.AlertWebhook)
+	case c.LinkCache.Max < 0 || c.LinkCache.Min < 0 || c.LinkCache.MaxBytes < 1 || c.LinkCache.TTL <= 0:
+		return c, errors.New("link cache sizes must not be negative, and its byte limit and TTL must be positive")
+	case c.Log.MaxSizeMB < 0 || c.Log.MaxBackups < 0 || c.Log.MaxAgeDays < 0:
+		return c, errors.New("log rotation limits must be 0 or more")
+	case !slices.Contains([]string{orphanDisable, orphanReassign, orphanDelete}, c.Orphans.Policy):
+		return c, fmt.Errorf("orphan policy %q must be disable, reassign or delete", c.Orphans.Policy)
+	case c.Orphans.Policy == orphanReassign && !validUserRegex.MatchString(c.Orphans.ReassignTo):
+		return c, errors.New("orphan policy reassign needs a user to reassign the links to")
+	case c.Orphans.Grace < 0 || c.Orphans.SweepInterval < 0:
+		return c, errors.New("orphan grace and sweep interval must be 0 or more")
+	case c.Replica.Of != "" && !isValidURL(c.Replica.Of):
+		return c, fmt.Errorf("primary URL %q must start with http:// or https://", c.Replica.Of)
+	case c.Replica.PollInterval <= 0:
+		return c, fmt.Errorf("replica poll interval %s must be positive", c.Replica.PollInterval)
+	case c.Verify.Interval < 0 || c.Verify.Sample < 1:
+		return c, errors.New("verify interval must be 0 (never) or more, and its sample positive")
+	}
+	if err := new(slog.Level).UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return c, fmt.Errorf("log level %q must be debug, info, warn or error", c.Log.Level)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, ok := parsePrefix(proxy); !ok {
+			return c, fmt.Errorf("trusted proxy %q is not an IP or CIDR", proxy)
+		}
+	}
+	for _, proxy := range c.AuthProxy.Trusted {
+		if _, ok := parsePrefix(proxy); !ok {
+			return c, fmt.Errorf("auth proxy %q is not an IP or CIDR", proxy)
+		}
+	}
+	if _, err := normalizeCountries(c.Geo.Block); err != nil {
+		return c, fmt.Errorf("geo block: %w", err)
+	}
+	if len(c.Geo.Block) > 0 && c.Geo.Header == "" && c.Geo.DB == "" {
+		return c, errors.New("geo blocking needs a GeoIP header or database to locate visitors")
+	}
+	return c, nil
+}
+
+// applyConfigSources reads the config file, path or CONFIG_FILE, into c
+// and then the environment through the flags of fs.
+func applyConfigSources(fs *flag.FlagSet, c *Config, path string) error {
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	for _, e := range configEnv {
+		if v := os.Getenv(e.env); v != "" {
+			if err := fs.Set(e.flag, v); err != nil {
+				return fmt.Errorf("%s=%q is not %s", e.env, v, flagKind(fs.Lookup(e.flag)))
+			}
+		}
+	}
+	for _, secret := range c.secrets() {
+		if v := os.Getenv(secret.env); v != "" {
+			*secret.value = v
+		}
+	}
+	if v := os.Getenv("REDIS_REGIONS"); v != "" {
+		regions, err := parseAssignments(v)
+		if err != nil {
+			return fmt.Errorf("REDIS_REGIONS: %w", err)
+		}
+		c.Redis.Regions = regions
+	}
+	return nil
+}
+
+// listFlag is a flag holding a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// assignmentsFlag is a flag holding comma-separated name=value pairs.
+type assignmentsFlag map[string]string
+
+func (a *assignmentsFlag) String() string {
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(*a)) {
+		pairs = append(pairs, name+"="+(*a)[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (a *assignmentsFlag) Set(v string) error {
+	m, err := parseAssignments(v)
+	*a = m
+	return err
+}
+
+// flagKind describes the values f accepts, for errors.
+func flagKind(f *flag.Flag) string {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "valid"
+	}
+	switch g.Get().(type) {
+	case time.Duration:
+		return "a duration (e.g. 30s, 24h)"
+	case int, int64:
+		return "an integer"
+	case float64:
+		return "a number"
+	case bool:
+		return "true or false"
+	}
+	return "valid"
+}
+
+// usesRedis reports whether the server connects to Redis: always with
+// store backend redis, and with the others when REDIS_ADDR is set. Without
+// it, links are served from the backend alone and what Redis keeps, such
+// as accounts, API keys, webhooks and click analytics, is unavailable.
+func (c Config) usesRedis() bool {
+	return c.StoreBackend == "redis" || c.Redis.Addr != ""
+}
+
+// listenAddr is the address the server listens on.
+func (c Config) listenAddr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// defaultExpirySeconds is the expiry_seconds of links created without one.
+func (c Config) defaultExpirySeconds() int64 {
+	return int64(c.DefaultExpiry / time.Second)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Consent mode. Besides the aggregate click counter, every redirect
+// records a raw click event with the visitor's IP and referrer. A
+// deployment that sets EU_FACING=true only records those events for
+// visitors who agreed to it; CONSENT_INTERSTITIAL=true asks them once,
+// before their first redirect. CLICK_EVENTS=false turns raw events off
+// for everyone, and with them the need to ask.
+var (
+	clickEventsEnabled  = config.Clicks.Events
+	euFacing            = config.Clicks.EUFacing
+	consentInterstitial = config.Clicks.ConsentInterstitial
+)
+
+const (
+	consentCookie    = "click_consent"
+	consentCookieTTL = 180 * 24 * time.Hour
+)
+
+// What the visitor decided, as stored in consentCookie.
+const (
+	consentGranted = "granted"
+	consentDenied  = "denied"
+)
+
+// clickConsent returns consentGranted, consentDenied or "" if the visitor
+// has not decided.
+func clickConsent(r *http.Request) string {
+	consent, _ := signedCookie(r, consentCookie)
+	return consent
+}
+
+// recordClickEvents reports whether a raw click event may be recorded for
+// the visitor.
+func recordClickEvents(r *http.Request) bool {
+	if !clickEventsEnabled {
+		return false
+	}
+	return !euFacing || clickConsent(r) == consentGranted
+}
+
+// consentPending reports whether the visitor should be asked before their
+// redirect.
+func consentPending(r *http.Request) bool {
+	return consentInterstitial && clickConsent(r) == ""
+}
+
+// Outcomes of the consent interstitial on /metrics.
+var consentResults = []string{"shown", consentGranted, consentDenied}
+
+var consentCounts = map[string]*atomic.Int64{
+	"shown":        {},
+	consentGranted: {},
+	consentDenied:  {},
+}
+
+func writeConsentMetrics(w io.Writer) {
+	if !consentInterstitial {
+		return
+	}
+	fmt.Fprintf(w, "# HELP urlshortener_consent_total Consent pages shown and decisions made since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_consent_total counter\n")
+	for _, result := range consentResults {
+		fmt.Fprintf(w, "urlshortener_consent_total{result=%q} %d\n", result, consentCounts[result].Load())
+	}
+}
+
+type consentPage struct {
+	Brand   string
+	Code    string
+	Query   string // of the visit, passed on to the redirect
+	Snippet string // tenant whose snippet frame is embedded
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Your privacy - {{.Brand}}</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+button { font-size: 1rem; padding: 0.4rem 1rem; margin-right: 0.5rem; }
+</style>
+</head>
+<body>
+<h1>Before you continue</h1>
+<p>{{.Brand}} counts how often each link is used. With your permission it
+also records your IP address and the page you came from when you follow
+a link, kept for a limited time to produce link statistics. We only ask
+once; either way you go straight on to the link.</p>
+<form method="post" action="/consent/{{.Code}}">
+	<input type="hidden" name="query" value="{{.Query}}">
+	<button name="consent" value="granted">Accept</button>
+	<button name="consent" value="denied">Decline</button>
+</form>
+{{if .Snippet}}<iframe src="/snippet/{{.Snippet}}/frame" sandbox="allow-scripts" title="" hidden></iframe>{{end}}
+</body>
+</html>
+`))
+
+func renderConsent(w http.ResponseWriter, page consentPage) {
+	var buf bytes.Buffer
+	if err := consentTemplate.Execute(&buf, page); err != nil {
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	setPageHeaders(w.Header())
+	w.Write(buf.Bytes())
+}
+
+// decideConsent stores the visitor's decision from the consent form and
+// returns where to send them: back to the link. Anything but an explicit
+// grant counts as a refusal.
+func decideConsent(w http.ResponseWriter, r *http.Request, code string) string {
+	consent := consentDenied
+	if r.PostFormValue("consent") == consentGranted {
+		consent = consentGranted
+	}
+	consentCounts[consent].Add(1)
+	setSignedCookie(w, consentCookie, consent, consentCookieTTL)
+	return interstitialReturn(code, r.PostFormValue("query"))
+}
+
+// showConsent asks for consent instead of redirecting when the visitor
+// has not decided yet, and reports whether it did.
+func showConsent(c *gin.Context, code string, data URLData) bool {
+	if !consentPending(c.Request) {
+		return false
+	}
+	consentCounts["shown"].Add(1)
+	renderConsent(c.Writer, consentPage{Brand: brandName, Code: code, Query: c.Request.URL.RawQuery, Snippet: snippetFor(data.Tenant)})
+	return true
+}
+
+func consentHandle(c *gin.Context) {
+	c.Redirect(http.StatusSeeOther, decideConsent(c.Writer, c.Request, c.Param("code")))
+}
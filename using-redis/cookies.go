@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cookieKey signs the cookies set on visitors. Without COOKIE_KEY it is
+// random per process, so cookies are forgotten on restart and are not
+// shared between instances.
+var cookieKey = func() []byte {
+	if key := config.CookieKey; key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// cookieMAC binds a signature to the cookie's name, so the value of one
+// signed cookie is never accepted as another.
+func cookieMAC(name, payload string) []byte {
+	key := sha256.Sum256(append([]byte("cookie:"), cookieKey...))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(name + "=" + payload))
+	return mac.Sum(nil)
+}
+
+// setSignedCookie stores payload for ttl as "<payload>.<expires>.<signature>".
+// The payload must not contain '.'.
+func setSignedCookie(w http.ResponseWriter, name, payload string, ttl time.Duration) {
+	expires := time.Now().Add(ttl)
+	signed := payload + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    signed + "." + base64.RawURLEncoding.EncodeToString(cookieMAC(name, signed)),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(baseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// signedCookie returns the payload of a cookie set by setSignedCookie,
+// and false if it is missing, forged or expired.
+func signedCookie(r *http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	i := strings.LastIndexByte(cookie.Value, '.')
+	if i < 0 {
+		return "", false
+	}
+	signed, sig := cookie.Value[:i], cookie.Value[i+1:]
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, cookieMAC(name, signed)) {
+		return "", false
+	}
+	payload, rawExpires, _ := strings.Cut(signed, ".")
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return payload, true
+}
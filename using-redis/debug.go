@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// DEBUG_ADDR, e.g. 127.0.0.1:6060, serves runtime diagnostics on a
+// listener of their own: net/http/pprof under /debug/pprof/ and expvar
+// under /debug/vars, which adds the sizes of the server's in-memory maps
+// to the memory stats, so their growth can be profiled in production. It
+// has no authentication, so bind it to localhost or a private network.
+var debugAddr = config.DebugAddr
+
+// startDebugServer listens on addr before returning, so a taken port
+// fails at startup.
+func startDebugServer(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	publishDebugVars()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Error serving debug endpoints:", err)
+		}
+	}()
+	return srv, nil
+}
+
+func publishDebugVars() {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("rate_limiters", expvar.Func(func() any {
+		rlMutex.Lock()
+		defer rlMutex.Unlock()
+		return len(rateLimiters)
+	}))
+	expvar.Publish("link_cache_entries", expvar.Func(func() any {
+		c := redirectCache
+		if c == nil {
+			return 0
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.entries)
+	}))
+	expvar.Publish("event_stream_queued", expvar.Func(func() any {
+		if eventStream == nil {
+			return 0
+		}
+		return len(eventStream.queue)
+	}))
+}
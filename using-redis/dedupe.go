@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// dedupe_urls (DEDUPE_URLS) makes shortening idempotent: a request that
+// sets nothing about the link but its URL gets the code of an active
+// link created for the same URL, by the same owner in the same tenant,
+// namespace and region, instead of a new one. Links are found through
+// urlIndexKey, a hash from dedupeField to the code, kept in Redis with
+// the stats unless the backend keeps it as a urlIndex. Every lookup is
+// checked against the link, so entries left behind by deleted, expired or
+// edited links are ignored and replaced by the next link for their URL.
+const urlIndexKey = "url_index"
+
+// normalizeLongURL is the form of a destination dedupe_urls compares:
+// scheme and host lowercased, and the default port and an empty path
+// spelled the same way as their absence and "/".
+func normalizeLongURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// dedupeField is the urlIndexKey field of a link.
+func dedupeField(longURL, owner, tenant, ns, region string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{normalizeLongURL(longURL), owner, tenant, ns, region}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// dedupable reports whether a request leaves everything but the URL to
+// the defaults, so an existing plain link is what it would create.
+func (req shortenRequest) dedupable() bool {
+	return req.CustomCode == "" && req.ExpirySeconds == 0 && req.Script == "" && len(req.Tags) == 0 &&
+		len(req.Fallbacks) == 0 && req.SampleRate == 0 && len(req.Variants) == 0 && !req.Bandit &&
+		len(req.BlockReferrers) == 0 && len(req.BlockCountries) == 0 && req.MinAge == 0 && len(req.Aliases) == 0 &&
+		req.MaxClicks == 0
+}
+
+// plain reports whether a link has none of the settings a dedupable
+// request leaves out.
+func (d URLData) plain() bool {
+	return d.Script == "" && len(d.Tags) == 0 && len(d.Fallbacks) == 0 && d.SampleRate == 0 &&
+		len(d.Variants) == 0 && !d.Bandit && d.Frozen == "" && len(d.BlockedReferrers) == 0 &&
+		len(d.BlockedCountries) == 0 && d.MinAge == 0 && len(d.Aliases) == 0 && d.AliasOf == "" && d.MaxClicks == 0
+}
+
+// findDuplicate returns the active plain link indexed for the request.
+func findDuplicate(ctx context.Context, body shortenRequest) (string, URLData, bool) {
+	field := dedupeField(body.URL, body.owner, body.tenant, body.namespace.Name, body.region)
+	var code string
+	if index, ok := links.(urlIndex); ok {
+		if code, ok = index.IndexedURL(field); !ok {
+			return "", URLData{}, false
+		}
+	} else {
+		var err error
+		if code, err = Rdb.HGet(ctx, urlIndexKey, field).Result(); err != nil {
+			if !errors.Is(err, redis.Nil) {
+				log.Println("Error reading URL index:", err)
+			}
+			return "", URLData{}, false
+		}
+	}
+	data, err := GetActiveURL(code)
+	if err != nil || !data.plain() || normalizeLongURL(data.LongURL) != normalizeLongURL(body.URL) ||
+		data.Owner != body.owner || data.Tenant != body.tenant || data.Namespace != body.namespace.Name {
+		return "", URLData{}, false
+	}
+	return code, data, true
+}
+
+// indexURL records a new plain link so findDuplicate can return it.
+func indexURL(ctx context.Context, code string, data URLData, region string) {
+	if !data.plain() {
+		return
+	}
+	field := dedupeField(data.LongURL, data.Owner, data.Tenant, data.Namespace, region)
+	if index, ok := links.(urlIndex); ok {
+		index.IndexURL(field, code)
+		return
+	}
+	if err := Rdb.HSet(ctx, urlIndexKey, field, code).Err(); err != nil {
+		log.Println("Error writing URL index:", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// checkMode is set by --check. It is read from os.Args directly because the
+// backend is set up before main runs.
+var checkMode = slices.Contains(os.Args[1:], "--check")
+
+// doctor collects the results of the --check self-test.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) ok(name, msg string) {
+	fmt.Printf("  ok    %-10s %s\n", name, msg)
+}
+
+func (d *doctor) warn(name, msg string) {
+	fmt.Printf("  warn  %-10s %s\n", name, msg)
+}
+
+func (d *doctor) fail(name, msg string) {
+	d.failed = true
+	fmt.Printf("  FAIL  %-10s %s\n", name, msg)
+}
+
+// checkBaseURL makes sure the host in short links resolves. The server is
+// usually not running during --check, so an unanswered request only warns.
+func (d *doctor) checkBaseURL() {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Hostname() == "" {
+		d.fail("base url", fmt.Sprintf("%q is not a valid URL", baseURL))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		d.fail("base url", fmt.Sprintf("host %s does not resolve: %v", u.Hostname(), err))
+		return
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		d.warn("base url", fmt.Sprintf("%s did not answer (fine if this instance is not running yet)", baseURL))
+		return
+	}
+	resp.Body.Close()
+	d.ok("base url", fmt.Sprintf("%s answered %d", baseURL, resp.StatusCode))
+}
+
+func (d *doctor) checkListen(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		d.fail("listen", fmt.Sprintf("cannot bind %s: %v (another process is using the port?)", addr, err))
+		return
+	}
+	ln.Close()
+	d.ok("listen", addr+" is free")
+}
+
+// checkClock flags clocks that are wildly off or behind data already
+// written, which would make every link look expired or never expire.
+func (d *doctor) checkClock(reference time.Time, source string) {
+	now := time.Now()
+	switch skew := now.Sub(reference); {
+	case now.Year() < 2024:
+		d.fail("clock", fmt.Sprintf("system time %s is in the past; enable NTP", now.UTC().Format(time.RFC3339)))
+	case reference.IsZero():
+		d.ok("clock", "system time "+now.UTC().Format(time.RFC3339))
+	case skew < -time.Minute || skew > time.Minute:
+		d.fail("clock", fmt.Sprintf("system time differs from %s by %s; enable NTP", source, skew.Round(time.Second)))
+	default:
+		d.ok("clock", fmt.Sprintf("within %s of %s", skew.Abs().Round(time.Millisecond), source))
+	}
+}
+
+// runChecks validates the deployment without serving traffic and returns
+// the process exit code.
+func runChecks() int {
+	d := &doctor{}
+	fmt.Println("Running self-check...")
+
+	envOK := true
+	if configErr != nil {
+		d.fail("config", configErr.Error())
+		envOK = false
+	}
+	for _, err := range []error{idGeneratorErr, geoErr, tenantSnippetsErr, eventStreamErr, storeBackendErr} {
+		if err != nil {
+			d.fail("config", err.Error())
+			envOK = false
+		}
+	}
+	if envOK {
+		d.ok("config", "settings are valid")
+	}
+
+	ctx, cancel := context.WithTimeout(Ctx, 5*time.Second)
+	defer cancel()
+
+	addr := Rdb.Options().Addr
+	if !config.usesRedis() {
+		d.ok("backend", "running without Redis (REDIS_ADDR is not set)")
+		d.checkClock(time.Time{}, "")
+	} else if err := Rdb.Ping(ctx).Err(); err != nil {
+		d.fail("backend", fmt.Sprintf("cannot reach Redis at %s: %v (check REDIS_ADDR, REDIS_USER, REDIS_PASSWORD)", addr, err))
+	} else {
+		d.ok("backend", "connected to Redis at "+addr)
+
+		// A throwaway key proves the credentials allow writes and the
+		// server is not a read-only replica.
+		if err := Rdb.Set(ctx, "url_selfcheck", time.Now().Unix(), 10*time.Second).Err(); err != nil {
+			d.fail("store", fmt.Sprintf("cannot write to Redis: %v", err))
+		} else {
+			Rdb.Del(ctx, "url_selfcheck")
+			d.ok("store", "Redis accepts writes")
+		}
+
+		if redisTime, err := Rdb.Time(ctx).Result(); err != nil {
+			d.checkClock(time.Time{}, "")
+		} else {
+			d.checkClock(redisTime, "the Redis server")
+		}
+	}
+
+	if regionsErr != nil {
+		d.fail("regions", regionsErr.Error())
+	}
+	for name, rdb := range regionClients {
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			d.fail("regions", fmt.Sprintf("cannot reach region %s at %s: %v (check REDIS_REGIONS)", name, rdb.Options().Addr, err))
+		} else {
+			d.ok("regions", fmt.Sprintf("connected to region %s at %s", name, rdb.Options().Addr))
+		}
+	}
+
+	// The setting is not echoed, DATABASE_URL usually holds a password.
+	if s, ok := links.(sqlStore); ok {
+		if err := s.db.PingContext(ctx); err != nil {
+			d.fail("links", fmt.Sprintf("cannot reach %s: %v (check %s)", s.dialect.name, err, s.dialect.setting))
+		} else {
+			d.ok("links", "connected to "+s.dialect.name)
+		}
+	}
+	// store.json is replaced through a temporary file next to it.
+	if s, ok := links.(*jsonStore); ok {
+		if probe, err := os.CreateTemp(filepath.Dir(s.path), ".check-*"); err != nil {
+			d.fail("links", fmt.Sprintf("cannot write next to %s: %v (check STORE_FILE)", s.path, err))
+		} else {
+			probe.Close()
+			os.Remove(probe.Name())
+			d.ok("links", "can write "+s.path)
+		}
+	}
+
+	d.checkListen(config.listenAddr())
+	if config.TLS.enabled() {
+		d.checkTLS(config.TLS)
+	}
+	if config.IPAccessFile != "" {
+		d.checkIPAccess(config.IPAccessFile)
+	}
+	d.checkBaseURL()
+
+	if d.failed {
+		fmt.Println("Self-check failed.")
+		return 1
+	}
+	fmt.Println("Self-check passed.")
+	return 0
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The egress client is shared by every job that fetches user-supplied URLs.
+// It resolves hosts through a small DNS cache, refuses to dial internal
+// addresses, and paces requests with a global token bucket so background
+// fetching can't be turned into a scanner for our own network.
+
+var errEgressBlocked = errors.New("destination resolves to a blocked internal address")
+
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// Cloud metadata services (169.254.169.254, fd00:ec2::254, 100.100.100.200)
+// fall inside the link-local, private and CGNAT ranges checked here.
+func isBlockedIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range egressAllow.prefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// dnsCacheMax bounds the hosts egressDNS remembers. Users pick link
+// destinations, and so the hosts it looks up.
+const dnsCacheMax = 10000
+
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+	ttl     time.Duration
+	max     int
+}
+
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.store(host, addrs)
+	return addrs, nil
+}
+
+// store remembers addrs for host. A full cache first drops its expired
+// entries and, if none had expired, an arbitrary one.
+func (d *dnsCache) store(host string, addrs []netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if _, ok := d.entries[host]; !ok && len(d.entries) >= d.max {
+		for h, entry := range d.entries {
+			if !now.Before(entry.expires) {
+				delete(d.entries, h)
+			}
+		}
+		for h := range d.entries {
+			if len(d.entries) < d.max {
+				break
+			}
+			delete(d.entries, h)
+		}
+	}
+	d.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(d.ttl)}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	burst  float64
+	rate   float64 // tokens per second
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, burst: burst, rate: rate, last: time.Now()}
+}
+
+// wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		_, delay, ok := b.take()
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// take takes a token without waiting for one. It returns the whole tokens
+// left, or false and the time until the next token when there is none.
+func (b *tokenBucket) take() (remaining int, retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return int(b.tokens), 0, true
+}
+
+// full reports whether the bucket has refilled completely, which is the
+// same as a new one.
+func (b *tokenBucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens == b.burst
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// egressAllowlist lets operators reach specific internal hosts or ranges.
+// EGRESS_ALLOW takes a comma-separated list of CIDRs, IPs and hostnames;
+// hosts the operator configures elsewhere (replication primary, alert
+// webhook) are added automatically.
+type egressAllowlist struct {
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+	hosts    map[string]bool
+}
+
+func parseEgressAllow(list []string) *egressAllowlist {
+	allow := &egressAllowlist{hosts: make(map[string]bool)}
+	for _, item := range list {
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			allow.prefixes = append(allow.prefixes, prefix)
+		} else if ip, err := netip.ParseAddr(item); err == nil {
+			allow.prefixes = append(allow.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		} else {
+			allow.hosts[strings.ToLower(item)] = true
+		}
+	}
+	return allow
+}
+
+func (a *egressAllowlist) allowsHost(host string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.hosts[strings.ToLower(host)]
+}
+
+// allowURLHost trusts the host of an operator-configured URL.
+func (a *egressAllowlist) allowURLHost(rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return
+	}
+	a.mu.Lock()
+	a.hosts[strings.ToLower(u.Hostname())] = true
+	a.mu.Unlock()
+}
+
+var (
+	egressAllow   = parseEgressAllow(config.Egress.Allow)
+	egressDNS     = &dnsCache{entries: make(map[string]dnsEntry), ttl: 5 * time.Minute, max: dnsCacheMax}
+	egressLimiter = newTokenBucket(config.Egress.Rate, 20)
+	egressClient  = newEgressClient()
+)
+
+// dialEgress resolves the host itself and dials the vetted IP directly, so
+// a second DNS answer can't swap in an internal address after the check.
+func dialEgress(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := egressDNS.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := egressLimiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	trusted := egressAllow.allowsHost(host)
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	lastErr := errEgressBlocked
+	for _, ip := range addrs {
+		if !trusted && isBlockedIP(ip) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func newEgressClient() *http.Client {
+	transport := &http.Transport{
+		Proxy:                 nil, // a proxy would dial on our behalf and bypass the checks
+		DialContext:           dialEgress,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   4,
+		MaxConnsPerHost:       4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   15 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// checkReachable reports whether a destination answers with a non-error
+// status. Some servers reject HEAD, so a 405 falls back to GET.
+func checkReachable(ctx context.Context, target string) error {
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "url-shortener-verifier/1.0")
+
+		resp, err := egressClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusMethodNotAllowed && method == http.MethodHead {
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("destination returned %s", resp.Status)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// EVENT_STREAM publishes a JSON event for every redirect served, so
+// analytics pipelines can follow clicks as they happen instead of polling
+// the API. It names a Kafka topic, kafka://host:9092[,host2:9092]/topic,
+// or a NATS subject, nats://[user:pass@]host:4222[,host2:4222]/subject.
+// Events are queued and sent in the background, so a slow or unreachable
+// broker never holds up a redirect; when the queue is full they are
+// dropped and counted on /metrics.
+var eventStream, eventStreamErr = newEventStream(config.EventStream)
+
+const (
+	eventStreamQueue   = 10000
+	eventStreamBatch   = 100
+	eventStreamTimeout = 10 * time.Second
+)
+
+// redirectEvent is the message published for a redirect. Visitor details
+// are left out when the visitor's click events are not recorded (consent
+// mode, CLICK_EVENTS=false), as they would be for the click stream in
+// Redis.
+type redirectEvent struct {
+	Type      string    `json:"type"`
+	Code      string    `json:"code"`
+	Time      time.Time `json:"time"`
+	LongURL   string    `json:"long_url"`
+	Variant   *int      `json:"variant,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Weight    int       `json:"weight"` // clicks counted for this redirect: 0 on replicas and sampled-out clicks
+	IPHash    string    `json:"ip_hash,omitempty"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+}
+
+type streamMessage struct {
+	key   string // the code, so a link's events stay on one Kafka partition in order
+	value []byte
+}
+
+// streamPublisher sends batches of messages to a broker.
+type streamPublisher interface {
+	publish(ctx context.Context, msgs []streamMessage) error
+	io.Closer
+}
+
+type eventStreamer struct {
+	target  string // the broker and topic or subject, for logs
+	connect func() (streamPublisher, error)
+	queue   chan streamMessage
+	quit    chan struct{}
+	done    chan struct{}
+
+	sent, dropped, failed atomic.Int64
+}
+
+func newEventStream(raw string) (*eventStreamer, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	scheme, rest, _ := strings.Cut(raw, "://")
+	hosts, name, _ := strings.Cut(rest, "/")
+	if hosts == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("EVENT_STREAM=%q must be kafka://host:port/topic or nats://host:port/subject", raw)
+	}
+	s := &eventStreamer{
+		queue: make(chan streamMessage, eventStreamQueue),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	servers := strings.Split(hosts, ",")
+	switch scheme {
+	case "kafka":
+		s.target = "Kafka topic " + name
+		s.connect = func() (streamPublisher, error) {
+			return kafkaPublisher{&kafka.Writer{
+				Addr:         kafka.TCP(servers...),
+				Topic:        name,
+				Balancer:     &kafka.Hash{},
+				RequiredAcks: kafka.RequireOne,
+				BatchSize:    eventStreamBatch,
+				BatchTimeout: 10 * time.Millisecond,
+			}}, nil
+		}
+	case "nats":
+		s.target = "NATS subject " + name
+		for i, server := range servers {
+			servers[i] = "nats://" + server
+		}
+		s.connect = func() (streamPublisher, error) {
+			// Retrying keeps a broker that is down at startup from
+			// disabling the stream; the client buffers while it reconnects.
+			nc, err := nats.Connect(strings.Join(servers, ","), nats.Name("url-shortener"),
+				nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+			if err != nil {
+				return nil, err
+			}
+			return natsPublisher{nc, name}, nil
+		}
+	default:
+		return nil, fmt.Errorf("EVENT_STREAM=%q must start with kafka:// or nats://", raw)
+	}
+	return s, nil
+}
+
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func (p kafkaPublisher) publish(ctx context.Context, msgs []streamMessage) error {
+	batch := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		batch[i] = kafka.Message{Key: []byte(msg.key), Value: msg.value}
+	}
+	return p.w.WriteMessages(ctx, batch...)
+}
+
+func (p kafkaPublisher) Close() error {
+	return p.w.Close()
+}
+
+type natsPublisher struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func (p natsPublisher) publish(ctx context.Context, msgs []streamMessage) error {
+	for _, msg := range msgs {
+		if err := p.nc.Publish(p.subject, msg.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p natsPublisher) Close() error {
+	err := p.nc.FlushTimeout(eventStreamTimeout)
+	p.nc.Close()
+	return err
+}
+
+// publishRedirect queues the event of a redirect of code to data.LongURL
+// that counted weight clicks.
+func publishRedirect(r *http.Request, ip, code string, data URLData, variant, weight int) {
+	s := eventStream
+	if s == nil {
+		return
+	}
+	ev := redirectEvent{
+		Type:    "redirect",
+		Code:    code,
+		Time:    time.Now().UTC(),
+		LongURL: data.LongURL,
+		Tenant:  data.Tenant,
+		Weight:  weight,
+	}
+	if variant >= 0 {
+		ev.Variant = &variant
+	}
+	if recordClickEvents(r) {
+		loc := geo.visitorLocation(r, ip)
+		ev.IPHash = hashIP(ip)
+		ev.Referrer = r.Referer()
+		ev.UserAgent = r.UserAgent()
+		if len(ev.UserAgent) > maxUserAgentLen {
+			ev.UserAgent = ev.UserAgent[:maxUserAgentLen]
+		}
+		ev.Country, ev.City = loc.Country, loc.City
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("Error encoding redirect event:", err)
+		return
+	}
+	select {
+	case s.queue <- streamMessage{key: code, value: payload}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run sends queued events in batches until stop is called.
+func (s *eventStreamer) run() {
+	defer close(s.done)
+	pub, err := s.connect()
+	if err != nil {
+		log.Printf("Error connecting to %s, redirect events are not published: %v", s.target, err)
+		return
+	}
+	defer pub.Close()
+	log.Println("Publishing redirect events to", s.target)
+
+	var failing bool
+	send := func(batch []streamMessage) {
+		ctx, cancel := context.WithTimeout(context.Background(), eventStreamTimeout)
+		defer cancel()
+		if err := pub.publish(ctx, batch); err != nil {
+			s.failed.Add(int64(len(batch)))
+			if !failing {
+				log.Printf("Error publishing redirect events to %s: %v", s.target, err)
+				failing = true
+			}
+			return
+		}
+		s.sent.Add(int64(len(batch)))
+		if failing {
+			log.Println("Publishing redirect events to", s.target, "again")
+			failing = false
+		}
+	}
+
+	for {
+		select {
+		case msg := <-s.queue:
+			batch := []streamMessage{msg}
+		fill:
+			for len(batch) < eventStreamBatch {
+				select {
+				case msg := <-s.queue:
+					batch = append(batch, msg)
+				default:
+					break fill
+				}
+			}
+			send(batch)
+		case <-s.quit:
+			// Flush what the last redirects queued.
+			for len(s.queue) > 0 {
+				batch := make([]streamMessage, 0, eventStreamBatch)
+				for len(batch) < eventStreamBatch && len(s.queue) > 0 {
+					batch = append(batch, <-s.queue)
+				}
+				send(batch)
+			}
+			return
+		}
+	}
+}
+
+// stop flushes the queued events and waits for run to return. Call it
+// once the server no longer serves redirects.
+func (s *eventStreamer) stop() {
+	close(s.quit)
+	<-s.done
+}
+
+func writeEventStreamMetrics(w io.Writer) {
+	s := eventStream
+	if s == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP urlshortener_event_stream_events_total Redirect events handed to EVENT_STREAM since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_event_stream_events_total counter\n")
+	fmt.Fprintf(w, "urlshortener_event_stream_events_total{result=\"sent\"} %d\n", s.sent.Load())
+	fmt.Fprintf(w, "urlshortener_event_stream_events_total{result=\"failed\"} %d\n", s.failed.Load())
+	fmt.Fprintf(w, "urlshortener_event_stream_events_total{result=\"dropped\"} %d\n", s.dropped.Load())
+	fmt.Fprintf(w, "# HELP urlshortener_event_stream_queued Redirect events waiting to be sent.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_event_stream_queued gauge\n")
+	fmt.Fprintf(w, "urlshortener_event_stream_queued %d\n", len(s.queue))
+}
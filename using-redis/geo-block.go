@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Geo blocking keeps links from working in countries where the campaign
+// behind them may not run. GEO_BLOCK is a deny-list of ISO country codes
+// for every link, and a link's block_countries adds to it. The visitor's
+// country comes from GEOIP_HEADER, a header set by a CDN in front of the
+// service (e.g. CF-IPCountry), or else from GEOIP_DB, a range file or a
+// MaxMind database.
+
+// unknownCountry is the country of visitors neither source can place.
+// Deny-listing it blocks them too.
+const unknownCountry = "XX"
+
+var validCountryRegex = regexp.MustCompile(`^[A-Z][A-Z0-9]$`)
+
+// maxBlockedCountries is more than there are country codes.
+const maxBlockedCountries = 300
+
+func normalizeCountries(countries []string) ([]string, error) {
+	if len(countries) > maxBlockedCountries {
+		return nil, fmt.Errorf("At most %d countries are allowed", maxBlockedCountries)
+	}
+	var normalized []string
+	for _, country := range countries {
+		c := strings.ToUpper(strings.TrimSpace(country))
+		if !validCountryRegex.MatchString(c) {
+			return nil, fmt.Errorf("Country %q must be a two-letter ISO code", country)
+		}
+		if !slices.Contains(normalized, c) {
+			normalized = append(normalized, c)
+		}
+	}
+	return normalized, nil
+}
+
+// geoRange maps the addresses from start to end to a country.
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// geoIPDB is sorted by start.
+type geoIPDB []geoRange
+
+// loadGeoIPDB reads a CSV of "first,last,country" address ranges, the
+// layout of the free DB-IP country file, or "cidr,country" rows. A header
+// row is skipped.
+func loadGeoIPDB(path string) (geoIPDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("GEOIP_DB: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	var db geoIPDB
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GEOIP_DB: %w", err)
+		}
+
+		var rng geoRange
+		switch len(record) {
+		case 2:
+			prefix, perr := netip.ParsePrefix(strings.TrimSpace(record[0]))
+			if perr != nil {
+				err = perr
+				break
+			}
+			rng.start, rng.end = prefix.Masked().Addr().Unmap(), lastAddr(prefix).Unmap()
+		case 3:
+			rng.start, err = netip.ParseAddr(strings.TrimSpace(record[0]))
+			if err == nil {
+				rng.end, err = netip.ParseAddr(strings.TrimSpace(record[1]))
+			}
+			rng.start, rng.end = rng.start.Unmap(), rng.end.Unmap()
+		default:
+			err = errors.New("want first,last,country or cidr,country")
+		}
+		if err != nil && line == 1 {
+			continue // header
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GEOIP_DB line %d: %w", line, err)
+		}
+		rng.country = strings.ToUpper(strings.TrimSpace(record[len(record)-1]))
+		if !validCountryRegex.MatchString(rng.country) {
+			return nil, fmt.Errorf("GEOIP_DB line %d: %q is not a country code", line, rng.country)
+		}
+		db = append(db, rng)
+	}
+	slices.SortFunc(db, func(a, b geoRange) int { return a.start.Compare(b.start) })
+	return db, nil
+}
+
+// lastAddr is the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// geoLocation is where a visitor is. City is only known from a MaxMind
+// database, as "Berlin, DE".
+type geoLocation struct {
+	Country string
+	City    string
+}
+
+// geoLocator finds addresses in GEOIP_DB: a geoIPDB or a maxMindDB.
+type geoLocator interface {
+	// locate returns a zero geoLocation if the address is not covered.
+	locate(addr netip.Addr) geoLocation
+}
+
+func (db geoIPDB) locate(addr netip.Addr) geoLocation {
+	addr = addr.Unmap()
+	i := sort.Search(len(db), func(i int) bool { return db[i].start.Compare(addr) > 0 })
+	if i == 0 || db[i-1].end.Compare(addr) < 0 {
+		return geoLocation{}
+	}
+	return geoLocation{Country: db[i-1].country}
+}
+
+type geoRules struct {
+	header  string     // GEOIP_HEADER
+	db      geoLocator // GEOIP_DB
+	blocked []string   // GEO_BLOCK
+	page    []byte     // GEO_BLOCK_PAGE, served instead of geoBlockedTemplate
+}
+
+// geo is loaded once at startup; a bad setting fails the start with geoErr
+// and -check reports it.
+var geo, geoErr = loadGeoRules()
+
+func loadGeoRules() (*geoRules, error) {
+	rules := &geoRules{header: config.Geo.Header}
+	var err error
+	if path := config.Geo.DB; strings.HasSuffix(path, ".mmdb") {
+		if rules.db, err = openMaxMindDB(path); err != nil {
+			return rules, err
+		}
+	} else if path != "" {
+		if rules.db, err = loadGeoIPDB(path); err != nil {
+			return rules, err
+		}
+	}
+	// loadConfig has checked the list.
+	rules.blocked, _ = normalizeCountries(config.Geo.Block)
+
+	if path := config.Geo.BlockPage; path != "" {
+		if rules.page, err = os.ReadFile(path); err != nil {
+			return rules, fmt.Errorf("GEO_BLOCK_PAGE: %w", err)
+		}
+	}
+	return rules, nil
+}
+
+// configured reports whether visitors can be located at all.
+func (g *geoRules) configured() bool {
+	return g.header != "" || g.db != nil
+}
+
+// visitorCountry locates a visitor. The header wins over the database
+// because the CDN sees the real client, not a proxy.
+func (g *geoRules) visitorCountry(r *http.Request, ip string) (country, source string) {
+	if c := g.headerCountry(r); c != "" {
+		return c, g.header
+	}
+	if c := g.dbLocation(ip).Country; c != "" {
+		return c, "GEOIP_DB"
+	}
+	return unknownCountry, "none"
+}
+
+// visitorLocation locates a visitor for click analytics, like
+// visitorCountry. The database's city is kept only if the header does not
+// place the visitor in another country. It returns a zero geoLocation when
+// neither source is configured.
+func (g *geoRules) visitorLocation(r *http.Request, ip string) geoLocation {
+	if !g.configured() {
+		return geoLocation{}
+	}
+	loc := g.dbLocation(ip)
+	if c := g.headerCountry(r); c != "" && c != loc.Country {
+		loc = geoLocation{Country: c}
+	}
+	if loc.Country == "" {
+		loc.Country = unknownCountry
+	}
+	return loc
+}
+
+func (g *geoRules) headerCountry(r *http.Request) string {
+	if g.header == "" {
+		return ""
+	}
+	if c := strings.ToUpper(strings.TrimSpace(r.Header.Get(g.header))); validCountryRegex.MatchString(c) {
+		return c
+	}
+	return ""
+}
+
+func (g *geoRules) dbLocation(ip string) geoLocation {
+	if g.db == nil {
+		return geoLocation{}
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return geoLocation{}
+	}
+	return g.db.locate(addr)
+}
+
+// applies reports whether redirects of data depend on the visitor's
+// country.
+func (g *geoRules) applies(data URLData) bool {
+	return len(g.blocked) > 0 || len(data.BlockedCountries) > 0
+}
+
+func (g *geoRules) blocks(data URLData, country string) bool {
+	return slices.Contains(g.blocked, country) || slices.Contains(data.BlockedCountries, country)
+}
+
+var geoBlockedTemplate = template.Must(template.New("geo").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Link unavailable - {{.Brand}}</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+h1 { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>This link is not available in your region</h1>
+<p>The content behind this link may not be offered where you are.</p>
+<p><small>{{.Brand}}</small></p>
+{{if .Snippet}}<iframe src="/snippet/{{.Snippet}}/frame" sandbox="allow-scripts" title="" hidden></iframe>{{end}}
+</body>
+</html>
+`))
+
+var bootGeoBlocked atomic.Int64
+
+// blockGeo serves the blocked page when the visitor is in a blocked
+// country, and reports whether it did.
+func blockGeo(c *gin.Context, data URLData) bool {
+	if !geo.applies(data) {
+		return false
+	}
+	if country, _ := geo.visitorCountry(c.Request, c.ClientIP()); !geo.blocks(data, country) {
+		return false
+	}
+	bootGeoBlocked.Add(1)
+	if geo.page != nil {
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusUnavailableForLegalReasons, "text/html; charset=utf-8", geo.page)
+		return true
+	}
+	setPageHeaders(c.Writer.Header())
+	c.Status(http.StatusUnavailableForLegalReasons)
+	if err := geoBlockedTemplate.Execute(c.Writer, newBrandedPage(data)); err != nil {
+		log.Println("Error rendering blocked page:", err)
+	}
+	return true
+}
+
+type blockedCountriesRequest struct {
+	Countries []string `json:"countries"`
+	Version   *int64   `json:"version"`
+}
+
+// blockedCountriesHandle replaces the countries a link is blocked in, on
+// top of GEO_BLOCK, for its owner or an admin. An empty list lifts the
+// link's own block.
+func blockedCountriesHandle(c *gin.Context) {
+	code := c.Param("code")
+	var req blockedCountriesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	countries, err := normalizeCountries(req.Countries)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(countries) > 0 && !geo.configured() {
+		c.JSON(400, gin.H{"error": "Country blocking needs GEOIP_HEADER or GEOIP_DB"})
+		return
+	}
+
+	updated, ok := editLink(c, "link.block_countries", req.Version, func(data *URLData) ([]string, error) {
+		data.BlockedCountries = countries
+		return []string{"blocked_countries"}, nil
+	})
+	if !ok {
+		return
+	}
+	if countries == nil {
+		countries = []string{}
+	}
+	c.JSON(200, gin.H{"code": code, "blocked_countries": countries, "version": updated.Version})
+}
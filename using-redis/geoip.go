@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxMindDB locates addresses with a MaxMind database, such as GeoLite2
+// City or Country, or a compatible one like DB-IP's .mmdb files. Country
+// databases place visitors in countries only.
+type maxMindDB struct {
+	reader *maxminddb.Reader
+}
+
+// maxMindRecord holds the fields read from each lookup.
+type maxMindRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// openMaxMindDB memory-maps the database; it stays open for the life of
+// the process.
+func openMaxMindDB(path string) (*maxMindDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("GEOIP_DB: %w", err)
+	}
+	if !strings.Contains(reader.Metadata.DatabaseType, "City") && !strings.Contains(reader.Metadata.DatabaseType, "Country") {
+		reader.Close()
+		return nil, fmt.Errorf("GEOIP_DB: %s is a %s database, not a City or Country one", path, reader.Metadata.DatabaseType)
+	}
+	return &maxMindDB{reader: reader}, nil
+}
+
+func (db *maxMindDB) locate(addr netip.Addr) geoLocation {
+	var record maxMindRecord
+	if err := db.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		return geoLocation{}
+	}
+	country := strings.ToUpper(record.Country.ISOCode)
+	if !validCountryRegex.MatchString(country) {
+		return geoLocation{}
+	}
+	loc := geoLocation{Country: country}
+	if city := record.City.Names["en"]; city != "" {
+		loc.City = city + ", " + country
+	}
+	return loc
+}
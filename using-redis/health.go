@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// healthKey holds destinations the checker last saw failing, with the time
+// of that check. It is local state and not part of the op log.
+const healthKey = "url_health"
+
+const maxFallbacks = 5
+
+// pickDestination returns the first destination in the chain that is not
+// marked broken. If every one is broken the primary is used anyway, since
+// a stale answer beats none.
+func pickDestination(primary string, fallbacks []string, broken map[string]bool) string {
+	if !broken[primary] {
+		return primary
+	}
+	for _, fallback := range fallbacks {
+		if !broken[fallback] {
+			return fallback
+		}
+	}
+	return primary
+}
+
+// probeDestinations checks each destination once through the egress client.
+func probeDestinations(ctx context.Context, dests []string) map[string]bool {
+	broken := make(map[string]bool, len(dests))
+	for _, dest := range dests {
+		probeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := checkReachable(probeCtx, dest); err != nil {
+			log.Printf("Destination %s is unhealthy: %v", dest, err)
+			broken[dest] = true
+		} else {
+			broken[dest] = false
+		}
+		cancel()
+	}
+	return broken
+}
+
+// BrokenDestinations reports which of dests are currently marked broken.
+// Without Redis none are checked, so none are.
+func BrokenDestinations(dests []string) (map[string]bool, error) {
+	if !config.usesRedis() {
+		return nil, nil
+	}
+	vals, err := Rdb.HMGet(Ctx, healthKey, dests...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	broken := make(map[string]bool)
+	for i, v := range vals {
+		if v != nil {
+			broken[dests[i]] = true
+		}
+	}
+	return broken, nil
+}
+
+// healthyDestination picks where a link with fallbacks should redirect.
+func healthyDestination(data URLData) string {
+	broken, err := BrokenDestinations(append([]string{data.LongURL}, data.Fallbacks...))
+	if err != nil {
+		log.Println("Error reading destination health:", err)
+		return data.LongURL
+	}
+	return pickDestination(data.LongURL, data.Fallbacks, broken)
+}
+
+// checkDestinations probes every destination of links that have fallbacks
+// and records the result. Links without fallbacks are never probed.
+func checkDestinations(ctx context.Context) error {
+	seen := make(map[string]bool)
+	var dests []string
+	err := ForEachURL(func(code string, data URLData) error {
+		if len(data.Fallbacks) == 0 {
+			return nil
+		}
+		for _, dest := range append([]string{data.LongURL}, data.Fallbacks...) {
+			if !seen[dest] {
+				seen[dest] = true
+				dests = append(dests, dest)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	results := probeDestinations(ctx, dests)
+
+	known, err := Rdb.HKeys(Ctx, healthKey).Result()
+	if err != nil {
+		return err
+	}
+	pipe := Rdb.TxPipeline()
+	for dest, broken := range results {
+		if broken {
+			pipe.HSet(Ctx, healthKey, dest, time.Now().Unix())
+		} else {
+			pipe.HDel(Ctx, healthKey, dest)
+		}
+	}
+	// Forget destinations no link points at any more.
+	for _, dest := range known {
+		if !seen[dest] {
+			pipe.HDel(Ctx, healthKey, dest)
+		}
+	}
+	_, err = pipe.Exec(Ctx)
+	return err
+}
+
+func startHealthChecker(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := checkDestinations(Ctx); err != nil {
+				log.Println("Error checking destinations:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
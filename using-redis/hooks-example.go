@@ -0,0 +1,45 @@
+//go:build examplehooks
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Build with `go build -tags examplehooks` to enable this sample policy:
+// it logs every lifecycle event and refuses links to plain-http targets.
+type exampleHooks struct {
+	NopHooks
+}
+
+func init() {
+	RegisterHooks(exampleHooks{})
+}
+
+func (exampleHooks) OnCreate(ctx context.Context, code string, data URLData) error {
+	if strings.HasPrefix(data.LongURL, "http://") {
+		return errors.New("only https destinations are allowed")
+	}
+	log.Printf("hook: created %s -> %s", code, data.LongURL)
+	return nil
+}
+
+func (exampleHooks) OnRedirect(ctx context.Context, code string, data URLData, r *http.Request) error {
+	if IsTraceRequest(ctx) {
+		return nil // a /debug/trace simulation, not a visitor
+	}
+	log.Printf("hook: redirect %s from %s", code, r.RemoteAddr)
+	return nil
+}
+
+func (exampleHooks) OnDelete(ctx context.Context, code string) {
+	log.Printf("hook: deleted %s", code)
+}
+
+func (exampleHooks) OnExpire(ctx context.Context, code string) {
+	log.Printf("hook: expired %s", code)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// LinkHooks lets custom builds observe or veto link lifecycle events
+// without patching handlers. Register an implementation from an init
+// function in a file of your own; embed NopHooks to implement only the
+// events you care about. Errors from OnCreate and OnRedirect reject the
+// request with 403, the other events are notifications only. OnCreate
+// also vets the new destination of an edited link. OnRedirect also runs
+// for /debug/trace simulations; see IsTraceRequest.
+type LinkHooks interface {
+	OnCreate(ctx context.Context, code string, data URLData) error
+	OnRedirect(ctx context.Context, code string, data URLData, r *http.Request) error
+	OnDelete(ctx context.Context, code string)
+	OnExpire(ctx context.Context, code string)
+}
+
+// NopHooks implements every hook as a no-op.
+type NopHooks struct{}
+
+func (NopHooks) OnCreate(context.Context, string, URLData) error                  { return nil }
+func (NopHooks) OnRedirect(context.Context, string, URLData, *http.Request) error { return nil }
+func (NopHooks) OnDelete(context.Context, string)                                 {}
+func (NopHooks) OnExpire(context.Context, string)                                 {}
+
+// ErrRejected wraps errors returned by a hook that vetoed a request.
+var ErrRejected = errors.New("rejected by policy")
+
+var registeredHooks []LinkHooks
+
+// RegisterHooks adds h to the hook chain. It is meant to be called from
+// init functions, before the server starts.
+func RegisterHooks(h LinkHooks) {
+	registeredHooks = append(registeredHooks, h)
+}
+
+func runCreateHooks(ctx context.Context, code string, data URLData) error {
+	for _, h := range registeredHooks {
+		if err := h.OnCreate(ctx, code, data); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+	return nil
+}
+
+func runRedirectHooks(ctx context.Context, code string, data URLData, r *http.Request) error {
+	for _, h := range registeredHooks {
+		if err := h.OnRedirect(ctx, code, data, r); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+	return nil
+}
+
+func runDeleteHooks(ctx context.Context, code string) {
+	for _, h := range registeredHooks {
+		h.OnDelete(ctx, code)
+	}
+}
+
+func runExpireHooks(ctx context.Context, code string) {
+	for _, h := range registeredHooks {
+		h.OnExpire(ctx, code)
+	}
+}
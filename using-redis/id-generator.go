@@ -0,0 +1,189 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IDGenerator hands out the IDs behind generated codes. codes.generator
+// (ID_GENERATOR) picks the implementation.
+type IDGenerator interface {
+	NextID() (int64, error)
+}
+
+const (
+	idGenCounter   = "counter"   // one shared counter, the default
+	idGenBlock     = "block"     // ranges reserved from the counter, Redis mode only
+	idGenRandom    = "random"    // random IDs of a fixed code length
+	idGenSnowflake = "snowflake" // timestamp, node and sequence; no shared state
+)
+
+// Alphabets of codes.alphabet, their digits in order of value. base58
+// leaves out 0, O, I and l, and unambiguous also 1, i and o, so codes
+// read out or typed from print are not mistaken for others.
+const (
+	alphabetBase62      = "base62"
+	alphabetBase58      = "base58"
+	alphabetUnambiguous = "unambiguous"
+)
+
+var codeAlphabets = map[string]string{
+	alphabetBase62:      "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	alphabetBase58:      "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+	alphabetUnambiguous: "23456789abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ",
+}
+
+// codeDigits are the digits of generated codes. loadConfig rejects unknown
+// alphabets; base62 stands in when the config did not load.
+var codeDigits = cmp.Or(codeAlphabets[config.Codes.Alphabet], codeAlphabets[alphabetBase62])
+
+// maxIDAttempts bounds how often a generated code that is already taken is
+// replaced by a new one. nextCode skips stored codes, so this only takes a
+// code claimed between its check and the write.
+const maxIDAttempts = 5
+
+// maxTakenCodes bounds how many taken codes in a row nextCode skips. A run
+// that long means the random code space is nearly full, or a range of
+// custom codes sits right ahead of the counter.
+const maxTakenCodes = 100
+
+// randomGenerator draws IDs whose encoding is exactly length characters
+// long.
+type randomGenerator struct {
+	low, span int64
+}
+
+func newRandomGenerator(length int) randomGenerator {
+	base := int64(len(codeDigits))
+	low := int64(1)
+	for i := 1; i < length; i++ {
+		low *= base
+	}
+	return randomGenerator{low: low, span: low*base - low}
+}
+
+func (g randomGenerator) NextID() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(g.span))
+	if err != nil {
+		return 0, err
+	}
+	return g.low + n.Int64(), nil
+}
+
+// Snowflake IDs are a millisecond timestamp since snowflakeEpoch, the node
+// ID and a per-millisecond sequence, in that order, so nodes never need to
+// coordinate and codes still grow over time.
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type snowflakeGenerator struct {
+	node int64
+
+	mu     sync.Mutex
+	lastMs int64
+	seq    int64
+}
+
+func (g *snowflakeGenerator) NextID() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := time.Since(snowflakeEpoch).Milliseconds()
+	if ms < g.lastMs {
+		// The clock went back; an ID from here could repeat one.
+		if g.lastMs-ms > 1000 {
+			return 0, fmt.Errorf("clock moved back %dms, refusing to generate IDs", g.lastMs-ms)
+		}
+		ms = g.lastMs
+	}
+	if ms == g.lastMs {
+		g.seq = (g.seq + 1) & snowflakeMaxSeq
+		if g.seq == 0 {
+			// Sequence exhausted for this millisecond.
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+	return ms<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq, nil
+}
+
+// counterGenerator is the shared url_id_counter, one INCR per code.
+type counterGenerator struct{}
+
+func (counterGenerator) NextID() (int64, error) {
+	return GetNextID()
+}
+
+// reserveBlockScript moves the counter past a whole block and logs it like
+// any other counter change, so replicas and backups see the new value.
+var reserveBlockScript = redis.NewScript(`
+local last = redis.call("INCRBY", KEYS[1], ARGV[1])
+redis.call("XADD", KEYS[2], "*", "op", "counter", "id_counter", last)
+return last
+`)
+
+// blockGenerator reserves size IDs from the counter at a time and hands
+// them out locally, so only one in size codes costs a round trip. IDs left
+// in a block when the process stops are skipped, never reused.
+type blockGenerator struct {
+	size int64
+
+	mu   sync.Mutex
+	next int64
+	last int64
+}
+
+func (g *blockGenerator) NextID() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next == 0 || g.next > g.last {
+		last, err := reserveBlockScript.Run(Ctx, Rdb, []string{counterKey, oplogKey}, g.size).Int64()
+		if err != nil {
+			return 0, err
+		}
+		g.next, g.last = last-g.size+1, last
+	}
+	id := g.next
+	g.next++
+	return id, nil
+}
+
+// newIDGenerator builds the generator c names. loadConfig has checked the
+// name and the sizes already.
+func newIDGenerator(c CodeConfig) (IDGenerator, error) {
+	switch c.Generator {
+	case idGenBlock:
+		if !redisBackend() {
+			return nil, fmt.Errorf("code generator block needs STORE_BACKEND=redis")
+		}
+		return &blockGenerator{size: c.BlockSize}, nil
+	case idGenRandom:
+		return newRandomGenerator(c.RandomLength), nil
+	case idGenSnowflake:
+		return &snowflakeGenerator{node: c.Node}, nil
+	default:
+		return counterGenerator{}, nil
+	}
+}
+
+// idGenerator is nil when the configuration is invalid; main refuses to
+// start with idGeneratorErr and -check reports it.
+var idGenerator, idGeneratorErr = newIDGenerator(config.Codes)
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// An Idempotency-Key header on POST /shorten lets a client retry after a
+// timeout or a 5xx without creating the link twice. The first successful
+// response for a key is kept for idempotencyTTL and replayed, marked with
+// Idempotent-Replayed: true, to later requests with the same key and body.
+// Keys are scoped to the caller's Authorization, X-API-Key and X-Tenant
+// headers and to the user signed in through the auth proxy.
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	idempotencyTTL       = 24 * time.Hour
+	maxIdempotencyKeyLen = 255
+)
+
+// idempotencyLease bounds how long a request that never finishes, e.g.
+// because the process died, keeps its key busy.
+const idempotencyLease = time.Minute
+
+var (
+	errIdempotencyKeyTooLong = fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)
+	errIdempotencyInProgress = errors.New("A request with this Idempotency-Key is still in progress")
+	errIdempotencyMismatch   = errors.New("This Idempotency-Key was already used with a different request")
+)
+
+// idempotentResponse is a stored response. Status is 0 while the first
+// request with the key is still running.
+type idempotentResponse struct {
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// idempotencyScope is the storage key of an Idempotency-Key, so two
+// callers picking the same key do not see each other's links.
+func idempotencyScope(r *http.Request, key string) string {
+	scope := r.Header.Get("Authorization") + "\x00" + r.Header.Get(tenantHeader) + "\x00" + key
+	if user := proxyUser(r); user != "" {
+		scope += "\x00" + user
+	}
+	if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+		scope += "\x00" + apiKey
+	}
+	sum := sha256.Sum256([]byte(scope))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint ties a key to the request it was first used with.
+func requestFingerprint(r *http.Request, raw []byte) string {
+	sum := sha256.Sum256(append([]byte(r.URL.Path+"\x00"), raw...))
+	return hex.EncodeToString(sum[:])
+}
+
+// replay checks a stored response against a new request with the same
+// key.
+func (stored idempotentResponse) replay(fingerprint string) error {
+	if stored.Fingerprint != fingerprint {
+		return errIdempotencyMismatch
+	}
+	if stored.Status == 0 {
+		return errIdempotencyInProgress
+	}
+	return nil
+}
+
+func writeIdempotentReplay(w http.ResponseWriter, stored idempotentResponse) {
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// idempotencyStatus is the status of a request that cannot use its key.
+// A key still in progress is worth retrying shortly.
+func idempotencyStatus(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, errIdempotencyInProgress):
+		w.Header().Set("Retry-After", "1")
+		return http.StatusConflict
+	case errors.Is(err, errIdempotencyMismatch):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// idempotencyPrefix keys hold an idempotentResponse as a hash, which link
+// scans skip as they do every key that is not a link string.
+const idempotencyPrefix = "url_idempotency:"
+
+// claimIdempotencyScript takes a key for a request unless an earlier one
+// holds it.
+var claimIdempotencyScript = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], "fingerprint", ARGV[1]) == 0 then
+	return 0
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+func loadIdempotentResponse(key string) (idempotentResponse, error) {
+	fields, err := Rdb.HGetAll(Ctx, key).Result()
+	if err != nil {
+		return idempotentResponse{}, err
+	}
+	status, _ := strconv.Atoi(fields["status"])
+	return idempotentResponse{
+		Fingerprint: fields["fingerprint"],
+		Status:      status,
+		ContentType: fields["content_type"],
+		Body:        []byte(fields["body"]),
+	}, nil
+}
+
+// bodyCapture keeps a copy of what a handler writes.
+type bodyCapture struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyCapture) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyCapture) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyMiddleware replays the stored response of a request that
+// repeats an Idempotency-Key, and stores the response of the first one.
+// Requests without the header pass straight through.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			c.AbortWithStatusJSON(idempotencyStatus(c.Writer, errIdempotencyKeyTooLong), gin.H{"error": errIdempotencyKeyTooLong.Error()})
+			return
+		}
+		raw, err := io.ReadAll(c.Request.Body)
+		if bodyTooLarge(err) {
+			c.AbortWithStatusJSON(413, gin.H{"error": bodyTooLargeMessage()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+
+		storeKey := idempotencyPrefix + idempotencyScope(c.Request, key)
+		fingerprint := requestFingerprint(c.Request, raw)
+		claimed, err := claimIdempotencyScript.Run(Ctx, Rdb, []string{storeKey}, fingerprint, idempotencyLease.Milliseconds()).Int()
+		if err != nil {
+			storeError(c, err)
+			c.Abort()
+			return
+		}
+		if claimed == 0 {
+			stored, err := loadIdempotentResponse(storeKey)
+			if err == nil {
+				err = stored.replay(fingerprint)
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(idempotencyStatus(c.Writer, err), gin.H{"error": err.Error()})
+				return
+			}
+			writeIdempotentReplay(c.Writer, stored)
+			c.Abort()
+			return
+		}
+
+		capture := &bodyCapture{ResponseWriter: c.Writer}
+		c.Writer = capture
+		c.Next()
+
+		// Only successes are kept; after a failure the client may try
+		// again with the same key.
+		status := capture.Status()
+		if status < 200 || status > 299 {
+			Rdb.Del(Ctx, storeKey)
+			return
+		}
+		_, err = Rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(Ctx, storeKey, "status", status, "content_type", capture.Header().Get("Content-Type"), "body", capture.body.Bytes())
+			pipe.Expire(Ctx, storeKey, idempotencyTTL)
+			return nil
+		})
+		if err != nil {
+			log.Println("Error storing idempotent response:", err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// adminToken authenticates admin-only endpoints (Authorization: Bearer),
+// as does the token of a user with the admin role.
+var adminToken = config.AdminToken
+
+// isAdminToken reports whether the request carries ADMIN_TOKEN itself;
+// isAdmin also accepts admin users.
+func isAdminToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && adminToken != "" && hmac.Equal([]byte(token), []byte(adminToken))
+}
+
+// Support staff act for a user by sending an impersonation token, minted
+// by an admin, in this header.
+const impersonationHeader = "X-Impersonation-Token"
+
+const (
+	maxImpersonationTTL = 3600
+	scopeLinksCreate    = "links:create"
+	scopeLinksUpdate    = "links:update"
+	scopeLinksDelete    = "links:delete"
+	scopeLinksRead      = "links:read"
+)
+
+var (
+	impersonationScopes = []string{scopeLinksCreate, scopeLinksUpdate, scopeLinksDelete, scopeLinksRead}
+	validUserRegex      = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+	errImpersonation    = errors.New("invalid or expired impersonation token")
+)
+
+type impersonationClaims struct {
+	ID      string   `json:"id"`
+	User    string   `json:"user"`
+	Scopes  []string `json:"scopes"`
+	Reason  string   `json:"reason"`
+	Expires int64    `json:"exp"`
+}
+
+type impersonationRequest struct {
+	User       string   `json:"user"`
+	Scopes     []string `json:"scopes"`
+	Reason     string   `json:"reason"`
+	TTLSeconds int64    `json:"ttl_seconds"`
+}
+
+func (req impersonationRequest) validate() []fieldError {
+	var errs []fieldError
+	if !validUserRegex.MatchString(req.User) {
+		errs = append(errs, fieldError{"user", "format", "User must be 1-64 letters, numbers or _.@-"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, fieldError{"scopes", "required", "At least one scope is required"})
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(impersonationScopes, scope) {
+			errs = append(errs, fieldError{"scopes", "enum", "Scopes must be links:create, links:update or links:delete"})
+			break
+		}
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		errs = append(errs, fieldError{"reason", "required", "A reason is required for the audit log"})
+	}
+	if req.TTLSeconds < 0 || req.TTLSeconds > maxImpersonationTTL {
+		errs = append(errs, fieldError{"ttl_seconds", "max", fmt.Sprintf("ttl_seconds must be between 1 and %d", maxImpersonationTTL)})
+	}
+	return errs
+}
+
+func impersonationMAC(payload string) []byte {
+	key := sha256.Sum256([]byte("impersonation:" + adminToken))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signImpersonation returns payload.signature, both base64url. Tokens are
+// bound to ADMIN_TOKEN, so rotating it revokes every outstanding token.
+func signImpersonation(claims impersonationClaims) (string, error) {
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(impersonationMAC(payload)), nil
+}
+
+func verifyImpersonation(token string) (impersonationClaims, error) {
+	var claims impersonationClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || adminToken == "" {
+		return claims, errImpersonation
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, impersonationMAC(payload)) {
+		return claims, errImpersonation
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return claims, errImpersonation
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, errImpersonation
+	}
+	return claims, nil
+}
+
+func newImpersonation(req impersonationRequest) (impersonationClaims, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return impersonationClaims{}, "", err
+	}
+
+	ttl := req.TTLSeconds
+	if ttl == 0 {
+		ttl = 900 // 15 minutes
+	}
+	claims := impersonationClaims{
+		ID:      hex.EncodeToString(id),
+		User:    req.User,
+		Scopes:  req.Scopes,
+		Reason:  req.Reason,
+		Expires: time.Now().Unix() + ttl,
+	}
+	token, err := signImpersonation(claims)
+	return claims, token, err
+}
+
+// auditEntry records who did what. Impersonated actions carry both the
+// admin ("actor") and the user they acted for.
+type auditEntry struct {
+	Time          int64  `json:"time"`
+	Actor         string `json:"actor"`
+	OnBehalfOf    string `json:"on_behalf_of,omitempty"`
+	Impersonation string `json:"impersonation,omitempty"`
+	Action        string `json:"action"`
+	Code          string `json:"code,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+func impersonatedAudit(claims impersonationClaims, action, code string) auditEntry {
+	return auditEntry{
+		Time:          time.Now().Unix(),
+		Actor:         "admin",
+		OnBehalfOf:    claims.User,
+		Impersonation: claims.ID,
+		Action:        action,
+		Code:          code,
+		Detail:        claims.Reason,
+	}
+}
+
+// auditKey is an append-only stream; nothing in the app trims it.
+const auditKey = "url_audit"
+
+// AppendAudit writes an entry to the audit stream, or without Redis to the
+// server log.
+func AppendAudit(entry auditEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if !config.usesRedis() {
+		log.Println("Audit:", string(raw))
+		return nil
+	}
+	return Rdb.XAdd(Ctx, &redis.XAddArgs{
+		Stream: auditKey,
+		Values: map[string]any{"entry": string(raw)},
+	}).Err()
+}
+
+// RecentAudit returns up to limit entries, newest first.
+func RecentAudit(limit int64) ([]auditEntry, error) {
+	msgs, err := Rdb.XRevRangeN(Ctx, auditKey, "+", "-", limit).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]auditEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		var entry auditEntry
+		raw, _ := msg.Values["entry"].(string)
+		if err := json.Unmarshal([]byte(raw), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func adminGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ipPermitted(c.ClientIP(), true) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Access from your address is not allowed"})
+			return
+		}
+		if adminToken == "" && jwtSecret == "" {
+			c.AbortWithStatusJSON(503, gin.H{"error": "Admin API disabled: ADMIN_TOKEN is not set"})
+			return
+		}
+		if !isAdmin(c.Request) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// signedInGuard refuses anonymous requests. Admins pass, and so do users
+// from a token, the auth proxy or an impersonation token, and requests
+// whose API key apiKeyGuard verified, whom handlers limit to their own
+// links.
+func signedInGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if requestUser(c) != "" || isAdmin(c.Request) {
+			c.Next()
+			return
+		}
+		if _, ok := impersonation(c); ok || c.GetString(apiKeyContextKey) != "" {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(401, gin.H{"error": "Sign in, or use the admin token"})
+	}
+}
+
+// impersonationGuard lets a request carrying an impersonation token through
+// only if the token grants scope. Requests without the header are untouched.
+func impersonationGuard(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader(impersonationHeader)
+		if token == "" {
+			c.Next()
+			return
+		}
+		claims, err := verifyImpersonation(token)
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid or expired impersonation token"})
+			return
+		}
+		if !slices.Contains(claims.Scopes, scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Impersonation token does not grant " + scope})
+			return
+		}
+		if deleted, err := OwnerDeleted(claims.User); err != nil {
+			storeError(c, err)
+			c.Abort()
+			return
+		} else if deleted {
+			c.AbortWithStatusJSON(403, gin.H{"error": "User " + claims.User + " is deleted"})
+			return
+		}
+		c.Set("impersonation", claims)
+		c.Next()
+	}
+}
+
+func impersonation(c *gin.Context) (impersonationClaims, bool) {
+	claims, ok := c.Get("impersonation")
+	if !ok {
+		return impersonationClaims{}, false
+	}
+	return claims.(impersonationClaims), true
+}
+
+// auditImpersonated records an action taken with an impersonation token.
+// An audit failure is logged rather than undoing the action.
+func auditImpersonated(c *gin.Context, action, code string) {
+	claims, ok := impersonation(c)
+	if !ok {
+		return
+	}
+	if err := AppendAudit(impersonatedAudit(claims, action, code)); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+func impersonateHandle(c *gin.Context) {
+	var req impersonationRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+
+	if deleted, err := OwnerDeleted(req.User); err != nil {
+		storeError(c, err)
+		return
+	} else if deleted {
+		c.JSON(400, gin.H{"error": "User " + req.User + " is deleted"})
+		return
+	}
+
+	claims, token, err := newImpersonation(req)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to issue token"})
+		return
+	}
+
+	// Refuse to hand out a token that would leave no trace.
+	entry := impersonatedAudit(claims, "impersonation.start", "")
+	entry.Detail = fmt.Sprintf("%s (scopes %s, expires %s)", claims.Reason, strings.Join(claims.Scopes, ","), formatUnix(claims.Expires))
+	if err := AppendAudit(entry); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"id":         claims.ID,
+		"user":       claims.User,
+		"scopes":     claims.Scopes,
+		"expires_at": formatUnix(claims.Expires),
+	})
+}
+
+func auditHandle(c *gin.Context) {
+	limit := int64(100)
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(400, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+
+	entries, err := RecentAudit(limit)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(200, entries)
+}
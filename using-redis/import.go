@@ -0,0 +1,545 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// CSV imports run as background jobs. The upload is saved under IMPORT_DIR
+// and processed row by row; progress is checkpointed as a byte offset into
+// the file, so a failed or interrupted job resumes where it stopped.
+
+const (
+	importRunning = "running"
+	importDone    = "done"
+	importFailed  = "failed"
+)
+
+// importCheckpointRows is how often progress is saved.
+const importCheckpointRows = 100
+
+// importMaxErrors caps the row errors kept on a job.
+const importMaxErrors = 20
+
+// importStallTimeout is how long a running job may go without a checkpoint
+// before it counts as failed, e.g. because its process died.
+const importStallTimeout = 5 * time.Minute
+
+type importRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+type importJob struct {
+	ID        string           `json:"id"`
+	Status    string           `json:"status"`
+	Columns   []string         `json:"columns"`
+	Size      int64            `json:"size"`   // bytes in the file
+	Offset    int64            `json:"offset"` // bytes processed at the last checkpoint
+	Row       int              `json:"row"`    // data rows processed at the last checkpoint
+	Created   int              `json:"created"`
+	Skipped   int              `json:"skipped"`   // rows that failed validation or were taken
+	Conflicts int              `json:"conflicts"` // skipped rows whose code was taken
+	Errors    []importRowError `json:"errors,omitempty"`
+	Error     string           `json:"error,omitempty"` // why the job failed
+	StartedAt int64            `json:"started_at"`
+	UpdatedAt int64            `json:"updated_at"`
+	IP        string           `json:"ip"` // of the uploader, copied to each link's source
+	UserAgent string           `json:"user_agent,omitempty"`
+}
+
+// effectiveStatus reports a running job that stopped checkpointing as
+// failed.
+func (j *importJob) effectiveStatus(now time.Time) string {
+	if j.Status == importRunning && now.Unix()-j.UpdatedAt > int64(importStallTimeout/time.Second) {
+		return importFailed
+	}
+	return j.Status
+}
+
+func (j *importJob) view(now time.Time) map[string]any {
+	progress := 1.0
+	if j.Size > 0 {
+		progress = float64(j.Offset) / float64(j.Size)
+	}
+	view := map[string]any{
+		"id":         j.ID,
+		"status":     j.effectiveStatus(now),
+		"rows":       j.Row,
+		"created":    j.Created,
+		"skipped":    j.Skipped,
+		"conflicts":  j.Conflicts,
+		"progress":   math.Round(progress*1000) / 1000,
+		"started_at": time.Unix(j.StartedAt, 0).UTC().Format(time.RFC3339),
+		"updated_at": time.Unix(j.UpdatedAt, 0).UTC().Format(time.RFC3339),
+		"errors":     j.Errors,
+	}
+	if j.Error != "" {
+		view["error"] = j.Error
+	} else if view["status"] == importFailed {
+		view["error"] = "no progress for " + importStallTimeout.String()
+	}
+	return view
+}
+
+func (j *importJob) skip(row int, message string) {
+	j.Skipped++
+	if len(j.Errors) < importMaxErrors {
+		j.Errors = append(j.Errors, importRowError{Row: row, Message: message})
+	}
+}
+
+// conflict skips a row whose code is taken. Conflicts are counted apart
+// from other skips, since moving an inventory in means giving those links
+// new codes.
+func (j *importJob) conflict(row int, code string) {
+	j.Conflicts++
+	if code == "" {
+		j.skip(row, "Short code already in use")
+		return
+	}
+	j.skip(row, fmt.Sprintf("Short code %q already in use", code))
+}
+
+func importPath(id string) string {
+	return filepath.Join(config.Import.Dir, id+".csv")
+}
+
+var validImportIDRegex = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// newImportJob saves the upload in body and reads its header. The file is
+// removed again if the header is unusable.
+func newImportJob(body io.Reader, ip, userAgent string) (*importJob, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	job := &importJob{ID: hex.EncodeToString(id), Status: importRunning, IP: ip, UserAgent: userAgent}
+
+	if err := os.MkdirAll(config.Import.Dir, 0755); err != nil {
+		return nil, err
+	}
+	path := importPath(job.ID)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	job.Size, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	if err := job.readHeader(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	job.StartedAt = time.Now().Unix()
+	job.UpdatedAt = job.StartedAt
+	return job, nil
+}
+
+// errImportHeader marks uploads the caller has to fix.
+var errImportHeader = errors.New("the first CSV row must name the columns and include url or long_url")
+
+// importColumnAliases map the column names of other shorteners' exports,
+// such as Bitly's long_url and link, to ours.
+var importColumnAliases = map[string]string{
+	"long_url": "url",
+	"code":     "custom_code",
+	"link":     "custom_code",
+}
+
+func (j *importJob) readHeader() error {
+	f, err := os.Open(importPath(j.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return errImportHeader
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff") // spreadsheet exports start with a BOM
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		header[i] = cmp.Or(importColumnAliases[header[i]], header[i])
+	}
+	if !slices.Contains(header, "url") {
+		return errImportHeader
+	}
+	j.Columns = header
+	j.Offset = r.InputOffset()
+	return nil
+}
+
+// importRequest turns a row into the request /shorten would get. Tags are
+// separated by semicolons. A custom code may be given as the whole short
+// URL, as exports list them.
+func (j *importJob) importRequest(record []string) (shortenRequest, error) {
+	var body shortenRequest
+	for i, value := range record {
+		if i >= len(j.Columns) {
+			break
+		}
+		value = strings.TrimSpace(value)
+		switch j.Columns[i] {
+		case "url":
+			body.URL = value
+		case "custom_code":
+			body.CustomCode = importCode(value)
+		case "expiry_seconds":
+			if value == "" {
+				continue
+			}
+			n, err := parseExpirySeconds(value)
+			if err != nil {
+				return body, fmt.Errorf("expiry_seconds %q is not a number or never", value)
+			}
+			body.ExpirySeconds = n
+		case "expiry":
+			n, err := importExpiry(value, time.Now())
+			if err != nil {
+				return body, err
+			}
+			body.ExpirySeconds = n
+		case "tags":
+			for _, tag := range strings.Split(value, ";") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					body.Tags = append(body.Tags, tag)
+				}
+			}
+		}
+	}
+	return body, nil
+}
+
+// importCode is the code of a short URL like https://bit.ly/abc, or value
+// itself if it is not one.
+func importCode(value string) string {
+	if u, err := url.Parse(value); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return strings.Trim(u.Path, "/")
+	}
+	return value
+}
+
+// importExpiry reads the expiry column: seconds, "never", a duration like
+// 720h, or the time or date (UTC) the link expires at, as seconds from now.
+func importExpiry(value string, now time.Time) (expirySeconds, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if n, err := parseExpirySeconds(value); err == nil {
+		return n, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return expirySeconds(d / time.Second), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		at, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if !at.After(now) {
+			return 0, fmt.Errorf("expired at %s", at.UTC().Format(time.RFC3339))
+		}
+		return expirySeconds(math.Ceil(at.Sub(now).Seconds())), nil
+	}
+	return 0, fmt.Errorf("expiry %q is not seconds, a duration or a time", value)
+}
+
+// importSource is the source recorded on the link created from row.
+func (j *importJob) importSource(row int) *linkSource {
+	return &linkSource{Channel: sourceImport, Batch: j.ID, Row: row, IP: j.IP, UserAgent: j.UserAgent}
+}
+
+// importReader opens the job's file at its last checkpoint. offset reports
+// the position after the last record read.
+func (j *importJob) importReader() (f *os.File, r *csv.Reader, offset func() int64, err error) {
+	f, err = os.Open(importPath(j.ID))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := f.Seek(j.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	r = csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	base := j.Offset
+	return f, r, func() int64 { return base + r.InputOffset() }, nil
+}
+
+// importsKey maps each job ID to the job as JSON. Job files live on the
+// instance that took the upload, so resume there.
+const importsKey = "url_imports"
+
+var errImportNotResumable = errors.New("only failed imports can be resumed")
+
+func saveImportJob(job *importJob) error {
+	jsonData, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return Rdb.HSet(Ctx, importsKey, job.ID, jsonData).Err()
+}
+
+func getImportJob(id string) (*importJob, error) {
+	raw, err := Rdb.HGet(Ctx, importsKey, id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job importJob
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// claimImportJob marks a failed job running again. WATCH makes sure two
+// resumes cannot both win.
+func claimImportJob(id string) (*importJob, error) {
+	var job *importJob
+	err := Rdb.Watch(Ctx, func(tx *redis.Tx) error {
+		raw, err := tx.HGet(Ctx, importsKey, id).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		job = &importJob{}
+		if err := json.Unmarshal(raw, job); err != nil {
+			return err
+		}
+		if job.effectiveStatus(time.Now()) != importFailed {
+			return errImportNotResumable
+		}
+
+		job.Status, job.Error, job.UpdatedAt = importRunning, "", time.Now().Unix()
+		jsonData, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(Ctx, importsKey, id, jsonData)
+			return nil
+		})
+		return err
+	}, importsKey)
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil, errImportNotResumable
+	}
+	return job, err
+}
+
+// importedRows finds rows past the last checkpoint whose links were
+// created before the job stopped, so a resume does not create them twice.
+func importedRows(job *importJob) (map[int]bool, error) {
+	done := make(map[int]bool)
+	err := ForEachURL(func(code string, data URLData) error {
+		if data.Source != nil && data.Source.Batch == job.ID && data.Source.Row > job.Row {
+			done[data.Source.Row] = true
+		}
+		return nil
+	})
+	return done, err
+}
+
+// runImport processes job to the end. resumed jobs first look for rows
+// created after their last checkpoint.
+func runImport(job *importJob, resumed bool) {
+	err := importRows(job, resumed)
+	if err != nil {
+		job.Status, job.Error = importFailed, err.Error()
+		log.Printf("Import %s failed after row %d: %v", job.ID, job.Row, err)
+	} else {
+		job.Status = importDone
+		os.Remove(importPath(job.ID))
+		log.Printf("Import %s done: %d created, %d skipped.", job.ID, job.Created, job.Skipped)
+	}
+	job.UpdatedAt = time.Now().Unix()
+	if err := saveImportJob(job); err != nil {
+		log.Println("Error saving import job:", err)
+	}
+}
+
+// importRows creates a link per row from the last checkpoint on. Rows that
+// are invalid or taken are skipped; a storage error stops the job.
+func importRows(job *importJob, resumed bool) error {
+	var done map[int]bool
+	if resumed {
+		var err error
+		if done, err = importedRows(job); err != nil {
+			return err
+		}
+	}
+	f, r, offset, err := job.importReader()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		row := job.Row + 1
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			job.skip(row, parseErr.Err.Error())
+		case err != nil:
+			return err
+		case done[row]:
+			job.Created++
+		default:
+			if err := job.importRow(row, record); err != nil {
+				return err
+			}
+		}
+
+		job.Row, job.Offset = row, offset()
+		if row%importCheckpointRows == 0 {
+			job.UpdatedAt = time.Now().Unix()
+			if err := saveImportJob(job); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (j *importJob) importRow(row int, record []string) error {
+	body, err := j.importRequest(record)
+	if err != nil {
+		j.skip(row, err.Error())
+		return nil
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		j.skip(row, errs[0].Message)
+		return nil
+	}
+	body.source = j.importSource(row)
+
+	code, _, created, err := createLink(context.Background(), body)
+	switch {
+	case err == nil && !created:
+		j.skip(row, "URL already shortened as "+code)
+	case err == nil:
+		j.Created++
+	case errors.Is(err, ErrConflict):
+		j.conflict(row, body.CustomCode)
+	case errors.Is(err, ErrRejected):
+		j.skip(row, err.Error())
+	default:
+		return err
+	}
+	return nil
+}
+
+func importHandle(c *gin.Context) {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, config.Import.MaxBytes)
+	job, err := newImportJob(body, c.ClientIP(), c.Request.UserAgent())
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.JSON(413, gin.H{"error": fmt.Sprintf("Import is larger than %d bytes", tooLarge.Limit)})
+		return
+	case errors.Is(err, errImportHeader):
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Println("Error saving import:", err)
+		c.JSON(500, gin.H{"error": "Failed to save import"})
+		return
+	}
+	if err := saveImportJob(job); err != nil {
+		os.Remove(importPath(job.ID))
+		c.JSON(500, gin.H{"error": "Failed to save import"})
+		return
+	}
+
+	go runImport(job, false)
+	c.Header("Location", "/import/"+job.ID)
+	c.JSON(202, job.view(time.Now()))
+}
+
+func importStatusHandle(c *gin.Context) {
+	id := c.Param("job")
+	if !validImportIDRegex.MatchString(id) {
+		c.JSON(404, gin.H{"error": "Import not found"})
+		return
+	}
+	job, err := getImportJob(id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "Import not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read import"})
+		return
+	}
+	c.JSON(200, job.view(time.Now()))
+}
+
+func resumeImportHandle(c *gin.Context) {
+	id := c.Param("job")
+	if !validImportIDRegex.MatchString(id) {
+		c.JSON(404, gin.H{"error": "Import not found"})
+		return
+	}
+	job, err := getImportJob(id)
+	if err == nil && job.effectiveStatus(time.Now()) != importFailed {
+		err = errImportNotResumable
+	}
+	if err == nil {
+		if _, statErr := os.Stat(importPath(id)); statErr != nil {
+			c.JSON(409, gin.H{"error": "Import file is not on this instance"})
+			return
+		}
+		job, err = claimImportJob(id)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(404, gin.H{"error": "Import not found"})
+		return
+	case errors.Is(err, errImportNotResumable):
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"error": "Failed to resume import"})
+		return
+	}
+
+	go runImport(job, true)
+	c.JSON(202, job.view(time.Now()))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ip_access_file (IP_ACCESS_FILE) names a file of rules that allow or
+// deny client IPs, one per line:
+//
+//	# scanners
+//	deny 203.0.113.0/24
+//	deny 198.51.100.7
+//	allow admin 10.0.0.0/8
+//
+// Rules without a scope apply to every route, "admin" ones to the routes
+// that need the admin or replication token, to adminScopeGuard's
+// management routes and to requests using admin credentials. A client matching a deny rule of a
+// scope is refused with 403, and once a scope has allow rules, so is every
+// client matching none of them. Changes are picked up within
+// ipAccessReloadInterval, so a source can be blocked without a restart.
+// A file that stops parsing is logged and the rules in force are kept.
+var ipAccess *ipAccessFile
+
+// ipAccessReloadInterval is how often the rules file is checked for
+// changes.
+const ipAccessReloadInterval = 5 * time.Second
+
+type ipRules struct {
+	allow, deny []netip.Prefix
+}
+
+func (r ipRules) permits(ip netip.Addr) bool {
+	contains := func(prefix netip.Prefix) bool { return prefix.Contains(ip) }
+	if slices.ContainsFunc(r.deny, contains) {
+		return false
+	}
+	return len(r.allow) == 0 || slices.ContainsFunc(r.allow, contains)
+}
+
+type ipAccessRules struct {
+	global, admin ipRules
+}
+
+func parseIPAccess(raw []byte) (ipAccessRules, error) {
+	var rules ipAccessRules
+	for i, line := range strings.Split(string(raw), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		scope := &rules.global
+		if len(fields) == 3 && fields[1] == "admin" {
+			scope = &rules.admin
+			fields = slices.Delete(fields, 1, 2)
+		}
+		if len(fields) != 2 {
+			return rules, fmt.Errorf("line %d: expected allow or deny, an optional scope (admin) and an IP or CIDR", i+1)
+		}
+		prefix, ok := parsePrefix(fields[1])
+		if !ok {
+			return rules, fmt.Errorf("line %d: %q is not an IP or CIDR", i+1, fields[1])
+		}
+		switch fields[0] {
+		case "allow":
+			scope.allow = append(scope.allow, prefix)
+		case "deny":
+			scope.deny = append(scope.deny, prefix)
+		default:
+			return rules, fmt.Errorf("line %d: %q is neither allow nor deny", i+1, fields[0])
+		}
+	}
+	return rules, nil
+}
+
+// ipAccessFile holds the rules of path, reloaded when its modification
+// time changes.
+type ipAccessFile struct {
+	path string
+
+	mu      sync.Mutex
+	rules   ipAccessRules
+	modTime time.Time
+	checked time.Time
+}
+
+func newIPAccessFile(path string) (*ipAccessFile, error) {
+	f := &ipAccessFile{path: path, checked: time.Now()}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ipAccessFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseIPAccess(raw)
+	if err != nil {
+		return fmt.Errorf("IP access rules %s: %w", f.path, err)
+	}
+	if !f.modTime.IsZero() {
+		log.Println("Reloaded IP access rules", f.path)
+	}
+	f.rules, f.modTime = rules, info.ModTime()
+	return nil
+}
+
+func (f *ipAccessFile) current() ipAccessRules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) >= ipAccessReloadInterval {
+		f.checked = time.Now()
+		if err := f.reload(); err != nil {
+			log.Println("Error reloading IP access rules, keeping the previous ones:", err)
+		}
+	}
+	return f.rules
+}
+
+// ipPermitted reports whether the rules let ip in, to any route or, with
+// admin, to the admin routes. Addresses that do not parse are let in,
+// since no rule can name them.
+func ipPermitted(ip string, admin bool) bool {
+	if ipAccess == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	rules := ipAccess.current()
+	return rules.global.permits(addr) && (!admin || rules.admin.permits(addr))
+}
+
+// ipAccessGuard refuses clients the global rules do not let in.
+func ipAccessGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ipPermitted(c.ClientIP(), false) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Access from your address is not allowed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminScopeGuard applies the admin rules to the management routes, which
+// list, edit, delete or read what is recorded about existing links. With
+// anyone false, as on the routes that create links, only requests using
+// admin credentials are checked, so others may create links from wherever
+// the global rules let them in.
+func adminScopeGuard(anyone bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if (anyone || isAdmin(c.Request)) && !ipPermitted(c.ClientIP(), true) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Access from your address is not allowed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkIPAccess reports a rules file that cannot be read or parsed.
+func (d *doctor) checkIPAccess(path string) {
+	f, err := newIPAccessFile(path)
+	if err != nil {
+		d.fail("ip access", err.Error())
+		return
+	}
+	g, a := f.rules.global, f.rules.admin
+	d.ok("ip access", fmt.Sprintf("%s: %d allow and %d deny rules, %d and %d for admin routes",
+		path, len(g.allow), len(g.deny), len(a.allow), len(a.deny)))
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// jsonStore keeps links, the ID counter and namespaces in memory and
+// writes them to the store.json at STORE_FILE (STORE_BACKEND=json). It
+// needs no Redis: the variant stats and blocked referrer hits of a link
+// are fields of the link, and the dedupe_urls index is rebuilt from the
+// links when the file is read. Every write replaces the file through a
+// temporary one before it returns, except clicks and those counters,
+// which are written together every jsonClickFlush and at shutdown. The
+// file ends with a checksum, checked when it is read, and is synced to
+// disk as STORE_FSYNC says. Keys of the file it does not use are written
+// back unchanged. Only one process may use the file.
+type jsonStore struct {
+	path string
+
+	mu         sync.Mutex
+	links      map[string]jsonStoreLink
+	counter    int64
+	namespaces map[string]namespace
+	index      map[string]string          // dedupeField -> code
+	file       map[string]json.RawMessage // the whole file, for writing it back
+	clicked    bool                       // clicks not yet written
+	unsynced   bool                       // written but not synced, with STORE_FSYNC=interval
+}
+
+// jsonNamespacesKey holds the namespaces in store.json.
+const jsonNamespacesKey = "namespaces"
+
+// jsonClickFlush is how long clicks may wait in memory before they are
+// written.
+const jsonClickFlush = time.Second
+
+func newJSONStore() (LinkStore, error) {
+	file, counter, links, err := readJSONStore(config.StoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("STORE_FILE %s: %w", config.StoreFile, err)
+	}
+	s := &jsonStore{path: config.StoreFile, links: links, counter: counter, file: file,
+		namespaces: make(map[string]namespace), index: make(map[string]string)}
+	if raw, ok := file[jsonNamespacesKey]; ok {
+		if err := json.Unmarshal(raw, &s.namespaces); err != nil {
+			return nil, fmt.Errorf("STORE_FILE %s: namespaces: %w", config.StoreFile, err)
+		}
+	}
+	for code, link := range links {
+		if link.plain() {
+			s.index[dedupeField(link.LongURL, link.Owner, link.Tenant, link.Namespace, "")] = code
+		}
+	}
+	return s, nil
+}
+
+// newMemoryStore is a jsonStore without a file, for STORE_BACKEND=memory.
+// Everything is lost when the process exits.
+func newMemoryStore() LinkStore {
+	return &jsonStore{links: make(map[string]jsonStoreLink), file: make(map[string]json.RawMessage),
+		namespaces: make(map[string]namespace), index: make(map[string]string)}
+}
+
+// Prepare starts writing clicks, and with STORE_FSYNC=interval syncing
+// the file, in the background.
+func (s *jsonStore) Prepare() error {
+	go func() {
+		for range time.Tick(jsonClickFlush) {
+			if err := s.flushClicks(); err != nil {
+				log.Println("Error writing clicks to", s.path+":", err)
+			}
+		}
+	}()
+	if config.StoreFsync.Mode == fsyncInterval {
+		go func() {
+			for range time.Tick(config.StoreFsync.Interval) {
+				if err := s.sync(); err != nil {
+					log.Println("Error syncing", s.path+":", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// Close writes the clicks not yet written and syncs the file.
+func (s *jsonStore) Close() error {
+	return errors.Join(s.flushClicks(), s.sync())
+}
+
+// sync flushes the file and its directory to disk if a write has not
+// been synced yet.
+func (s *jsonStore) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.unsynced {
+		return nil
+	}
+	if err := syncPath(s.path); err != nil {
+		return err
+	}
+	if err := syncPath(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	s.unsynced = false
+	return nil
+}
+
+func (s *jsonStore) flushClicks() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.clicked {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the file, if there is one. The caller holds s.mu.
+func (s *jsonStore) save() error {
+	if s.path == "" {
+		s.clicked = false
+		return nil
+	}
+	if len(s.namespaces) > 0 {
+		raw, err := json.Marshal(s.namespaces)
+		if err != nil {
+			return err
+		}
+		s.file[jsonNamespacesKey] = raw
+	} else {
+		delete(s.file, jsonNamespacesKey)
+	}
+	if err := writeJSONStore(s.path, s.file, s.counter, s.links, config.StoreFsync.Mode); err != nil {
+		return err
+	}
+	s.clicked = false
+	s.unsynced = config.StoreFsync.Mode == fsyncInterval
+	return nil
+}
+
+// commit saves a change made to s.links, and undoes it if the file could
+// not be written, so memory never holds what the file does not.
+func (s *jsonStore) commit(codes []string) func() error {
+	old := make(map[string]*jsonStoreLink, len(codes))
+	for _, code := range codes {
+		if link, ok := s.links[code]; ok {
+			old[code] = &link
+		} else {
+			old[code] = nil
+		}
+	}
+	return func() error {
+		err := s.save()
+		if err == nil {
+			return nil
+		}
+		for code, link := range old {
+			if link == nil {
+				delete(s.links, code)
+			} else {
+				s.links[code] = *link
+			}
+		}
+		return err
+	}
+}
+
+func (s *jsonStore) GetURL(ctx context.Context, code string) (URLData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return URLData{}, ErrNotFound
+	}
+	return link.URLData, nil
+}
+
+func (s *jsonStore) SaveURL(code string, data URLData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	save := s.commit([]string{code})
+	link := s.links[code]
+	link.URLData = data
+	s.links[code] = link
+	return save()
+}
+
+func (s *jsonStore) CreateURLs(ctx context.Context, region string, codes []string, data []URLData) error {
+	if region != "" {
+		return errors.New("regions need STORE_BACKEND=redis")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, code := range codes {
+		if _, taken := s.links[code]; taken {
+			return codeTakenError{code}
+		}
+	}
+	save := s.commit(codes)
+	for i, code := range codes {
+		s.links[code] = jsonStoreLink{URLData: data[i]}
+	}
+	return save()
+}
+
+func (s *jsonStore) UpdateURL(code string, fn func(*URLData) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := fn(&link.URLData); err != nil {
+		return err
+	}
+	save := s.commit([]string{code})
+	s.links[code] = link
+	return save()
+}
+
+func (s *jsonStore) DeleteURL(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.links[code]; !ok {
+		return ErrNotFound
+	}
+	save := s.commit([]string{code})
+	delete(s.links, code)
+	return save()
+}
+
+// IncrementClicks counts in memory under the lock, which makes the limit
+// check and the count one step; the total is written by the next flush.
+func (s *jsonStore) IncrementClicks(ctx context.Context, code string, n, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	clicks := link.Clicks + n
+	if limit > 0 && clicks > limit {
+		return clicks, ErrClickLimit
+	}
+	link.Clicks = clicks
+	s.links[code] = link
+	s.clicked = true
+	return clicks, nil
+}
+
+// ForEachURL calls fn in code order without holding the lock, so fn may
+// write to the store itself. Links created meanwhile may be missed.
+func (s *jsonStore) ForEachURL(fn func(code string, data URLData) error) error {
+	s.mu.Lock()
+	codes := slices.Sorted(maps.Keys(s.links))
+	s.mu.Unlock()
+	for _, code := range codes {
+		data, err := s.GetURL(Ctx, code)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err := fn(code, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot copies everything under the lock. There is no op log, so the
+// revision is empty.
+func (s *jsonStore) Snapshot() (Store, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := Store{IDCounter: s.counter, URLStore: make(map[string]URLData, len(s.links))}
+	for code, link := range s.links {
+		snapshot.URLStore[code] = link.URLData
+	}
+	return snapshot, nil
+}
+
+func (s *jsonStore) Counter() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counter, nil
+}
+
+// updateCounter sets the counter to next(current).
+func (s *jsonStore) updateCounter(next func(int64) int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.counter
+	s.counter = next(old)
+	if err := s.save(); err != nil {
+		s.counter = old
+		return 0, err
+	}
+	return s.counter, nil
+}
+
+func (s *jsonStore) GetNextID() (int64, error) {
+	return s.updateCounter(func(n int64) int64 { return n + 1 })
+}
+
+func (s *jsonStore) EnsureCounterFloor(floor int64) error {
+	_, err := s.updateCounter(func(n int64) int64 { return max(n, floor) })
+	return err
+}
+
+func (s *jsonStore) SetCounter(n int64) error {
+	_, err := s.updateCounter(func(int64) int64 { return n })
+	return err
+}
+
+// DeleteExpired scans every link, which is what a file without an index
+// allows.
+func (s *jsonStore) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	return deleteExpiredPages(ctx, func(skip int64) ([]string, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var codes []string
+		for _, code := range slices.Sorted(maps.Keys(s.links)) {
+			if !s.links[code].expired(now) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if codes = append(codes, code); len(codes) == cleanupPageSize {
+				break
+			}
+		}
+		return codes, nil
+	})
+}
+
+func (s *jsonStore) VariantStats(code string, n int) ([]variantStat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]variantStat, n)
+	copy(stats, s.links[code].VariantStats)
+	return stats, nil
+}
+
+// RecordVariant counts in memory like IncrementClicks.
+func (s *jsonStore) RecordVariant(code string, variant int, counter string, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return ErrNotFound
+	}
+	for len(link.VariantStats) <= variant {
+		link.VariantStats = append(link.VariantStats, variantStat{})
+	}
+	switch counter {
+	case "visits":
+		link.VariantStats[variant].Visits += int64(n)
+	case "conversions":
+		link.VariantStats[variant].Conversions += int64(n)
+	default:
+		return fmt.Errorf("unknown variant counter %q", counter)
+	}
+	s.links[code] = link
+	s.clicked = true
+	return nil
+}
+
+func (s *jsonStore) ReferrerBlockedHits(code string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.links[code].BlockedHits, nil
+}
+
+// RecordReferrerBlocked counts in memory like IncrementClicks.
+func (s *jsonStore) RecordReferrerBlocked(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return ErrNotFound
+	}
+	link.BlockedHits++
+	s.links[code] = link
+	s.clicked = true
+	return nil
+}
+
+func (s *jsonStore) SetCounters(code string, stats []variantStat, blockedHits int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[code]
+	if !ok {
+		return ErrNotFound
+	}
+	save := s.commit([]string{code})
+	link.VariantStats, link.BlockedHits = stats, blockedHits
+	s.links[code] = link
+	return save()
+}
+
+// saveNamespaces applies change to the namespaces and writes them, undoing
+// the change if the file could not be written.
+func (s *jsonStore) saveNamespaces(change func(map[string]namespace) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := maps.Clone(s.namespaces)
+	if err := change(s.namespaces); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.namespaces = old
+		return err
+	}
+	return nil
+}
+
+func (s *jsonStore) SaveNamespace(ns namespace) error {
+	return s.saveNamespaces(func(all map[string]namespace) error {
+		all[ns.Name] = ns
+		return nil
+	})
+}
+
+func (s *jsonStore) GetNamespace(name string) (namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns, ok := s.namespaces[name]
+	if !ok {
+		return namespace{}, ErrNotFound
+	}
+	return ns, nil
+}
+
+func (s *jsonStore) Namespaces() ([]namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]namespace, 0, len(s.namespaces))
+	for _, name := range slices.Sorted(maps.Keys(s.namespaces)) {
+		all = append(all, s.namespaces[name])
+	}
+	return all, nil
+}
+
+func (s *jsonStore) DeleteNamespace(name string) error {
+	return s.saveNamespaces(func(all map[string]namespace) error {
+		if _, ok := all[name]; !ok {
+			return ErrNotFound
+		}
+		delete(all, name)
+		return nil
+	})
+}
+
+// IndexedURL looks a dedupeField up in the index built from the links.
+func (s *jsonStore) IndexedURL(field string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.index[field]
+	return code, ok
+}
+
+// IndexURL only changes memory: the index is rebuilt when the file is
+// read.
+func (s *jsonStore) IndexURL(field, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index[field] = code
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// kvPushKey remembers the last revision pushed to Cloudflare KV, so every
+// push after the first only sends what changed.
+const kvPushKey = "url_kv_push"
+
+// kvPair is one entry of Cloudflare's KV bulk format, as accepted by
+// `wrangler kv bulk put` and the bulk write API.
+type kvPair struct {
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	Expiration int64  `json:"expiration,omitempty"`
+}
+
+const (
+	kvBulkLimit = 10000 // pairs per bulk API request
+	kvMinTTL    = 60    // Cloudflare rejects expirations closer than this
+)
+
+// kvPairs converts links to KV pairs. Links the edge must not serve itself
+// (expired, about to expire or scripted) are returned as removals instead.
+// Links that never expire are written without an expiration.
+func kvPairs(entries []syncEntry, now int64) (pairs []kvPair, removals []string) {
+	pairs = []kvPair{}
+	for _, entry := range entries {
+		if entry.Dynamic || (entry.expiresAt != 0 && entry.expiresAt < now+kvMinTTL) {
+			removals = append(removals, entry.Code)
+			continue
+		}
+		pairs = append(pairs, kvPair{Key: entry.Code, Value: entry.LongURL, Expiration: entry.expiresAt})
+	}
+	return pairs, removals
+}
+
+// kvClient talks to the Cloudflare KV bulk API through the egress client.
+type kvClient struct {
+	base  string
+	token string
+}
+
+// newKVClient returns nil unless the account, namespace and API token are
+// all set.
+func newKVClient(c KVConfig) *kvClient {
+	if c.AccountID == "" || c.NamespaceID == "" || c.APIToken == "" {
+		return nil
+	}
+
+	egressAllow.allowURLHost(c.APIURL)
+	return &kvClient{
+		base:  fmt.Sprintf("%s/accounts/%s/storage/kv/namespaces/%s", c.APIURL, url.PathEscape(c.AccountID), url.PathEscape(c.NamespaceID)),
+		token: c.APIToken,
+	}
+}
+
+func (k *kvClient) call(ctx context.Context, method, path string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.base+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := egressClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil || !result.Success {
+		msg := resp.Status
+		if len(result.Errors) > 0 {
+			msg = result.Errors[0].Message
+		}
+		return fmt.Errorf("cloudflare KV %s %s: %s", method, path, msg)
+	}
+	return nil
+}
+
+// push writes pairs and deletes keys in chunks the bulk API accepts.
+func (k *kvClient) push(ctx context.Context, pairs []kvPair, deletes []string) error {
+	for chunk := range slices.Chunk(pairs, kvBulkLimit) {
+		if err := k.call(ctx, http.MethodPut, "/bulk", chunk); err != nil {
+			return err
+		}
+	}
+	for chunk := range slices.Chunk(deletes, kvBulkLimit) {
+		if err := k.call(ctx, http.MethodPost, "/bulk/delete", chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	kvPusher = newKVClient(config.KV)
+	kvPushMu sync.Mutex
+)
+
+// kvPushInterval is how often links are pushed to Cloudflare KV; zero
+// disables the schedule.
+func kvPushInterval() time.Duration {
+	if kvPusher == nil {
+		return 0
+	}
+	return config.KV.PushInterval
+}
+
+type kvPushResult struct {
+	Written  int    `json:"written"`
+	Deleted  int    `json:"deleted"`
+	Revision string `json:"revision"`
+}
+
+func pushKV(ctx context.Context) (kvPushResult, error) {
+	kvPushMu.Lock()
+	defer kvPushMu.Unlock()
+
+	since, err := Rdb.HGet(Ctx, kvPushKey, "revision").Result()
+	if err == redis.Nil {
+		since = "0"
+	} else if err != nil {
+		return kvPushResult{}, err
+	}
+
+	revision, created, updated, deleted, err := syncChanges(since)
+	if err != nil {
+		return kvPushResult{}, err
+	}
+
+	pairs, removals := kvPairs(append(created, updated...), time.Now().Unix())
+	deletes := append(deleted, removals...)
+	if err := kvPusher.push(ctx, pairs, deletes); err != nil {
+		return kvPushResult{}, err
+	}
+	if err := Rdb.HSet(Ctx, kvPushKey, "revision", revision).Err(); err != nil {
+		return kvPushResult{}, err
+	}
+	return kvPushResult{Written: len(pairs), Deleted: len(deletes), Revision: revision}, nil
+}
+
+func startKVPush(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Replicas hold the same links; only the primary pushes.
+			if replicaMode.Load() {
+				continue
+			}
+			if result, err := pushKV(Ctx); err != nil {
+				log.Println("Error pushing to Cloudflare KV:", err)
+			} else if result.Written+result.Deleted > 0 {
+				log.Printf("Pushed %d links to Cloudflare KV and deleted %d.", result.Written, result.Deleted)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// kvExportHandle returns every servable link in KV bulk format, for
+// `wrangler kv bulk put` or any edge store that takes the same shape.
+func kvExportHandle(c *gin.Context) {
+	var entries []syncEntry
+	err := ForEachURL(func(code string, data URLData) error {
+		entries = append(entries, syncEntryFor(code, data))
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list URLs"})
+		return
+	}
+
+	pairs, _ := kvPairs(entries, time.Now().Unix())
+	c.JSON(200, pairs)
+}
+
+func kvPushHandle(c *gin.Context) {
+	if kvPusher == nil {
+		c.JSON(503, gin.H{"error": "Cloudflare KV push is not configured"})
+		return
+	}
+
+	result, err := pushKV(c.Request.Context())
+	if err != nil {
+		log.Println("Error pushing to Cloudflare KV:", err)
+		c.JSON(502, gin.H{"error": "Failed to push to Cloudflare KV"})
+		return
+	}
+	c.JSON(200, result)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	mathrand "math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyMonitor keeps one minute of redirect timings at a time and raises
+// an alert when the p99 stays above the budget for alertAfter minutes.
+type latencyMonitor struct {
+	mu         sync.Mutex
+	samples    []time.Duration
+	seen       int
+	lastP99    time.Duration
+	breaches   int
+	alerting   bool
+	budget     time.Duration
+	alertAfter int
+	webhook    string
+}
+
+// maxLatencySamples bounds memory per window; beyond it samples are kept
+// by reservoir sampling so the percentile stays representative.
+const maxLatencySamples = 10000
+
+var redirectLatency = newLatencyMonitor()
+
+func newLatencyMonitor() *latencyMonitor {
+	m := &latencyMonitor{
+		budget:     time.Duration(config.Latency.BudgetMS) * time.Millisecond,
+		alertAfter: config.Latency.AlertMinutes,
+		webhook:    config.Latency.AlertWebhook,
+	}
+	egressAllow.allowURLHost(m.webhook)
+	return m
+}
+
+func (m *latencyMonitor) observe(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seen++
+	if len(m.samples) < maxLatencySamples {
+		m.samples = append(m.samples, d)
+	} else if i := mathrand.IntN(m.seen); i < maxLatencySamples {
+		m.samples[i] = d
+	}
+}
+
+func (m *latencyMonitor) p99() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastP99
+}
+
+// rotate closes the current window and evaluates it against the budget.
+func (m *latencyMonitor) rotate() {
+	m.mu.Lock()
+	samples := m.samples
+	m.samples = nil
+	m.seen = 0
+
+	var p99 time.Duration
+	if len(samples) > 0 {
+		slices.Sort(samples)
+		p99 = samples[(len(samples)*99-1)/100]
+	}
+	m.lastP99 = p99
+
+	if m.budget == 0 {
+		m.mu.Unlock()
+		return
+	}
+
+	fire, recovered := false, false
+	if p99 > m.budget {
+		m.breaches++
+		if m.breaches >= m.alertAfter && !m.alerting {
+			m.alerting, fire = true, true
+		}
+	} else {
+		m.breaches = 0
+		if m.alerting {
+			m.alerting, recovered = false, true
+		}
+	}
+	breaches := m.breaches
+	m.mu.Unlock()
+
+	if fire {
+		log.Printf("ALERT: redirect p99 latency %v above budget %v for %d minutes", p99, m.budget, breaches)
+		m.notify("firing", p99, breaches)
+	} else if recovered {
+		log.Printf("Redirect p99 latency back under budget (%v)", p99)
+		m.notify("resolved", p99, 0)
+	}
+}
+
+func (m *latencyMonitor) notify(status string, p99 time.Duration, minutes int) {
+	if m.webhook == "" {
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]any{
+		"alert":     "redirect_latency_budget",
+		"status":    status,
+		"p99_ms":    float64(p99.Microseconds()) / 1000,
+		"budget_ms": m.budget.Milliseconds(),
+		"minutes":   minutes,
+	})
+
+	resp, err := egressClient.Post(m.webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Println("Error sending latency alert:", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (m *latencyMonitor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.rotate()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func latencyMiddleware(m *latencyMonitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		m.observe(time.Since(start))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bulkTransferTimeout replaces the server's read and write timeouts on
+// routes that move whole stores, such as imports and exports, which take
+// longer than any other request.
+const bulkTransferTimeout = time.Hour
+
+// limitBody caps the request body at config.MaxBodyBytes. Bodies that
+// announce a larger Content-Length are refused before they are read; the
+// handler sees an error from reading past the cap otherwise.
+func limitBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > config.MaxBodyBytes {
+			c.AbortWithStatusJSON(413, gin.H{"error": bodyTooLargeMessage()})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxBodyBytes)
+	}
+}
+
+// bodyTooLarge reports whether err came from reading past limitBody's cap.
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+func bodyTooLargeMessage() string {
+	return fmt.Sprintf("Request body is larger than %d bytes", config.MaxBodyBytes)
+}
+
+// bulkTransfer extends the read and write deadlines of the request to
+// bulkTransferTimeout. Put it after the guards of a route, so only
+// allowed clients get the longer deadlines.
+func bulkTransfer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rc := http.NewResponseController(c.Writer)
+		deadline := time.Now().Add(bulkTransferTimeout)
+		// Writers that cannot change deadlines have none to extend.
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// linkCache keeps recently redirected links in memory so hot links skip
+// the Redis round trip. It is off unless LINK_CACHE_MAX is set. Entries
+// live for at most LINK_CACHE_TTL, so edits made through other instances
+// show up within that time; edits made through this one drop the entry
+// at once.
+//
+// The cache starts at LINK_CACHE_MIN entries and resizes itself every
+// minute between LINK_CACHE_MIN and LINK_CACHE_MAX: it grows while it
+// evicts entries and misses more than linkCacheTargetHitRatio, shrinks
+// while most of it sits unused, and never holds more than
+// LINK_CACHE_MAX_BYTES of link data.
+type linkCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	bytes    int64
+	capacity int
+
+	min, max int
+	maxBytes int64
+	ttl      time.Duration
+
+	// Counts since the last tuning, and since the process started.
+	hits, misses, evictions         int64
+	totalHits, totalMisses, resizes int64
+	lastHitRatio                    float64
+	lastAdvice                      string
+}
+
+type linkCacheEntry struct {
+	code    string
+	data    URLData
+	size    int64
+	expires time.Time
+}
+
+// linkCacheTargetHitRatio is the hit ratio below which a cache that is
+// evicting grows.
+const linkCacheTargetHitRatio = 0.9
+
+var redirectCache = newLinkCache()
+
+func newLinkCache() *linkCache {
+	cfg := config.LinkCache
+	if cfg.Max == 0 {
+		return nil
+	}
+	c := &linkCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		max:      cfg.Max,
+		min:      cmp.Or(cfg.Min, cfg.Max/16),
+		maxBytes: cfg.MaxBytes,
+		ttl:      cfg.TTL,
+	}
+	c.min = min(max(c.min, 1), c.max)
+	c.capacity = c.min
+	return c
+}
+
+// get returns a cached link. A nil cache never has one.
+func (c *linkCache) get(code string) (URLData, bool) {
+	if c == nil {
+		return URLData{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[code]; ok {
+		entry := el.Value.(*linkCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(el)
+			c.hits++
+			c.totalHits++
+			return entry.data, true
+		}
+		c.remove(el)
+	}
+	c.misses++
+	c.totalMisses++
+	return URLData{}, false
+}
+
+func (c *linkCache) put(code string, data URLData) {
+	if c == nil {
+		return
+	}
+	// The JSON size is close enough to what the entry holds on to.
+	raw, _ := json.Marshal(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[code]; ok {
+		c.remove(el)
+	}
+	entry := &linkCacheEntry{code: code, data: data, size: int64(len(raw) + len(code)), expires: time.Now().Add(c.ttl)}
+	c.entries[code] = c.order.PushFront(entry)
+	c.bytes += entry.size
+	c.trim()
+}
+
+// forget drops code after this instance changed or deleted it.
+func (c *linkCache) forget(code string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[code]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *linkCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*linkCacheEntry)
+	delete(c.entries, entry.code)
+	c.bytes -= entry.size
+}
+
+// trim evicts least recently used entries down to the capacity and the
+// byte budget.
+func (c *linkCache) trim() {
+	for c.order.Len() > 0 && (c.order.Len() > c.capacity || c.bytes > c.maxBytes) {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// tune resizes the cache from the traffic since the last call and
+// records advice for operators when the bounds hold it back.
+func (c *linkCache) tune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lookups := c.hits + c.misses
+	if lookups == 0 {
+		return
+	}
+	c.lastHitRatio = float64(c.hits) / float64(lookups)
+	full := c.bytes > c.maxBytes*9/10
+	capacity := c.capacity
+	switch {
+	case c.evictions > 0 && c.lastHitRatio < linkCacheTargetHitRatio && !full:
+		capacity = min(c.capacity*2, c.max)
+	case c.evictions == 0 && c.order.Len() < c.capacity/4:
+		capacity = max(c.capacity/2, c.min)
+	}
+	if capacity != c.capacity {
+		c.capacity = capacity
+		c.resizes++
+		c.trim()
+	}
+
+	c.lastAdvice = ""
+	switch {
+	case c.evictions > 0 && c.lastHitRatio < linkCacheTargetHitRatio && full:
+		c.lastAdvice = "The cache is at LINK_CACHE_MAX_BYTES and still misses; raise LINK_CACHE_MAX_BYTES if memory allows"
+	case c.evictions > 0 && c.lastHitRatio < linkCacheTargetHitRatio && c.capacity == c.max:
+		c.lastAdvice = "The cache is at LINK_CACHE_MAX and still misses; raise LINK_CACHE_MAX if memory allows"
+	case c.evictions == 0 && c.capacity == c.min && c.order.Len() < c.min/4:
+		c.lastAdvice = fmt.Sprintf("Fewer than a quarter of LINK_CACHE_MIN entries are used; LINK_CACHE_MIN=%d would do", max(c.order.Len()*2, 1))
+	}
+	c.hits, c.misses, c.evictions = 0, 0, 0
+}
+
+func (c *linkCache) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.tune()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// report is the link_cache section of /admin/storage.
+func (c *linkCache) report() map[string]any {
+	if c == nil {
+		return map[string]any{"enabled": false}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]any{
+		"enabled":        true,
+		"entries":        c.order.Len(),
+		"bytes":          c.bytes,
+		"capacity":       c.capacity,
+		"min":            c.min,
+		"max":            c.max,
+		"max_bytes":      c.maxBytes,
+		"ttl_seconds":    c.ttl.Seconds(),
+		"hit_ratio":      c.lastHitRatio,
+		"hits":           c.totalHits,
+		"misses":         c.totalMisses,
+		"resizes":        c.resizes,
+		"recommendation": c.lastAdvice,
+	}
+}
+
+func writeLinkCacheMetrics(w io.Writer) {
+	c := redirectCache
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP urlshortener_link_cache_lookups_total Redirect cache lookups since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_link_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "urlshortener_link_cache_lookups_total{result=\"hit\"} %d\n", c.totalHits)
+	fmt.Fprintf(w, "urlshortener_link_cache_lookups_total{result=\"miss\"} %d\n", c.totalMisses)
+	fmt.Fprintf(w, "# HELP urlshortener_link_cache_entries Links in the redirect cache.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_link_cache_entries gauge\n")
+	fmt.Fprintf(w, "urlshortener_link_cache_entries %d\n", c.order.Len())
+	fmt.Fprintf(w, "# HELP urlshortener_link_cache_capacity Entries the redirect cache may hold, as tuned.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_link_cache_capacity gauge\n")
+	fmt.Fprintf(w, "urlshortener_link_cache_capacity %d\n", c.capacity)
+	fmt.Fprintf(w, "# HELP urlshortener_link_cache_bytes Approximate link data held by the redirect cache.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_link_cache_bytes gauge\n")
+	fmt.Fprintf(w, "urlshortener_link_cache_bytes %d\n", c.bytes)
+}
+
+// GetRedirectURL is GetActiveURL through the redirect cache. Expiry and
+// disabling are checked on every call, so a cached link stops working
+// on time.
+func GetRedirectURL(ctx context.Context, code string) (URLData, error) {
+	data, ok := redirectCache.get(code)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("link.cached", ok))
+	if !ok {
+		var err error
+		if data, err = GetURLContext(ctx, code); err != nil {
+			return data, err
+		}
+		redirectCache.put(code, data)
+	}
+	if data.Expiry != 0 && time.Now().Unix() > data.CreatedAt+data.Expiry {
+		return data, ErrExpired
+	}
+	if data.Disabled {
+		return data, ErrDisabled
+	}
+	if data.clicksUsedUp() {
+		return data, ErrClickLimit
+	}
+	return data, nil
+}
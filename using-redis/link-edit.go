@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// patchLinkRequest changes a link in place, keeping its code, clicks and
+// stats. Fields left out stay as they are. expiry_seconds counts from now,
+// as it does for /shorten, and may be neverExpires.
+type patchLinkRequest struct {
+	URL           *string        `json:"url"`
+	ExpirySeconds *expirySeconds `json:"expiry_seconds"`
+	Version       *int64         `json:"version"`
+	Verify        bool           `json:"verify"`
+}
+
+func (req patchLinkRequest) validate() []fieldError {
+	var errs []fieldError
+	if req.URL == nil && req.ExpirySeconds == nil {
+		errs = append(errs, fieldError{"url", "required", "Provide url, expiry_seconds or both"})
+	}
+	if req.URL != nil && !isValidURL(*req.URL) {
+		errs = append(errs, fieldError{"url", "scheme", "URL must start with http:// or https://"})
+	}
+	if req.ExpirySeconds != nil && *req.ExpirySeconds <= 0 && *req.ExpirySeconds != neverExpires {
+		errs = append(errs, fieldError{"expiry_seconds", "min", `Expiry must be a positive number of seconds, or -1 or "never" for none`})
+	}
+	return errs
+}
+
+// versionConflictError is returned when the version of a patch is not
+// the link's.
+type versionConflictError struct {
+	current int64
+}
+
+func (e versionConflictError) Error() string {
+	return fmt.Sprintf("link is at version %d", e.current)
+}
+
+var (
+	errLinkOwner    = errors.New("link belongs to another user")
+	errNeverExpires = errors.New("link never expires")
+)
+
+// apply edits data as req asks and returns the fields that changed. A
+// new destination is vetted by the create hooks, like the one the link was
+// created with.
+func (req patchLinkRequest) apply(ctx context.Context, code string, data *URLData) ([]string, error) {
+	var changed []string
+	if req.URL != nil && *req.URL != data.LongURL {
+		data.LongURL = *req.URL
+		changed = append(changed, "url")
+		if err := runCreateHooks(ctx, code, *data); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case req.ExpirySeconds == nil:
+	case *req.ExpirySeconds == neverExpires:
+		data.Expiry = 0
+		changed = append(changed, "expiry")
+	default:
+		data.Expiry = time.Now().Unix() - data.CreatedAt + int64(*req.ExpirySeconds)
+		changed = append(changed, "expiry")
+	}
+	return changed, nil
+}
+
+// extendRequest renews a link by duration (e.g. "720h") or seconds,
+// counted from its expiry, or from now if it has expired already.
+type extendRequest struct {
+	Duration string `json:"duration"`
+	Seconds  int64  `json:"seconds"`
+	Version  *int64 `json:"version"`
+}
+
+func (req extendRequest) validate() []fieldError {
+	if (req.Duration == "") == (req.Seconds == 0) {
+		return []fieldError{{"duration", "required", "Provide exactly one of duration or seconds"}}
+	}
+	if req.Duration != "" {
+		if d, err := time.ParseDuration(req.Duration); err != nil || d < time.Second {
+			return []fieldError{{"duration", "format", "Duration must be at least 1s, like 720h or 90m"}}
+		}
+	}
+	if req.Seconds < 0 {
+		return []fieldError{{"seconds", "min", "Seconds must be positive"}}
+	}
+	return nil
+}
+
+// seconds is the extension in seconds; validate has checked it.
+func (req extendRequest) seconds() int64 {
+	if req.Duration != "" {
+		d, _ := time.ParseDuration(req.Duration)
+		return int64(d / time.Second)
+	}
+	return req.Seconds
+}
+
+func (req extendRequest) apply(data *URLData) ([]string, error) {
+	if data.Expiry == 0 {
+		return nil, errNeverExpires
+	}
+	base := max(data.CreatedAt+data.Expiry, time.Now().Unix())
+	data.Expiry = base + req.seconds() - data.CreatedAt
+	return []string{"expiry"}, nil
+}
+
+// patchLinkHandle edits the destination or expiry of a link.
+func patchLinkHandle(c *gin.Context) {
+	var req patchLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+	if req.URL != nil {
+		if errs := (shortenRequest{URL: *req.URL, Verify: req.Verify}).verifyDestination(c.Request.Context()); len(errs) > 0 {
+			c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+			return
+		}
+	}
+	updated, ok := editLink(c, "link.update", req.Version, func(data *URLData) ([]string, error) {
+		return req.apply(c.Request.Context(), c.Param("code"), data)
+	})
+	if ok {
+		c.JSON(200, editedLink(c.Param("code"), updated))
+	}
+}
+
+// extendLinkHandle renews a link in one call, where deleting and creating
+// it again would change its code.
+func extendLinkHandle(c *gin.Context) {
+	var req extendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+	updated, ok := editLink(c, "link.extend", req.Version, func(data *URLData) ([]string, error) {
+		return req.apply(data)
+	})
+	if ok {
+		c.JSON(200, editedLink(c.Param("code"), updated))
+	}
+}
+
+// linkScope is the user whose links the request may change, or "" for any
+// link. Admins may change every link; signed-in users and impersonation
+// tokens only the user's own.
+func linkScope(c *gin.Context) string {
+	if claims, ok := impersonation(c); ok {
+		return claims.User
+	}
+	if isAdmin(c.Request) {
+		return ""
+	}
+	return requestUser(c)
+}
+
+// mayManage reports whether the request may change, delete or read what
+// is recorded about link data. Requests signed only with an API key may
+// manage the links created with that key; everyone else those of
+// linkScope.
+func mayManage(c *gin.Context, data *URLData) bool {
+	if key := c.GetString(apiKeyContextKey); key != "" {
+		return data.Source != nil && data.Source.APIKey == key
+	}
+	user := linkScope(c)
+	return user == "" || data.Owner == user
+}
+
+// linkGuards puts the guards of every route that changes or deletes an
+// existing link in front of handler: it needs a signed-in user, an admin,
+// an impersonation token granting scope or an API key, and the handler
+// keeps the change to the links mayManage allows.
+func linkGuards(scope string, handler gin.HandlerFunc) []gin.HandlerFunc {
+	return []gin.HandlerFunc{adminScopeGuard(true), readOnlyGuard(), authProxyGuard(), userTokenGuard(), impersonationGuard(scope), apiKeyGuard(), signedInGuard(), handler}
+}
+
+// linkReadGuards puts the guards of routes that read what is recorded
+// about an existing link, such as its analytics, in front of handlers.
+// They admit whom linkGuards admits, with impersonation tokens needing
+// links:read, also on replicas; the handler keeps the read to the links
+// mayManage allows.
+func linkReadGuards(handlers ...gin.HandlerFunc) []gin.HandlerFunc {
+	guards := []gin.HandlerFunc{adminScopeGuard(true), authProxyGuard(), userTokenGuard(), impersonationGuard(scopeLinksRead), apiKeyGuard(), signedInGuard()}
+	return append(guards, handlers...)
+}
+
+// editLink runs edit on the link of the request, bumps its version and
+// returns the edited link. If the edit fails, it answers the request and
+// returns false. Like deletes, edits are limited to the links mayManage
+// allows. version, when given, must be the link's current version (0
+// for a link never edited), so an edit based on a stale read fails instead
+// of undoing another one.
+func editLink(c *gin.Context, action string, version *int64, edit func(*URLData) ([]string, error)) (URLData, bool) {
+	code := c.Param("code")
+
+	var updated URLData
+	var changed []string
+	err := UpdateURL(code, func(data *URLData) error {
+		if !mayManage(c, data) {
+			return errLinkOwner
+		}
+		if version != nil && *version != data.Version {
+			return versionConflictError{data.Version}
+		}
+		var err error
+		if changed, err = edit(data); err != nil {
+			return err
+		}
+		data.Version++
+		updated = *data
+		return nil
+	})
+	var conflict versionConflictError
+	switch {
+	case errors.As(err, &conflict):
+		c.JSON(409, gin.H{"error": "Link was changed since the version given", "version": conflict.current})
+		return updated, false
+	case errors.Is(err, errLinkOwner):
+		c.JSON(403, gin.H{"error": "Link belongs to another user"})
+		return updated, false
+	case errors.Is(err, errNeverExpires):
+		c.JSON(409, gin.H{"error": "Link never expires"})
+		return updated, false
+	case err != nil:
+		storeError(c, err)
+		return updated, false
+	}
+
+	if config.DedupeURLs && slices.Contains(changed, "url") {
+		region, _ := regionOf(code)
+		indexURL(c.Request.Context(), code, updated, region)
+	}
+	notifyWebhooks(eventLinkUpdated, code, updated, gin.H{"changed": changed, "version": updated.Version})
+	auditImpersonated(c, action, code)
+	return updated, true
+}
+
+// editedLink is the answer to an edit of a link's destination or expiry.
+func editedLink(code string, data URLData) gin.H {
+	return gin.H{
+		"code":       code,
+		"short_url":  baseURL + code,
+		"long_url":   data.LongURL,
+		"expires_at": data.expiresAt(),
+		"version":    data.Version,
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Per-link routing scripts are small Lua chunks run in a sandbox: only the
+// base, string, table and math libraries are loaded, file/OS access and
+// dynamic loading are removed, and each run is capped by a short deadline.
+// The chunk sees a read-only `request` table and returns the destination
+// URL, or nil to use the link's default.
+
+const (
+	maxScriptBytes = 4096
+	scriptTimeout  = 50 * time.Millisecond
+)
+
+var (
+	scriptCache   = make(map[[32]byte]*lua.FunctionProto)
+	scriptCacheMu sync.Mutex
+)
+
+func compileScript(source string) (*lua.FunctionProto, error) {
+	key := sha256.Sum256([]byte(source))
+
+	scriptCacheMu.Lock()
+	proto, ok := scriptCache[key]
+	scriptCacheMu.Unlock()
+	if ok {
+		return proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), "link-script")
+	if err != nil {
+		return nil, err
+	}
+	proto, err = lua.Compile(chunk, "link-script")
+	if err != nil {
+		return nil, err
+	}
+
+	scriptCacheMu.Lock()
+	scriptCache[key] = proto
+	scriptCacheMu.Unlock()
+	return proto, nil
+}
+
+func validateScript(source string) error {
+	if len(source) > maxScriptBytes {
+		return fmt.Errorf("script must be at most %d bytes", maxScriptBytes)
+	}
+	_, err := compileScript(source)
+	return err
+}
+
+func newSandbox() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 64, RegistrySize: 1024 * 16})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "getfenv", "setfenv", "rawset", "rawget", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	// string.rep can allocate gigabytes in a single call.
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", lua.LNil)
+	}
+	return L
+}
+
+func requestTable(L *lua.LState, code string, r *http.Request) *lua.LTable {
+	headers := L.NewTable()
+	for name, values := range r.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+
+	query := L.NewTable()
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+
+	req := L.NewTable()
+	req.RawSetString("code", lua.LString(code))
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("user_agent", lua.LString(r.UserAgent()))
+	req.RawSetString("referer", lua.LString(r.Referer()))
+	req.RawSetString("headers", headers)
+	req.RawSetString("query", query)
+	req.RawSetString("time", lua.LNumber(time.Now().Unix()))
+	return req
+}
+
+// runLinkScript returns the destination chosen by the link's script. Any
+// failure falls back to the default destination so a broken script never
+// takes a link down.
+func runLinkScript(ctx context.Context, code string, data URLData, r *http.Request, clientIP string) string {
+	if data.Script == "" {
+		return data.LongURL
+	}
+
+	dest, err := evalLinkScript(ctx, code, data.Script, r, clientIP)
+	if err != nil {
+		log.Printf("Script for %s failed: %v", code, err)
+		return data.LongURL
+	}
+	if dest == "" {
+		return data.LongURL
+	}
+	if !isValidURL(dest) {
+		log.Printf("Script for %s returned invalid destination %q", code, dest)
+		return data.LongURL
+	}
+	return dest
+}
+
+func evalLinkScript(ctx context.Context, code, source string, r *http.Request, clientIP string) (string, error) {
+	proto, err := compileScript(source)
+	if err != nil {
+		return "", err
+	}
+
+	L := newSandbox()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	req := requestTable(L, code, r)
+	req.RawSetString("ip", lua.LString(clientIP))
+	L.SetGlobal("request", req)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		return "", err
+	}
+
+	switch ret := L.Get(-1).(type) {
+	case *lua.LNilType:
+		return "", nil
+	case lua.LString:
+		return string(ret), nil
+	default:
+		return "", errors.New("script must return a URL string or nil")
+	}
+}
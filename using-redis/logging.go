@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// The server logs JSON lines through log/slog: an access log line per
+// request and the server's own messages. LOG_LEVEL (debug, info, warn or
+// error; default info) drops lines below it; access lines are info, warn
+// for 4xx answers and error for 5xx. Logs go to stdout unless LOG_FILE is
+// set, which is rotated once it reaches LOG_MAX_SIZE_MB (default 100),
+// keeping LOG_MAX_BACKUPS old files (default 5) for up to
+// LOG_MAX_AGE_DAYS (default 0, no limit). LOG_MAX_BACKUPS=0 keeps them
+// all.
+//
+// Logging is set up while the package initializes, so messages from
+// startup are structured too.
+var logger = setupLogging(config.Log)
+
+func setupLogging(c LogConfig) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level)) // checked by loadConfig
+
+	var w io.Writer = os.Stdout
+	if c.File != "" {
+		w = &lumberjack.Logger{
+			Filename:   c.File,
+			MaxSize:    c.MaxSizeMB,
+			MaxBackups: c.MaxBackups,
+			MaxAge:     c.MaxAgeDays,
+		}
+	}
+	l := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(l)
+	log.SetFlags(0)
+	log.SetOutput(logBridge{l})
+	return l
+}
+
+// logBridge turns the server's log.Print lines into slog records. Lines
+// reporting a failure are logged as errors, the rest as info.
+type logBridge struct {
+	l *slog.Logger
+}
+
+func (b logBridge) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := slog.LevelInfo
+	for _, prefix := range []string{"Error", "Failed", "Giving up", "listen:"} {
+		if strings.HasPrefix(msg, prefix) {
+			level = slog.LevelError
+			break
+		}
+	}
+	b.l.Log(context.Background(), level, msg)
+	return len(p), nil
+}
+
+// accessLog writes a line per request. Queries are left out, since they
+// can carry tokens.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		ctx := c.Request.Context()
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+		}
+		if code := c.Param("code"); code != "" {
+			attrs = append(attrs, slog.String("code", code))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+		logger.LogAttrs(ctx, level, "request", attrs...)
+	}
+}
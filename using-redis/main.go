@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,32 +20,159 @@ import (
 )
 
 var (
-	base62    = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	baseURL   = config.BaseURL
 	validCodeRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
-	rateLimiters = make(map[string]*rateLimiter)
+	rateLimiters = make(map[string]*tokenBucket)
 	rlMutex sync.Mutex
 )
 
-type rateLimiter struct {
-    lastRequest time.Time
-    requests    int
+// rateLimitStatus is a client's standing after a request: its limit, the
+// requests it has left right now and, once it has none, how long until
+// the next one is accepted.
+type rateLimitStatus struct {
+	limit      int
+	remaining  int
+	retryAfter time.Duration
 }
 
-const (
-	rateLimitWindow = 1 * time.Minute
-	maxRequests = 5
-)
+// setHeaders reports s in X-RateLimit-Limit, X-RateLimit-Remaining and,
+// for a refused request, Retry-After in whole seconds. When a request
+// counts against several limits, the one with the fewest requests left
+// is reported.
+func (s rateLimitStatus) setHeaders(h http.Header) {
+	if prev, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil && prev < s.remaining {
+		return
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(s.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(s.remaining))
+	if s.retryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(s.retryAfter.Seconds()))))
+	}
+}
 
 type URLData struct {
 	LongURL string `json:"long_url"`
 	Clicks int `json:"clicks"`
 	CreatedAt int64  `json:"created_at"`
-    Expiry    int64  `json:"expiry"` 
+    Expiry    int64  `json:"expiry"` // seconds after CreatedAt, 0 if the link never expires
+	Script    string `json:"script,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Variants  []string `json:"variants,omitempty"`
+	Bandit    bool   `json:"bandit,omitempty"`
+	Frozen    string `json:"frozen,omitempty"` // variant every redirect goes to while frozen
+	Owner     string `json:"owner,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Namespace string `json:"namespace,omitempty"` // the code starts with it and a '.'
+	Disabled  bool   `json:"disabled,omitempty"` // by the orphan policy after the owner was deleted
+	BlockedReferrers []string `json:"blocked_referrers,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"` // on top of GEO_BLOCK
+	MinAge    int    `json:"min_age,omitempty"` // visitors confirm this age before redirecting
+	Aliases   []string `json:"aliases,omitempty"` // created together with this link
+	AliasOf   string `json:"alias_of,omitempty"` // code this alias was created with
+	Source    *linkSource `json:"source,omitempty"`
+	Version   int64  `json:"version,omitempty"` // edits since creation, for PATCH /links/:code
+	MaxClicks int    `json:"max_clicks,omitempty"` // redirects before the link answers 410
+}
+
+// lifetime is the expiry_seconds of the link, neverExpires if it has none.
+func (d URLData) lifetime() int64 {
+	if d.Expiry == 0 {
+		return neverExpires
+	}
+	return d.Expiry
+}
+
+// expired reports whether the link has expired by now.
+func (d URLData) expired(now int64) bool {
+	return d.Expiry != 0 && now > d.CreatedAt+d.Expiry
+}
+
+// expiresAt is the expires_at of responses, null for a link that never
+// expires.
+func (d URLData) expiresAt() any {
+	if d.Expiry == 0 {
+		return nil
+	}
+	return formatUnix(d.CreatedAt + d.Expiry)
 }
 
 type Store struct {
 	IDCounter int64             `json:"idCounter"`
 	URLStore  map[string]URLData `json:"urlStore"`
+	Revision  string             `json:"revision,omitempty"`
+}
+
+// storeErrorStatus maps storage errors to HTTP statuses so every handler
+// reports the same code for the same failure.
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrExpired), errors.Is(err, ErrDisabled), errors.Is(err, ErrClickLimit):
+		return http.StatusGone
+	case errors.Is(err, ErrRejected), errors.As(err, new(quotaError)):
+		return http.StatusForbidden
+	case errors.Is(err, errNoRedis):
+		return http.StatusNotImplemented
+	case errors.Is(err, errRedisDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func storeError(c *gin.Context, err error) {
+	var quota quotaError
+	if errors.As(err, &quota) {
+		c.JSON(http.StatusForbidden, gin.H{"error": quota.Error(), "quota": quota.view()})
+		return
+	}
+	if errors.Is(err, ErrRejected) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrDisabled) {
+		c.JSON(http.StatusGone, gin.H{"error": "Link disabled"})
+		return
+	}
+	if errors.Is(err, ErrClickLimit) {
+		c.JSON(http.StatusGone, gin.H{"error": "Link reached its click limit"})
+		return
+	}
+	if errors.Is(err, errNoRedis) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Not available: " + err.Error()})
+		return
+	}
+	if errors.Is(err, errRedisDown) {
+		log.Println("Storage error:", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Not available: Redis is unreachable, try again later"})
+		return
+	}
+
+	status := storeErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Println("Storage error:", err)
+	}
+	c.JSON(status, gin.H{"error": storeErrorMessage(status)})
+}
+
+func storeErrorMessage(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return "Short URL not found"
+	case http.StatusConflict:
+		return "Short code already in use"
+	case http.StatusGone:
+		return "URL expired"
+	case http.StatusForbidden:
+		return "Rejected by policy"
+	default:
+		return "Internal storage error"
+	}
 }
 
 func isValidCode(code string) bool {
@@ -52,157 +183,443 @@ func isValidURL(url string) bool {
 	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
 }
 
-func cleanUpExpiredLinks() {
-	now := time.Now().Unix()
+// encodeID writes n in the digits of codes.alphabet, padded with its zero
+// digit to codes.min_length, so short codes like /1 never appear.
+func encodeID(n int64) string {
+	base := int64(len(codeDigits))
+	var result []byte
+	for n > 0 {
+		result = append([]byte{codeDigits[n%base]}, result...)
+		n /= base
+	}
+	for len(result) < max(config.Codes.MinLength, 1) {
+		result = append([]byte{codeDigits[0]}, result...)
+	}
+	return string(result)
+}
 
-	urls, err := ListURLs()
+func shortenHandler(c *gin.Context) {
+	body, err := bindShortenRequest(c.Request)
+	if bodyTooLarge(err) {
+		c.JSON(413, gin.H{"error": bodyTooLargeMessage()})
+		return
+	}
 	if err != nil {
-		fmt.Println("Error listing URLs:", err)
-        return
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
 	}
 
-	for _, urlData := range urls {
-		code := urlData["code"].(string)
-		expiresAtStr := urlData["expires_at"].(string)
+	if errs := body.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
 
-		expiresAt, err1 := time.Parse(time.RFC3339, expiresAtStr)
-        if err1 != nil {
-            continue
-        }
+	if errs := body.verifyDestination(c.Request.Context()); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
 
-		if  now > expiresAt.Unix() {
-			DeleteURL(code)
+	if body.Stateless {
+		expiry := int64(body.ExpirySeconds)
+		if expiry == 0 {
+			expiry = config.defaultExpirySeconds()
 		}
+		statelessShorten(c, body.URL, expiry)
+		return
 	}
 
-	fmt.Println("Expired links cleaned up.")
-}
+	body.source = newLinkSource(sourceAPI, c.Request, c.ClientIP())
+	body.owner = requestUser(c)
+	claims, impersonating := impersonation(c)
+	if impersonating {
+		body.owner = claims.User
+		body.source.Impersonation = claims.ID
+	}
+	body.source.APIKey = c.GetString(apiKeyContextKey)
+	body.tenant = requestTenant(c.Request)
 
-func encodeBase62(n int64) string {
-	if n == 0 {
-		return "0"
+	ns, err := requestNamespace(c, body.Namespace)
+	if err != nil {
+		namespaceError(c, body.Namespace, err)
+		return
 	}
-	var result []byte
-	for n > 0 {
-		result = append([]byte{base62[n%62]}, result...)
-		n /= 62
+	if !allowNamespaceCreate(c, ns) {
+		return
 	}
-	return string(result)
-}
+	body.inNamespace(ns)
+	body.region = requestRegion(c.Request, ns.Name)
 
-func shortenHandler(c *gin.Context) {
-	var body struct {
-		URL        string `json:"url"`
-		CustomCode string `json:"custom_code,omitempty"`
-		ExpirySeconds  int64  `json:"expiry_seconds,omitempty"`
+	code, expiry, created, err := createLink(c.Request.Context(), body)
+	if err != nil {
+		storeError(c, err)
+		return
 	}
 
-	if err := c.BindJSON(&body); err != nil || body.URL == ""{
-		c.JSON(400, gin.H{"error": "Invalid request body"})
-		return
+	if created {
+		auditImpersonated(c, "link.create", code)
 	}
 
-	if !isValidURL(body.URL) {
-		c.JSON(400, gin.H{"error": "Invalid URL. Must start with http:// or https://"})
-		return
+	shortURL := baseURL + code
+	payload := gin.H{"code": code, "short_url": shortURL, "expiry_seconds": expiry}
+	if !created {
+		payload["existing"] = true
 	}
+	if len(body.Aliases) > 0 {
+		payload["aliases"] = body.Aliases
+	}
+	respondFields(c, payload)
+}
 
-	var code string
-	if body.CustomCode != "" {
-		if !isValidCode(body.CustomCode) {
-			c.JSON(400, gin.H{"error": "Invalid custom code. Use only letters and numbers"})
-			return
-		}
-		_, err := GetURL(body.CustomCode) 
-		if err == nil {
-			c.JSON(409, gin.H{"error": "Custom code already in use"})
-			return
+// createLink stores a validated request and returns its code and expiry.
+// created is false when on_conflict=return_existing or dedupe_urls matched
+// an existing link.
+func createLink(ctx context.Context, body shortenRequest) (code string, expiry int64, created bool, err error) {
+	body.CustomCode = foldCode(body.CustomCode)
+	for i, alias := range body.Aliases {
+		body.Aliases[i] = foldCode(alias)
+	}
+	if config.DedupeURLs && body.dedupable() {
+		if code, existing, ok := findDuplicate(ctx, body); ok {
+			return code, existing.lifetime(), false, nil
 		}
+	}
+	if body.CustomCode != "" {
 		code = body.CustomCode
-	} else {
-		id, err := GetNextID()
-		if err != nil {
-			c.JSON(500, gin.H{"error": "Failed to generate short code"})
-			return
-		}
-		code = encodeBase62(id)
+	} else if code, err = nextCode(body.namespace.Name); err != nil {
+		return "", 0, false, err
 	}
 
-	expiry := body.ExpirySeconds
+	expiry = int64(body.ExpirySeconds)
 	if expiry == 0 {
-		expiry = 7 * 24 * 3600 // Default 7 days
+		expiry = config.defaultExpirySeconds()
 	}
+	blockedReferrers, _ := normalizeReferrerPatterns(body.BlockReferrers) // checked by validate
+	blockedCountries, _ := normalizeCountries(body.BlockCountries)
 
 	data := URLData{
 		LongURL: body.URL,
 		Clicks: 0,
 		CreatedAt: time.Now().Unix(),
-		Expiry: expiry, // 7 days in seconds
+		Expiry: max(expiry, 0), // neverExpires is stored as 0
+		Script: body.Script,
+		Tags: body.Tags,
+		Fallbacks: body.Fallbacks,
+		SampleRate: body.SampleRate,
+		Variants: body.Variants,
+		Bandit: body.Bandit,
+		BlockedReferrers: blockedReferrers,
+		BlockedCountries: blockedCountries,
+		MinAge: body.MinAge,
+		Aliases: body.Aliases,
+		MaxClicks: body.MaxClicks,
+		Owner: body.owner,
+		Tenant: body.tenant,
+		Namespace: body.namespace.Name,
+		Source: body.source,
+	}
+	if err := checkLinkQuotas(data, body.namespace, len(body.Aliases)+1); err != nil {
+		return "", 0, false, err
 	}
 
-	err := SaveURL(code, data)
+	// Aliases are links of their own with the same settings, created in
+	// one step with the link so a failure leaves none of them behind.
+	create := func(code string) error {
+		if slices.Contains(body.Aliases, code) {
+			return codeTakenError{code} // a generated code that is also an alias
+		}
+		codes, links := []string{code}, []URLData{data}
+		for _, alias := range body.Aliases {
+			aliasData := data
+			aliasData.Aliases, aliasData.AliasOf = nil, code
+			codes, links = append(codes, alias), append(links, aliasData)
+		}
+		for i := range codes {
+			if err := runCreateHooks(ctx, codes[i], links[i]); err != nil {
+				return err
+			}
+		}
+		return CreateURLsIn(ctx, body.region, codes, links)
+	}
+
+	err = create(code)
+	// A generated code can still be claimed by another request between
+	// nextCode's check and the write; another one is tried instead.
+	var taken codeTakenError
+	for attempt := 1; errors.As(err, &taken) && taken.code == code && body.CustomCode == "" && attempt < maxIDAttempts; attempt++ {
+		if code, err = nextCode(body.namespace.Name); err != nil {
+			return "", 0, false, err
+		}
+		err = create(code)
+	}
+	if errors.Is(err, ErrConflict) && body.CustomCode != "" {
+		switch body.OnConflict {
+		case conflictReturnExisting:
+			if existing, getErr := GetActiveURL(code); getErr == nil && existing.LongURL == body.URL {
+				return code, existing.lifetime(), false, nil
+			}
+		case conflictSuffix:
+			for n := 2; n <= maxConflictSuffix && errors.Is(err, ErrConflict); n++ {
+				code = fmt.Sprintf("%s-%d", body.CustomCode, n)
+				err = create(code)
+			}
+		}
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving URL"})
-		return
+		return "", 0, false, err
+	}
+	if config.DedupeURLs {
+		indexURL(ctx, code, data, body.region)
+	}
+	for range len(body.Aliases) + 1 {
+		recordLinkCreated(data.Tenant, data.Source.apiKey())
+	}
+	notifyWebhooks(eventLinkCreated, code, data, nil)
+	for _, alias := range body.Aliases {
+		notifyWebhooks(eventLinkCreated, alias, data, gin.H{"alias_of": code})
+	}
+	return code, expiry, true, nil
+}
+
+// nextCode returns a generated code in namespace ns that no link has and
+// no route or reserved word shadows. Taken codes are skipped, so a counter
+// that runs into custom codes claimed ahead of it moves past the whole
+// run at once; maxTakenCodes in a row is an error rather than a loop.
+func nextCode(ns string) (string, error) {
+	for skipped := 0; ; skipped++ {
+		id, err := idGenerator.NextID()
+		if err != nil {
+			return "", err
+		}
+		code := encodeID(id)
+		taken := ns == "" && reservedCode(code)
+		if !taken {
+			code = qualify(ns, code)
+			if taken, err = codeStored(code); err != nil {
+				return "", err
+			}
+		}
+		if !taken {
+			if skipped > 0 {
+				log.Printf("Skipped %d taken generated codes before %s", skipped, code)
+			}
+			return code, nil
+		}
+		if skipped+1 >= maxTakenCodes {
+			return "", fmt.Errorf("%d generated codes in a row were taken: %w", maxTakenCodes, ErrConflict)
+		}
 	}
+}
 
-	shortURL := fmt.Sprintf("http://localhost:8080/%s", code)
-	c.JSON(200, gin.H{"short_url": shortURL})
+// codeStored reports whether a link has code or, with
+// codes.case_insensitive, the lowercase code it would also answer to.
+func codeStored(code string) (bool, error) {
+	for _, c := range slices.Compact([]string{code, foldCode(code)}) {
+		_, err := GetURL(c)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+	}
+	return false, nil
 }
 
 func handleRedirects(c *gin.Context) {
 	code := c.Param("code")
 
-	now := time.Now().Unix()
-
-	data, err := GetURL(code)
+	ctx := c.Request.Context()
+	data, err := GetRedirectURL(ctx, code)
+	if errors.Is(err, ErrNotFound) {
+		if normalized := normalizeCode(code); normalized != code {
+			code = normalized
+			data, err = GetRedirectURL(ctx, code)
+		}
+	}
 	if err != nil {
-		c.JSON(404, gin.H{"error": "URL not found"})
+		storeError(c, err)
 		return
 	}
 
-	if data.Expiry != 0 && now > data.CreatedAt+data.Expiry {
-		c.JSON(410, gin.H{"error": "URL expired"})
+	if blockGeo(c, data) || blockReferrer(c, code, data) || showAgeGate(c, code, data) || showConsent(c, code, data) {
 		return
 	}
-	data.Clicks++
-	err = SaveURL(code, data)
-
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to update clicks"})
+	if err := runRedirectHooks(c.Request.Context(), code, data, c.Request); err != nil {
+		storeError(c, err)
+		return
+	}
+	// Replicas only serve redirects; clicks are counted on the primary.
+	// Sampled links write 1 in sample_rate clicks, counted that many times.
+	if data.MaxClicks > 0 && replicaMode.Load() {
+		redirectToPrimary(c)
 		return
 	}
+	variant := -1
+	if len(data.Variants) > 0 {
+		variant = pickVariant(code, data)
+		data.LongURL = data.destinations()[variant]
+		setVariantCookie(c, code, variant)
+	}
+
+	var weight int
+	if !replicaMode.Load() && sampleClick(data.SampleRate) {
+		weight = max(data.SampleRate, 1)
+		data.Clicks, err = IncrementClicks(ctx, code, weight, data.MaxClicks)
+		if errors.Is(err, ErrClickLimit) {
+			storeError(c, err)
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update clicks"})
+			return
+		}
+		// The counters below write with the background context, so their
+		// Redis commands show up as this one span.
+		_, span := startSpan(ctx, "redirect.recordClick")
+		recordClickBuckets(code, weight, time.Now())
+		recordTopClicks(code, data.Clicks)
+		notifyClickThreshold(code, data, data.Clicks-weight, data.Clicks)
+		recordUnique(code, c.ClientIP())
+		if recordClickEvents(c.Request) {
+			recordClick(code, c.ClientIP(), c.Request.Referer(), c.Request.UserAgent(), geo.visitorLocation(c.Request, c.ClientIP()), weight)
+		}
+		if variant >= 0 {
+			if err := RecordVariant(code, variant, "visits", weight); err != nil {
+				log.Println("Error recording variant visit:", err)
+			}
+		}
+		span.End()
+	}
 
-	c.Redirect(http.StatusFound, data.LongURL)
+	recordRedirect(data.Tenant, data.Source.apiKey())
+	if len(data.Fallbacks) > 0 {
+		data.LongURL = healthyDestination(data)
+	}
+	publishRedirect(c.Request, c.ClientIP(), code, data, variant, weight)
+	c.Redirect(http.StatusFound, runLinkScript(c.Request.Context(), code, data, c.Request, c.ClientIP()))
 }
 
 func infoHandler(c *gin.Context) {
 	code := c.Param("code")
 	data, err := GetURL(code)
 	if err != nil {
-		c.JSON(404, gin.H{"error": "Short URL not found"})
+		storeError(c, err)
 		return
 	}
 
-	current_time := time.Now().Unix()
-	expiryTime := data.CreatedAt + data.Expiry
+	blockedHits, err := ReferrerBlockedHits(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	uniqueClicks, err := UniqueClicks(code, data.SampleRate)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
 
 	info := gin.H{
+		"code":       code,
+		"short_url":  baseURL + code,
 		"long_url":   data.LongURL,
 		"clicks":     data.Clicks,
+		"unique_clicks": uniqueClicks,
 		"created_at": time.Unix(data.CreatedAt, 0).UTC().Format(time.RFC3339),
-		"expires_at": time.Unix(expiryTime, 0).UTC().Format(time.RFC3339),
-		"is_expired": current_time > expiryTime,
+		"expires_at": data.expiresAt(),
+		"is_expired": data.expired(time.Now().Unix()),
+		"tags":       data.Tags,
+		"fallbacks":  data.Fallbacks,
+		"sample_rate": max(data.SampleRate, 1),
+		"variants":   data.Variants,
+		"bandit":     data.Bandit,
+		"owner":      data.Owner,
+		"namespace":  data.Namespace,
+		"disabled":   data.Disabled,
+		"blocked_referrers": data.BlockedReferrers,
+		"blocked_countries": data.BlockedCountries,
+		"min_age":    data.MinAge,
+		"aliases":    data.Aliases,
+		"alias_of":   data.AliasOf,
+		"blocked_hits": blockedHits,
+		"version":    data.Version,
+		"max_clicks": data.MaxClicks,
+		"clicks_left": data.clicksLeft(),
+		"source":     data.Source.view(isAdmin(c.Request)),
 	}
 
-	c.JSON(200, info)
+	respondFields(c, info)
+}
+
+// respondFields honours ?fields=a,b. A single field is written as plain
+// text so shell scripts can use it directly; several fields return a
+// trimmed JSON object.
+func respondFields(c *gin.Context, payload gin.H) {
+	fields := c.Query("fields")
+	if fields == "" {
+		c.JSON(200, payload)
+		return
+	}
+
+	selected := gin.H{}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		value, ok := payload[field]
+		if !ok {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Unknown field %q", field)})
+			return
+		}
+		selected[field] = value
+	}
+
+	if len(selected) == 1 {
+		for _, value := range selected {
+			c.String(200, "%v\n", value)
+		}
+		return
+	}
+	c.JSON(200, selected)
 }
 
 func listHandle(c *gin.Context) {
 
+	filter, err := parseSourceFilter(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	admin := isAdmin(c.Request)
+	if filter.ip.IsValid() && !admin {
+		c.JSON(401, gin.H{"error": "Admin token required to filter by ip"})
+		return
+	}
+
 	var allLinks []map[string]any
 
-	allLinks, err := ListURLs()
+	// Signed-in users see only their own links, API keys the links made
+	// with them, admins everything. A namespace's users and keys all see
+	// its links.
+	owner := requestUser(c)
+	key := c.GetString(apiKeyContextKey)
+	filter.apiKey = key
+	ns := c.Query("namespace")
+	if ns != "" && !admin {
+		bound := c.GetString(namespaceContextKey)
+		if key == "" {
+			if bound, err = userNamespace(owner); err != nil {
+				storeError(c, err)
+				return
+			}
+		}
+		if bound != ns {
+			c.JSON(403, gin.H{"error": "You may not list namespace " + ns})
+			return
+		}
+		owner, filter.apiKey = "", ""
+	}
+	if admin {
+		owner = ""
+	}
+	allLinks, err = ListURLs(filter, owner, ns, admin)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to list URLs"})
 		return
@@ -213,57 +630,223 @@ func listHandle(c *gin.Context) {
 
 func deleteHandle(c *gin.Context) {
 	code := c.Param("code")
+	data, err := GetURL(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	if !mayManage(c, &data) {
+		c.JSON(403, gin.H{"error": "Link belongs to another user"})
+		return
+	}
 
-	err := DeleteURL(code)
-    if err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found or could not be deleted"})
-        return
-    }
+	if err := DeleteURL(code); err != nil {
+		storeError(c, err)
+		return
+	}
+	runDeleteHooks(c.Request.Context(), code)
+	notifyWebhooks(eventLinkDeleted, code, data, nil)
+	auditImpersonated(c, "link.delete", code)
 
 	c.Status(http.StatusNoContent)
 }
 
-func rateLimitMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ip := c.ClientIP()
-
-		rlMutex.Lock()
-		limiter, exists := rateLimiters[ip]
-		if !exists || time.Since(limiter.lastRequest) > rateLimitWindow {
-			limiter = &rateLimiter{
-				lastRequest: time.Now(),
-				requests: 1,
-			}
+func exportHandle(c *gin.Context) {
+	var snapshot Store
+	var err error
+	if at := c.Query("at"); at != "" {
+		ts, parseErr := strconv.ParseInt(at, 10, 64)
+		if parseErr != nil {
+			c.JSON(400, gin.H{"error": "Invalid at timestamp"})
+			return
+		}
+		snapshot, err = SnapshotAt(ts)
+	} else {
+		snapshot, err = SnapshotStore()
+	}
+	if errors.Is(err, errNoOplog) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to export store"})
+		return
+	}
 
-			rateLimiters[ip] = limiter
-			rlMutex.Unlock()
+	if backupKey != "" {
+		artifact, err := sealBackup(snapshot)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to encrypt export"})
 			return
 		}
+		c.JSON(200, artifact)
+		return
+	}
+	c.JSON(200, snapshot)
+}
+
+func changesHandle(c *gin.Context) {
+	since := c.DefaultQuery("since", "0")
+
+	if err := checkCompacted(since); err != nil {
+		if errors.Is(err, errCompacted) {
+			c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		} else {
+			storeError(c, err)
+		}
+		return
+	}
+
+	ops, err := ChangesSince(since)
+	if errors.Is(err, errNoOplog) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid since revision"})
+		return
+	}
 
-		if limiter.requests >= maxRequests {
-			rlMutex.Unlock()
+	revision := since
+	if len(ops) > 0 {
+		revision = ops[len(ops)-1].Revision
+	}
+	c.JSON(200, gin.H{"since": since, "revision": revision, "changes": ops})
+}
+
+// rateLimitMiddleware limits requests with an API key by the key and the
+// rest by client IP. It runs after apiKeyGuard.
+func rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, limit := c.ClientIP(), config.RateLimit.Requests
+		if id := c.GetString(apiKeyContextKey); id != "" {
+			key, limit = "key:"+id, c.GetInt(apiKeyRateLimitContextKey)
+		}
+		status, ok := allowRequest(key, limit, config.RateLimit.Window)
+		status.setHeaders(c.Writer.Header())
+		if !ok {
 			c.AbortWithStatusJSON(429, gin.H{"error": "Rate limit exceeded. Try again later."})
 			return
 		}
+	}
+}
+
+// redirectRateLimit limits redirects per client IP, in buckets separate
+// from the API's, so a client flooding a link runs out of redirects long
+// before it could slow the store down, and neither limit uses up the
+// other. Only refused redirects report the limit: the others may be kept
+// by edge caches, which would hand one client's count to everyone.
+func redirectRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.RateLimit.Redirects == 0 {
+			return
+		}
+		status, ok := allowRequest("redirect:"+c.ClientIP(), config.RateLimit.Redirects, config.RateLimit.Window)
+		if !ok {
+			status.setHeaders(c.Writer.Header())
+			c.AbortWithStatusJSON(429, gin.H{"error": "Too many redirects. Try again later."})
+		}
+	}
+}
 
-		limiter.requests++
-		limiter.lastRequest = time.Now()
-		rlMutex.Unlock()
+// allowRequest takes a token for a request from the bucket of key, a
+// client IP, "redirect:" and a client IP, "key:" and an API key ID or
+// "ns:" and a namespace. Buckets hold limit tokens, refilled
+// evenly over window, so a client can burst limit requests and is then
+// held to their average rate instead of waiting for a window to end. A
+// changed limit starts a new bucket.
+func allowRequest(key string, limit int, window time.Duration) (rateLimitStatus, bool) {
+	rlMutex.Lock()
+	limiter, exists := rateLimiters[key]
+	if !exists || limiter.burst != float64(limit) {
+		limiter = newTokenBucket(float64(limit)/window.Seconds(), float64(limit))
+		rateLimiters[key] = limiter
 	}
+	rlMutex.Unlock()
+
+	remaining, retryAfter, ok := limiter.take()
+	return rateLimitStatus{limit: limit, remaining: remaining, retryAfter: retryAfter}, ok
 }
 
 func main() {
-	router := gin.Default()
+	if configErr != nil && !checkMode {
+		log.Fatal(configErr)
+	}
+	if !config.dotenv {
+		log.Println("No .env file found, using system environment variables")
+	}
+	connectRedis()
 
-	router.POST("/shorten", rateLimitMiddleware(), shortenHandler)
-	router.GET("/:code", handleRedirects)
-	router.GET("/info/:code", infoHandler)
-	router.GET("/list", listHandle)
-	router.DELETE("/delete/:code", deleteHandle)
+	if checkMode {
+		os.Exit(runChecks())
+	}
+	if storeBackendErr != nil {
+		log.Fatal(storeBackendErr)
+	}
+	if seedMode {
+		os.Exit(runSeed(os.Args[2:]))
+	}
+	if backfillMode {
+		os.Exit(runBackfill(os.Args[2:]))
+	}
+	if migrateMode {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	if floor := config.Codes.CounterStart; floor > 0 && primaryURL == "" {
+		if err := EnsureCounterFloor(floor); err != nil {
+			log.Fatalf("Failed to apply ID counter floor: %v", err)
+		}
+	}
+	if idGeneratorErr != nil {
+		log.Fatal(idGeneratorErr)
+	}
+	if geoErr != nil {
+		log.Fatal(geoErr)
+	}
+	if tenantSnippetsErr != nil {
+		log.Fatal(tenantSnippetsErr)
+	}
+	if eventStreamErr != nil {
+		log.Fatal(eventStreamErr)
+	}
+	if err := links.Prepare(); err != nil {
+		log.Fatalf("Failed to prepare store: %v", err)
+	}
+	// Without Redis at startup, the indexes are built at the next start.
+	if err := prepareQuotaIndex(); errors.Is(err, errRedisDown) {
+		log.Println("Quota index not built:", err)
+	} else if err != nil {
+		log.Fatalf("Failed to build quota index: %v", err)
+	}
+	if err := prepareTopIndex(); errors.Is(err, errRedisDown) {
+		log.Println("Top links index not built:", err)
+	} else if err != nil {
+		log.Fatalf("Failed to build top links index: %v", err)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to start tracing: %v", err)
+	}
+
+	if config.IPAccessFile != "" {
+		if ipAccess, err = newIPAccessFile(config.IPAccessFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	router, err := newRouter()
+	if err != nil {
+		log.Fatalf("Failed to set up routes: %v", err)
+	}
 
 	srv := &http.Server{
-		Addr: ":8080",
+		Addr: config.listenAddr(),
 		Handler: router,
+		ReadHeaderTimeout: config.Timeouts.ReadHeader,
+		ReadTimeout: config.Timeouts.Read,
+		WriteTimeout: config.Timeouts.Write,
+		IdleTimeout: config.Timeouts.Idle,
 	}
 
 	go func(){
@@ -275,21 +858,81 @@ func main() {
 
 	stopCleanup := make(chan struct{})
 	go startCleanupTicker(stopCleanup)
+	go redirectLatency.run(stopCleanup)
+	if redirectCache != nil {
+		go redirectCache.run(stopCleanup)
+	}
+	// These keep their state in Redis; without it they have nothing to do.
+	if config.usesRedis() {
+		if interval := config.HealthCheck; interval > 0 {
+			go startHealthChecker(interval, stopCleanup)
+		}
+		if interval := config.Orphans.SweepInterval; interval > 0 {
+			go startOrphanSweeper(interval, stopCleanup)
+		}
+		if interval := config.Verify.Interval; interval > 0 {
+			go startVerifier(interval, stopCleanup)
+		}
+		if interval := kvPushInterval(); interval > 0 {
+			go startKVPush(interval, stopCleanup)
+		}
+		if primaryURL == "" {
+			go startWebhookDeliveries(stopCleanup)
+		}
+	}
+	if eventStream != nil {
+		go eventStream.run()
+	}
+
+	if primaryURL != "" {
+		replicaMode.Store(true)
+		egressAllow.allowURLHost(primaryURL)
+		go startReplication(config.Replica.PollInterval)
+		log.Println("Running as read-only replica of", primaryURL)
+	}
+
+	var debugSrv *http.Server
+	if debugAddr != "" {
+		if debugSrv, err = startDebugServer(debugAddr); err != nil {
+			log.Fatalf("Failed to serve debug endpoints: %v", err)
+		}
+		log.Println("Serving pprof and expvar at", debugAddr)
+	}
+
+	var redirectSrv *http.Server
+	if config.TLS.enabled() {
+		tlsConfig, redirect, err := newTLSConfig(config.TLS)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		srv.TLSConfig = tlsConfig
+		if port := config.TLS.RedirectPort; port != 0 {
+			if redirectSrv, err = startRedirectServer(port, redirect); err != nil {
+				log.Fatalf("Failed to serve HTTPS redirects: %v", err)
+			}
+			log.Printf("Redirecting HTTP on :%d to HTTPS", port)
+		}
+	}
 
 	go func(){
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serve := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
-    log.Println("Server is running at :8080")
+    log.Println("Server is running at", config.listenAddr())
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
-	fmt.Println("Shutdown Server ...")
+	log.Println("Shutdown Server ...")
 
 	close(stopCleanup)
+	stopReplication()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
 	defer cancel()
@@ -297,31 +940,203 @@ func main() {
     if err := srv.Shutdown(ctx); err != nil {
         log.Fatal("Server Shutdown:", err)
     }
+	closeLinks()
+	if eventStream != nil {
+		eventStream.stop()
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Println("Error flushing traces:", err)
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+	}
+	if redirectSrv != nil {
+		redirectSrv.Close()
+	}
 
 	log.Println("Server exiting")
 }
 
+// newRouter registers every route with its middleware.
+func newRouter() (*gin.Engine, error) {
+	router := gin.New()
+	// ClientIP, which rate limits, logs and counts clicks by, believes
+	// X-Forwarded-For and X-Real-IP only from these peers. With none, it
+	// is the peer's address.
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	// accessLog runs inside the tracing middleware to log the trace ID,
+	// and logs the clients ipAccessGuard refuses too.
+	router.Use(gin.Recovery(), tracingMiddleware(), accessLog(), ipAccessGuard(), caseInsensitiveCodes())
+	// Wrong methods get 405 with an Allow header instead of 404.
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(methodNotAllowed)
+
+	router.POST("/shorten", limitBody(), readOnlyGuard(), adminScopeGuard(false), authProxyGuard(), userTokenGuard(), impersonationGuard(scopeLinksCreate), apiKeyGuard(), rateLimitMiddleware(), idempotencyMiddleware(), shortenHandler)
+	router.GET("/:code", redirectRateLimit(), latencyMiddleware(redirectLatency), handleRedirects)
+	router.GET("/s/:token", redirectRateLimit(), latencyMiddleware(redirectLatency), statelessRedirect)
+	router.GET("/new", newFormHandle)
+	router.POST("/new", limitBody(), readOnlyGuard(), adminScopeGuard(false), authProxyGuard(), userTokenGuard(), apiKeyGuard(), rateLimitMiddleware(), newFormSubmit)
+	router.GET("/qr/:code", qrHandle)
+	router.GET("/pixel/:code", readOnlyGuard(), pixelHandle)
+	router.GET("/variants/:code", variantsHandle)
+	router.POST("/variants/:code/freeze", linkGuards(scopeLinksUpdate, freezeVariantHandle)...)
+	router.DELETE("/variants/:code/freeze", linkGuards(scopeLinksUpdate, unfreezeVariantHandle)...)
+	router.PUT("/blocked-referrers/:code", linkGuards(scopeLinksUpdate, blockedReferrersHandle)...)
+	router.PUT("/blocked-countries/:code", linkGuards(scopeLinksUpdate, blockedCountriesHandle)...)
+	router.POST("/age/:code", ageGateHandle)
+	router.POST("/consent/:code", consentHandle)
+	router.GET("/snippet/:tenant/:file", snippetHandle)
+	router.POST("/auth/signup", readOnlyGuard(), accountsGuard(), redisGuard(), apiKeyGuard(), rateLimitMiddleware(), signupHandle)
+	router.POST("/auth/login", accountsGuard(), redisGuard(), rateLimitMiddleware(), loginHandle)
+	router.GET("/auth/oauth/:provider", oauthGuard(), redisGuard(), oauthStartHandle)
+	router.GET("/auth/oauth/:provider/callback", readOnlyGuard(), oauthGuard(), redisGuard(), rateLimitMiddleware(), oauthCallbackHandle)
+	router.GET("/info/:code", infoHandler)
+	router.GET("/quota", authProxyGuard(), userTokenGuard(), impersonationGuard(scopeLinksCreate), apiKeyGuard(), quotaHandle)
+	router.GET("/list", adminScopeGuard(true), authProxyGuard(), userTokenGuard(), apiKeyGuard(), signedInGuard(), listHandle)
+	router.GET("/top", adminGuard(), redisGuard(), topHandle)
+	router.POST("/webhooks", adminScopeGuard(true), redisGuard(), readOnlyGuard(), authProxyGuard(), userTokenGuard(), signedInGuard(), createWebhookHandle)
+	router.GET("/webhooks", adminScopeGuard(true), redisGuard(), authProxyGuard(), userTokenGuard(), signedInGuard(), listWebhooksHandle)
+	router.DELETE("/webhooks/:id", adminScopeGuard(true), redisGuard(), readOnlyGuard(), authProxyGuard(), userTokenGuard(), signedInGuard(), deleteWebhookHandle)
+	router.GET("/calendar.ics", calendarHandle)
+	router.POST("/calendar-token", adminScopeGuard(true), authProxyGuard(), userTokenGuard(), signedInGuard(), calendarTokenHandle)
+	router.GET("/status", statusHandle)
+	router.GET("/stats/summary", statsSummaryHandle)
+	router.GET("/stats/compare", redisGuard(), compareStatsHandle)
+	router.GET("/stats/:code", redisGuard(), clickBucketsHandle)
+	router.GET("/analytics/export", adminGuard(), redisGuard(), bulkTransfer(), exportAllAnalyticsHandle)
+	router.GET("/analytics/:code", linkReadGuards(redisGuard(), analyticsHandle)...)
+	router.GET("/analytics/:code/export", linkReadGuards(redisGuard(), bulkTransfer(), exportAnalyticsHandle)...)
+	router.GET("/metrics", metricsHandle)
+	router.PATCH("/links/:code", linkGuards(scopeLinksUpdate, patchLinkHandle)...)
+	router.POST("/links/:code/extend", linkGuards(scopeLinksUpdate, extendLinkHandle)...)
+	router.DELETE("/delete/:code", linkGuards(scopeLinksDelete, deleteHandle)...)
+	router.GET("/export", replicationGuard(), bulkTransfer(), exportHandle)
+	router.POST("/export/verify", replicationGuard(), bulkTransfer(), verifyBackupHandle)
+	router.GET("/export/changes", replicationGuard(), changesHandle)
+	router.GET("/sync", replicationGuard(), syncHandle)
+	router.GET("/export/kv", replicationGuard(), redisGuard(), bulkTransfer(), kvExportHandle)
+	router.POST("/export/kv/push", replicationGuard(), redisGuard(), kvPushHandle)
+	router.GET("/admin/export", adminGuard(), bulkTransfer(), adminExportHandle)
+	router.POST("/admin/import", readOnlyGuard(), adminGuard(), bulkTransfer(), adminImportHandle)
+	router.POST("/admin/promote", adminGuard(), promoteHandle)
+	router.POST("/admin/links/expiry", readOnlyGuard(), adminGuard(), bulkExpiryHandle)
+	router.POST("/admin/impersonate", readOnlyGuard(), adminGuard(), redisGuard(), impersonateHandle)
+	router.GET("/admin/audit", adminGuard(), redisGuard(), auditHandle)
+	router.POST("/admin/api-keys", readOnlyGuard(), adminGuard(), redisGuard(), createAPIKeyHandle)
+	router.GET("/admin/api-keys", adminGuard(), redisGuard(), listAPIKeysHandle)
+	router.DELETE("/admin/api-keys/:id", readOnlyGuard(), adminGuard(), redisGuard(), revokeAPIKeyHandle)
+	router.PUT("/admin/api-keys/:id/rate-limit", readOnlyGuard(), adminGuard(), redisGuard(), setAPIKeyRateLimitHandle)
+	router.GET("/debug/trace/:code", adminGuard(), traceHandle)
+	router.DELETE("/admin/users/:user", readOnlyGuard(), adminGuard(), redisGuard(), deleteOwnerHandle)
+	router.POST("/admin/users/:user/restore", readOnlyGuard(), adminGuard(), redisGuard(), restoreOwnerHandle)
+	router.PUT("/admin/users/:user/role", readOnlyGuard(), adminGuard(), redisGuard(), setRoleHandle)
+	router.PUT("/admin/users/:user/namespace", readOnlyGuard(), adminGuard(), redisGuard(), setUserNamespaceHandle)
+	router.GET("/admin/namespaces", adminGuard(), listNamespacesHandle)
+	router.PUT("/admin/namespaces/:namespace", readOnlyGuard(), adminGuard(), putNamespaceHandle)
+	router.DELETE("/admin/namespaces/:namespace", readOnlyGuard(), adminGuard(), deleteNamespaceHandle)
+	router.POST("/admin/cleanup", readOnlyGuard(), adminGuard(), cleanupHandle)
+	router.POST("/admin/calendar-token", adminGuard(), calendarTokenHandle)
+	router.GET("/admin/storage", adminGuard(), redisGuard(), storageHandle)
+	router.POST("/admin/storage/compact", readOnlyGuard(), adminGuard(), redisGuard(), compactHandle)
+	router.POST("/import", readOnlyGuard(), adminGuard(), redisGuard(), bulkTransfer(), importHandle)
+	router.GET("/import/:job", adminGuard(), redisGuard(), importStatusHandle)
+	router.POST("/import/:job/resume", readOnlyGuard(), adminGuard(), redisGuard(), resumeImportHandle)
+	registerOptions(router)
+	return router, nil
+}
+
+// routeAllow maps each route pattern to its Allow header value.
+var routeAllow = make(map[string]string)
+
+// registerOptions answers OPTIONS on every registered path with the methods
+// it supports. Call it after all other routes are added.
+func registerOptions(router *gin.Engine) {
+	methods := make(map[string][]string)
+	for _, route := range router.Routes() {
+		methods[route.Path] = append(methods[route.Path], route.Method)
+	}
+
+	for path, allowed := range methods {
+		slices.Sort(allowed)
+		header := strings.Join(append(allowed, http.MethodOptions), ", ")
+		routeAllow[path] = header
+		router.OPTIONS(path, func(c *gin.Context) {
+			c.Header("Allow", header)
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
+
+// methodNotAllowed replaces gin's Allow header, which can list methods of
+// unrelated routes, with the one for the pattern the path actually hits.
+func methodNotAllowed(c *gin.Context) {
+	best, bestStatic := "", -1
+	parts := strings.Split(c.Request.URL.Path, "/")
+	for pattern := range routeAllow {
+		segments := strings.Split(pattern, "/")
+		if len(segments) != len(parts) {
+			continue
+		}
+		static := 0
+		for i, seg := range segments {
+			if strings.HasPrefix(seg, ":") {
+				continue
+			}
+			if seg != parts[i] {
+				static = -1
+				break
+			}
+			static++
+		}
+		if static > bestStatic {
+			best, bestStatic = pattern, static
+		}
+	}
+
+	if best != "" {
+		c.Header("Allow", routeAllow[best])
+	}
+	c.JSON(405, gin.H{"error": "Method not allowed"})
+}
+
 func cleanRateLimiters() {
 	rlMutex.Lock()
 	defer rlMutex.Unlock()
 
-	now := time.Now()
-
-	for ip, rl := range rateLimiters {
-		if now.Sub(rl.lastRequest) > 2 * time.Minute {
-			delete(rateLimiters, ip)
+	for key, rl := range rateLimiters {
+		if rl.full() {
+			delete(rateLimiters, key)
 		}
 	}
 }
 
 func startCleanupTicker(stop <-chan struct{}) {
-    ticker := time.NewTicker(24 * time.Hour)
+    ticker := time.NewTicker(config.CleanupInterval)
     defer ticker.Stop()
 
+    // A run in progress stops at the next page once shutdown begins.
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        <-stop
+        cancel()
+    }()
+
     for {
         select {
         case <-ticker.C:
-            cleanUpExpiredLinks()
+            // Expired links are removed on the primary and replicated.
+            if !replicaMode.Load() {
+                cleanUpExpiredLinks(ctx)
+                if !config.usesRedis() {
+                    continue
+                }
+                if err := rollUpClicks(time.Now()); err != nil {
+                    log.Println("Error rolling up clicks:", err)
+                }
+            }
         case <-stop:
             log.Println("Cleanup ticker stopped.")
             return
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// max_clicks stops a link after that many redirects, e.g. 1 for a one-time
+// link. IncrementClicks checks the limit in the same atomic step that
+// counts the click, so concurrent redirects cannot get past it: the one
+// that would goes the way of every later one, 410. Every click of such a
+// link has to be counted, so it cannot be sampled, and it cannot have
+// aliases, which count clicks of their own. Replicas count no clicks and
+// send these links to the primary.
+
+// ErrClickLimit is returned for links that have used up their max_clicks.
+var ErrClickLimit = errors.New("link reached its click limit")
+
+// clicksUsedUp reports whether the link has no redirects left.
+func (d URLData) clicksUsedUp() bool {
+	return d.MaxClicks > 0 && d.Clicks >= d.MaxClicks
+}
+
+// clicksLeft is the clicks_left of /info, null for links without a limit.
+func (d URLData) clicksLeft() any {
+	if d.MaxClicks == 0 {
+		return nil
+	}
+	return max(d.MaxClicks-d.Clicks, 0)
+}
+
+// redirectToPrimary sends the visitor of a max_clicks link from a replica
+// to the primary, which can count the click.
+func redirectToPrimary(c *gin.Context) {
+	c.Redirect(http.StatusTemporaryRedirect, primaryURL+c.Request.URL.RequestURI())
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// migrateMode is set when the binary runs as `migrate`, which copies the
+// links and ID counter of a store.json into the configured backend, or
+// from the backend into a store.json.
+var migrateMode = len(os.Args) > 1 && os.Args[1] == "migrate"
+
+type migrateOptions struct {
+	from, to  string // the store.json to read or write; exactly one is set
+	dryRun    bool
+	overwrite bool
+}
+
+func parseMigrateArgs(args []string) (migrateOptions, error) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "copy the links of this store.json into the configured backend")
+	to := fs.String("to", "", "copy the links of the configured backend into this store.json")
+	dryRun := fs.Bool("dry-run", false, "report what would be copied and the conflicts, without writing")
+	overwrite := fs.Bool("overwrite", false, "replace conflicting links in the destination instead of keeping them")
+	if err := fs.Parse(args); err != nil {
+		return migrateOptions{}, err
+	}
+	if (*from == "") == (*to == "") {
+		return migrateOptions{}, errors.New("give exactly one of -from and -to")
+	}
+	return migrateOptions{from: *from, to: *to, dryRun: *dryRun, overwrite: *overwrite}, nil
+}
+
+// jsonStoreLink is a link as store.json keeps it: the counters that Redis
+// keeps next to a link are fields of the link there.
+type jsonStoreLink struct {
+	URLData
+	VariantStats []variantStat `json:"variant_stats,omitempty"`
+	BlockedHits  int64         `json:"blocked_hits,omitempty"`
+}
+
+// readJSONStore reads the links and counter of a store.json, and keeps
+// the rest as they are for writing the file back. A missing file is an
+// empty store, and a file whose checksum does not match is refused.
+func readJSONStore(path string) (map[string]json.RawMessage, int64, map[string]jsonStoreLink, error) {
+	file := make(map[string]json.RawMessage)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, 0, map[string]jsonStoreLink{}, nil
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var store struct {
+		IDCounter int64                    `json:"idCounter"`
+		URLStore  map[string]jsonStoreLink `json:"urlStore"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, 0, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, ok := file[jsonChecksumKey]; ok && !validJSONChecksum(raw) {
+		return nil, 0, nil, fmt.Errorf("%s failed checksum verification (restore it from a backup)", path)
+	}
+	delete(file, jsonChecksumKey)
+	if err := json.Unmarshal(raw, &store); err != nil {
+		return nil, 0, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if store.URLStore == nil {
+		store.URLStore = map[string]jsonStoreLink{}
+	}
+	return file, store.IDCounter, store.URLStore, nil
+}
+
+// jsonChecksumKey is the last key of a store.json: the hex SHA-256 of the
+// file as it is without the key, which is how using-json wrote it too.
+const jsonChecksumKey = "checksum"
+
+// jsonChecksumPrefix starts the checksum entry at the end of the file.
+const jsonChecksumPrefix = ",\n  \"" + jsonChecksumKey + "\": \""
+
+func jsonChecksum(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// validJSONChecksum reports whether raw ends with the checksum of the rest
+// of it.
+func validJSONChecksum(raw []byte) bool {
+	i := bytes.LastIndex(raw, []byte(jsonChecksumPrefix))
+	if i < 0 {
+		return false
+	}
+	body := append(raw[:i:i], "\n}"...)
+	return string(bytes.TrimRight(raw[i:], "\n")) == jsonChecksumPrefix+jsonChecksum(body)+"\"\n}"
+}
+
+// writeJSONStore replaces the links and counter of a store.json through a
+// temporary file, so a crash leaves the old file or the new one, and ends
+// it with a checksum. fsync is STORE_FSYNC: always syncs the file and its
+// directory before returning, interval and off leave that to the caller
+// and to the system.
+func writeJSONStore(path string, file map[string]json.RawMessage, counter int64, links map[string]jsonStoreLink, fsync string) error {
+	var err error
+	if file["idCounter"], err = json.Marshal(counter); err != nil {
+		return err
+	}
+	if file["urlStore"], err = json.Marshal(links); err != nil {
+		return err
+	}
+	delete(file, jsonChecksumKey)
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	sum := jsonChecksum(raw)
+	raw = append(raw[:len(raw)-2], jsonChecksumPrefix+sum+"\"\n}"...)
+
+	// CreateTemp makes the file readable by its owner only, which the file
+	// needs: it holds webhook secrets and password and API key hashes.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".migrate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(raw); err == nil && fsync == fsyncAlways {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if fsync == fsyncAlways {
+		return syncPath(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncPath flushes a file or directory to disk. The directory of a
+// renamed file must be synced for the rename to survive a crash.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// linkDiff names the fields in which two links differ, or returns nil if
+// they are the same.
+func linkDiff(a, b jsonStoreLink) []string {
+	rawA, _ := json.Marshal(a)
+	rawB, _ := json.Marshal(b)
+	if bytes.Equal(rawA, rawB) {
+		return nil
+	}
+	var fieldsA, fieldsB map[string]json.RawMessage
+	json.Unmarshal(rawA, &fieldsA)
+	json.Unmarshal(rawB, &fieldsB)
+	var diff []string
+	for _, field := range slices.Sorted(maps.Keys(fieldsA)) {
+		if !bytes.Equal(fieldsA[field], fieldsB[field]) {
+			diff = append(diff, field)
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(fieldsB)) {
+		if _, ok := fieldsA[field]; !ok {
+			diff = append(diff, field)
+		}
+	}
+	return diff
+}
+
+// migrateReport counts what happened to each source link and prints the
+// conflicts as they are found.
+type migrateReport struct {
+	copied, present, conflicts, replaced int
+	warnings                             []string
+}
+
+func (r *migrateReport) conflict(code string, diff []string, overwrite bool) {
+	r.conflicts++
+	action := "kept the destination's link; -overwrite replaces it"
+	if overwrite {
+		action = "replaced"
+		r.replaced++
+	}
+	fmt.Printf("conflict: %s differs in %s (%s)\n", code, strings.Join(diff, ", "), action)
+}
+
+// backendLink reads a link with the counters kept next to it. The long
+// URL counts as variant 0.
+func backendLink(code string, data URLData) (jsonStoreLink, error) {
+	link := jsonStoreLink{URLData: data}
+	var err error
+	if len(data.Variants) > 0 {
+		if link.VariantStats, err = VariantStats(code, len(data.Variants)+1); err != nil {
+			return link, err
+		}
+		if !slices.ContainsFunc(link.VariantStats, func(s variantStat) bool { return s != variantStat{} }) {
+			link.VariantStats = nil
+		}
+	}
+	link.BlockedHits, err = ReferrerBlockedHits(code)
+	return link, err
+}
+
+// saveBackendCounters writes the counters store.json keeps on a link to
+// where the backend keeps them.
+func saveBackendCounters(code string, link jsonStoreLink) error {
+	if counters, ok := links.(linkCounters); ok {
+		return counters.SetCounters(code, link.VariantStats, link.BlockedHits)
+	}
+	if !config.usesRedis() {
+		return nil // nothing keeps them; migrateIn warns
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Del(Ctx, variantStatsPrefix+code)
+	for i, stat := range link.VariantStats {
+		pipe.HSet(Ctx, variantStatsPrefix+code,
+			strconv.Itoa(i)+":visits", stat.Visits, strconv.Itoa(i)+":conversions", stat.Conversions)
+	}
+	if link.BlockedHits > 0 {
+		pipe.HSet(Ctx, referrerBlockedKey, code, link.BlockedHits)
+	} else {
+		pipe.HDel(Ctx, referrerBlockedKey, code)
+	}
+	_, err = pipe.Exec(Ctx)
+	return err
+}
+
+// migrateIn copies a store.json into the backend.
+func migrateIn(opts migrateOptions, report *migrateReport) error {
+	_, counter, source, err := readJSONStore(opts.from)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Read %d links and ID counter %d from %s.\n", len(source), counter, opts.from)
+	if _, ok := links.(linkCounters); !ok && !config.usesRedis() {
+		report.warnings = append(report.warnings, "the variant and blocked-referrer counters are not copied without Redis (REDIS_ADDR)")
+	}
+
+	for _, code := range slices.Sorted(maps.Keys(source)) {
+		link := source[code]
+		data, err := GetURL(code)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			report.copied++
+			if opts.dryRun {
+				continue
+			}
+			if err := CreateURL(code, link.URLData); errors.Is(err, ErrConflict) {
+				// Created by someone else since the read; compared on the next run.
+				report.copied--
+				report.conflict(code, []string{"code"}, false)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("copying %s: %w", code, err)
+			}
+		case err != nil:
+			return fmt.Errorf("reading %s: %w", code, err)
+		default:
+			existing, err := backendLink(code, data)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", code, err)
+			}
+			diff := linkDiff(link, existing)
+			if diff == nil {
+				report.present++
+				continue
+			}
+			report.conflict(code, diff, opts.overwrite)
+			if !opts.overwrite || opts.dryRun {
+				continue
+			}
+			if err := SaveURL(code, link.URLData); err != nil {
+				return fmt.Errorf("replacing %s: %w", code, err)
+			}
+		}
+		if err := saveBackendCounters(code, link); err != nil {
+			return fmt.Errorf("copying the counters of %s: %w", code, err)
+		}
+	}
+
+	current, err := links.Counter()
+	if err != nil {
+		return err
+	}
+	if counter > current {
+		fmt.Printf("ID counter: raised from %d to %d.\n", current, counter)
+		if !opts.dryRun {
+			return EnsureCounterFloor(counter)
+		}
+	} else {
+		fmt.Printf("ID counter: %d, already at or above %d.\n", current, counter)
+	}
+	return nil
+}
+
+// migrateOut copies the backend into a store.json, adding to the links
+// the file already has.
+func migrateOut(opts migrateOptions, report *migrateReport) error {
+	file, counter, dest, err := readJSONStore(opts.to)
+	if err != nil {
+		return err
+	}
+	snapshot, err := SnapshotStore()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Read %d links and ID counter %d from the %s backend.\n", len(snapshot.URLStore), snapshot.IDCounter, config.StoreBackend)
+
+	for _, code := range slices.Sorted(maps.Keys(snapshot.URLStore)) {
+		link, err := backendLink(code, snapshot.URLStore[code])
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", code, err)
+		}
+		existing, ok := dest[code]
+		switch {
+		case !ok:
+			report.copied++
+		case linkDiff(link, existing) == nil:
+			report.present++
+			continue
+		default:
+			report.conflict(code, linkDiff(link, existing), opts.overwrite)
+			if !opts.overwrite {
+				continue
+			}
+		}
+		dest[code] = link
+	}
+
+	if snapshot.IDCounter > counter {
+		fmt.Printf("ID counter: raised from %d to %d.\n", counter, snapshot.IDCounter)
+		counter = snapshot.IDCounter
+	} else {
+		fmt.Printf("ID counter: %d, already at or above %d.\n", counter, snapshot.IDCounter)
+	}
+	if opts.dryRun {
+		return nil
+	}
+	return writeJSONStore(opts.to, file, counter, dest, fsyncAlways)
+}
+
+// runMigrate copies links between a store.json and the configured backend.
+// Links whose code the destination already has with other data are
+// conflicts: they are listed and kept unless -overwrite is given. It
+// exits with 1 when conflicts were kept, so scripts notice.
+func runMigrate(args []string) int {
+	opts, err := parseMigrateArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := links.Prepare(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error preparing store:", err)
+		return 1
+	}
+
+	var report migrateReport
+	if opts.from != "" {
+		err = migrateIn(opts, &report)
+	} else {
+		err = migrateOut(opts, &report)
+	}
+	for _, warning := range report.warnings {
+		fmt.Println("warning:", warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	verb := "Copied"
+	if opts.dryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("%s %d links; %d were already there, %d conflicts (%d replaced).\n",
+		verb, report.copied, report.present, report.conflicts, report.replaced)
+	if opts.dryRun {
+		fmt.Println("Dry run: nothing was written.")
+	}
+	if report.conflicts > report.replaced {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Namespaces let one instance serve several teams. Each has its own code
+// space: a link created in namespace "sales" with code "promo" is stored
+// and served as "sales.promo", which no plain code can collide with. A
+// namespace caps its active links and how many it may create per minute.
+// API keys and user accounts are bound to a namespace by an admin, and
+// everything they create goes into it.
+type namespace struct {
+	Name      string `json:"name"`
+	Quota     int64  `json:"quota,omitempty"`      // active links, 0 for no limit
+	RateLimit int    `json:"rate_limit,omitempty"` // links created per minute, 0 for no limit
+	CreatedAt int64  `json:"created_at"`
+}
+
+// namespacesKey maps each namespace name to its namespace JSON, unless
+// the backend keeps namespaces as a namespaceStore.
+const namespacesKey = "url_namespaces"
+
+// namespaceContextKey holds the namespace of the request's API key.
+const namespaceContextKey = "namespace"
+
+var (
+	validNamespaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+	errNamespaceDenied  = errors.New("namespace denied")
+)
+
+// qualify returns the stored code of code in namespace ns.
+func qualify(ns, code string) string {
+	if ns == "" {
+		return code
+	}
+	return ns + "." + code
+}
+
+func (ns namespace) view(active int64) gin.H {
+	return gin.H{
+		"name":       ns.Name,
+		"quota":      ns.Quota,
+		"rate_limit": ns.RateLimit,
+		"active":     active,
+		"created_at": formatUnix(ns.CreatedAt),
+	}
+}
+
+func SaveNamespace(ns namespace) error {
+	if store, ok := links.(namespaceStore); ok {
+		return store.SaveNamespace(ns)
+	}
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	return Rdb.HSet(Ctx, namespacesKey, ns.Name, raw).Err()
+}
+
+// GetNamespace returns a namespace, or ErrNotFound.
+func GetNamespace(name string) (namespace, error) {
+	if store, ok := links.(namespaceStore); ok {
+		return store.GetNamespace(name)
+	}
+	var ns namespace
+	raw, err := Rdb.HGet(Ctx, namespacesKey, name).Result()
+	if errors.Is(err, redis.Nil) {
+		return ns, ErrNotFound
+	}
+	if err != nil {
+		return ns, err
+	}
+	err = json.Unmarshal([]byte(raw), &ns)
+	return ns, err
+}
+
+// Namespaces returns every namespace by name.
+func Namespaces() ([]namespace, error) {
+	if store, ok := links.(namespaceStore); ok {
+		return store.Namespaces()
+	}
+	raw, err := Rdb.HGetAll(Ctx, namespacesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	all := make([]namespace, 0, len(raw))
+	for _, value := range raw {
+		var ns namespace
+		if err := json.Unmarshal([]byte(value), &ns); err == nil {
+			all = append(all, ns)
+		}
+	}
+	slices.SortFunc(all, func(a, b namespace) int { return strings.Compare(a.Name, b.Name) })
+	return all, nil
+}
+
+func DeleteNamespace(name string) error {
+	if store, ok := links.(namespaceStore); ok {
+		return store.DeleteNamespace(name)
+	}
+	n, err := Rdb.HDel(Ctx, namespacesKey, name).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// userNamespace returns the namespace a user's account is bound to, or ""
+// for users without an account, which is every user without Redis.
+func userNamespace(user string) (string, error) {
+	if !config.usesRedis() {
+		return "", nil
+	}
+	acct, err := GetAccount(user)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return acct.Namespace, err
+}
+
+// boundNamespace returns the namespace the caller is bound to: the
+// account's for users, else the API key's.
+func boundNamespace(c *gin.Context) (string, error) {
+	if claims, ok := impersonation(c); ok {
+		return userNamespace(claims.User)
+	}
+	if user := requestUser(c); user != "" {
+		return userNamespace(user)
+	}
+	return c.GetString(namespaceContextKey), nil
+}
+
+// requestNamespace returns the namespace a create request goes into: the
+// caller's, or for admins, the requested one. It returns
+// errNamespaceDenied when a non-admin asks for another namespace, and
+// ErrNotFound when the namespace does not exist (any more).
+func requestNamespace(c *gin.Context, requested string) (namespace, error) {
+	bound, err := boundNamespace(c)
+	if err != nil {
+		return namespace{}, err
+	}
+	name := bound
+	if requested != "" && requested != bound {
+		if _, impersonating := impersonation(c); impersonating || !isAdmin(c.Request) {
+			return namespace{}, errNamespaceDenied
+		}
+		name = requested
+	}
+	if name == "" {
+		return namespace{}, nil
+	}
+	return GetNamespace(name)
+}
+
+// namespaceError answers a failed requestNamespace.
+func namespaceError(c *gin.Context, name string, err error) {
+	switch {
+	case errors.Is(err, errNamespaceDenied):
+		c.JSON(403, gin.H{"error": "You may not create links in namespace " + name})
+	case errors.Is(err, ErrNotFound):
+		c.JSON(404, gin.H{"error": "Namespace not found"})
+	default:
+		storeError(c, err)
+	}
+}
+
+// allowNamespaceCreate counts a create against the namespace's rate
+// limit, answering 429 when it is used up.
+func allowNamespaceCreate(c *gin.Context, ns namespace) bool {
+	if ns.RateLimit == 0 {
+		return true
+	}
+	status, ok := allowRequest("ns:"+ns.Name, ns.RateLimit, time.Minute)
+	status.setHeaders(c.Writer.Header())
+	if !ok {
+		c.JSON(429, gin.H{"error": "Rate limit of namespace " + ns.Name + " exceeded. Try again later."})
+		return false
+	}
+	return true
+}
+
+func validateNamespaceParam(name string) error {
+	if !validNamespaceRegex.MatchString(name) {
+		return errors.New("namespace must be 1-32 lowercase letters, numbers or '-', starting with a letter or number")
+	}
+	return nil
+}
+
+func putNamespaceHandle(c *gin.Context) {
+	name := c.Param("namespace")
+	if err := validateNamespaceParam(name); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Quota     int64 `json:"quota"`
+		RateLimit int   `json:"rate_limit"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	var errs []fieldError
+	if req.Quota < 0 {
+		errs = append(errs, fieldError{"quota", "min", "Quota must be 0 (no limit) or more"})
+	}
+	if req.RateLimit < 0 {
+		errs = append(errs, fieldError{"rate_limit", "min", "Rate limit must be 0 (no limit) or more"})
+	}
+	if len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+
+	ns, err := GetNamespace(name)
+	status := http.StatusOK
+	if errors.Is(err, ErrNotFound) {
+		ns = namespace{Name: name, CreatedAt: time.Now().Unix()}
+		status = http.StatusCreated
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	ns.Quota, ns.RateLimit = req.Quota, req.RateLimit
+	if err := SaveNamespace(ns); err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", Action: "namespace.put",
+		Detail: fmt.Sprintf("%s (quota %d, rate limit %d)", name, ns.Quota, ns.RateLimit)}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	active, err := ActiveLinks("ns:" + name)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(status, ns.view(active))
+}
+
+func listNamespacesHandle(c *gin.Context) {
+	all, err := Namespaces()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	views := make([]gin.H, 0, len(all))
+	for _, ns := range all {
+		active, err := ActiveLinks("ns:" + ns.Name)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		views = append(views, ns.view(active))
+	}
+	c.JSON(200, views)
+}
+
+// deleteNamespaceHandle refuses namespaces that still have active links,
+// which would otherwise be left in a namespace nobody can create in.
+func deleteNamespaceHandle(c *gin.Context) {
+	name := c.Param("namespace")
+	active, err := reconcileQuota("ns:" + name)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	if active > 0 {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("Namespace %s still has %d active links", name, active)})
+		return
+	}
+	if err := DeleteNamespace(name); errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "Namespace not found"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", Action: "namespace.delete", Detail: name}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// setUserNamespaceHandle binds a user's account to a namespace, or with
+// "" releases it.
+func setUserNamespaceHandle(c *gin.Context) {
+	user := c.Param("user")
+	if err := validateUserParam(user); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Namespace string `json:"namespace"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Namespace != "" {
+		if _, err := GetNamespace(req.Namespace); errors.Is(err, ErrNotFound) {
+			c.JSON(400, gin.H{"error": "Validation failed", "fields": []fieldError{
+				{"namespace", "exists", "Namespace " + req.Namespace + " does not exist"},
+			}})
+			return
+		} else if err != nil {
+			storeError(c, err)
+			return
+		}
+	}
+
+	err := UpdateAccount(user, func(acct *account) { acct.Namespace = req.Namespace })
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "User " + user + " has no account"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", OnBehalfOf: user, Action: "user.namespace",
+		Detail: cmp.Or(req.Namespace, "none")}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.JSON(200, gin.H{"user": user, "namespace": req.Namespace})
+}
+
+// inNamespace puts a validated request into ns, qualifying its custom code
+// and aliases.
+func (req *shortenRequest) inNamespace(ns namespace) {
+	req.namespace = ns
+	if ns.Name == "" {
+		return
+	}
+	if req.CustomCode != "" {
+		req.CustomCode = qualify(ns.Name, req.CustomCode)
+	}
+	aliases := make([]string, len(req.Aliases))
+	for i, alias := range req.Aliases {
+		aliases[i] = qualify(ns.Name, alias)
+	}
+	req.Aliases = aliases
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"html/template"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+var newFormTemplate = template.Must(template.New("new").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Shorten a URL</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 3rem auto; padding: 0 1rem; }
+label { display: block; margin-top: 1rem; }
+input, select { width: 100%; padding: .4rem; box-sizing: border-box; }
+button { margin-top: 1.5rem; padding: .5rem 1.5rem; }
+.error { color: #b00020; }
+.result { margin-top: 2rem; padding: 1rem; background: #f3f3f3; }
+</style>
+</head>
+<body>
+<h1>Shorten a URL</h1>
+{{range .Errors}}<p class="error">{{.}}</p>{{end}}
+<form method="post" action="/new">
+	<label>Long URL <input type="url" name="url" value="{{.URL}}" placeholder="https://example.com/..." required></label>
+	<label>Custom code (optional) <input type="text" name="custom_code" value="{{.CustomCode}}" pattern="[a-zA-Z0-9]+"></label>
+	<label>Expires after
+		<select name="expiry_seconds">
+		{{range .Expiries}}<option value="{{.Seconds}}"{{if .Selected}} selected{{end}}>{{.Label}}</option>{{end}}
+		</select>
+	</label>
+	<button type="submit">Shorten</button>
+</form>
+{{if .ShortURL}}
+<div class="result">
+	<p>Your short link: <a href="{{.ShortURL}}">{{.ShortURL}}</a></p>
+	{{if .QRCode}}<img src="{{.QRCode}}" alt="QR code for {{.ShortURL}}" width="200" height="200">{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+type expiryOption struct {
+	Seconds  int64
+	Label    string
+	Selected bool
+}
+
+type newFormPage struct {
+	URL        string
+	CustomCode string
+	Expiries   []expiryOption
+	Errors     []string
+	ShortURL   string
+	QRCode     string
+}
+
+func newFormData(selected int64) newFormPage {
+	if selected == 0 {
+		selected = config.defaultExpirySeconds()
+	}
+
+	options := []expiryOption{
+		{Seconds: 3600, Label: "1 hour"},
+		{Seconds: 24 * 3600, Label: "1 day"},
+		{Seconds: 7 * 24 * 3600, Label: "7 days"},
+		{Seconds: 30 * 24 * 3600, Label: "30 days"},
+		{Seconds: 365 * 24 * 3600, Label: "1 year"},
+	}
+	// A configured default that is not one of the choices is offered too.
+	if def := config.defaultExpirySeconds(); !slices.ContainsFunc(options, func(o expiryOption) bool { return o.Seconds == def }) {
+		options = append(options, expiryOption{Seconds: def, Label: config.DefaultExpiry.String()})
+		slices.SortFunc(options, func(a, b expiryOption) int { return cmp.Compare(a.Seconds, b.Seconds) })
+	}
+	options = append(options, expiryOption{Seconds: neverExpires, Label: "Never"})
+	for i := range options {
+		options[i].Selected = options[i].Seconds == selected
+	}
+	return newFormPage{Expiries: options}
+}
+
+func renderNewForm(c *gin.Context, status int, page newFormPage) {
+	var buf bytes.Buffer
+	if err := newFormTemplate.Execute(&buf, page); err != nil {
+		c.String(500, "Failed to render page")
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
+
+func newFormHandle(c *gin.Context) {
+	renderNewForm(c, 200, newFormData(0))
+}
+
+func newFormSubmit(c *gin.Context) {
+	body, err := bindShortenRequest(c.Request)
+	page := newFormData(int64(body.ExpirySeconds))
+	page.URL = body.URL
+	page.CustomCode = body.CustomCode
+
+	if bodyTooLarge(err) {
+		page.Errors = []string{bodyTooLargeMessage()}
+		renderNewForm(c, 413, page)
+		return
+	}
+	if err != nil {
+		page.Errors = []string{"Invalid form submission"}
+		renderNewForm(c, 400, page)
+		return
+	}
+
+	body.Stateless = false
+	body.source = newLinkSource(sourceForm, c.Request, c.ClientIP())
+	body.owner = requestUser(c)
+	body.source.APIKey = c.GetString(apiKeyContextKey)
+	body.tenant = requestTenant(c.Request)
+	if errs := body.validate(); len(errs) > 0 {
+		for _, e := range errs {
+			page.Errors = append(page.Errors, e.Message)
+		}
+		renderNewForm(c, 400, page)
+		return
+	}
+
+	ns, err := requestNamespace(c, body.Namespace)
+	if errors.Is(err, errNamespaceDenied) {
+		page.Errors = []string{"You may not create links in namespace " + body.Namespace}
+		renderNewForm(c, 403, page)
+		return
+	} else if errors.Is(err, ErrNotFound) {
+		page.Errors = []string{"Namespace not found"}
+		renderNewForm(c, 404, page)
+		return
+	} else if err != nil {
+		status := storeErrorStatus(err)
+		page.Errors = []string{storeErrorMessage(status)}
+		renderNewForm(c, status, page)
+		return
+	}
+	if ns.RateLimit > 0 {
+		status, ok := allowRequest("ns:"+ns.Name, ns.RateLimit, time.Minute)
+		status.setHeaders(c.Writer.Header())
+		if !ok {
+			page.Errors = []string{"Rate limit of namespace " + ns.Name + " exceeded. Try again later."}
+			renderNewForm(c, 429, page)
+			return
+		}
+	}
+	body.inNamespace(ns)
+	body.region = requestRegion(c.Request, ns.Name)
+
+	code, _, _, err := createLink(c.Request.Context(), body)
+	if err != nil {
+		status := storeErrorStatus(err)
+		page.Errors = []string{storeErrorMessage(status)}
+		var quota quotaError
+		if errors.As(err, &quota) {
+			page.Errors = []string{quota.Error()}
+		}
+		renderNewForm(c, status, page)
+		return
+	}
+
+	page.ShortURL = baseURL + code
+	page.QRCode = "/qr/" + code
+	renderNewForm(c, 200, page)
+}
+
+func qrHandle(c *gin.Context) {
+	code := c.Param("code")
+	if _, err := GetURL(code); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	png, err := qrcode.Encode(baseURL+code, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate QR code"})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OAuth2 sign-in lets a team log in with Google or GitHub instead of
+// passwords. GET /auth/oauth/:provider sends the browser to the provider,
+// which sends it back to /auth/oauth/:provider/callback. The verified
+// email becomes the user name, and the user gets the same JWT as from
+// /auth/login.
+type oauthProvider struct {
+	name         string
+	clientID     string
+	clientSecret string
+	authURL      string
+	tokenURL     string
+	scope        string
+	// email returns the account's verified email, or "" if it has none.
+	email func(ctx context.Context, accessToken string) (string, error)
+}
+
+var (
+	oauthProviders = configuredOAuthProviders()
+	oauthAllowed   = parseOAuthAllowed(config.OAuth.Allowed)
+	// oauthSuccessURL receives the token in its fragment, so a dashboard
+	// can pick it up. Without it the callback answers with JSON.
+	oauthSuccessURL   = config.OAuth.SuccessURL
+	oauthRedirectBase = config.OAuth.RedirectBase
+)
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+var errOwnerDeleted = errors.New("user is deleted")
+
+func configuredOAuthProviders() map[string]*oauthProvider {
+	providers := make(map[string]*oauthProvider)
+	for _, p := range []*oauthProvider{
+		{
+			name:     "google",
+			authURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+			tokenURL: "https://oauth2.googleapis.com/token",
+			scope:    "openid email",
+			email:    googleEmail,
+
+			clientID:     config.OAuth.Google.ClientID,
+			clientSecret: config.OAuth.Google.ClientSecret,
+		},
+		{
+			name:     "github",
+			authURL:  "https://github.com/login/oauth/authorize",
+			tokenURL: "https://github.com/login/oauth/access_token",
+			scope:    "user:email",
+			email:    githubEmail,
+
+			clientID:     config.OAuth.GitHub.ClientID,
+			clientSecret: config.OAuth.GitHub.ClientSecret,
+		},
+	} {
+		if p.clientID != "" {
+			providers[p.name] = p
+		}
+	}
+	return providers
+}
+
+// parseOAuthAllowed reads a comma-separated list of emails and @domains.
+func parseOAuthAllowed(list []string) []string {
+	var allowed []string
+	for _, entry := range list {
+		allowed = append(allowed, strings.ToLower(entry))
+	}
+	return allowed
+}
+
+// oauthEmailAllowed reports whether OAUTH_ALLOWED lets email sign in. An
+// empty list allows every verified email.
+func oauthEmailAllowed(email string) bool {
+	if len(oauthAllowed) == 0 {
+		return true
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	return slices.Contains(oauthAllowed, email) || slices.Contains(oauthAllowed, "@"+domain)
+}
+
+func (p *oauthProvider) redirectURI() string {
+	return oauthRedirectBase + "/auth/oauth/" + p.name + "/callback"
+}
+
+// exchange trades an authorization code for an access token.
+func (p *oauthProvider) exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := oauthDo(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%s token endpoint: %s", p.name, cmp.Or(token.Error, "no access token"))
+	}
+	return token.AccessToken, nil
+}
+
+// oauthDo sends a request to a provider and decodes its JSON answer.
+func oauthDo(req *http.Request, into any) error {
+	resp, err := egressClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.Unmarshal(body, into)
+}
+
+func oauthGet(ctx context.Context, target, accessToken string, into any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	return oauthDo(req, into)
+}
+
+func googleEmail(ctx context.Context, accessToken string) (string, error) {
+	var info struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"email_verified"`
+	}
+	if err := oauthGet(ctx, "https://openidconnect.googleapis.com/v1/userinfo", accessToken, &info); err != nil {
+		return "", err
+	}
+	if !info.Verified {
+		return "", nil
+	}
+	return info.Email, nil
+}
+
+// githubEmail returns the account's primary email if it is verified. The
+// public profile email is not used, since GitHub does not verify it.
+func githubEmail(ctx context.Context, accessToken string) (string, error) {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := oauthGet(ctx, "https://api.github.com/user/emails", accessToken, &emails); err != nil {
+		return "", err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// oauthGuard answers 404 for providers that are not configured.
+func oauthGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := oauthProviders[c.Param("provider")]; !ok {
+			c.AbortWithStatusJSON(404, gin.H{"error": "Sign-in with " + c.Param("provider") + " is not configured"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// oauthStartHandle sends the browser to the provider. The state is kept in
+// a signed cookie and must come back unchanged, so a callback can only
+// finish a sign-in this browser started.
+func oauthStartHandle(c *gin.Context) {
+	p := oauthProviders[c.Param("provider")]
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(raw)
+	setSignedCookie(c.Writer, oauthStateCookie, p.name+"-"+state, oauthStateTTL)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURI()},
+		"scope":         {p.scope},
+		"state":         {state},
+	}
+	c.Redirect(http.StatusFound, p.authURL+"?"+query.Encode())
+}
+
+func oauthCallbackHandle(c *gin.Context) {
+	p := oauthProviders[c.Param("provider")]
+	cookie, ok := signedCookie(c.Request, oauthStateCookie)
+	state := c.Query("state")
+	if !ok || state == "" || !hmac.Equal([]byte(cookie), []byte(p.name+"-"+state)) {
+		c.JSON(400, gin.H{"error": "Sign-in expired or was started elsewhere; start again"})
+		return
+	}
+	// The state is single-use.
+	http.SetCookie(c.Writer, &http.Cookie{Name: oauthStateCookie, Path: "/", MaxAge: -1})
+	if reason := c.Query("error"); reason != "" {
+		c.JSON(401, gin.H{"error": "Sign-in with " + p.name + " failed: " + reason})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 20*time.Second)
+	defer cancel()
+	accessToken, err := p.exchange(ctx, c.Query("code"))
+	if err != nil {
+		log.Printf("OAuth %s: %v", p.name, err)
+		c.JSON(502, gin.H{"error": "Sign-in with " + p.name + " failed"})
+		return
+	}
+	email, err := p.email(ctx, accessToken)
+	if err != nil {
+		log.Printf("OAuth %s: %v", p.name, err)
+		c.JSON(502, gin.H{"error": "Sign-in with " + p.name + " failed"})
+		return
+	}
+	email = strings.ToLower(email)
+	if email == "" {
+		c.JSON(403, gin.H{"error": "Your " + p.name + " account has no verified email"})
+		return
+	}
+	if !oauthEmailAllowed(email) {
+		c.JSON(403, gin.H{"error": email + " may not sign in here"})
+		return
+	}
+	if !validUserRegex.MatchString(email) {
+		c.JSON(403, gin.H{"error": email + " cannot be used as a user name"})
+		return
+	}
+
+	acct, err := oauthAccount(email, p.name)
+	switch {
+	case errors.Is(err, errUserTaken):
+		c.JSON(409, gin.H{"error": "User " + email + " signs in with a password"})
+		return
+	case errors.Is(err, errOwnerDeleted):
+		c.JSON(403, gin.H{"error": "User " + email + " is deleted"})
+		return
+	case err != nil:
+		storeError(c, err)
+		return
+	}
+
+	if oauthSuccessURL == "" {
+		respondWithToken(c, 200, acct)
+		return
+	}
+	token, claims, err := signUserToken(acct)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to issue token"})
+		return
+	}
+	fragment := url.Values{"token": {token}, "user": {acct.User}, "expires_at": {formatUnix(claims.Expires)}}
+	c.Redirect(http.StatusFound, oauthSuccessURL+"#"+fragment.Encode())
+}
+
+// oauthAccount returns the account for a verified email, creating it on
+// first sign-in. An account that has a password is not handed to whoever
+// proves the email, since it may have been signed up by someone else;
+// that returns errUserTaken.
+func oauthAccount(email, provider string) (account, error) {
+	if deleted, err := OwnerDeleted(email); err != nil {
+		return account{}, err
+	} else if deleted {
+		return account{}, errOwnerDeleted
+	}
+	acct, err := GetAccount(email)
+	if errors.Is(err, ErrNotFound) {
+		acct = account{User: email, Provider: provider, CreatedAt: time.Now().Unix()}
+		if err := CreateAccount(acct); errors.Is(err, errUserTaken) {
+			// Created by a concurrent sign-in.
+			acct, err = GetAccount(email)
+			if err != nil {
+				return account{}, err
+			}
+		} else if err != nil {
+			return account{}, err
+		}
+	} else if err != nil {
+		return account{}, err
+	}
+	if acct.PasswordHash != "" {
+		return account{}, errUserTaken
+	}
+	return acct, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleting a user is a soft delete: the user is recorded in
+// deletedOwnersKey and, once ORPHAN_GRACE has passed, a background sweep
+// applies ORPHAN_POLICY to their links so none are left that nobody can
+// manage.
+
+// deletedOwnersKey maps each deleted user to the unix time of deletion.
+const deletedOwnersKey = "url_deleted_owners"
+
+// What happens to the links of a deleted user once ORPHAN_GRACE is over.
+const (
+	orphanDisable  = "disable"  // redirects answer 410 until the user is restored
+	orphanReassign = "reassign" // links move to ORPHAN_REASSIGN_TO
+	orphanDelete   = "delete"
+)
+
+// orphanPolicy defaults to disable, the one policy a restore can undo.
+var (
+	orphanPolicy     = config.Orphans.Policy
+	orphanReassignTo = config.Orphans.ReassignTo
+)
+
+// ErrDisabled is returned for links disabled by the orphan policy.
+var ErrDisabled = errors.New("link disabled")
+
+// dueOwners picks the deleted users (user -> deletion time) whose grace
+// period is over.
+func dueOwners(deleted map[string]int64, now time.Time) map[string]bool {
+	due := make(map[string]bool)
+	cutoff := now.Add(-config.Orphans.Grace).Unix()
+	for user, deletedAt := range deleted {
+		if deletedAt <= cutoff {
+			due[user] = true
+		}
+	}
+	return due
+}
+
+// orphanAction applies the disable or reassign policy to one link of a
+// deleted owner in place and reports whether it changed anything. Deletion
+// is left to the caller.
+func orphanAction(data *URLData) bool {
+	switch orphanPolicy {
+	case orphanReassign:
+		data.Owner = orphanReassignTo
+		return true
+	case orphanDisable:
+		if data.Disabled {
+			return false
+		}
+		data.Disabled = true
+		return true
+	}
+	return false
+}
+
+func orphanAudit(owner, code string) auditEntry {
+	return auditEntry{
+		Time:       time.Now().Unix(),
+		Actor:      "system",
+		OnBehalfOf: owner,
+		Action:     "orphan." + orphanPolicy,
+		Code:       code,
+		Detail:     "owner was deleted",
+	}
+}
+
+func validateUserParam(user string) error {
+	if !validUserRegex.MatchString(user) {
+		return errors.New("user must be 1-64 letters, numbers, '.', '_', '-' or '@'")
+	}
+	return nil
+}
+
+// DeleteOwner soft-deletes user and returns when they were deleted.
+// Deleting again keeps the original time, so the grace period is not
+// extended.
+func DeleteOwner(user string) (int64, error) {
+	if err := Rdb.HSetNX(Ctx, deletedOwnersKey, user, time.Now().Unix()).Err(); err != nil {
+		return 0, err
+	}
+	return Rdb.HGet(Ctx, deletedOwnersKey, user).Int64()
+}
+
+// RestoreOwner undoes DeleteOwner. It returns ErrNotFound if user is not
+// deleted.
+func RestoreOwner(user string) error {
+	n, err := Rdb.HDel(Ctx, deletedOwnersKey, user).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func OwnerDeleted(user string) (bool, error) {
+	if !config.usesRedis() {
+		return false, nil // deleting users needs Redis
+	}
+	return Rdb.HExists(Ctx, deletedOwnersKey, user).Result()
+}
+
+func DeletedOwners() (map[string]int64, error) {
+	raw, err := Rdb.HGetAll(Ctx, deletedOwnersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]int64, len(raw))
+	for user, value := range raw {
+		deleted[user], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return deleted, nil
+}
+
+// errOrphanUnchanged aborts an update that would not change the link.
+var errOrphanUnchanged = errors.New("link needs no change")
+
+// sweepOrphans applies the orphan policy to every link of a deleted user
+// whose grace period is over. It returns how many links it changed.
+func sweepOrphans(ctx context.Context) (int, error) {
+	deleted, err := DeletedOwners()
+	if err != nil {
+		return 0, err
+	}
+	due := dueOwners(deleted, time.Now())
+	if len(due) == 0 {
+		return 0, nil
+	}
+
+	orphans := make(map[string]URLData)
+	err = ForEachURL(func(code string, data URLData) error {
+		if due[data.Owner] && !(orphanPolicy == orphanDisable && data.Disabled) {
+			orphans[code] = data
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for code, orphan := range orphans {
+		owner := orphan.Owner
+		if orphanPolicy == orphanDelete {
+			err = DeleteURL(code)
+			if err == nil {
+				runDeleteHooks(ctx, code)
+				notifyWebhooks(eventLinkDeleted, code, orphan, nil)
+			}
+		} else {
+			err = UpdateURL(code, func(data *URLData) error {
+				if data.Owner != owner || !orphanAction(data) {
+					return errOrphanUnchanged
+				}
+				return nil
+			})
+		}
+		if errors.Is(err, ErrNotFound) || errors.Is(err, errOrphanUnchanged) {
+			continue // deleted or changed meanwhile
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed++
+		if err := AppendAudit(orphanAudit(owner, code)); err != nil {
+			log.Println("Error writing audit log:", err)
+		}
+	}
+	return changed, nil
+}
+
+func startOrphanSweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Like cleanup, the policy runs on the primary and is replicated.
+			if replicaMode.Load() {
+				continue
+			}
+			if n, err := sweepOrphans(Ctx); err != nil {
+				log.Println("Error applying orphan policy:", err)
+			} else if n > 0 {
+				log.Printf("Orphan policy %s applied to %d links.", orphanPolicy, n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func deleteOwnerHandle(c *gin.Context) {
+	user := c.Param("user")
+	if err := validateUserParam(user); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	deletedAt, err := DeleteOwner(user)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	links := 0
+	err = ForEachURL(func(code string, data URLData) error {
+		if data.Owner == user {
+			links++
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list URLs"})
+		return
+	}
+
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", OnBehalfOf: user, Action: "owner.delete",
+		Detail: fmt.Sprintf("%d links, policy %s", links, orphanPolicy)}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+
+	c.JSON(200, gin.H{
+		"user":       user,
+		"deleted_at": formatUnix(deletedAt),
+		"policy":     orphanPolicy,
+		"applies_at": formatUnix(deletedAt + int64(config.Orphans.Grace.Seconds())),
+		"links":      links,
+	})
+}
+
+// restoreOwnerHandle brings a deleted user back and re-enables links the
+// disable policy turned off. Deleted or reassigned links stay as they are.
+func restoreOwnerHandle(c *gin.Context) {
+	user := c.Param("user")
+	if err := validateUserParam(user); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := RestoreOwner(user); errors.Is(err, ErrNotFound) {
+		c.JSON(404, gin.H{"error": "User is not deleted"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	var disabled []string
+	err := ForEachURL(func(code string, data URLData) error {
+		if data.Owner == user && data.Disabled {
+			disabled = append(disabled, code)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list URLs"})
+		return
+	}
+	for _, code := range disabled {
+		err := UpdateURL(code, func(data *URLData) error {
+			data.Disabled = false
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeError(c, err)
+			return
+		}
+	}
+
+	entry := auditEntry{Time: time.Now().Unix(), Actor: "admin", OnBehalfOf: user, Action: "owner.restore",
+		Detail: fmt.Sprintf("%d links re-enabled", len(disabled))}
+	if err := AppendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+	c.JSON(200, gin.H{"user": user, "restored": true, "links_enabled": len(disabled)})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "github.com/lib/pq" // registers the "postgres" driver
+)
+
+// postgresDialect keeps links in PostgreSQL (STORE_BACKEND=postgres), with
+// the JSON of a link in a jsonb column.
+var postgresDialect = sqlDialect{
+	name:    "Postgres",
+	setting: "DATABASE_URL",
+	migrations: []string{
+		`CREATE TABLE links (
+			code       text PRIMARY KEY,
+			long_url   text NOT NULL,
+			clicks     bigint NOT NULL DEFAULT 0,
+			created_at bigint NOT NULL,
+			expires_at bigint, -- created_at + expiry, NULL if the link never expires
+			data       jsonb NOT NULL
+		);
+		CREATE INDEX links_expires_at ON links (expires_at) WHERE expires_at IS NOT NULL;
+		CREATE TABLE counters (
+			name  text PRIMARY KEY,
+			value bigint NOT NULL
+		);
+		INSERT INTO counters (name, value) VALUES ('id', 0);`,
+		`ALTER TABLE links ADD COLUMN blocked_hits bigint NOT NULL DEFAULT 0;
+		CREATE TABLE link_variants (
+			code        text NOT NULL,
+			variant     integer NOT NULL,
+			visits      bigint NOT NULL DEFAULT 0,
+			conversions bigint NOT NULL DEFAULT 0,
+			PRIMARY KEY (code, variant)
+		);
+		CREATE TABLE namespaces (
+			name text PRIMARY KEY,
+			data jsonb NOT NULL
+		);
+		CREATE TABLE url_index (
+			field text PRIMARY KEY, -- dedupeField
+			code  text NOT NULL
+		);
+		INSERT INTO counters (name, value) VALUES ('redis_copied', 0);`,
+	},
+	migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	lockMigrations: `SELECT pg_advisory_xact_lock(7262011)`,
+	forUpdate:      ` FOR UPDATE`,
+	snapshot:       &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+}
+
+func newPostgresStore() (LinkStore, error) {
+	dsn := config.DatabaseURL
+	if dsn == "" {
+		return nil, errors.New("STORE_BACKEND=postgres needs DATABASE_URL")
+	}
+	// Open only checks the URL; Prepare connects.
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	return sqlStore{db: db, dialect: postgresDialect}, nil
+}
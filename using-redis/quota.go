@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// LINK_QUOTA caps the active links each user or API key may have; links
+// created by neither, and admins, are not limited. Active means stored
+// and not expired, so deleting or letting links expire frees quota.
+// Namespaces have quotas of their own, on top of LINK_QUOTA.
+var linkQuota = config.LinkQuota
+
+// quotaKeyPrefix + principal is a sorted set of the principal's codes
+// scored by expiry time, so counting active links skips expired ones
+// without reading them. Deletes and ownership changes can leave stale
+// codes behind; they are dropped when a principal reaches its quota.
+const quotaKeyPrefix = "url_quota:"
+
+// linkPrincipal is who a link counts against: its owner, or else the
+// API key that created it. "" for neither.
+func linkPrincipal(data URLData) string {
+	if data.Owner != "" {
+		return "user:" + data.Owner
+	}
+	if data.Source != nil && data.Source.APIKey != "" {
+		return "key:" + data.Source.APIKey
+	}
+	return ""
+}
+
+// quotaPrincipals are all the principals a link counts against: its
+// linkPrincipal and its namespace.
+func quotaPrincipals(data URLData) []string {
+	var principals []string
+	if principal := linkPrincipal(data); principal != "" {
+		principals = append(principals, principal)
+	}
+	if data.Namespace != "" {
+		principals = append(principals, "ns:"+data.Namespace)
+	}
+	return principals
+}
+
+func quotaScore(data URLData) float64 {
+	if data.Expiry == 0 {
+		return math.Inf(1)
+	}
+	return float64(data.CreatedAt + data.Expiry)
+}
+
+// trackQuota records written links against their principals. It only
+// logs failures, since the links are stored by then.
+func trackQuota(codes []string, data []URLData) {
+	if !config.usesRedis() {
+		return
+	}
+	pipe := Rdb.Pipeline()
+	for i, code := range codes {
+		for _, principal := range quotaPrincipals(data[i]) {
+			pipe.ZAdd(Ctx, quotaKeyPrefix+principal, redis.Z{Score: quotaScore(data[i]), Member: code})
+		}
+	}
+	if _, err := pipe.Exec(Ctx); err != nil {
+		log.Println("Error tracking link quota:", err)
+	}
+}
+
+func untrackQuota(code string, data URLData) {
+	if !config.usesRedis() {
+		return
+	}
+	for _, principal := range quotaPrincipals(data) {
+		if err := Rdb.ZRem(Ctx, quotaKeyPrefix+principal, code).Err(); err != nil {
+			log.Println("Error tracking link quota:", err)
+		}
+	}
+}
+
+// ActiveLinks returns how many active links count against principal.
+// Without Redis there is no index, so it counts the links of the store.
+func ActiveLinks(principal string) (int64, error) {
+	if !config.usesRedis() {
+		return countActiveLinks(principal)
+	}
+	key := quotaKeyPrefix + principal
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var count *redis.IntCmd
+	_, err := Rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(Ctx, key, "-inf", now)
+		count = pipe.ZCard(Ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// reconcileQuota checks every code counted against principal with the
+// store, dropping the ones deleted or handed to someone else and
+// correcting changed expiries, and returns the corrected count.
+func reconcileQuota(principal string) (int64, error) {
+	if !config.usesRedis() {
+		return countActiveLinks(principal) // counted from the store already
+	}
+	key := quotaKeyPrefix + principal
+	codes, err := Rdb.ZRange(Ctx, key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	pipe := Rdb.Pipeline()
+	for _, code := range codes {
+		data, err := GetURL(code)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			pipe.ZRem(Ctx, key, code)
+		case err != nil:
+			return 0, err
+		case !slices.Contains(quotaPrincipals(data), principal):
+			pipe.ZRem(Ctx, key, code)
+		default:
+			pipe.ZAdd(Ctx, key, redis.Z{Score: quotaScore(data), Member: code})
+		}
+	}
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return 0, err
+	}
+	return ActiveLinks(principal)
+}
+
+// countActiveLinks counts the active links of principal by reading every
+// link.
+func countActiveLinks(principal string) (int64, error) {
+	var active int64
+	now := time.Now().Unix()
+	err := ForEachURL(func(code string, data URLData) error {
+		if !data.expired(now) && slices.Contains(quotaPrincipals(data), principal) {
+			active++
+		}
+		return nil
+	})
+	return active, err
+}
+
+type quotaError struct {
+	limit     int64
+	active    int64
+	requested int
+	namespace string // set when the namespace's quota is used up
+}
+
+func (e quotaError) Error() string {
+	if e.namespace != "" {
+		return fmt.Sprintf("Link quota of namespace %s exceeded: %d of %d active links used", e.namespace, e.active, e.limit)
+	}
+	return fmt.Sprintf("Link quota exceeded: %d of %d active links used", e.active, e.limit)
+}
+
+func (e quotaError) view() gin.H {
+	view := gin.H{"limit": e.limit, "active": e.active, "requested": e.requested}
+	if e.namespace != "" {
+		view["namespace"] = e.namespace
+	}
+	return view
+}
+
+// checkQuota returns a quotaError if creating n more links would take
+// principal past limit. Concurrent requests can each pass the check, so a
+// principal may end up a few links over.
+func checkQuota(principal string, limit int64, n int) error {
+	if limit == 0 || principal == "" {
+		return nil
+	}
+	active, err := ActiveLinks(principal)
+	if err != nil {
+		return err
+	}
+	if active+int64(n) > limit {
+		if active, err = reconcileQuota(principal); err != nil {
+			return err
+		}
+	}
+	if active+int64(n) > limit {
+		err := quotaError{limit: limit, active: active, requested: n}
+		if name, ok := strings.CutPrefix(principal, "ns:"); ok {
+			err.namespace = name
+		}
+		return err
+	}
+	return nil
+}
+
+// checkLinkQuotas checks both the quota of the link's principal and that
+// of its namespace.
+func checkLinkQuotas(data URLData, ns namespace, n int) error {
+	if err := checkQuota(linkPrincipal(data), linkQuota, n); err != nil {
+		return err
+	}
+	return checkQuota("ns:"+ns.Name, ns.Quota, n)
+}
+
+// prepareQuotaIndex counts links written before quotas were tracked, once
+// per store.
+func prepareQuotaIndex() error {
+	if !config.usesRedis() {
+		return nil
+	}
+	built, err := Rdb.HExists(Ctx, indexStateKey, "quota").Result()
+	if err != nil || built {
+		return err
+	}
+	var indexed int
+	pipe := Rdb.Pipeline()
+	err = ForEachURL(func(code string, data URLData) error {
+		principals := quotaPrincipals(data)
+		if len(principals) == 0 {
+			return nil
+		}
+		for _, principal := range principals {
+			pipe.ZAdd(Ctx, quotaKeyPrefix+principal, redis.Z{Score: quotaScore(data), Member: code})
+		}
+		if indexed++; indexed%1000 == 0 {
+			_, err := pipe.Exec(Ctx)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return err
+	}
+	if err := Rdb.HSet(Ctx, indexStateKey, "quota", time.Now().Unix()).Err(); err != nil {
+		return err
+	}
+	log.Printf("Built quota index for %d links.", indexed)
+	return nil
+}
+
+// requestPrincipal is who links created by this request count against.
+func requestPrincipal(c *gin.Context) string {
+	if claims, ok := impersonation(c); ok {
+		return "user:" + claims.User
+	}
+	if user := requestUser(c); user != "" {
+		return "user:" + user
+	}
+	if key := c.GetString(apiKeyContextKey); key != "" {
+		return "key:" + key
+	}
+	return ""
+}
+
+// quotaHandle shows the caller's active links and, with LINK_QUOTA set,
+// how many more they may create.
+func quotaHandle(c *gin.Context) {
+	principal := requestPrincipal(c)
+	if principal == "" {
+		c.JSON(401, gin.H{"error": "Sign in or send an API key to see your quota"})
+		return
+	}
+	active, err := ActiveLinks(principal)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	resp := gin.H{"active": active}
+	if linkQuota > 0 {
+		resp["limit"] = linkQuota
+		resp["remaining"] = max(linkQuota-active, 0)
+	}
+	if name, err := boundNamespace(c); err != nil {
+		storeError(c, err)
+		return
+	} else if name != "" {
+		ns, err := GetNamespace(name)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			storeError(c, err)
+			return
+		}
+		active, err := ActiveLinks("ns:" + name)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		view := gin.H{"name": name, "active": active}
+		if ns.Quota > 0 {
+			view["limit"] = ns.Quota
+			view["remaining"] = max(ns.Quota-active, 0)
+		}
+		resp["namespace"] = view
+	}
+	c.JSON(200, resp)
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"net"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -19,42 +23,314 @@ var (
     Rdb *redis.Client
 )
 
+// Storage errors returned to handlers instead of driver errors such as
+// redis.Nil, so every backend maps to the same HTTP statuses.
+var (
+	ErrNotFound = errors.New("short URL not found")
+	ErrConflict = errors.New("short code already in use")
+	ErrExpired  = errors.New("short URL expired")
+)
 
-func init() {
-    err := godotenv.Load()
-    if err != nil {
-        log.Println("No .env file found, using system environment variables")
-    }
+// errNoRedis is returned by every Redis command when the server runs
+// without Redis, which store backends other than redis do when REDIS_ADDR
+// is unset. Handlers answer it with 501.
+var errNoRedis = errors.New("this needs Redis, which this server runs without: set REDIS_ADDR")
+
+// noRedisHook fails every command of a client with errNoRedis.
+type noRedisHook struct{}
+
+func (noRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errNoRedis
+	}
+}
+
+func (noRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		cmd.SetErr(errNoRedis)
+		return errNoRedis
+	}
+}
+
+func (noRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			cmd.SetErr(errNoRedis)
+		}
+		return errNoRedis
+	}
+}
+
+// errRedisDown wraps the connection errors of a Redis that a store
+// backend other than redis uses for everything but links. Links are
+// still served while it is down; what needs Redis answers 503.
+var errRedisDown = errors.New("Redis is unreachable")
+
+// redisRetryAfter is how long commands fail without reaching Redis after
+// a connection failed.
+const redisRetryAfter = 5 * time.Second
+
+// redisBreaker fails commands with errRedisDown for redisRetryAfter after
+// one could not reach Redis, so that redirects, which count clicks in
+// Redis, do not wait for a timeout on each command while Redis is down.
+type redisBreaker struct {
+	mu        sync.Mutex
+	openUntil time.Time
+}
+
+// check returns errRedisDown while commands fail fast.
+func (b *redisBreaker) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return errRedisDown
+	}
+	return nil
+}
+
+// record opens the breaker if err is a connection error rather than an
+// answer of Redis, and wraps it in errRedisDown.
+func (b *redisBreaker) record(err error) error {
+	var reply interface{ RedisError() }
+	if err == nil || errors.Is(err, redis.Nil) || errors.As(err, &reply) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	b.mu.Lock()
+	b.openUntil = time.Now().Add(redisRetryAfter)
+	b.mu.Unlock()
+	return fmt.Errorf("%w: %w", errRedisDown, err)
+}
+
+func (b *redisBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
 
-	db, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
-	fmt.Println(os.Getenv("REDIS_ADDR"))
+func (b *redisBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := b.check()
+		if err == nil {
+			err = b.record(next(ctx, cmd))
+		}
+		if errors.Is(err, errRedisDown) {
+			cmd.SetErr(err)
+		}
+		return err
+	}
+}
+
+func (b *redisBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := b.check()
+		if err == nil {
+			err = b.record(next(ctx, cmds))
+		}
+		if errors.Is(err, errRedisDown) {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+		}
+		return err
+	}
+}
+
+// connectRedis sets up Rdb and the regional clients. main runs it before
+// anything else touches Redis.
+func connectRedis() {
+	if !config.usesRedis() {
+		// Every command fails with errNoRedis without dialing, so what
+		// needs Redis answers 501 instead of waiting on a connection.
+		Rdb = redis.NewClient(&redis.Options{})
+		Rdb.AddHook(noRedisHook{})
+		log.Printf("Running without Redis: links are kept by store backend %s. Set REDIS_ADDR for the features that need Redis.", config.StoreBackend)
+		return
+	}
+
+	log.Println("Connecting to Redis at", config.Redis.Addr)
 
     Rdb = redis.NewClient(&redis.Options{
-        Addr:     os.Getenv("REDIS_ADDR"),
-		Username: os.Getenv("REDIS_USER"),
-        Password: os.Getenv("REDIS_PASSWORD"),
-        DB: db,
+        Addr:     config.Redis.Addr,
+		Username: config.Redis.User,
+        Password: config.Redis.Password,
+        DB: config.Redis.DB,
     })
 
-    _, err = Rdb.Ping(Ctx).Result()
-    if err != nil {
+	// Only the redis backend needs Redis for links; the others start
+	// without it and serve links while it is down.
+	if config.StoreBackend != "redis" {
+		Rdb.AddHook(&redisBreaker{})
+	}
+
+    _, err := Rdb.Ping(Ctx).Result()
+    switch {
+    case err == nil:
+        log.Println("Connected to Redis successfully.")
+    case checkMode:
+        return
+    case config.StoreBackend != "redis":
+        log.Printf("Redis is unreachable: %v. Serving links from store backend %s; what needs Redis answers 503 until it is back.", err, config.StoreBackend)
+    default:
         log.Fatalf("Failed to connect to Redis: %v", err)
     }
-    fmt.Println("Connected to Redis successfully.")
+
+	regionsErr = initRegions()
+	if regionsErr != nil && !checkMode {
+		log.Fatal(regionsErr)
+	}
+}
+
+// redisGuard answers 501 on routes that only work with Redis while the
+// server runs without it.
+func redisGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.usesRedis() {
+			c.AbortWithStatusJSON(501, gin.H{"error": "Not available: " + errNoRedis.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+const (
+	counterKey     = "url_id_counter"
+	oplogKey       = "url_oplog"
+	expiryIndexKey = "url_expiry" // sorted set of codes scored by expiry time
+	indexStateKey  = "url_indexes" // hash: index name -> unix time it was built
+)
+
+// opEntry is one record of the url_oplog stream. The stream ID doubles as
+// the revision and carries the millisecond timestamp of the change.
+type opEntry struct {
+	Revision  string   `json:"revision"`
+	Timestamp int64    `json:"timestamp"`
+	Op        string   `json:"op"` // set, delete or counter
+	Code      string   `json:"code,omitempty"`
+	Data      *URLData `json:"data,omitempty"`
+	IDCounter int64    `json:"id_counter,omitempty"`
 }
 
-func SaveURL(code string, data URLData) error {
+// redisStore keeps each link as JSON under its code, in the home Redis or
+// the region the code was created in, and logs every write to url_oplog in
+// the same atomic step.
+type redisStore struct{}
+
+func (redisStore) SaveURL(code string, data URLData) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	err = Rdb.Set(Ctx, code, jsonData, 0).Err() // 0 expiry means "no expiry", we handle expiry ourselves
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return err
+	}
+
+	// The write and its op log record go out in one MULTI/EXEC so the log
+	// never misses a change that reached the keyspace.
+	_, err = rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(Ctx, code, jsonData, 0) // 0 expiry means "no expiry", we handle expiry ourselves
+		pipe.XAdd(Ctx, &redis.XAddArgs{
+			Stream: oplogKey,
+			Values: map[string]any{"op": "set", "code": code, "data": jsonData},
+		})
+		indexExpiry(pipe, code, data)
+		return nil
+	})
+	return err
+}
+
+// createScript claims codes only if all of them are free (and not bound
+// to another region) and logs the writes in the same atomic step. KEYS[4:]
+// are the codes and ARGV holds a data, expires-at pair for each. It
+// returns the position of the first taken code, or 0.
+var createScript = redis.NewScript(`
+for i = 4, #KEYS do
+	if redis.call("HEXISTS", KEYS[2], KEYS[i]) == 1 or redis.call("EXISTS", KEYS[i]) == 1 then
+		return i - 3
+	end
+end
+for i = 4, #KEYS do
+	local data, expiresAt = ARGV[2 * (i - 4) + 1], ARGV[2 * (i - 4) + 2]
+	redis.call("SET", KEYS[i], data)
+	redis.call("XADD", KEYS[1], "*", "op", "set", "code", KEYS[i], "data", data)
+	if expiresAt ~= "" then
+		redis.call("ZADD", KEYS[3], expiresAt, KEYS[i])
+	end
+end
+return 0
+`)
+
+// codeTakenError is the ErrConflict of CreateURLs, naming the code that
+// was taken.
+type codeTakenError struct {
+	code string
+}
+
+func (e codeTakenError) Error() string {
+	return "short code " + e.code + " already in use"
+}
+
+func (e codeTakenError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// CreateURLs claims regional codes in the home directory first, then
+// writes them to the region; the claims are released again if the write
+// fails.
+func (redisStore) CreateURLs(ctx context.Context, region string, codes []string, data []URLData) error {
+	keys := []string{oplogKey, regionDirKey, expiryIndexKey}
+	var args []any
+	for i, code := range codes {
+		jsonData, err := json.Marshal(data[i])
+		if err != nil {
+			return err
+		}
+		expiresAt := ""
+		if data[i].Expiry != 0 {
+			expiresAt = strconv.FormatInt(data[i].CreatedAt+data[i].Expiry, 10)
+		}
+		keys = append(keys, code)
+		args = append(args, jsonData, expiresAt)
+	}
+
+	if region != "" {
+		for i, code := range codes {
+			claimed, err := claimScript.Run(ctx, Rdb, []string{code, regionDirKey}, region).Int()
+			if err == nil && claimed == 0 {
+				err = codeTakenError{code}
+			}
+			if err != nil {
+				if i > 0 {
+					Rdb.HDel(Ctx, regionDirKey, codes[:i]...)
+				}
+				return err
+			}
+		}
+	}
+
+	taken, err := createScript.Run(ctx, clientFor(region), keys, args...).Int()
+	if err == nil && taken > 0 {
+		err = codeTakenError{codes[taken-1]}
+	}
+	if err != nil && region != "" {
+		Rdb.HDel(Ctx, regionDirKey, codes...)
+	}
 	return err
 }
 
-func GetURL(code string) (URLData, error) {
-	val, err := Rdb.Get(Ctx, code).Result()
+func (redisStore) GetURL(ctx context.Context, code string) (URLData, error) {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return URLData{}, err
+	}
+	return getURLFrom(ctx, rdb, code)
+}
+
+func getURLFrom(ctx context.Context, rdb *redis.Client, code string) (URLData, error) {
+	val, err := rdb.Get(ctx, code).Result()
+	if err == redis.Nil {
+		return URLData{}, ErrNotFound
+	}
 	if err != nil {
 		return URLData{}, err
 	}
@@ -64,40 +340,396 @@ func GetURL(code string) (URLData, error) {
 	return data, err
 }
 
-func DeleteURL(code string) error {
-	return Rdb.Del(Ctx, code).Err()
+var deleteScript = redis.NewScript(`
+if redis.call("DEL", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("XADD", KEYS[2], "*", "op", "delete", "code", KEYS[1])
+redis.call("ZREM", KEYS[3], KEYS[1])
+return 1
+`)
+
+func (redisStore) DeleteURL(code string) error {
+	region, err := regionOf(code)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := deleteScript.Run(Ctx, clientFor(region), []string{code, oplogKey, expiryIndexKey}).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	if region != "" {
+		return Rdb.HDel(Ctx, regionDirKey, code).Err()
+	}
+	return nil
+}
+
+// incrementClicksScript adds ARGV[1] to the clicks field inside the stored JSON, so
+// concurrent redirects can neither lose a click nor overwrite other edits
+// made since the link was read. A positive ARGV[2] is the limit the clicks
+// may not pass. The pattern cannot match inside a string value, where
+// every quote is escaped.
+var incrementClicksScript = redis.NewScript(`
+local raw = redis.call("GET", KEYS[1])
+if not raw then
+	return -1
+end
+local limit = tonumber(ARGV[2])
+if limit > 0 and tonumber(string.match(raw, '"clicks":(%d+)')) + tonumber(ARGV[1]) > limit then
+	return -2
+end
+local clicks = 0
+raw = string.gsub(raw, '"clicks":(%d+)', function(n)
+	clicks = tonumber(n) + tonumber(ARGV[1])
+	return '"clicks":' .. clicks
+end, 1)
+redis.call("SET", KEYS[1], raw)
+redis.call("XADD", KEYS[2], "*", "op", "set", "code", KEYS[1], "data", raw)
+return clicks
+`)
+
+func (redisStore) IncrementClicks(ctx context.Context, code string, n, limit int) (int, error) {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return 0, err
+	}
+	clicks, err := incrementClicksScript.Run(ctx, rdb, []string{code, oplogKey}, n, limit).Int()
+	if err != nil {
+		return 0, err
+	}
+	switch clicks {
+	case -1:
+		return 0, ErrNotFound
+	case -2:
+		return 0, ErrClickLimit
+	}
+	return clicks, nil
 }
 
-func ListURLs() ([]map[string]any, error) {
-	var results []map[string]any
+// indexExpiry keeps url_expiry in step with a write. Links without an
+// expiry are left out.
+func indexExpiry(pipe redis.Pipeliner, code string, data URLData) {
+	if data.Expiry == 0 {
+		pipe.ZRem(Ctx, expiryIndexKey, code)
+		return
+	}
+	pipe.ZAdd(Ctx, expiryIndexKey, redis.Z{Score: float64(data.CreatedAt + data.Expiry), Member: code})
+}
+
+// Prepare builds url_expiry for stores written before it existed. The
+// scan goes to a scratch key that is merged in afterwards, so entries
+// written by other instances meanwhile are kept.
+func (redisStore) Prepare() error {
+	for _, rdb := range allClients() {
+		built, err := rdb.HExists(Ctx, indexStateKey, "expiry").Result()
+		if err != nil {
+			return err
+		}
+		if built {
+			continue
+		}
 
-	iter := Rdb.Scan(Ctx, 0, "*", 0).Iterator()
-	for iter.Next(Ctx) {
-		key := iter.Val()
-		data, err := GetURL(key)
+		scratch := expiryIndexKey + ":build"
+		var indexed int
+		iter := rdb.Scan(Ctx, 0, "*", 1000).Iterator()
+		pipe := rdb.Pipeline()
+		for iter.Next(Ctx) {
+			data, err := getURLFrom(Ctx, rdb, iter.Val())
+			if err != nil || data.Expiry == 0 {
+				continue
+			}
+			pipe.ZAdd(Ctx, scratch, redis.Z{Score: float64(data.CreatedAt + data.Expiry), Member: iter.Val()})
+			if indexed++; indexed%1000 == 0 {
+				if _, err := pipe.Exec(Ctx); err != nil {
+					return err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if _, err := pipe.Exec(Ctx); err != nil {
+			return err
+		}
+
+		_, err = rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			if indexed > 0 {
+				pipe.ZUnionStore(Ctx, expiryIndexKey, &redis.ZStore{Keys: []string{expiryIndexKey, scratch}, Aggregate: "MAX"})
+				pipe.Del(Ctx, scratch)
+			}
+			pipe.HSet(Ctx, indexStateKey, "expiry", time.Now().Unix())
+			return nil
+		})
 		if err != nil {
+			return err
+		}
+		log.Printf("Built expiry index for %d links.", indexed)
+	}
+	return nil
+}
+
+// UpdateURL runs fn under WATCH, retrying if another writer changes the
+// key in between.
+func (redisStore) UpdateURL(code string, fn func(*URLData) error) error {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		err := rdb.Watch(Ctx, func(tx *redis.Tx) error {
+			val, err := tx.Get(Ctx, code).Result()
+			if err == redis.Nil {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+
+			var data URLData
+			if err := json.Unmarshal([]byte(val), &data); err != nil {
+				return err
+			}
+			if err := fn(&data); err != nil {
+				return err
+			}
+
+			jsonData, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(Ctx, code, jsonData, 0)
+				pipe.XAdd(Ctx, &redis.XAddArgs{
+					Stream: oplogKey,
+					Values: map[string]any{"op": "set", "code": code, "data": jsonData},
+				})
+				indexExpiry(pipe, code, data)
+				return nil
+			})
+			return err
+		}, code)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.New("too much contention updating " + code)
+}
+
+// ForEachURL visits every region, skipping internal keys.
+func (redisStore) ForEachURL(fn func(code string, data URLData) error) error {
+	for _, rdb := range allClients() {
+		iter := rdb.Scan(Ctx, 0, "*", 0).Iterator()
+		for iter.Next(Ctx) {
+			key := iter.Val()
+			data, err := getURLFrom(Ctx, rdb, key)
+			if err != nil {
+				continue
+			}
+			if err := fn(key, data); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotScript walks the keyspace and reads every value inside a single
+// script call. Redis runs scripts atomically, so no write can land halfway
+// through and the counter always matches the codes returned with it.
+var snapshotScript = redis.NewScript(`
+local last = redis.call("XREVRANGE", KEYS[2], "+", "-", "COUNT", 1)
+local result = {redis.call("GET", KEYS[1]) or "0", last[1] and last[1][1] or ""}
+local cursor = "0"
+repeat
+	local page = redis.call("SCAN", cursor, "COUNT", 1000)
+	cursor = page[1]
+	for _, key in ipairs(page[2]) do
+		if key ~= KEYS[1] and redis.call("TYPE", key).ok == "string" then
+			table.insert(result, key)
+			table.insert(result, redis.call("GET", key))
+		end
+	end
+until cursor == "0"
+return result
+`)
+
+func (redisStore) Snapshot() (Store, error) {
+	res, err := snapshotScript.Run(Ctx, Rdb, []string{counterKey, oplogKey}).StringSlice()
+	if err != nil {
+		return Store{}, err
+	}
+
+	counter, err := strconv.ParseInt(res[0], 10, 64)
+	if err != nil {
+		return Store{}, err
+	}
+
+	snapshot := Store{
+		IDCounter: counter,
+		URLStore:  make(map[string]URLData),
+		Revision:  res[1],
+	}
+	for i := 2; i+1 < len(res); i += 2 {
+		var data URLData
+		if err := json.Unmarshal([]byte(res[i+1]), &data); err != nil {
 			continue
 		}
+		snapshot.URLStore[res[i]] = data
+	}
 
-		current_time := time.Now().Unix()
-		expiryTime := data.CreatedAt + data.Expiry
+	return snapshot, nil
+}
+
+var nextIDScript = redis.NewScript(`
+local id = redis.call("INCR", KEYS[1])
+redis.call("XADD", KEYS[2], "*", "op", "counter", "id_counter", id)
+return id
+`)
+
+func (redisStore) Counter() (int64, error) {
+	counter, err := Rdb.Get(Ctx, counterKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return counter, err
+}
 
-		results = append(results, map[string]any{
-			"code":       key,
-			"long_url":   data.LongURL,
-			"clicks":     data.Clicks,
-			"created_at": time.Unix(data.CreatedAt, 0).UTC().Format(time.RFC3339),
-			"expires_at": time.Unix(expiryTime, 0).UTC().Format(time.RFC3339),
-			"is_expired": current_time > expiryTime,
+func (redisStore) GetNextID() (int64, error) {
+	return nextIDScript.Run(Ctx, Rdb, []string{counterKey, oplogKey}).Int64()
+}
+
+// counterFloorScript only ever raises the counter, so restarting with a
+// floor below the current value is a no-op.
+var counterFloorScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local floor = tonumber(ARGV[1])
+if current < floor then
+	redis.call("SET", KEYS[1], floor)
+	redis.call("XADD", KEYS[2], "*", "op", "counter", "id_counter", floor)
+end
+return 0
+`)
+
+func (redisStore) EnsureCounterFloor(floor int64) error {
+	return counterFloorScript.Run(Ctx, Rdb, []string{counterKey, oplogKey}, floor).Err()
+}
+
+func (redisStore) SetCounter(n int64) error {
+	_, err := Rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(Ctx, counterKey, n, 0)
+		pipe.XAdd(Ctx, &redis.XAddArgs{
+			Stream: oplogKey,
+			Values: map[string]any{"op": "counter", "id_counter": n},
 		})
+		return nil
+	})
+	return err
+}
+
+func parseOp(msg redis.XMessage) opEntry {
+	op := opEntry{Revision: msg.ID}
+	op.Op, _ = msg.Values["op"].(string)
+	op.Code, _ = msg.Values["code"].(string)
+	if ms, _, ok := strings.Cut(msg.ID, "-"); ok {
+		ts, _ := strconv.ParseInt(ms, 10, 64)
+		op.Timestamp = ts / 1000
+	}
+	if raw, ok := msg.Values["data"].(string); ok {
+		var data URLData
+		if json.Unmarshal([]byte(raw), &data) == nil {
+			op.Data = &data
+		}
+	}
+	if raw, ok := msg.Values["id_counter"].(string); ok {
+		op.IDCounter, _ = strconv.ParseInt(raw, 10, 64)
+	}
+	return op
+}
+
+// ChangesSince returns every op logged after the given revision ("0" for all).
+func ChangesSince(since string) ([]opEntry, error) {
+	if !redisBackend() {
+		return nil, errNoOplog
 	}
-	if err := iter.Err(); err != nil {
+	msgs, err := Rdb.XRange(Ctx, oplogKey, "("+since, "+").Result()
+	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	ops := make([]opEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		ops = append(ops, parseOp(msg))
+	}
+	return ops, nil
+}
+
+// SnapshotAt replays the op log up to the given unix timestamp.
+func SnapshotAt(at int64) (Store, error) {
+	if !redisBackend() {
+		return Store{}, errNoOplog
+	}
+	msgs, err := Rdb.XRange(Ctx, oplogKey, "-", strconv.FormatInt(at*1000+999, 10)).Result()
+	if err != nil {
+		return Store{}, err
+	}
+
+	snapshot := Store{URLStore: make(map[string]URLData)}
+	for _, msg := range msgs {
+		op := parseOp(msg)
+		switch op.Op {
+		case "set":
+			if op.Data != nil {
+				snapshot.URLStore[op.Code] = *op.Data
+			}
+		case "delete":
+			delete(snapshot.URLStore, op.Code)
+		case "counter":
+			snapshot.IDCounter = op.IDCounter
+		}
+		snapshot.Revision = op.Revision
+	}
+	return snapshot, nil
 }
 
-func GetNextID() (int64, error) {
-	return Rdb.Incr(Ctx, "url_id_counter").Result()
+// LinksAt replays the op log up to and including revision and returns the
+// state the given codes had at that point. Codes that did not exist yet are
+// absent from the result.
+func LinksAt(revision string, codes []string) (map[string]URLData, error) {
+	if !redisBackend() {
+		return nil, errNoOplog
+	}
+	links := make(map[string]URLData)
+	if revision == "0" || len(codes) == 0 {
+		return links, nil
+	}
+
+	msgs, err := Rdb.XRange(Ctx, oplogKey, "-", revision).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		op := parseOp(msg)
+		if !slices.Contains(codes, op.Code) {
+			continue
+		}
+		switch op.Op {
+		case "set":
+			if op.Data != nil {
+				links[op.Code] = *op.Data
+			}
+		case "delete":
+			delete(links, op.Code)
+		}
+	}
+	return links, nil
 }
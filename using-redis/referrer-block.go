@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Referrer blocking keeps a link from working when it is embedded on
+// sites the owner does not want, such as spam forums. A pattern is a host,
+// which also covers its subdomains, optionally followed by a path prefix:
+// "spam.example" or "forum.example/t/".
+
+const maxBlockedReferrers = 20
+
+var validReferrerPatternRegex = regexp.MustCompile(`^([a-z0-9-]+\.)+[a-z0-9-]+(/\S*)?$`)
+
+// normalizeReferrerPatterns lowercases patterns and drops a scheme pasted
+// with them. It fails on the first pattern that is not a host.
+func normalizeReferrerPatterns(patterns []string) ([]string, error) {
+	if len(patterns) > maxBlockedReferrers {
+		return nil, fmt.Errorf("At most %d referrer patterns are allowed", maxBlockedReferrers)
+	}
+	var normalized []string
+	for _, pattern := range patterns {
+		p := strings.ToLower(strings.TrimSpace(pattern))
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "https://"), "http://")
+		if !validReferrerPatternRegex.MatchString(p) {
+			return nil, fmt.Errorf("Referrer pattern %q must be a host, optionally followed by a path", pattern)
+		}
+		if !slices.Contains(normalized, p) {
+			normalized = append(normalized, p)
+		}
+	}
+	return normalized, nil
+}
+
+// referrerBlocked reports whether referer matches one of patterns. A
+// missing or unparsable Referer never matches.
+func referrerBlocked(patterns []string, referer string) bool {
+	if len(patterns) == 0 || referer == "" {
+		return false
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	path := cmp.Or(u.EscapedPath(), "/")
+	for _, pattern := range patterns {
+		patternHost, patternPath, _ := strings.Cut(pattern, "/")
+		if host != patternHost && !strings.HasSuffix(host, "."+patternHost) {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(path), "/"+patternPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// brandName is shown on pages served to visitors instead of a redirect.
+var brandName = config.BrandName
+
+var referrerBlockedTemplate = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Link unavailable - {{.Brand}}</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+h1 { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>This link is not available from here</h1>
+<p>The owner of this link has blocked it on the page you came from. If you
+were expecting it to work, open it directly instead of following it from
+that site.</p>
+<p><small>{{.Brand}}</small></p>
+{{if .Snippet}}<iframe src="/snippet/{{.Snippet}}/frame" sandbox="allow-scripts" title="" hidden></iframe>{{end}}
+</body>
+</html>
+`))
+
+// referrerBlockedKey is a hash of blocked hits per link, kept next to the
+// link on its backend.
+const referrerBlockedKey = "url_referrer_blocked"
+
+var bootReferrerBlocked atomic.Int64
+
+// recordReferrerBlocked counts a blocked hit for code and in the all-time
+// stats. Like clicks, the per-link count is only written on the primary.
+func recordReferrerBlocked(code string) {
+	recordStat(&bootReferrerBlocked, "referrer_blocked")
+	if replicaMode.Load() {
+		return
+	}
+	if counters, ok := links.(linkCounters); ok {
+		if err := counters.RecordReferrerBlocked(code); err != nil {
+			log.Println("Error counting blocked referrer:", err)
+		}
+		return
+	}
+	if !config.usesRedis() {
+		return
+	}
+	rdb, err := clientForCode(code)
+	if err == nil {
+		err = rdb.HIncrBy(Ctx, referrerBlockedKey, code, 1).Err()
+	}
+	if err != nil {
+		log.Println("Error counting blocked referrer:", err)
+	}
+}
+
+// ReferrerBlockedHits returns how many redirects of code were blocked,
+// 0 when nothing counts them.
+func ReferrerBlockedHits(code string) (int64, error) {
+	if counters, ok := links.(linkCounters); ok {
+		return counters.ReferrerBlockedHits(code)
+	}
+	if !config.usesRedis() {
+		return 0, nil
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return 0, err
+	}
+	hits, err := rdb.HGet(Ctx, referrerBlockedKey, code).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return hits, err
+}
+
+// blockReferrer serves the blocked page when the visitor came from a
+// blocked referrer, and reports whether it did.
+func blockReferrer(c *gin.Context, code string, data URLData) bool {
+	if !referrerBlocked(data.BlockedReferrers, c.Request.Referer()) {
+		return false
+	}
+	recordReferrerBlocked(code)
+	setPageHeaders(c.Writer.Header())
+	c.Status(403)
+	if err := referrerBlockedTemplate.Execute(c.Writer, newBrandedPage(data)); err != nil {
+		log.Println("Error rendering blocked page:", err)
+	}
+	return true
+}
+
+type blockedReferrersRequest struct {
+	Patterns []string `json:"patterns"`
+	Version  *int64   `json:"version"`
+}
+
+// blockedReferrersHandle replaces the referrer patterns of a link. An
+// empty list lifts the block. It is an edit like any other, so only the
+// link's owner or an admin may make it.
+func blockedReferrersHandle(c *gin.Context) {
+	code := c.Param("code")
+	var req blockedReferrersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	patterns, err := normalizeReferrerPatterns(req.Patterns)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, ok := editLink(c, "link.block_referrers", req.Version, func(data *URLData) ([]string, error) {
+		data.BlockedReferrers = patterns
+		return []string{"blocked_referrers"}, nil
+	})
+	if !ok {
+		return
+	}
+	if patterns == nil {
+		patterns = []string{}
+	}
+	c.JSON(200, gin.H{"code": code, "blocked_referrers": patterns, "version": updated.Version})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Data residency: links created for a tenant bound to a region are stored
+// only on that region's Redis, oplog and click events included. The home
+// Redis (REDIS_ADDR) keeps just a code -> region directory so redirects can
+// find them.
+const (
+	regionDirKey = "url_region"
+	tenantHeader = "X-Tenant"
+)
+
+// tenantProxies are the TRUSTED_PROXIES, the only peers whose X-Tenant is
+// believed.
+var tenantProxies = parsePrefixes(config.TrustedProxies)
+
+// requestTenant is the tenant of r: the X-Tenant header set by a gateway
+// in TRUSTED_PROXIES, or "" for requests from anywhere else, so a client
+// cannot pick the tenant its links are counted, styled and stored as.
+func requestTenant(r *http.Request) string {
+	if !peerIn(r, tenantProxies) {
+		return ""
+	}
+	return r.Header.Get(tenantHeader)
+}
+
+var (
+	regionClients = make(map[string]*redis.Client)
+	tenantRegions = make(map[string]string)
+	regionsErr    error // reported by --check instead of exiting
+)
+
+// parseAssignments reads "name=value,name=value" lists.
+func parseAssignments(list string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%q is not name=value", item)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// initRegions connects to redis.regions (region=redis://... URLs) and
+// checks that every tenant_regions binding (tenant=region) names one.
+func initRegions() error {
+	for name, rawURL := range config.Redis.Regions {
+		opts, err := redis.ParseURL(rawURL)
+		if err != nil {
+			return fmt.Errorf("REDIS_REGIONS: region %s: %w", name, err)
+		}
+		regionClients[name] = redis.NewClient(opts)
+	}
+
+	tenants := config.TenantRegions
+	for tenant, region := range tenants {
+		if _, ok := regionClients[region]; !ok {
+			return fmt.Errorf("TENANT_REGIONS: tenant %s is bound to unknown region %q", tenant, region)
+		}
+	}
+	tenantRegions = tenants
+	return nil
+}
+
+// requestRegion is the region new links from r in namespace ns must be
+// stored in, "" for home. TENANT_REGIONS binds namespaces by name like
+// tenants, and a bound namespace wins over the tenant, which only a
+// trusted proxy may set.
+func requestRegion(r *http.Request, ns string) string {
+	if region, ok := tenantRegions[ns]; ok && ns != "" {
+		return region
+	}
+	return tenantRegions[requestTenant(r)]
+}
+
+func clientFor(region string) *redis.Client {
+	if client, ok := regionClients[region]; ok {
+		return client
+	}
+	return Rdb
+}
+
+// regionOf looks code up in the directory; "" means the home Redis.
+func regionOf(code string) (string, error) {
+	if len(regionClients) == 0 {
+		return "", nil
+	}
+	region, err := Rdb.HGet(Ctx, regionDirKey, code).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return region, err
+}
+
+func clientForCode(code string) (*redis.Client, error) {
+	region, err := regionOf(code)
+	if err != nil {
+		return nil, err
+	}
+	return clientFor(region), nil
+}
+
+// allClients returns the home Redis followed by every region.
+func allClients() []*redis.Client {
+	names := make([]string, 0, len(regionClients))
+	for name := range regionClients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clients := []*redis.Client{Rdb}
+	for _, name := range names {
+		clients = append(clients, regionClients[name])
+	}
+	return clients
+}
+
+// claimScript reserves a code in the directory so codes stay unique across
+// regions. It fails if the home Redis already holds the code itself.
+var claimScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+return redis.call("HSETNX", KEYS[2], KEYS[1], ARGV[1])
+`)
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const replicaRevisionKey = "replica_revision"
+
+var (
+	primaryURL    = config.Replica.Of
+	replicaMode   atomic.Bool
+	stopReplica   = make(chan struct{})
+	promoteOnce   sync.Once
+	replicaClient = &http.Client{Transport: egressClient.Transport, Timeout: 30 * time.Second}
+
+	// replicationToken lets replicas and edge caches read the routes that
+	// dump every link, without the admin token. A replica sends its own.
+	replicationToken = config.Replica.Token
+)
+
+// remoteSnapshot and remoteChanges mirror the /export and /export/changes
+// payloads. Revisions are kept raw, as the primary sent them: stream IDs
+// from a Redis primary, numbers from older primaries.
+type remoteSnapshot struct {
+	IDCounter int64              `json:"idCounter"`
+	URLStore  map[string]URLData `json:"urlStore"`
+	Revision  json.RawMessage    `json:"revision"`
+}
+
+type remoteChanges struct {
+	Revision json.RawMessage `json:"revision"`
+	Changes  []struct {
+		Op        string   `json:"op"`
+		Code      string   `json:"code"`
+		Data      *URLData `json:"data"`
+		IDCounter int64    `json:"id_counter"`
+	} `json:"changes"`
+}
+
+func rawRevision(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+func fetchPrimary(path string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, primaryURL+path, nil)
+	if err != nil {
+		return err
+	}
+	if replicationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+replicationToken)
+	}
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errCompacted
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// replicationGuard admits REPLICATION_TOKEN and admins to the exports,
+// which hold every link with its owner and source.
+func replicationGuard() gin.HandlerFunc {
+	admin := adminGuard()
+	return func(c *gin.Context) {
+		if !ipPermitted(c.ClientIP(), true) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Access from your address is not allowed"})
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok && replicationToken != "" && hmac.Equal([]byte(token), []byte(replicationToken)) {
+			c.Next()
+			return
+		}
+		admin(c)
+	}
+}
+
+func fullSync() (string, error) {
+	var snapshot remoteSnapshot
+	if backupKey != "" {
+		var artifact backupArtifact
+		if err := fetchPrimary("/export", &artifact); err != nil {
+			return "", err
+		}
+		plaintext, _, err := openBackupBytes(artifact)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(plaintext, &snapshot); err != nil {
+			return "", err
+		}
+	} else if err := fetchPrimary("/export", &snapshot); err != nil {
+		return "", err
+	}
+
+	for code, data := range snapshot.URLStore {
+		if err := SaveURL(code, data); err != nil {
+			return "", err
+		}
+	}
+	if err := SetCounter(snapshot.IDCounter); err != nil {
+		return "", err
+	}
+
+	// Drop links deleted on the primary since an earlier sync.
+	var stale []string
+	err := ForEachURL(func(code string, _ URLData) error {
+		if _, ok := snapshot.URLStore[code]; !ok {
+			stale = append(stale, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, code := range stale {
+		if err := DeleteURL(code); err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+	}
+
+	log.Printf("Replica synced %d entries from %s", len(snapshot.URLStore), primaryURL)
+	return rawRevision(snapshot.Revision), nil
+}
+
+func pullChanges(since string) (string, error) {
+	var changes remoteChanges
+	err := fetchPrimary("/export/changes?since="+url.QueryEscape(since), &changes)
+	if errors.Is(err, errCompacted) {
+		log.Println("Replica fell behind the primary's op log compaction; resyncing.")
+		return fullSync()
+	}
+	if err != nil {
+		return since, err
+	}
+
+	for _, op := range changes.Changes {
+		var err error
+		switch op.Op {
+		case "set":
+			if op.Data != nil {
+				err = SaveURL(op.Code, *op.Data)
+			}
+		case "delete":
+			if err = DeleteURL(op.Code); errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+		case "counter":
+			err = SetCounter(op.IDCounter)
+		}
+		if err != nil {
+			return since, err
+		}
+		// Older primaries record the counter on every op.
+		if op.IDCounter > 0 && op.Op != "counter" {
+			if err := SetCounter(op.IDCounter); err != nil {
+				return since, err
+			}
+		}
+	}
+	return rawRevision(changes.Revision), nil
+}
+
+// startReplication tails the primary's op log until promoted or stopped.
+func startReplication(interval time.Duration) {
+	revision, _ := Rdb.Get(Ctx, replicaRevisionKey).Result()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		next := revision
+		if revision == "" {
+			next, err = fullSync()
+		} else {
+			next, err = pullChanges(revision)
+		}
+
+		if err != nil {
+			log.Println("Replication error:", err)
+		} else if next != revision {
+			revision = next
+			Rdb.Set(Ctx, replicaRevisionKey, revision, 0)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopReplica:
+			log.Println("Replication stopped.")
+			return
+		}
+	}
+}
+
+func readOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if replicaMode.Load() {
+			c.AbortWithStatusJSON(503, gin.H{"error": "Read-only replica", "primary": primaryURL})
+		}
+	}
+}
+
+func stopReplication() {
+	promoteOnce.Do(func() {
+		close(stopReplica)
+	})
+}
+
+func promoteHandle(c *gin.Context) {
+	if !replicaMode.Load() {
+		c.JSON(409, gin.H{"error": "Instance is already primary"})
+		return
+	}
+
+	stopReplication()
+	replicaMode.Store(false)
+	log.Println("Replica promoted to primary. Unset REPLICA_OF before the next restart.")
+	c.JSON(200, gin.H{"status": "promoted"})
+}
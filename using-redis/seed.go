@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	mathrand "math/rand/v2"
+	"os"
+	"time"
+)
+
+// seedMode is set when the binary runs as `seed`, which fills the
+// configured backend with made-up links for staging and demos.
+var seedMode = len(os.Args) > 1 && os.Args[1] == "seed"
+
+type seedOptions struct {
+	count int
+	days  int
+	rng   *mathrand.Rand
+}
+
+func parseSeedArgs(args []string) (seedOptions, error) {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	count := fs.Int("n", 100, "number of links to create")
+	days := fs.Int("days", 90, "spread creation dates over this many past days")
+	seed := fs.Uint64("seed", 0, "random seed for repeatable data (default: random)")
+	if err := fs.Parse(args); err != nil {
+		return seedOptions{}, err
+	}
+	if *count < 1 || *count > 1_000_000 {
+		return seedOptions{}, fmt.Errorf("-n must be between 1 and 1000000")
+	}
+	if *days < 1 {
+		return seedOptions{}, fmt.Errorf("-days must be positive")
+	}
+	if *seed == 0 {
+		*seed = mathrand.Uint64()
+	}
+	return seedOptions{count: *count, days: *days, rng: mathrand.New(mathrand.NewPCG(*seed, *seed))}, nil
+}
+
+var (
+	seedHosts  = []string{"example.com", "blog.example.org", "docs.example.net", "shop.example.com", "news.example.io", "github.com", "youtube.com"}
+	seedPaths  = []string{"", "pricing", "blog/launch-week", "docs/getting-started", "careers", "events/2026", "products/42", "watch", "support/faq"}
+	seedTags   = []string{"marketing", "docs", "launch", "newsletter", "social", "internal", "events", "support"}
+	seedOwners = []string{"", "", "alice", "bob", "carol", "dave"}
+	// Seven days is the default, so most real links have it.
+	seedExpiries = []int64{86400, 7 * 86400, 7 * 86400, 7 * 86400, 30 * 86400, 90 * 86400, 365 * 86400}
+)
+
+// seedLink makes one link and its daily click history. Some links are
+// already expired, like in a real store; clicks only land on days the
+// link was live.
+func (o seedOptions) seedLink(now time.Time) (URLData, map[string]dailyClicks) {
+	rng := o.rng
+	created := now.Add(-time.Duration(rng.Int64N(int64(o.days) * int64(24*time.Hour))))
+
+	url := "https://" + seedHosts[rng.IntN(len(seedHosts))] + "/" + seedPaths[rng.IntN(len(seedPaths))]
+	if rng.IntN(3) == 0 {
+		url += "?utm_source=" + seedTags[rng.IntN(len(seedTags))]
+	}
+
+	var tags []string
+	for _, i := range rng.Perm(len(seedTags))[:rng.IntN(4)] {
+		tags = append(tags, seedTags[i])
+	}
+
+	data := URLData{
+		LongURL:   url,
+		CreatedAt: created.Unix(),
+		Expiry:    seedExpiries[rng.IntN(len(seedExpiries))],
+		Tags:      tags,
+		Owner:     seedOwners[rng.IntN(len(seedOwners))],
+		Source:    &linkSource{Channel: sourceSeed},
+	}
+
+	end := now
+	if expires := created.Add(time.Duration(data.Expiry) * time.Second); data.Expiry != 0 && expires.Before(end) {
+		end = expires
+	}
+	live := int64(end.Sub(created) / time.Second)
+	if live <= 0 {
+		return data, nil
+	}
+
+	// Most links get a handful of clicks and a few get thousands.
+	clicks := int(math.Exp(rng.Float64()*8)) - 1
+	daily := make(map[string]dailyClicks)
+	for range clicks {
+		day := clickDay(data.CreatedAt + rng.Int64N(live))
+		agg := daily[day]
+		agg.Count++
+		daily[day] = agg
+	}
+	for day, agg := range daily {
+		agg.Uniques = max(1, agg.Count*int64(60+rng.IntN(35))/100)
+		daily[day] = agg
+	}
+	data.Clicks = clicks
+	return data, daily
+}
+
+// runSeed writes the links through CreateURL, so the op log, expiry index
+// and counter stay consistent with links created the usual way.
+func runSeed(args []string) int {
+	opts, err := parseSeedArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if idGeneratorErr != nil {
+		fmt.Fprintln(os.Stderr, idGeneratorErr)
+		return 1
+	}
+
+	now := time.Now()
+	var created, clicks int64
+	for range opts.count {
+		data, daily := opts.seedLink(now)
+
+		var code string
+		err := ErrConflict
+		for attempt := 0; errors.Is(err, ErrConflict) && attempt < maxIDAttempts; attempt++ {
+			if code, err = nextCode(""); err == nil {
+				err = CreateURL(code, data)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating link:", err)
+			return 1
+		}
+
+		pipe := Rdb.Pipeline()
+		for day, agg := range daily {
+			jsonData, err := json.Marshal(agg)
+			if err != nil {
+				return 1
+			}
+			pipe.HSet(Ctx, clickDailyPrefix+code, day, jsonData)
+		}
+		pipe.HIncrBy(Ctx, statsKey, "links_created", 1)
+		pipe.HIncrBy(Ctx, statsKey, "redirects", int64(data.Clicks))
+		if _, err := pipe.Exec(Ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing click history:", err)
+			return 1
+		}
+
+		created++
+		clicks += int64(data.Clicks)
+		if created%1000 == 0 {
+			fmt.Printf("Seeded %d of %d links...\n", created, opts.count)
+		}
+	}
+	fmt.Printf("Seeded %d links with %d clicks over the last %d days.\n", created, clicks, opts.days)
+	return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tenants can run their own JavaScript, such as a tag manager, on the
+// pages served instead of a redirect (age gate, consent, blocked pages).
+// TENANT_SNIPPETS names a JSON file mapping a tenant to its script and
+// the origins the script may load more code from:
+//
+//	{"acme": {"js": "...", "sources": ["https://www.googletagmanager.com"]}}
+//
+// The script never runs in our pages. It runs in a sandboxed iframe with
+// an opaque origin, so it cannot read our cookies, forms or the page, and
+// our pages keep a strict Content-Security-Policy without inline scripts.
+type tenantSnippet struct {
+	JS      string   `json:"js"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+var validTenantRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validSnippetSource admits https origins with an optional path, and
+// nothing that could end the CSP directive it is put in.
+var validSnippetSource = regexp.MustCompile(`^https://[a-zA-Z0-9.-]+(:[0-9]+)?(/[^\s;,']*)?$`)
+
+const maxSnippetBytes = 64 << 10
+
+var tenantSnippets, tenantSnippetsErr = loadTenantSnippets(config.TenantSnippets)
+
+func loadTenantSnippets(path string) (map[string]tenantSnippet, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("TENANT_SNIPPETS: %w", err)
+	}
+	var snippets map[string]tenantSnippet
+	if err := json.Unmarshal(raw, &snippets); err != nil {
+		return nil, fmt.Errorf("TENANT_SNIPPETS: %w", err)
+	}
+	for tenant, snippet := range snippets {
+		if !validTenantRegex.MatchString(tenant) {
+			return nil, fmt.Errorf("TENANT_SNIPPETS: tenant %q must be 1-64 letters, numbers, '-' or '_'", tenant)
+		}
+		if len(snippet.JS) > maxSnippetBytes {
+			return nil, fmt.Errorf("TENANT_SNIPPETS: the script of %s is over %d bytes", tenant, maxSnippetBytes)
+		}
+		for _, source := range snippet.Sources {
+			if !validSnippetSource.MatchString(source) {
+				return nil, fmt.Errorf("TENANT_SNIPPETS: source %q of %s must be an https origin", source, tenant)
+			}
+		}
+	}
+	return snippets, nil
+}
+
+// snippetFor returns tenant if it has a snippet, for the Snippet field of
+// page templates, and "" otherwise.
+func snippetFor(tenant string) string {
+	if _, ok := tenantSnippets[tenant]; ok {
+		return tenant
+	}
+	return ""
+}
+
+// pageCSP is the policy of the pages served instead of a redirect. They
+// have inline styles but no scripts; a tenant snippet comes in as a frame.
+const pageCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self'; frame-src 'self'; form-action 'self'; base-uri 'none'"
+
+func setPageHeaders(h http.Header) {
+	h.Set("Content-Security-Policy", pageCSP)
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+}
+
+// brandedPage is the data of a page that shows nothing but the brand.
+type brandedPage struct {
+	Brand   string
+	Snippet string // tenant whose snippet frame is embedded
+}
+
+func newBrandedPage(data URLData) brandedPage {
+	return brandedPage{Brand: brandName, Snippet: snippetFor(data.Tenant)}
+}
+
+// snippetFrameHTML is the document loaded into the sandboxed iframe.
+const snippetFrameHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<script src="/snippet/%s/script.js"></script>
+</head>
+<body></body>
+</html>
+`
+
+// writeSnippetFrame serves the frame document. Its policy lets the script
+// load from the tenant's sources and send data anywhere, which is what
+// tag managers do.
+func writeSnippetFrame(w http.ResponseWriter, tenant string) bool {
+	snippet, ok := tenantSnippets[tenant]
+	if !ok {
+		return false
+	}
+	scriptSrc := strings.Join(append([]string{"'self'"}, snippet.Sources...), " ")
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src %s; img-src * data:; connect-src *; frame-src %s", scriptSrc, scriptSrc))
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, snippetFrameHTML, tenant)
+	return true
+}
+
+func writeSnippetScript(w http.ResponseWriter, tenant string) bool {
+	snippet, ok := tenantSnippets[tenant]
+	if !ok {
+		return false
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.WriteString(w, snippet.JS)
+	return true
+}
+
+// snippetHandle serves /snippet/:tenant/frame and /snippet/:tenant/script.js.
+func snippetHandle(c *gin.Context) {
+	tenant := c.Param("tenant")
+	found := false
+	switch c.Param("file") {
+	case "frame":
+		found = writeSnippetFrame(c.Writer, tenant)
+	case "script.js":
+		found = writeSnippetScript(c.Writer, tenant)
+	}
+	if !found {
+		c.JSON(404, gin.H{"error": "Snippet not found"})
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+)
+
+// sqlStore keeps links in a SQL database. Each link is a row with its full
+// URLData as JSON; the columns beside it hold what queries need: the click
+// count, which is incremented in place, and the expiry, which cleanup
+// finds through an index. The blocked referrer hits are a column too, and
+// variant stats, namespaces and the dedupe_urls index have tables of their
+// own, so none of them need Redis. The queries are written for Postgres,
+// and the dialect covers what other databases do differently.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+type sqlDialect struct {
+	name    string // for messages, e.g. "Postgres"
+	setting string // the variable that points at the database
+
+	// migrations are applied in order by Prepare and recorded in
+	// schema_migrations; migration i is version i+1. Append new
+	// migrations, never edit applied ones.
+	migrations      []string
+	migrationsTable string
+	// lockMigrations runs first in every migration transaction, so that
+	// instances starting together apply each migration once. It is empty
+	// where transactions already exclude each other.
+	lockMigrations string
+
+	forUpdate string         // appended to the read of UpdateURL to lock the row
+	snapshot  *sql.TxOptions // the transaction Snapshot reads in
+	numbered  bool           // placeholders are ?1 instead of $1
+}
+
+var dollarParam = regexp.MustCompile(`\$(\d+)`)
+
+// q adapts a query to the dialect.
+func (s sqlStore) q(query string) string {
+	if s.dialect.numbered {
+		return dollarParam.ReplaceAllString(query, "?$1")
+	}
+	return query
+}
+
+func (s sqlStore) Prepare() error {
+	if err := s.db.PingContext(Ctx); err != nil {
+		return fmt.Errorf("connecting to %s: %w", s.dialect.name, err)
+	}
+	if _, err := s.db.ExecContext(Ctx, s.dialect.migrationsTable); err != nil {
+		return err
+	}
+
+	for i, migration := range s.dialect.migrations {
+		version := i + 1
+		err := s.inTx(nil, func(tx *sql.Tx) error {
+			if s.dialect.lockMigrations != "" {
+				if _, err := tx.ExecContext(Ctx, s.dialect.lockMigrations); err != nil {
+					return err
+				}
+			}
+			var applied bool
+			err := tx.QueryRowContext(Ctx, s.q(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`), version).Scan(&applied)
+			if err != nil || applied {
+				return err
+			}
+			if _, err := tx.ExecContext(Ctx, migration); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(Ctx, s.q(`INSERT INTO schema_migrations (version) VALUES ($1)`), version); err != nil {
+				return err
+			}
+			log.Printf("Applied %s schema migration %d.", s.dialect.name, version)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("schema migration %d: %w", version, err)
+		}
+	}
+	if err := s.copyFromRedis(); errors.Is(err, errRedisDown) {
+		log.Println("Not copying counters and namespaces from Redis until it is reachable:", err)
+	} else if err != nil {
+		return fmt.Errorf("copying counters and namespaces from Redis: %w", err)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction that is committed if fn succeeds.
+func (s sqlStore) inTx(opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(Ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// linkRow splits a link into the columns of the links table.
+func linkRow(data URLData) (jsonData []byte, expiresAt sql.NullInt64, err error) {
+	jsonData, err = json.Marshal(data)
+	if data.Expiry != 0 {
+		expiresAt = sql.NullInt64{Int64: data.CreatedAt + data.Expiry, Valid: true}
+	}
+	return jsonData, expiresAt, err
+}
+
+// decodeLink reads the data and clicks columns. The clicks column wins
+// over the count in the JSON, which IncrementClicks leaves alone.
+func decodeLink(raw []byte, clicks int) (URLData, error) {
+	var data URLData
+	err := json.Unmarshal(raw, &data)
+	data.Clicks = clicks
+	return data, err
+}
+
+func scanLink(row *sql.Row) (URLData, error) {
+	var raw []byte
+	var clicks int
+	if err := row.Scan(&raw, &clicks); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return URLData{}, ErrNotFound
+		}
+		return URLData{}, err
+	}
+	return decodeLink(raw, clicks)
+}
+
+func (s sqlStore) GetURL(ctx context.Context, code string) (URLData, error) {
+	return scanLink(s.db.QueryRowContext(ctx, s.q(`SELECT data, clicks FROM links WHERE code = $1`), code))
+}
+
+func (s sqlStore) SaveURL(code string, data URLData) error {
+	jsonData, expiresAt, err := linkRow(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(Ctx, s.q(`INSERT INTO links (code, long_url, clicks, created_at, expires_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (code) DO UPDATE SET long_url = EXCLUDED.long_url, clicks = EXCLUDED.clicks,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at, data = EXCLUDED.data`),
+		code, data.LongURL, data.Clicks, data.CreatedAt, expiresAt, jsonData)
+	return err
+}
+
+// CreateURLs inserts every code in one transaction, so a taken code
+// leaves none of them behind.
+func (s sqlStore) CreateURLs(ctx context.Context, region string, codes []string, data []URLData) error {
+	if region != "" {
+		return errors.New("regions need STORE_BACKEND=redis")
+	}
+	return s.inTx(nil, func(tx *sql.Tx) error {
+		for i, code := range codes {
+			jsonData, expiresAt, err := linkRow(data[i])
+			if err != nil {
+				return err
+			}
+			res, err := tx.ExecContext(ctx, s.q(`INSERT INTO links (code, long_url, clicks, created_at, expires_at, data)
+				VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (code) DO NOTHING`),
+				code, data[i].LongURL, data[i].Clicks, data[i].CreatedAt, expiresAt, jsonData)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				return codeTakenError{code}
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateURL locks the row for the length of fn, so concurrent updates and
+// click increments wait for it instead of being lost.
+func (s sqlStore) UpdateURL(code string, fn func(*URLData) error) error {
+	return s.inTx(nil, func(tx *sql.Tx) error {
+		data, err := scanLink(tx.QueryRowContext(Ctx, s.q(`SELECT data, clicks FROM links WHERE code = $1`+s.dialect.forUpdate), code))
+		if err != nil {
+			return err
+		}
+		if err := fn(&data); err != nil {
+			return err
+		}
+		jsonData, expiresAt, err := linkRow(data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(Ctx, s.q(`UPDATE links SET long_url = $2, clicks = $3, created_at = $4, expires_at = $5, data = $6
+			WHERE code = $1`), code, data.LongURL, data.Clicks, data.CreatedAt, expiresAt, jsonData)
+		return err
+	})
+}
+
+// DeleteURL deletes the variant stats with the link.
+func (s sqlStore) DeleteURL(code string) error {
+	return s.inTx(nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(Ctx, s.q(`DELETE FROM links WHERE code = $1`), code)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.ExecContext(Ctx, s.q(`DELETE FROM link_variants WHERE code = $1`), code)
+		return err
+	})
+}
+
+func (s sqlStore) IncrementClicks(ctx context.Context, code string, n, limit int) (int, error) {
+	var clicks int
+	err := s.db.QueryRowContext(ctx, s.q(`UPDATE links SET clicks = clicks + $2 WHERE code = $1 AND ($3 <= 0 OR clicks + $2 <= $3) RETURNING clicks`), code, n, limit).Scan(&clicks)
+	if errors.Is(err, sql.ErrNoRows) && limit > 0 {
+		// The link is missing or out of clicks; only the first is not found.
+		var exists int
+		if err := s.db.QueryRowContext(ctx, s.q(`SELECT 1 FROM links WHERE code = $1`), code).Scan(&exists); err == nil {
+			return 0, ErrClickLimit
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return clicks, err
+}
+
+// sqlPageSize is how many links ForEachURL reads per query.
+const sqlPageSize = 1000
+
+// ForEachURL reads a page at a time in code order and calls fn between
+// queries, so fn may use the store itself.
+func (s sqlStore) ForEachURL(fn func(code string, data URLData) error) error {
+	after := ""
+	for {
+		codes, page, err := s.page(after)
+		if err != nil {
+			return err
+		}
+		for i, code := range codes {
+			if err := fn(code, page[i]); err != nil {
+				return err
+			}
+		}
+		if len(codes) < sqlPageSize {
+			return nil
+		}
+		after = codes[len(codes)-1]
+	}
+}
+
+func (s sqlStore) page(after string) ([]string, []URLData, error) {
+	rows, err := s.db.QueryContext(Ctx, s.q(`SELECT code, data, clicks FROM links WHERE code > $1 ORDER BY code LIMIT $2`),
+		after, sqlPageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var codes []string
+	var page []URLData
+	for rows.Next() {
+		var code string
+		var raw []byte
+		var clicks int
+		if err := rows.Scan(&code, &raw, &clicks); err != nil {
+			return nil, nil, err
+		}
+		data, err := decodeLink(raw, clicks)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		page = append(page, data)
+	}
+	return codes, page, rows.Err()
+}
+
+// Snapshot reads the counter and every link in one transaction. SQL
+// backends keep no op log, so the revision is empty.
+func (s sqlStore) Snapshot() (Store, error) {
+	snapshot := Store{URLStore: make(map[string]URLData)}
+	err := s.inTx(s.dialect.snapshot, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(Ctx, `SELECT value FROM counters WHERE name = 'id'`).Scan(&snapshot.IDCounter)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(Ctx, `SELECT code, data, clicks FROM links`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var code string
+			var raw []byte
+			var clicks int
+			if err := rows.Scan(&code, &raw, &clicks); err != nil {
+				return err
+			}
+			data, err := decodeLink(raw, clicks)
+			if err != nil {
+				return err
+			}
+			snapshot.URLStore[code] = data
+		}
+		return rows.Err()
+	})
+	return snapshot, err
+}
+
+func (s sqlStore) Counter() (int64, error) {
+	var counter int64
+	err := s.db.QueryRowContext(Ctx, `SELECT value FROM counters WHERE name = 'id'`).Scan(&counter)
+	return counter, err
+}
+
+func (s sqlStore) GetNextID() (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(Ctx, `UPDATE counters SET value = value + 1 WHERE name = 'id' RETURNING value`).Scan(&id)
+	return id, err
+}
+
+func (s sqlStore) EnsureCounterFloor(floor int64) error {
+	_, err := s.db.ExecContext(Ctx, s.q(`UPDATE counters SET value = $1 WHERE name = 'id' AND value < $1`), floor)
+	return err
+}
+
+func (s sqlStore) SetCounter(n int64) error {
+	_, err := s.db.ExecContext(Ctx, s.q(`UPDATE counters SET value = $1 WHERE name = 'id'`), n)
+	return err
+}
+
+// DeleteExpired reads expired codes through the expires_at index.
+func (s sqlStore) DeleteExpired(ctx context.Context, now int64) (int64, error) {
+	return deleteExpiredPages(ctx, func(skip int64) ([]string, error) {
+		rows, err := s.db.QueryContext(ctx, s.q(`SELECT code FROM links WHERE expires_at < $1 ORDER BY expires_at, code LIMIT $2 OFFSET $3`),
+			now, cleanupPageSize, skip)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var codes []string
+		for rows.Next() {
+			var code string
+			if err := rows.Scan(&code); err != nil {
+				return nil, err
+			}
+			codes = append(codes, code)
+		}
+		return codes, rows.Err()
+	})
+}
+
+func (s sqlStore) VariantStats(code string, n int) ([]variantStat, error) {
+	rows, err := s.db.QueryContext(Ctx, s.q(`SELECT variant, visits, conversions FROM link_variants WHERE code = $1 AND variant < $2`), code, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make([]variantStat, n)
+	for rows.Next() {
+		var i int
+		var stat variantStat
+		if err := rows.Scan(&i, &stat.Visits, &stat.Conversions); err != nil {
+			return nil, err
+		}
+		if i >= 0 {
+			stats[i] = stat
+		}
+	}
+	return stats, rows.Err()
+}
+
+// RecordVariant adds to a counter in place, so concurrent redirects do not
+// lose counts.
+func (s sqlStore) RecordVariant(code string, variant int, counter string, n int) error {
+	var visits, conversions int
+	switch counter {
+	case "visits":
+		visits = n
+	case "conversions":
+		conversions = n
+	default:
+		return fmt.Errorf("unknown variant counter %q", counter)
+	}
+	return s.inTx(nil, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(Ctx, s.q(`SELECT 1 FROM links WHERE code = $1`), code).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(Ctx, s.q(`INSERT INTO link_variants (code, variant, visits, conversions) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (code, variant) DO UPDATE SET visits = link_variants.visits + EXCLUDED.visits,
+				conversions = link_variants.conversions + EXCLUDED.conversions`), code, variant, visits, conversions)
+		return err
+	})
+}
+
+// ReferrerBlockedHits is 0 for a link that does not exist, as in Redis.
+func (s sqlStore) ReferrerBlockedHits(code string) (int64, error) {
+	var hits int64
+	err := s.db.QueryRowContext(Ctx, s.q(`SELECT blocked_hits FROM links WHERE code = $1`), code).Scan(&hits)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return hits, err
+}
+
+func (s sqlStore) RecordReferrerBlocked(code string) error {
+	res, err := s.db.ExecContext(Ctx, s.q(`UPDATE links SET blocked_hits = blocked_hits + 1 WHERE code = $1`), code)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s sqlStore) SetCounters(code string, stats []variantStat, blockedHits int64) error {
+	return s.inTx(nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(Ctx, s.q(`UPDATE links SET blocked_hits = $2 WHERE code = $1`), code, blockedHits)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+		if _, err := tx.ExecContext(Ctx, s.q(`DELETE FROM link_variants WHERE code = $1`), code); err != nil {
+			return err
+		}
+		for i, stat := range stats {
+			if stat == (variantStat{}) {
+				continue
+			}
+			_, err := tx.ExecContext(Ctx, s.q(`INSERT INTO link_variants (code, variant, visits, conversions) VALUES ($1, $2, $3, $4)`),
+				code, i, stat.Visits, stat.Conversions)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s sqlStore) SaveNamespace(ns namespace) error {
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(Ctx, s.q(`INSERT INTO namespaces (name, data) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET data = EXCLUDED.data`), ns.Name, raw)
+	return err
+}
+
+func (s sqlStore) GetNamespace(name string) (namespace, error) {
+	var ns namespace
+	var raw []byte
+	err := s.db.QueryRowContext(Ctx, s.q(`SELECT data FROM namespaces WHERE name = $1`), name).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ns, ErrNotFound
+	}
+	if err != nil {
+		return ns, err
+	}
+	err = json.Unmarshal(raw, &ns)
+	return ns, err
+}
+
+func (s sqlStore) Namespaces() ([]namespace, error) {
+	rows, err := s.db.QueryContext(Ctx, `SELECT data FROM namespaces ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := []namespace{}
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var ns namespace
+		if err := json.Unmarshal(raw, &ns); err == nil {
+			all = append(all, ns)
+		}
+	}
+	return all, rows.Err()
+}
+
+func (s sqlStore) DeleteNamespace(name string) error {
+	res, err := s.db.ExecContext(Ctx, s.q(`DELETE FROM namespaces WHERE name = $1`), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// IndexedURL treats a failed read as a miss, so shortening goes on and
+// creates a new link.
+func (s sqlStore) IndexedURL(field string) (string, bool) {
+	var code string
+	err := s.db.QueryRowContext(Ctx, s.q(`SELECT code FROM url_index WHERE field = $1`), field).Scan(&code)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("Error reading URL index:", err)
+	}
+	return code, err == nil
+}
+
+func (s sqlStore) IndexURL(field, code string) {
+	_, err := s.db.ExecContext(Ctx, s.q(`INSERT INTO url_index (field, code) VALUES ($1, $2)
+		ON CONFLICT (field) DO UPDATE SET code = EXCLUDED.code`), field, code)
+	if err != nil {
+		log.Println("Error writing URL index:", err)
+	}
+}
+
+// copyFromRedis copies the counters, namespaces and dedupe_urls index that
+// Redis kept before the tables above existed, once, at the first start
+// with Redis reachable. Rows already in the tables are kept.
+func (s sqlStore) copyFromRedis() error {
+	var copied int64
+	err := s.db.QueryRowContext(Ctx, `SELECT value FROM counters WHERE name = 'redis_copied'`).Scan(&copied)
+	if err != nil || copied != 0 || !config.usesRedis() {
+		return err
+	}
+
+	rawNamespaces, err := Rdb.HGetAll(Ctx, namespacesKey).Result()
+	if err != nil {
+		return err
+	}
+	for name, raw := range rawNamespaces {
+		_, err := s.db.ExecContext(Ctx, s.q(`INSERT INTO namespaces (name, data) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`),
+			name, []byte(raw))
+		if err != nil {
+			return err
+		}
+	}
+	index := Rdb.HScan(Ctx, urlIndexKey, 0, "", 1000).Iterator()
+	for index.Next(Ctx) {
+		field := index.Val()
+		if !index.Next(Ctx) {
+			break
+		}
+		_, err := s.db.ExecContext(Ctx, s.q(`INSERT INTO url_index (field, code) VALUES ($1, $2) ON CONFLICT (field) DO NOTHING`),
+			field, index.Val())
+		if err != nil {
+			return err
+		}
+	}
+	if err := index.Err(); err != nil {
+		return err
+	}
+	blocked := Rdb.HScan(Ctx, referrerBlockedKey, 0, "", 1000).Iterator()
+	for blocked.Next(Ctx) {
+		code := blocked.Val()
+		if !blocked.Next(Ctx) {
+			break
+		}
+		hits, _ := strconv.ParseInt(blocked.Val(), 10, 64)
+		_, err := s.db.ExecContext(Ctx, s.q(`UPDATE links SET blocked_hits = $2 WHERE code = $1 AND blocked_hits = 0`), code, hits)
+		if err != nil {
+			return err
+		}
+	}
+	if err := blocked.Err(); err != nil {
+		return err
+	}
+	err = s.ForEachURL(func(code string, data URLData) error {
+		if len(data.Variants) == 0 {
+			return nil
+		}
+		raw, err := Rdb.HGetAll(Ctx, variantStatsPrefix+code).Result()
+		if err != nil {
+			return err
+		}
+		for i, stat := range parseVariantStats(raw, len(data.Variants)+1) {
+			if stat == (variantStat{}) {
+				continue
+			}
+			_, err := s.db.ExecContext(Ctx, s.q(`INSERT INTO link_variants (code, variant, visits, conversions) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (code, variant) DO NOTHING`), code, i, stat.Visits, stat.Conversions)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(Ctx, `UPDATE counters SET value = 1 WHERE name = 'redis_copied'`)
+	if err == nil {
+		log.Printf("Copied %d namespaces and the counters and URL index from Redis into %s.", len(rawNamespaces), s.dialect.name)
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var statelessKey = config.StatelessKey
+
+// maxStatelessURL keeps tokens short enough to survive chat apps and QR codes.
+const maxStatelessURL = 1024
+
+var errInvalidToken = errors.New("invalid stateless token")
+
+func statelessCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(statelessKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealStateless packs the expiry and destination into an encrypted token,
+// so the redirect needs no storage lookup.
+func sealStateless(longURL string, expiresAt int64) (string, error) {
+	aead, err := statelessCipher()
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, 8, 8+len(longURL))
+	binary.BigEndian.PutUint64(payload, uint64(expiresAt))
+	payload = append(payload, longURL...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, payload, nil)), nil
+}
+
+func openStateless(token string) (string, int64, error) {
+	aead, err := statelessCipher()
+	if err != nil {
+		return "", 0, err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", 0, errInvalidToken
+	}
+	payload, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil || len(payload) < 8 {
+		return "", 0, errInvalidToken
+	}
+
+	return string(payload[8:]), int64(binary.BigEndian.Uint64(payload[:8])), nil
+}
+
+func statelessShorten(c *gin.Context, longURL string, expiry int64) {
+	if statelessKey == "" {
+		c.JSON(400, gin.H{"error": "Stateless links are disabled (STATELESS_KEY not set)"})
+		return
+	}
+
+	token, err := sealStateless(longURL, time.Now().Unix()+expiry)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create stateless link"})
+		return
+	}
+
+	data := URLData{LongURL: longURL, CreatedAt: time.Now().Unix(), Expiry: expiry}
+	if err := runCreateHooks(c.Request.Context(), token, data); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	recordLinkCreated(requestTenant(c.Request), c.GetString(apiKeyContextKey))
+	shortURL := baseURL + "s/" + token
+	respondFields(c, gin.H{"code": token, "short_url": shortURL, "expiry_seconds": expiry})
+}
+
+func statelessRedirect(c *gin.Context) {
+	if statelessKey == "" {
+		c.JSON(404, gin.H{"error": "URL not found"})
+		return
+	}
+
+	longURL, expiresAt, err := openStateless(c.Param("token"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "URL not found"})
+		return
+	}
+
+	if time.Now().Unix() > expiresAt {
+		c.JSON(410, gin.H{"error": "URL expired"})
+		return
+	}
+
+	data := URLData{LongURL: longURL}
+	if err := runRedirectHooks(c.Request.Context(), c.Param("token"), data, c.Request); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	recordRedirect("", "") // the token does not carry a tenant or key
+	c.Redirect(http.StatusFound, longURL)
+}
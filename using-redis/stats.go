@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const statsKey = "url_stats"
+
+var (
+	bootTime         = time.Now()
+	bootLinksCreated atomic.Int64
+	bootRedirects    atomic.Int64
+)
+
+// recordStat bumps the in-process counter and the persisted all-time total
+// kept in a Redis hash, so neither has to be derived by scanning keys.
+func recordStat(counter *atomic.Int64, field string) {
+	counter.Add(1)
+	if !config.usesRedis() {
+		return
+	}
+	if err := Rdb.HIncrBy(Ctx, statsKey, field, 1).Err(); err != nil {
+		log.Println("Error updating stats:", err)
+	}
+}
+
+// recordLinkCreated and recordRedirect count a link's activity, toward
+// its tenant and the API key it was created with ("" for none).
+func recordLinkCreated(tenant, key string) {
+	recordStat(&bootLinksCreated, "links_created")
+	tenantCountersFor(tenant).linkCreated()
+	keyCountersFor(key).linkCreated()
+}
+
+func recordRedirect(tenant, key string) {
+	recordStat(&bootRedirects, "redirects")
+	tenantCountersFor(tenant).redirected()
+	keyCountersFor(key).redirected()
+}
+
+// tenantCounters back the per-tenant and per-key series on /metrics.
+type tenantCounters struct {
+	linksCreated atomic.Int64
+	redirects    atomic.Int64
+}
+
+// otherTenant labels every tenant missing from METRICS_TENANTS, and links
+// without a tenant.
+const otherTenant = "other"
+
+// tenantMetrics has an entry per METRICS_TENANTS tenant plus otherTenant,
+// so the number of series stays bounded however many tenants send
+// traffic. It is nil when per-tenant metrics are off and is never
+// modified after startup.
+var tenantMetrics = parseTenantMetrics(config.MetricsTenants)
+
+func parseTenantMetrics(list []string) map[string]*tenantCounters {
+	if len(list) == 0 {
+		return nil
+	}
+	metrics := map[string]*tenantCounters{otherTenant: {}}
+	for _, tenant := range list {
+		metrics[tenant] = &tenantCounters{}
+	}
+	return metrics
+}
+
+// tenantCountersFor returns the counters for tenant's activity, or nil
+// when per-tenant metrics are off. Counting on nil is a no-op.
+func tenantCountersFor(tenant string) *tenantCounters {
+	if tenantMetrics == nil {
+		return nil
+	}
+	if counters, ok := tenantMetrics[tenant]; ok {
+		return counters
+	}
+	return tenantMetrics[otherTenant]
+}
+
+// keyMetrics holds a tenantCounters per API key (by ID) that links were
+// created with. Only admins create keys, so the series stay bounded.
+var keyMetrics sync.Map
+
+// keyCountersFor returns the counters for key's activity, or nil for
+// links created without a key.
+func keyCountersFor(key string) *tenantCounters {
+	if key == "" {
+		return nil
+	}
+	if counters, ok := keyMetrics.Load(key); ok {
+		return counters.(*tenantCounters)
+	}
+	counters, _ := keyMetrics.LoadOrStore(key, &tenantCounters{})
+	return counters.(*tenantCounters)
+}
+
+func (t *tenantCounters) linkCreated() {
+	if t != nil {
+		t.linksCreated.Add(1)
+	}
+}
+
+func (t *tenantCounters) redirected() {
+	if t != nil {
+		t.redirects.Add(1)
+	}
+}
+
+func writeTenantMetrics(w io.Writer) {
+	if tenantMetrics == nil {
+		return
+	}
+	tenants := slices.Sorted(maps.Keys(tenantMetrics))
+
+	fmt.Fprintf(w, "# HELP urlshortener_tenant_links_created_total Links created since the process started, by tenant.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_tenant_links_created_total counter\n")
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "urlshortener_tenant_links_created_total{tenant=%q} %d\n", tenant, tenantMetrics[tenant].linksCreated.Load())
+	}
+	fmt.Fprintf(w, "# HELP urlshortener_tenant_redirects_total Redirects served since the process started, by tenant.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_tenant_redirects_total counter\n")
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "urlshortener_tenant_redirects_total{tenant=%q} %d\n", tenant, tenantMetrics[tenant].redirects.Load())
+	}
+}
+
+func writeKeyMetrics(w io.Writer) {
+	counters := make(map[string]*tenantCounters)
+	keyMetrics.Range(func(key, value any) bool {
+		counters[key.(string)] = value.(*tenantCounters)
+		return true
+	})
+	keys := slices.Sorted(maps.Keys(counters))
+
+	fmt.Fprintf(w, "# HELP urlshortener_api_key_links_created_total Links created since the process started, by API key.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_api_key_links_created_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "urlshortener_api_key_links_created_total{api_key=%q} %d\n", key, counters[key].linksCreated.Load())
+	}
+	fmt.Fprintf(w, "# HELP urlshortener_api_key_redirects_total Redirects served since the process started, by the API key the link was created with.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_api_key_redirects_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "urlshortener_api_key_redirects_total{api_key=%q} %d\n", key, counters[key].redirects.Load())
+	}
+}
+
+func allTimeStats() (map[string]int64, error) {
+	if !config.usesRedis() {
+		// Nothing outlives the process without Redis.
+		return map[string]int64{
+			"links_created":    bootLinksCreated.Load(),
+			"redirects":        bootRedirects.Load(),
+			"referrer_blocked": bootReferrerBlocked.Load(),
+		}, nil
+	}
+	raw, err := Rdb.HGetAll(Ctx, statsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]int64{"links_created": 0, "redirects": 0, "referrer_blocked": 0}
+	for field, value := range raw {
+		stats[field], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return stats, nil
+}
+
+func statsSummaryHandle(c *gin.Context) {
+	allTime, err := allTimeStats()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"since_boot": gin.H{
+			"links_created":    bootLinksCreated.Load(),
+			"redirects":        bootRedirects.Load(),
+			"referrer_blocked": bootReferrerBlocked.Load(),
+			"uptime_seconds":   int64(time.Since(bootTime).Seconds()),
+		},
+		"all_time": allTime,
+	})
+}
+
+func metricsHandle(c *gin.Context) {
+	allTime, err := allTimeStats()
+	if err != nil {
+		c.String(500, "failed to read stats\n")
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_links_created_total Links created since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_links_created_total counter\n")
+	fmt.Fprintf(c.Writer, "urlshortener_links_created_total %d\n", bootLinksCreated.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_redirects_total Redirects served since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_redirects_total counter\n")
+	fmt.Fprintf(c.Writer, "urlshortener_redirects_total %d\n", bootRedirects.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_referrer_blocked_total Redirects refused for a blocked referrer since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_referrer_blocked_total counter\n")
+	fmt.Fprintf(c.Writer, "urlshortener_referrer_blocked_total %d\n", bootReferrerBlocked.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_geo_blocked_total Redirects refused for a blocked country since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_geo_blocked_total counter\n")
+	fmt.Fprintf(c.Writer, "urlshortener_geo_blocked_total %d\n", bootGeoBlocked.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_links_created_all_time Links created over the lifetime of the store.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_links_created_all_time gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_links_created_all_time %d\n", allTime["links_created"])
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_redirects_all_time Redirects served over the lifetime of the store.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_redirects_all_time gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_redirects_all_time %d\n", allTime["redirects"])
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_redirect_latency_p99_seconds Redirect p99 latency over the last full minute.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_redirect_latency_p99_seconds gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_redirect_latency_p99_seconds %g\n", redirectLatency.p99().Seconds())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_cleanup_running Whether an expired link cleanup is in progress.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_cleanup_running gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_cleanup_running %d\n", boolMetric(cleanupRunning.Load()))
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_cleanup_checked Links examined by the current or last cleanup.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_cleanup_checked gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_cleanup_checked %d\n", cleanupChecked.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_cleanup_deleted_total Expired links deleted since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_cleanup_deleted_total counter\n")
+	fmt.Fprintf(c.Writer, "urlshortener_cleanup_deleted_total %d\n", cleanupDeleted.Load())
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_cleanup_duration_seconds Duration of the last completed cleanup.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_cleanup_duration_seconds gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_cleanup_duration_seconds %g\n", float64(cleanupDuration.Load())/1000)
+	fmt.Fprintf(c.Writer, "# HELP urlshortener_uptime_seconds Seconds since the process started.\n")
+	fmt.Fprintf(c.Writer, "# TYPE urlshortener_uptime_seconds gauge\n")
+	fmt.Fprintf(c.Writer, "urlshortener_uptime_seconds %d\n", int64(time.Since(bootTime).Seconds()))
+	writeTenantMetrics(c.Writer)
+	writeKeyMetrics(c.Writer)
+	writeVerifyMetrics(c.Writer)
+	writeAgeGateMetrics(c.Writer)
+	writeConsentMetrics(c.Writer)
+	writeLinkCacheMetrics(c.Writer)
+	writeEventStreamMetrics(c.Writer)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// validCompareCode also admits suffixed codes such as "promo-2" and
+// namespaced ones such as "sales.promo".
+var validCompareCode = regexp.MustCompile(`^[a-zA-Z0-9.-]{1,97}$`)
+
+const (
+	maxCompareCodes = 20
+	maxCompareDays  = 366
+)
+
+// clickSeries is one link's daily clicks, aligned with the response's days.
+type clickSeries struct {
+	Code    string  `json:"code"`
+	Total   int64   `json:"total"`
+	Clicks  []int64 `json:"clicks"`
+	Uniques []int64 `json:"uniques"`
+}
+
+func parseCompareCodes(param string) ([]string, error) {
+	var codes []string
+	for _, code := range strings.Split(param, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" || slices.Contains(codes, code) {
+			continue
+		}
+		if !validCompareCode.MatchString(code) {
+			return nil, fmt.Errorf("Invalid code %q", code)
+		}
+		codes = append(codes, code)
+	}
+
+	if len(codes) == 0 {
+		return nil, errors.New("Provide at least one code in codes")
+	}
+	if len(codes) > maxCompareCodes {
+		return nil, fmt.Errorf("At most %d codes can be compared", maxCompareCodes)
+	}
+	return codes, nil
+}
+
+// parseCompareRange reads from/to as UTC dates (YYYY-MM-DD), both inclusive,
+// defaulting to the 30 days ending today.
+func parseCompareRange(fromParam, toParam string, now time.Time) (time.Time, time.Time, error) {
+	to := now.UTC().Truncate(24 * time.Hour)
+	if toParam != "" {
+		t, err := time.Parse(time.DateOnly, toParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid to date (use YYYY-MM-DD)")
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -29)
+	if fromParam != "" {
+		t, err := time.Parse(time.DateOnly, fromParam)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid from date (use YYYY-MM-DD)")
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("The from date must not be after to")
+	}
+	if to.Sub(from) >= maxCompareDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("Range is limited to %d days", maxCompareDays)
+	}
+	return from, to, nil
+}
+
+// buildClickSeries merges rolled-up days with raw events of the days that
+// are not rolled up yet into one row per code.
+func buildClickSeries(codes []string, from, to time.Time, daily map[string]map[string]dailyClicks, raw []clickEvent) ([]string, []clickSeries) {
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(time.DateOnly))
+	}
+
+	rawByDay := make(map[string][]clickEvent)
+	for _, ev := range raw {
+		day := clickDay(ev.Timestamp)
+		rawByDay[day] = append(rawByDay[day], ev)
+	}
+	recent := make(map[string]map[string]dailyClicks, len(rawByDay))
+	for day, events := range rawByDay {
+		recent[day] = aggregateClicks(events)
+	}
+
+	series := make([]clickSeries, 0, len(codes))
+	for _, code := range codes {
+		s := clickSeries{
+			Code:    code,
+			Clicks:  make([]int64, len(days)),
+			Uniques: make([]int64, len(days)),
+		}
+		for i, day := range days {
+			agg, ok := daily[code][day]
+			if !ok {
+				agg = recent[day][code]
+			}
+			s.Clicks[i] = agg.Count
+			s.Uniques[i] = agg.Uniques
+			s.Total += agg.Count
+		}
+		series = append(series, s)
+	}
+	return days, series
+}
+
+func compareStatsHandle(c *gin.Context) {
+	codes, err := parseCompareCodes(c.Query("codes"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := parseCompareRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	daily := make(map[string]map[string]dailyClicks, len(codes))
+	for _, code := range codes {
+		if daily[code], err = DailyClicks(code); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to read stats"})
+			return
+		}
+	}
+	raw, err := PendingClicksOf(codes, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read stats"})
+		return
+	}
+
+	days, series := buildClickSeries(codes, from, to, daily, raw)
+	c.JSON(200, gin.H{
+		"from":   from.Format(time.DateOnly),
+		"to":     to.Format(time.DateOnly),
+		"days":   days,
+		"series": series,
+	})
+}
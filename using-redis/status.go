@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceStatus is what /status exposes. It deliberately carries no link
+// data, keys or addresses so it can be embedded in dashboards.
+type serviceStatus struct {
+	Status        string `json:"status"` // ok or degraded
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	Backend       string `json:"backend"`
+	BackendOK     bool   `json:"backend_ok"`
+	LastCleanup   string `json:"last_cleanup"`
+	QueueDepth    int64  `json:"queue_depth"`
+}
+
+var lastCleanup atomic.Int64
+
+func lastCleanupText() string {
+	ts := lastCleanup.Load()
+	if ts == 0 {
+		return "never"
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>URL Shortener Status</title>
+<style>
+body { font-family: sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+th { text-align: left; padding-right: 1rem; }
+.ok { color: #1b7f3b; }
+.degraded { color: #b00020; }
+</style>
+</head>
+<body>
+<h1 class="{{.Status}}">{{if eq .Status "ok"}}All systems operational{{else}}Degraded{{end}}</h1>
+<table>
+	<tr><th>Uptime</th><td>{{.UptimeSeconds}}s</td></tr>
+	<tr><th>Backend ({{.Backend}})</th><td>{{if .BackendOK}}connected{{else}}unreachable{{end}}</td></tr>
+	<tr><th>Last cleanup</th><td>{{.LastCleanup}}</td></tr>
+	<tr><th>Raw clicks kept</th><td>{{.QueueDepth}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// statusHandle serves HTML by default and JSON for ?format=json or an
+// Accept: application/json header. Degraded status returns 503 so plain
+// HTTP monitors can alert on it.
+func statusHandle(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	status := serviceStatus{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(bootTime).Seconds()),
+		Backend:       "redis",
+		LastCleanup:   lastCleanupText(),
+	}
+	if config.usesRedis() {
+		status.BackendOK = Rdb.Ping(ctx).Err() == nil
+		if status.BackendOK {
+			status.QueueDepth, _ = Rdb.XLen(ctx, clickEventsKey).Result()
+		}
+	} else {
+		// Without Redis the store is the backend, and there is no queue.
+		status.Backend = config.StoreBackend
+		_, err := links.Counter()
+		status.BackendOK = err == nil
+	}
+	if !status.BackendOK {
+		status.Status = "degraded"
+	}
+
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	if c.Query("format") == "json" || c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(code, status)
+		return
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(code)
+	statusTemplate.Execute(c.Writer, status)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// compactionKey records the newest op removed by compaction. Incremental
+// readers whose cursor is older than it must start over from a full load.
+const compactionKey = "url_compaction"
+
+// storageSampleSize caps MEMORY USAGE calls per namespace; the rest of the
+// namespace is extrapolated from the sampled average.
+const storageSampleSize = 100
+
+var internalKeys = []string{
+	counterKey, oplogKey, clickEventsKey, statsKey, kvPushKey, healthKey,
+	auditKey, deletedOwnersKey, regionDirKey, compactionKey, replicaRevisionKey, expiryIndexKey, indexStateKey,
+	verifyKey, importsKey, referrerBlockedKey, clickRollupKey, apiKeysKey, usersKey, namespacesKey, topLinksKey,
+	webhooksKey, webhookQueueKey,
+}
+
+func namespaceOf(key string) string {
+	switch {
+	case strings.HasPrefix(key, clickDailyPrefix):
+		return "click_daily"
+	case strings.HasPrefix(key, clickDaysPrefix):
+		return "click_days"
+	case strings.HasPrefix(key, clickHoursPrefix):
+		return "click_hours"
+	case strings.HasPrefix(key, clickUniquesPrefix):
+		return "click_uniques"
+	case strings.HasPrefix(key, clickLinkPrefix):
+		return "click_links"
+	case strings.HasPrefix(key, variantStatsPrefix):
+		return "variant_stats"
+	case strings.HasPrefix(key, idempotencyPrefix):
+		return "idempotency"
+	case strings.HasPrefix(key, quotaKeyPrefix):
+		return "quota"
+	case slices.Contains(internalKeys, key):
+		return key
+	default:
+		return "links"
+	}
+}
+
+type namespaceUsage struct {
+	Name           string `json:"name"`
+	Keys           int64  `json:"keys"`
+	SampledKeys    int64  `json:"sampled_keys"`
+	EstimatedBytes int64  `json:"estimated_bytes"`
+
+	sampledBytes int64
+}
+
+type backendUsage struct {
+	Backend    string           `json:"backend"` // "home" or a region name
+	Keys       int64            `json:"keys"`
+	UsedMemory int64            `json:"used_memory,omitempty"`
+	Namespaces []namespaceUsage `json:"namespaces"`
+	Streams    map[string]int64 `json:"streams"`
+	Indexes    map[string]int64 `json:"indexes"`
+}
+
+func usedMemory(rdb *redis.Client) int64 {
+	info, err := rdb.Info(Ctx, "memory").Result()
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "used_memory:"); ok {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// measureBackend scans one Redis, counting keys per namespace and sampling
+// MEMORY USAGE for the first keys of each.
+func measureBackend(name string, rdb *redis.Client) (backendUsage, error) {
+	usage := backendUsage{
+		Backend:    name,
+		UsedMemory: usedMemory(rdb),
+		Streams:    make(map[string]int64),
+		Indexes:    make(map[string]int64),
+	}
+
+	byName := make(map[string]*namespaceUsage)
+	iter := rdb.Scan(Ctx, 0, "*", 1000).Iterator()
+	for iter.Next(Ctx) {
+		key := iter.Val()
+		ns := byName[namespaceOf(key)]
+		if ns == nil {
+			ns = &namespaceUsage{Name: namespaceOf(key)}
+			byName[ns.Name] = ns
+		}
+		ns.Keys++
+		usage.Keys++
+
+		if ns.SampledKeys < storageSampleSize {
+			if bytes, err := rdb.MemoryUsage(Ctx, key).Result(); err == nil {
+				ns.SampledKeys++
+				ns.sampledBytes += bytes
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return usage, err
+	}
+
+	for _, ns := range byName {
+		if ns.SampledKeys > 0 {
+			ns.EstimatedBytes = ns.sampledBytes / ns.SampledKeys * ns.Keys
+		}
+		usage.Namespaces = append(usage.Namespaces, *ns)
+	}
+	slices.SortFunc(usage.Namespaces, func(a, b namespaceUsage) int {
+		return int(b.EstimatedBytes - a.EstimatedBytes)
+	})
+
+	for _, stream := range []string{oplogKey, clickEventsKey, auditKey} {
+		usage.Streams[stream], _ = rdb.XLen(Ctx, stream).Result()
+	}
+	usage.Indexes[regionDirKey], _ = rdb.HLen(Ctx, regionDirKey).Result()
+	usage.Indexes[expiryIndexKey], _ = rdb.ZCard(Ctx, expiryIndexKey).Result()
+	return usage, nil
+}
+
+func storageHandle(c *gin.Context) {
+	backends := []backendUsage{}
+	names := []string{"home"}
+	for name := range regionClients {
+		names = append(names, name)
+	}
+	slices.Sort(names[1:])
+
+	for _, name := range names {
+		rdb := Rdb
+		if name != "home" {
+			rdb = regionClients[name]
+		}
+		usage, err := measureBackend(name, rdb)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		backends = append(backends, usage)
+	}
+
+	compacted, _ := Rdb.HGet(Ctx, compactionKey, "revision").Result()
+	c.JSON(200, gin.H{
+		"backends":           backends,
+		"compacted_revision": compacted,
+		"sample_size":        storageSampleSize,
+		"link_cache":         redirectCache.report(),
+	})
+}
+
+// revisionBefore compares stream IDs ("ms-seq").
+func revisionBefore(a, b string) bool {
+	aMs, aSeq, _ := strings.Cut(a, "-")
+	bMs, bSeq, _ := strings.Cut(b, "-")
+	am, _ := strconv.ParseInt(aMs, 10, 64)
+	bm, _ := strconv.ParseInt(bMs, 10, 64)
+	if am != bm {
+		return am < bm
+	}
+	as, _ := strconv.ParseInt(aSeq, 10, 64)
+	bs, _ := strconv.ParseInt(bSeq, 10, 64)
+	return as < bs
+}
+
+var errCompacted = errors.New("since is older than the last op log compaction; start again from since=0")
+
+// checkCompacted rejects incremental cursors that point into compacted
+// history, where deletes may be missing.
+func checkCompacted(since string) error {
+	if since == "0" {
+		return nil
+	}
+	compacted, err := Rdb.HGet(Ctx, compactionKey, "revision").Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if revisionBefore(since, compacted) {
+		return errCompacted
+	}
+	return nil
+}
+
+// CompactOplog removes ops older than cutoff that replay no longer needs
+// (see compactableOps) from one backend's op log. Only old entries are
+// touched, so concurrent writes are unaffected and revisions stay valid.
+func CompactOplog(rdb *redis.Client, cutoff int64) (int, error) {
+	msgs, err := rdb.XRange(Ctx, oplogKey, "-", strconv.FormatInt(cutoff*1000-1, 10)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	ops := make([]opEntry, len(msgs))
+	for i, msg := range msgs {
+		ops[i] = parseOp(msg)
+	}
+	drop := compactableOps(ops, cutoff)
+	if len(drop) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(drop))
+	for i, idx := range drop {
+		ids[i] = msgs[idx].ID
+	}
+	newest := ids[len(ids)-1]
+
+	_, err = rdb.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+		for start := 0; start < len(ids); start += 1000 {
+			pipe.XDel(Ctx, oplogKey, ids[start:min(start+1000, len(ids))]...)
+		}
+		pipe.HSet(Ctx, compactionKey, "revision", newest)
+		return nil
+	})
+	return len(ids), err
+}
+
+func compactHandle(c *gin.Context) {
+	var req compactRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	cutoff, err := req.cutoff(time.Now())
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Never compact history the KV pusher has yet to send.
+	if pushed, err := Rdb.HGet(Ctx, kvPushKey, "revision").Result(); err == nil && kvPusher != nil {
+		ms, _, _ := strings.Cut(pushed, "-")
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			cutoff = min(cutoff, n/1000)
+		}
+	}
+
+	var before, removed int64
+	for _, rdb := range allClients() {
+		n, _ := rdb.XLen(Ctx, oplogKey).Result()
+		before += n
+		dropped, err := CompactOplog(rdb, cutoff)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		removed += int64(dropped)
+	}
+	// Also drop raw clicks that are already past retention.
+	if err := rollUpClicks(time.Now()); err != nil {
+		storeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cutoff":        formatUnix(cutoff),
+		"oplog_before":  before,
+		"oplog_removed": removed,
+	})
+}
+
+// compactableOps returns the indexes of ops older than cutoff that a replay
+// does not need: ops overwritten by a later op on the same code, deletes
+// (whose earlier sets are dropped with them) and all but the last counter
+// op. Replaying the remaining log still yields the same store at any point
+// from cutoff on. ops must be in log order.
+func compactableOps(ops []opEntry, cutoff int64) []int {
+	lastOp := make(map[string]int)
+	lastCounter := -1
+	for i, op := range ops {
+		if op.Timestamp >= cutoff {
+			break
+		}
+		if op.Op == "counter" {
+			lastCounter = i
+		} else {
+			lastOp[op.Code] = i
+		}
+	}
+
+	var drop []int
+	for i, op := range ops {
+		if op.Timestamp >= cutoff {
+			break
+		}
+		switch {
+		case op.Op == "counter":
+			if i != lastCounter {
+				drop = append(drop, i)
+			}
+		case lastOp[op.Code] != i, op.Op == "delete":
+			drop = append(drop, i)
+		}
+	}
+	return drop
+}
+
+type compactRequest struct {
+	KeepDays int `json:"keep_days"`
+}
+
+// cutoff is the unix time before which op history is collapsed.
+// The last week is kept by default so recent point-in-time exports work.
+func (req compactRequest) cutoff(now time.Time) (int64, error) {
+	days := req.KeepDays
+	if days == 0 {
+		days = 7
+	}
+	if days < 0 {
+		return 0, errors.New("keep_days must be positive")
+	}
+	return now.AddDate(0, 0, -days).Unix(), nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// LinkStore is where links and the ID counter are kept. Handlers go
+// through the functions below, which add what every backend shares: the
+// redirect cache and the per-link data kept next to it in Redis. A new
+// backend implements LinkStore and gets a case in newLinkStore.
+//
+// The name avoids Store, which is the export format of a whole store.
+// ListURLs, GetActiveURL and the create helpers are built on these
+// methods, so backends only implement the primitives. Raw clicks, stats,
+// the audit log and the op log are not part of a backend and stay in
+// Redis; a backend may keep some of the rest itself by implementing
+// linkCounters, namespaceStore or urlIndex. Without Redis, backends other
+// than redis serve links alone and the features Redis keeps answer 501.
+type LinkStore interface {
+	// GetURL returns ErrNotFound for a code that is not stored.
+	GetURL(ctx context.Context, code string) (URLData, error)
+	// SaveURL creates or overwrites a link.
+	SaveURL(code string, data URLData) error
+	// CreateURLs stores data[i] under codes[i]: all of them, or none if
+	// any code is taken, with an error that matches ErrConflict and
+	// names the code. region is "" unless REGIONS is configured.
+	CreateURLs(ctx context.Context, region string, codes []string, data []URLData) error
+	// UpdateURL applies fn to a stored link so that concurrent writers
+	// never clobber each other. An error from fn leaves the link as it was.
+	UpdateURL(code string, fn func(*URLData) error) error
+	// DeleteURL returns ErrNotFound for a code that is not stored.
+	DeleteURL(code string) error
+	// IncrementClicks atomically adds n clicks and returns the new total.
+	// With a positive limit, clicks that would take the total past it
+	// fail with ErrClickLimit and are not added.
+	IncrementClicks(ctx context.Context, code string, n, limit int) (int, error)
+	// ForEachURL calls fn for every stored link until fn fails.
+	ForEachURL(fn func(code string, data URLData) error) error
+	// Snapshot returns every link together with the counter, consistent
+	// with each other.
+	Snapshot() (Store, error)
+
+	// Counter returns the ID counter without moving it.
+	Counter() (int64, error)
+	GetNextID() (int64, error)
+	// EnsureCounterFloor raises the counter to floor; it never lowers it.
+	EnsureCounterFloor(floor int64) error
+	SetCounter(n int64) error
+
+	// DeleteExpired deletes links expired at now and returns how many.
+	DeleteExpired(ctx context.Context, now int64) (int64, error)
+	// Prepare runs at startup, e.g. to build indexes or migrate a schema.
+	Prepare() error
+}
+
+// store_backend picks the LinkStore.
+var links, storeBackendErr = newLinkStore(config.StoreBackend)
+
+func newLinkStore(backend string) (LinkStore, error) {
+	var store LinkStore
+	var err error
+	switch backend {
+	case "", "redis":
+		return redisStore{}, nil
+	case "postgres":
+		store, err = newPostgresStore()
+	case "sqlite":
+		store, err = newSQLiteStore()
+	case "bolt":
+		store, err = newBoltStore()
+	case "json":
+		store, err = newJSONStore()
+	case "memory":
+		store = newMemoryStore()
+	default:
+		err = fmt.Errorf("STORE_BACKEND=%q is not a known backend (use redis, postgres, sqlite, bolt or json)", backend)
+	}
+	if err != nil {
+		return redisStore{}, err
+	}
+	return store, nil
+}
+
+// errNoOplog is returned by the features that replay the op log, which
+// only the Redis backend writes.
+var errNoOplog = errors.New("this needs STORE_BACKEND=redis, which keeps the op log")
+
+// linkCounters is implemented by backends that keep the variant stats and
+// blocked referrer hits of a link with the link, as store.json and the SQL
+// backends do. The other backends leave them to Redis.
+type linkCounters interface {
+	VariantStats(code string, n int) ([]variantStat, error)
+	RecordVariant(code string, variant int, counter string, n int) error
+	ReferrerBlockedHits(code string) (int64, error)
+	RecordReferrerBlocked(code string) error
+	// SetCounters replaces both counters of a link, for migrate.
+	SetCounters(code string, stats []variantStat, blockedHits int64) error
+}
+
+// namespaceStore is implemented by backends that keep namespaces
+// themselves. The other backends leave them to Redis.
+type namespaceStore interface {
+	SaveNamespace(ns namespace) error
+	// GetNamespace returns ErrNotFound for a namespace that is not stored.
+	GetNamespace(name string) (namespace, error)
+	Namespaces() ([]namespace, error)
+	// DeleteNamespace returns ErrNotFound for a namespace that is not stored.
+	DeleteNamespace(name string) error
+}
+
+// urlIndex is implemented by backends that keep the dedupe_urls index
+// themselves. The other backends leave it to Redis.
+type urlIndex interface {
+	// IndexedURL returns the code indexed under a dedupeField.
+	IndexedURL(field string) (string, bool)
+	IndexURL(field, code string)
+}
+
+// closeLinks writes what the backend still holds in memory, at shutdown.
+func closeLinks() {
+	if closer, ok := links.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("Error closing the store:", err)
+		}
+	}
+}
+
+func redisBackend() bool {
+	_, ok := links.(redisStore)
+	return ok
+}
+
+func GetURL(code string) (URLData, error) {
+	return GetURLContext(Ctx, code)
+}
+
+// GetURLContext is GetURL traced as part of the request of ctx.
+func GetURLContext(ctx context.Context, code string) (URLData, error) {
+	ctx, span := startSpan(ctx, "store.GetURL", attribute.String("link.code", code))
+	data, err := links.GetURL(ctx, code)
+	endSpan(span, err)
+	return data, err
+}
+
+// GetActiveURL is GetURL for redirects: expired links return ErrExpired,
+// and links out of clicks ErrClickLimit.
+func GetActiveURL(code string) (URLData, error) {
+	data, err := GetURL(code)
+	if err != nil {
+		return data, err
+	}
+	if data.Expiry != 0 && time.Now().Unix() > data.CreatedAt+data.Expiry {
+		return data, ErrExpired
+	}
+	if data.Disabled {
+		return data, ErrDisabled
+	}
+	if data.clicksUsedUp() {
+		return data, ErrClickLimit
+	}
+	return data, nil
+}
+
+func SaveURL(code string, data URLData) error {
+	if err := links.SaveURL(code, data); err != nil {
+		return err
+	}
+	redirectCache.forget(code)
+	trackQuota([]string{code}, []URLData{data})
+	return nil
+}
+
+// CreateURL stores a new code, failing with ErrConflict if it is taken.
+func CreateURL(code string, data URLData) error {
+	return CreateURLIn("", code, data)
+}
+
+// CreateURLIn is CreateURL for a region ("" for home).
+func CreateURLIn(region, code string, data URLData) error {
+	return CreateURLsIn(Ctx, region, []string{code}, []URLData{data})
+}
+
+// CreateURLsIn stores several new codes, data[i] under codes[i]: all of
+// them, or none if any is taken.
+func CreateURLsIn(ctx context.Context, region string, codes []string, data []URLData) error {
+	ctx, span := startSpan(ctx, "store.CreateURLs", attribute.StringSlice("link.codes", codes))
+	err := links.CreateURLs(ctx, region, codes, data)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	trackQuota(codes, data)
+	return nil
+}
+
+// UpdateURL applies fn to a stored link, so read-modify-write callers
+// never clobber each other.
+func UpdateURL(code string, fn func(*URLData) error) error {
+	var updated URLData
+	err := links.UpdateURL(code, func(data *URLData) error {
+		if err := fn(data); err != nil {
+			return err
+		}
+		updated = *data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	redirectCache.forget(code)
+	trackQuota([]string{code}, []URLData{updated})
+	return nil
+}
+
+// DeleteURL deletes a link along with its variant stats, unique visitor
+// count and blocked referrer count.
+func DeleteURL(code string) error {
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return err
+	}
+	data, _ := links.GetURL(Ctx, code) // for the quota it counted against
+	if err := links.DeleteURL(code); err != nil {
+		return err
+	}
+	redirectCache.forget(code)
+	if !config.usesRedis() {
+		return nil
+	}
+	untrackQuota(code, data)
+	untrackTopLinks(code)
+	rdb.Del(Ctx, variantStatsPrefix+code, clickUniquesPrefix+code, clickLinkPrefix+code)
+	rdb.HDel(Ctx, referrerBlockedKey, code)
+	return nil
+}
+
+func IncrementClicks(ctx context.Context, code string, n, limit int) (int, error) {
+	ctx, span := startSpan(ctx, "store.IncrementClicks", attribute.String("link.code", code))
+	clicks, err := links.IncrementClicks(ctx, code, n, limit)
+	endSpan(span, err)
+	return clicks, err
+}
+
+func ForEachURL(fn func(code string, data URLData) error) error {
+	return links.ForEachURL(fn)
+}
+
+// ListURLs returns the links whose source passes filter, and only those
+// of owner and of namespace ns unless they are "". Sources include the
+// creator's IP only for admins.
+func ListURLs(filter sourceFilter, owner, ns string, admin bool) ([]map[string]any, error) {
+	var results []map[string]any
+
+	err := ForEachURL(func(key string, data URLData) error {
+		if !filter.match(data.Source) || (owner != "" && data.Owner != owner) || (ns != "" && data.Namespace != ns) {
+			return nil
+		}
+		results = append(results, map[string]any{
+			"code":       key,
+			"long_url":   data.LongURL,
+			"clicks":     data.Clicks,
+			"created_at": time.Unix(data.CreatedAt, 0).UTC().Format(time.RFC3339),
+			"expires_at": data.expiresAt(),
+			"is_expired": data.expired(time.Now().Unix()),
+			"tags":       data.Tags,
+			"owner":      data.Owner,
+			"namespace":  data.Namespace,
+			"disabled":   data.Disabled,
+			"source":     data.Source.view(admin),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func SnapshotStore() (Store, error) {
+	return links.Snapshot()
+}
+
+func GetNextID() (int64, error) {
+	return links.GetNextID()
+}
+
+func EnsureCounterFloor(floor int64) error {
+	return links.EnsureCounterFloor(floor)
+}
+
+func SetCounter(n int64) error {
+	return links.SetCounter(n)
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// concurrentClicks is how many redirects the tests below run at once.
+const concurrentClicks = 100
+
+// TestMain points Redis at an in-process server instead of REDIS_ADDR,
+// as main would at the real one.
+func TestMain(m *testing.M) {
+	server, err := miniredis.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start in-memory Redis:", err)
+		os.Exit(1)
+	}
+	config.Redis = RedisConfig{Addr: server.Addr()}
+	connectRedis()
+	os.Exit(m.Run())
+}
+
+// testStores opens every backend that runs without a server. Redis is the
+// in-process one tests get instead of REDIS_ADDR.
+func testStores(t *testing.T) map[string]LinkStore {
+	t.Helper()
+	dir := t.TempDir()
+	config.StoreFile = filepath.Join(dir, "store.json")
+	config.SQLitePath = filepath.Join(dir, "links.db")
+	config.BoltPath = filepath.Join(dir, "links.bolt")
+
+	stores := map[string]LinkStore{"redis": redisStore{}}
+	for name, open := range map[string]func() (LinkStore, error){
+		"json":   newJSONStore,
+		"sqlite": newSQLiteStore,
+		"bolt":   newBoltStore,
+	} {
+		store, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := store.Prepare(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() {
+			switch store := store.(type) {
+			case sqlStore:
+				store.db.Close()
+			case boltStore:
+				store.db.Close()
+			}
+		})
+		stores[name] = store
+	}
+	return stores
+}
+
+// createTestLink stores a fresh link under a code unique to the test.
+func createTestLink(t *testing.T, store LinkStore, maxClicks int) string {
+	t.Helper()
+	code := "t" + encodeID(time.Now().UnixNano())
+	data := URLData{LongURL: "https://example.com/", CreatedAt: time.Now().Unix(), Expiry: 3600, MaxClicks: maxClicks}
+	if err := store.CreateURLs(context.Background(), "", []string{code}, []URLData{data}); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// incrementConcurrently adds one click per goroutine and returns the
+// totals the successful ones saw and how many hit the limit.
+func incrementConcurrently(t *testing.T, store LinkStore, code string, limit int) (totals []int, limited int) {
+	t.Helper()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range concurrentClicks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clicks, err := store.IncrementClicks(context.Background(), code, 1, limit)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrClickLimit):
+				limited++
+			case err != nil:
+				t.Error(err)
+			default:
+				totals = append(totals, clicks)
+			}
+		}()
+	}
+	wg.Wait()
+	slices.Sort(totals)
+	return totals, limited
+}
+
+func TestIncrementClicksConcurrent(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			code := createTestLink(t, store, 0)
+			totals, _ := incrementConcurrently(t, store, code, 0)
+
+			// Every increment saw its own total: none was lost or counted twice.
+			for i, clicks := range totals {
+				if clicks != i+1 {
+					t.Fatalf("totals = %v, want 1 to %d once each", totals, concurrentClicks)
+				}
+			}
+			data, err := store.GetURL(context.Background(), code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Clicks != concurrentClicks {
+				t.Errorf("clicks = %d, want %d", data.Clicks, concurrentClicks)
+			}
+		})
+	}
+}
+
+func TestIncrementClicksLimit(t *testing.T) {
+	const limit = 10
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			code := createTestLink(t, store, limit)
+			totals, limited := incrementConcurrently(t, store, code, limit)
+
+			if len(totals) != limit || limited != concurrentClicks-limit {
+				t.Errorf("%d counted and %d refused, want %d and %d", len(totals), limited, limit, concurrentClicks-limit)
+			}
+			data, err := store.GetURL(context.Background(), code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Clicks != limit {
+				t.Errorf("clicks = %d, want %d", data.Clicks, limit)
+			}
+		})
+	}
+}
+
+// TestRedirectClicksJSON runs concurrent redirects against the JSON store
+// and reads the count back from the file its flush wrote.
+func TestRedirectClicksJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		maxClicks int
+		want      int
+	}{
+		{"unlimited", 0, concurrentClicks},
+		{"max_clicks", 10, 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config.StoreFile = filepath.Join(t.TempDir(), "store.json")
+			store, err := newJSONStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := links
+			links = store
+			t.Cleanup(func() { links = saved })
+
+			router, err := newRouter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := createTestLink(t, store, tc.maxClicks)
+
+			var mu sync.Mutex
+			statuses := make(map[int]int)
+			var wg sync.WaitGroup
+			for range concurrentClicks {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+					mu.Lock()
+					statuses[w.Code]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if statuses[http.StatusFound] != tc.want {
+				t.Errorf("statuses = %v, want %d redirects", statuses, tc.want)
+			}
+			if err := store.(*jsonStore).flushClicks(); err != nil {
+				t.Fatal(err)
+			}
+			_, _, stored, err := readJSONStore(config.StoreFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clicks := stored[code].Clicks; clicks != tc.want {
+				t.Errorf("clicks in %s = %d, want %d", config.StoreFile, clicks, tc.want)
+			}
+		})
+	}
+}
+
+// TestJSONStoreReopen checks that what the JSON store keeps instead of
+// Redis survives reopening the file.
+func TestJSONStoreReopen(t *testing.T) {
+	config.StoreFile = filepath.Join(t.TempDir(), "store.json")
+	store, err := newJSONStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := createTestLink(t, store, 0)
+	s := store.(*jsonStore)
+	if err := s.SaveNamespace(namespace{Name: "sales", Quota: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordVariant(code, 1, "visits", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordReferrerBlocked(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flushClicks(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newJSONStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := reopened.(*jsonStore)
+	if ns, err := r.GetNamespace("sales"); err != nil || ns.Quota != 5 {
+		t.Errorf("namespace = %+v, %v, want quota 5", ns, err)
+	}
+	if stats, _ := r.VariantStats(code, 2); stats[1].Visits != 3 {
+		t.Errorf("variant stats = %+v, want 3 visits of variant 1", stats)
+	}
+	if hits, _ := r.ReferrerBlockedHits(code); hits != 1 {
+		t.Errorf("blocked hits = %d, want 1", hits)
+	}
+	field := dedupeField("https://example.com/", "", "", "", "")
+	if indexed, ok := r.IndexedURL(field); !ok || indexed != code {
+		t.Errorf("index has %q, %v for the link's URL, want %s", indexed, ok, code)
+	}
+}
+
+// TestJSONStoreChecksum checks that store.json is written with a checksum
+// that a using-json file's checksum also passes, and that a changed file
+// is refused.
+func TestJSONStoreChecksum(t *testing.T) {
+	config.StoreFile = filepath.Join(t.TempDir(), "store.json")
+	store, err := newJSONStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestLink(t, store, 0)
+	if _, err := newJSONStore(); err != nil {
+		t.Fatalf("reading the written file: %v", err)
+	}
+
+	// using-json wrote its Store struct, with the checksum of the file
+	// without it as the last field.
+	type legacyStore struct {
+		IDCounter int64              `json:"idCounter"`
+		URLStore  map[string]URLData `json:"urlStore"`
+		Revision  int64              `json:"revision"`
+		Checksum  string             `json:"checksum,omitempty"`
+	}
+	legacy := legacyStore{IDCounter: 7, URLStore: map[string]URLData{"abc": {LongURL: "https://example.com/"}}, Revision: 3}
+	body, _ := json.MarshalIndent(legacy, "", "  ")
+	legacy.Checksum = jsonChecksum(body)
+	raw, _ := json.MarshalIndent(legacy, "", "  ")
+	if err := os.WriteFile(config.StoreFile, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJSONStore(); err != nil {
+		t.Fatalf("reading a using-json file: %v", err)
+	}
+
+	tampered := bytes.Replace(raw, []byte(`"idCounter": 7`), []byte(`"idCounter": 8`), 1)
+	if err := os.WriteFile(config.StoreFile, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJSONStore(); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("reading a changed file: %v, want a checksum error", err)
+	}
+}
+
+// TestRedisBreaker checks that with Redis down, commands fail with
+// errRedisDown, and that answers of Redis such as redis.Nil pass.
+func TestRedisBreaker(t *testing.T) {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	rdb.AddHook(&redisBreaker{})
+	defer rdb.Close()
+
+	if err := rdb.Get(Ctx, "missing").Err(); err != redis.Nil {
+		t.Fatalf("Get of a missing key = %v, want redis.Nil", err)
+	}
+	server.Close()
+	if err := rdb.Get(Ctx, "missing").Err(); !errors.Is(err, errRedisDown) || err == errRedisDown {
+		t.Fatalf("Get with Redis down = %v, want the connection error wrapped in errRedisDown", err)
+	}
+	start := time.Now()
+	if err := rdb.Get(Ctx, "missing").Err(); err != errRedisDown {
+		t.Fatalf("Get after a failure = %v, want errRedisDown without reaching Redis", err)
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("failing fast took %s", took)
+	}
+}
+
+// TestSQLStoreExtras checks what the SQL backends keep instead of Redis,
+// and the copy of what Redis kept before.
+func TestSQLStoreExtras(t *testing.T) {
+	config.SQLitePath = filepath.Join(t.TempDir(), "links.db")
+	store, err := newSQLiteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	s := store.(sqlStore)
+	code := createTestLink(t, store, 0)
+
+	if err := s.RecordVariant(code, 1, "visits", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordVariant(code, 1, "conversions", 1); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := s.VariantStats(code, 2); stats[1] != (variantStat{Visits: 3, Conversions: 1}) {
+		t.Errorf("variant stats = %+v, want 3 visits and 1 conversion of variant 1", stats)
+	}
+	if err := s.RecordReferrerBlocked(code); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := s.ReferrerBlockedHits(code); hits != 1 {
+		t.Errorf("blocked hits = %d, want 1", hits)
+	}
+	if err := s.RecordReferrerBlocked("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("blocked hit of a missing link = %v, want ErrNotFound", err)
+	}
+	if err := s.SaveNamespace(namespace{Name: "sales", Quota: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if ns, err := s.GetNamespace("sales"); err != nil || ns.Quota != 5 {
+		t.Errorf("namespace = %+v, %v, want quota 5", ns, err)
+	}
+	s.IndexURL("field", code)
+	if indexed, ok := s.IndexedURL("field"); !ok || indexed != code {
+		t.Errorf("index has %q, %v, want %s", indexed, ok, code)
+	}
+	if err := s.DeleteURL(code); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := s.VariantStats(code, 2); stats[1] != (variantStat{}) {
+		t.Errorf("variant stats after delete = %+v, want none", stats)
+	}
+
+	split := createTestLink(t, store, 0)
+	if err := s.UpdateURL(split, func(data *URLData) error {
+		data.Variants = []string{"https://example.org/"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	Rdb.HSet(Ctx, namespacesKey, "legacy", `{"name":"legacy","quota":7}`)
+	Rdb.HSet(Ctx, variantStatsPrefix+split, "1:visits", 4)
+	Rdb.HSet(Ctx, referrerBlockedKey, split, 2)
+	if _, err := s.db.ExecContext(Ctx, `UPDATE counters SET value = 0 WHERE name = 'redis_copied'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.copyFromRedis(); err != nil {
+		t.Fatal(err)
+	}
+	if ns, err := s.GetNamespace("legacy"); err != nil || ns.Quota != 7 {
+		t.Errorf("copied namespace = %+v, %v, want quota 7", ns, err)
+	}
+	if stats, _ := s.VariantStats(split, 2); stats[1].Visits != 4 {
+		t.Errorf("copied variant stats = %+v, want 4 visits of variant 1", stats)
+	}
+	if hits, _ := s.ReferrerBlockedHits(split); hits != 2 {
+		t.Errorf("copied blocked hits = %d, want 2", hits)
+	}
+}
+
+// TestLinkAnalytics checks that a link's analytics need its owner or an
+// admin, and read only that link's events.
+func TestLinkAnalytics(t *testing.T) {
+	saved := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = saved })
+
+	code, other := createTestLink(t, links, 0), createTestLink(t, links, 0)
+	recordClick(code, "192.0.2.1", "", "", geoLocation{}, 1)
+	recordClick(other, "192.0.2.2", "", "", geoLocation{}, 1)
+	now := time.Now()
+	events, err := PendingClicksOf([]string{code}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Code != code {
+		t.Errorf("pending events of %s = %+v, want its one click", code, events)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/analytics/" + code, "/analytics/" + code + "/export"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous GET %s = %d, want 401", path, w.Code)
+		}
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("admin GET %s = %d, want 200: %s", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAPIKeyLinks(t *testing.T) {
+	key, secret, err := newAPIKey("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAPIKey(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RevokeAPIKey(key.ID) })
+
+	code, other := "k"+encodeID(time.Now().UnixNano()), createTestLink(t, links, 0)
+	data := URLData{LongURL: "https://example.com/", CreatedAt: time.Now().Unix(), Expiry: 3600, Source: &linkSource{Channel: sourceAPI, APIKey: key.ID}}
+	if err := links.CreateURLs(context.Background(), "", []string{code}, []URLData{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, path, presented string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if presented != "" {
+			req.Header.Set(apiKeyHeader, presented)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/list", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET /list = %d, want 401", w.Code)
+	}
+	w := serve(http.MethodGet, "/list", secret)
+	var listed []struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].Code != code {
+		t.Errorf("GET /list with the key = %d %s, want only %s", w.Code, w.Body, code)
+	}
+	if w := serve(http.MethodDelete, "/delete/"+other, secret); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE of another link with the key = %d, want 403", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/delete/"+code, secret); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of the key's link = %d, want 204: %s", w.Code, w.Body)
+	}
+}
+
+func TestBulkExpiry(t *testing.T) {
+	saved := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = saved })
+
+	owner := "bulk" + encodeID(time.Now().UnixNano())
+	code, other := "b"+encodeID(time.Now().UnixNano()), createTestLink(t, links, 0)
+	data := URLData{LongURL: "https://example.com/", CreatedAt: time.Now().Unix() - 60, Expiry: 3600, Owner: owner}
+	if err := links.CreateURLs(context.Background(), "", []string{code}, []URLData{data}); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"filter": {"owner": "` + owner + `"}, "set_expires_at": ` + strconv.FormatInt(data.CreatedAt, 10) + `}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/links/expiry", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /admin/links/expiry = %d: %s", w.Code, w.Body)
+	}
+
+	got, err := GetURL(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Expiry <= 0 || !got.expired(time.Now().Unix()+1) {
+		t.Errorf("expiry set to the creation time = %d, want the link to expire now", got.Expiry)
+	}
+	if untouched, err := GetURL(other); err != nil || untouched.Expiry != 3600 {
+		t.Errorf("link of another owner = %+v, %v, want its expiry kept", untouched, err)
+	}
+}
+
+func TestRequestTenant(t *testing.T) {
+	saved := tenantProxies
+	tenantProxies = parsePrefixes([]string{"10.0.0.0/8"})
+	t.Cleanup(func() { tenantProxies = saved })
+
+	for remote, want := range map[string]string{"10.1.2.3:4000": "acme", "192.0.2.1:4000": ""} {
+		req := httptest.NewRequest(http.MethodPost, "/shorten", nil)
+		req.RemoteAddr = remote
+		req.Header.Set(tenantHeader, "acme")
+		if got := requestTenant(req); got != want {
+			t.Errorf("tenant from %s = %q, want %q", remote, got, want)
+		}
+	}
+
+	savedRegions := tenantRegions
+	tenantRegions = map[string]string{"acme": "eu", "sales": "us"}
+	t.Cleanup(func() { tenantRegions = savedRegions })
+	req := httptest.NewRequest(http.MethodPost, "/shorten", nil)
+	req.Header.Set(tenantHeader, "acme")
+	if got := requestRegion(req, ""); got != "" {
+		t.Errorf("region of an untrusted X-Tenant = %q, want home", got)
+	}
+	if got := requestRegion(req, "sales"); got != "us" {
+		t.Errorf("region of namespace sales = %q, want us", got)
+	}
+
+	recordLinkCreated("", "testkey")
+	if got := keyCountersFor("testkey").linksCreated.Load(); got != 1 {
+		t.Errorf("links created with testkey = %d, want 1", got)
+	}
+}
+
+func TestDNSCacheBounded(t *testing.T) {
+	d := &dnsCache{entries: make(map[string]dnsEntry), ttl: time.Minute, max: 2}
+	addrs := []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	d.store("a.example", addrs)
+	d.entries["a.example"] = dnsEntry{addrs: addrs, expires: time.Now().Add(-time.Second)}
+	d.store("b.example", addrs)
+	d.store("c.example", addrs)
+	if _, ok := d.entries["a.example"]; ok || len(d.entries) != 2 {
+		t.Errorf("entries = %v, want the expired a.example swept and 2 left", slices.Sorted(maps.Keys(d.entries)))
+	}
+	d.store("d.example", addrs)
+	if len(d.entries) != 2 {
+		t.Errorf("%d entries, want at most 2", len(d.entries))
+	}
+}
+
+func TestAdminScopeRules(t *testing.T) {
+	rules, err := parseIPAccess([]byte("allow admin 10.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedAdmin, savedReplication := ipAccess, adminToken, replicationToken
+	ipAccess = &ipAccessFile{rules: rules, checked: time.Now().Add(time.Hour)}
+	adminToken, replicationToken = "test-admin-token", "test-replication-token"
+	t.Cleanup(func() { ipAccess, adminToken, replicationToken = saved, savedAdmin, savedReplication })
+
+	router, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ method, path, token string }{
+		{http.MethodGet, "/list", adminToken},
+		{http.MethodDelete, "/delete/nope", adminToken},
+		{http.MethodPost, "/shorten", adminToken},
+		{http.MethodGet, "/export", replicationToken},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{"url": "https://example.com/"}`))
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s from outside the admin rules = %d, want 403", tc.method, tc.path, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(`{"url": "https://example.com/"}`)))
+	if w.Code == http.StatusForbidden {
+		t.Errorf("anonymous POST /shorten from outside the admin rules = 403, want it let in")
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	var b strings.Builder
+	icsLine(&b, "DESCRIPTION:"+strings.Repeat("x", 200))
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("folded line of %d octets, want at most 75: %q", len(line), line)
+		}
+	}
+
+	saved := adminToken
+	adminToken = "test-admin-token"
+	t.Cleanup(func() { adminToken = saved })
+	router, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, want := range map[string]int{"": http.StatusCreated, `{"owner": "bob"}`: http.StatusForbidden, `{"tag": "q4"}`: http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodPost, "/calendar-token", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		c.Set("user", "alice")
+		calendarTokenHandle(c)
+		if w.Code != want {
+			t.Errorf("alice asking for feed %q = %d, want %d: %s", body, w.Code, want, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/calendar-token", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous POST /calendar-token = %d, want 401", w.Code)
+	}
+}
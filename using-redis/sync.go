@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"maps"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// syncEntry is the part of a link an edge cache needs to redirect on its own.
+type syncEntry struct {
+	Code      string `json:"code"`
+	LongURL   string `json:"long_url"`
+	ExpiresAt string `json:"expires_at,omitempty"` // left out if the link never expires
+	// Dynamic links pick their destination per request (routing script,
+	// health-based fallbacks or unfrozen variants) and must be sent to the
+	// origin. So must disabled links, which the origin answers with 410,
+	// links that block referrers or countries or ask for the visitor's
+	// age, which only the origin checks, and links with max_clicks, which
+	// only the origin counts.
+	Dynamic bool `json:"dynamic,omitempty"`
+
+	expiresAt int64 // 0 if the link never expires
+}
+
+// diffSync compares each touched code's state at the since revision with its
+// latest state. Codes whose edge-visible fields did not change (a click
+// only bumps the counter) are left out.
+func diffSync(before map[string]URLData, after map[string]*URLData) (created, updated []syncEntry, deleted []string) {
+	created, updated, deleted = []syncEntry{}, []syncEntry{}, []string{}
+
+	codes := slices.Sorted(maps.Keys(after))
+	for _, code := range codes {
+		old, existed := before[code]
+		data := after[code]
+		switch {
+		case data == nil && existed:
+			deleted = append(deleted, code)
+		case data == nil:
+			// Created and deleted since the last sync; the edge never saw it.
+		case !existed:
+			created = append(created, syncEntryFor(code, *data))
+		case syncEntryFor(code, old) != syncEntryFor(code, *data):
+			updated = append(updated, syncEntryFor(code, *data))
+		}
+	}
+	return created, updated, deleted
+}
+
+func syncEntryFor(code string, data URLData) syncEntry {
+	entry := syncEntry{
+		Code:    code,
+		LongURL: cmp.Or(data.Frozen, data.LongURL),
+		Dynamic: data.Script != "" || len(data.Fallbacks) > 0 || (len(data.Variants) > 0 && data.Frozen == "") || data.Disabled || len(data.BlockedReferrers) > 0 || geo.applies(data) || data.MinAge > 0 || data.MaxClicks > 0,
+	}
+	if data.Expiry != 0 {
+		entry.expiresAt = data.CreatedAt + data.Expiry
+		entry.ExpiresAt = formatUnix(entry.expiresAt)
+	}
+	return entry
+}
+
+var errInvalidRevision = errors.New("invalid since revision")
+
+// syncChanges diffs the link table between since and the latest revision.
+func syncChanges(since string) (revision string, created, updated []syncEntry, deleted []string, err error) {
+	if err := checkCompacted(since); err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	ops, err := ChangesSince(since)
+	if errors.Is(err, errNoOplog) {
+		return "", nil, nil, nil, err
+	}
+	if err != nil {
+		return "", nil, nil, nil, errInvalidRevision
+	}
+
+	after := make(map[string]*URLData)
+	for _, op := range ops {
+		switch op.Op {
+		case "set":
+			if op.Data != nil {
+				after[op.Code] = op.Data
+			}
+		case "delete":
+			after[op.Code] = nil
+		}
+	}
+
+	before, err := LinksAt(since, slices.Collect(maps.Keys(after)))
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	revision = since
+	if len(ops) > 0 {
+		revision = ops[len(ops)-1].Revision
+	}
+	created, updated, deleted = diffSync(before, after)
+	return revision, created, updated, deleted, nil
+}
+
+// syncHandle lets edge caches keep a local redirect table current. Pass the
+// returned revision as since on the next call; since=0 returns every link.
+func syncHandle(c *gin.Context) {
+	since := c.DefaultQuery("since", "0")
+
+	revision, created, updated, deleted, err := syncChanges(since)
+	if errors.Is(err, errInvalidRevision) {
+		c.JSON(400, gin.H{"error": "Invalid since revision"})
+		return
+	}
+	if errors.Is(err, errNoOplog) {
+		c.JSON(501, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errCompacted) {
+		c.JSON(410, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read changes"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"since":    since,
+		"revision": revision,
+		"created":  created,
+		"updated":  updated,
+		"deleted":  deleted,
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server terminates TLS itself when config.TLS names certificate
+// files or domains. Certificate files are read again when they change, so
+// certificates renewed by certbot or similar are picked up without a
+// restart. With domains, autocert obtains certificates from Let's Encrypt
+// and renews them before they expire, answering the tls-alpn-01 challenge
+// on the HTTPS port, or http-01 on the redirect port when one is set; one
+// of them must be reachable as port 443 or 80 from the internet.
+
+// certReloadInterval is how often certificate files are checked for
+// changes.
+const certReloadInterval = time.Minute
+
+// certFiles serves the certificate in certFile and keyFile.
+type certFiles struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertFiles(certFile, keyFile string) (*certFiles, error) {
+	c := &certFiles{certFile: certFile, keyFile: keyFile}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the files again if the certificate changed since the last
+// read.
+func (c *certFiles) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Since(c.checked) < certReloadInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return c.loaded(err)
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// A renewal may have replaced one file but not yet the other.
+		return c.loaded(fmt.Errorf("TLS certificate %s: %w", c.certFile, err))
+	}
+	if c.cert != nil {
+		log.Println("Reloaded TLS certificate", c.certFile)
+	}
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// loaded keeps serving the last good certificate after err.
+func (c *certFiles) loaded(err error) (*tls.Certificate, error) {
+	if c.cert == nil {
+		return nil, err
+	}
+	log.Println("Error reloading TLS certificate, serving the previous one:", err)
+	return c.cert, nil
+}
+
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.load()
+}
+
+// newTLSConfig returns the TLS settings of the server and the handler of
+// its redirect port.
+func newTLSConfig(t TLSConfig) (*tls.Config, http.Handler, error) {
+	if len(t.Domains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.Domains...),
+			Cache:      autocert.DirCache(t.CacheDir),
+			Email:      t.Email,
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, m.HTTPHandler(http.HandlerFunc(redirectToHTTPS)), nil
+	}
+	files, err := newCertFiles(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: files.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	return cfg, http.HandlerFunc(redirectToHTTPS), nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS
+// port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if config.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(config.Port))
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+// startRedirectServer serves handler on the redirect port. It listens
+// before returning, so a taken port fails at startup.
+func startRedirectServer(port int, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Error serving HTTPS redirects:", err)
+		}
+	}()
+	return srv, nil
+}
+
+// checkTLS reports certificates that cannot be served or expire soon,
+// and autocert cache directories that cannot be written.
+func (d *doctor) checkTLS(t TLSConfig) {
+	if len(t.Domains) > 0 {
+		if err := os.MkdirAll(t.CacheDir, 0o700); err != nil {
+			d.fail("tls", fmt.Sprintf("cannot create autocert cache %s: %v", t.CacheDir, err))
+			return
+		}
+		probe, err := os.CreateTemp(t.CacheDir, ".check-*")
+		if err != nil {
+			d.fail("tls", fmt.Sprintf("cannot write autocert cache %s: %v", t.CacheDir, err))
+			return
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		d.ok("tls", fmt.Sprintf("autocert for %v, cache in %s", t.Domains, t.CacheDir))
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		d.fail("tls", fmt.Sprintf("cannot load %s and %s: %v", t.CertFile, t.KeyFile, err))
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		d.fail("tls", fmt.Sprintf("cannot parse %s: %v", t.CertFile, err))
+		return
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		d.fail("tls", fmt.Sprintf("%s expired on %s", t.CertFile, leaf.NotAfter.UTC().Format(time.DateOnly)))
+	case left < 14*24*time.Hour:
+		d.warn("tls", fmt.Sprintf("%s expires on %s", t.CertFile, leaf.NotAfter.UTC().Format(time.DateOnly)))
+	default:
+		d.ok("tls", fmt.Sprintf("%s is valid until %s", t.CertFile, leaf.NotAfter.UTC().Format(time.DateOnly)))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// topLinksKey is a sorted set of every code scored by its clicks, so the
+// most-clicked links are read without scanning the store.
+const topLinksKey = "url_top"
+
+const (
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+)
+
+// recordTopClicks sets a link's score to its click count. GT keeps a
+// redirect that read an older count from lowering it. It only logs
+// failures, since the clicks are counted by then.
+func recordTopClicks(code string, clicks int) {
+	if !config.usesRedis() {
+		return
+	}
+	err := Rdb.ZAddGT(Ctx, topLinksKey, redis.Z{Score: float64(clicks), Member: code}).Err()
+	if err != nil {
+		log.Println("Error updating top links:", err)
+	}
+}
+
+func untrackTopLinks(code string) {
+	if !config.usesRedis() {
+		return
+	}
+	if err := Rdb.ZRem(Ctx, topLinksKey, code).Err(); err != nil {
+		log.Println("Error updating top links:", err)
+	}
+}
+
+// TopLinks returns up to limit of the most-clicked links, most clicks
+// first. Codes whose link is gone are dropped from the set on the way.
+func TopLinks(limit int) ([]gin.H, error) {
+	top := []gin.H{}
+	// Read a few spare entries in case some links are gone.
+	entries, err := Rdb.ZRevRangeWithScores(Ctx, topLinksKey, 0, int64(limit+limit/2)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if len(top) == limit {
+			break
+		}
+		code := entry.Member.(string)
+		data, err := GetURL(code)
+		if errors.Is(err, ErrNotFound) {
+			untrackTopLinks(code)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		top = append(top, gin.H{
+			"rank":      len(top) + 1,
+			"code":      code,
+			"short_url": baseURL + code,
+			"long_url":  data.LongURL,
+			"clicks":    data.Clicks,
+			"disabled":  data.Disabled,
+		})
+	}
+	return top, nil
+}
+
+// prepareTopIndex scores links clicked before the index existed, once per
+// store.
+func prepareTopIndex() error {
+	if !config.usesRedis() {
+		return nil
+	}
+	built, err := Rdb.HExists(Ctx, indexStateKey, "top").Result()
+	if err != nil || built {
+		return err
+	}
+	var indexed int
+	pipe := Rdb.Pipeline()
+	err = ForEachURL(func(code string, data URLData) error {
+		if data.Clicks == 0 {
+			return nil
+		}
+		pipe.ZAddGT(Ctx, topLinksKey, redis.Z{Score: float64(data.Clicks), Member: code})
+		if indexed++; indexed%1000 == 0 {
+			_, err := pipe.Exec(Ctx)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return err
+	}
+	if err := Rdb.HSet(Ctx, indexStateKey, "top", time.Now().Unix()).Err(); err != nil {
+		return err
+	}
+	log.Printf("Built top links index for %d links.", indexed)
+	return nil
+}
+
+// topHandle lists the most-clicked links, ?limit= of them (default 10, at
+// most 100).
+func topHandle(c *gin.Context) {
+	limit := defaultTopLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxTopLimit {
+			c.JSON(400, gin.H{"error": "limit must be a number from 1 to 100"})
+			return
+		}
+		limit = n
+	}
+	links, err := TopLinks(limit)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(200, links)
+}
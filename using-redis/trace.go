@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /debug/trace runs a redirect's rules against a simulated request and
+// reports each decision, without counting a click or setting cookies.
+
+// traceStep is one rule a redirect went through and what it decided.
+type traceStep struct {
+	Rule   string `json:"rule"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// redirectTrace is the decision path of a simulated redirect: the status
+// the visitor would get and, for 302, where they would land.
+type redirectTrace struct {
+	Code        string      `json:"code"`
+	Steps       []traceStep `json:"steps"`
+	Status      int         `json:"status"`
+	Destination string      `json:"destination,omitempty"`
+}
+
+func (t *redirectTrace) step(rule, result, detail string) {
+	t.Steps = append(t.Steps, traceStep{Rule: rule, Result: result, Detail: detail})
+}
+
+type traceCtxKey struct{}
+
+// IsTraceRequest reports whether an OnRedirect hook runs for a
+// /debug/trace simulation rather than a real visitor, so hooks can skip
+// side effects such as counting.
+func IsTraceRequest(ctx context.Context) bool {
+	return ctx.Value(traceCtxKey{}) != nil
+}
+
+// traceRequest builds the visitor request a trace simulates from the
+// trace's own query: ip, user_agent, referer, query (the visitor's query
+// string) and header (repeatable, "Name: value").
+func traceRequest(ctx context.Context, code string, q url.Values) (*http.Request, error) {
+	target := "/" + url.PathEscape(code)
+	if query := q.Get("query"); query != "" {
+		target += "?" + query
+	}
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, traceCtxKey{}, true), http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range q["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("header %q must be \"Name: value\"", header)
+		}
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if ua := q.Get("user_agent"); ua != "" {
+		r.Header.Set("User-Agent", ua)
+	}
+	if referer := q.Get("referer"); referer != "" {
+		r.Header.Set("Referer", referer)
+	}
+	r.RemoteAddr = net.JoinHostPort(cmp.Or(q.Get("ip"), "127.0.0.1"), "0")
+	return r, nil
+}
+
+// traceVariant explains how a split link divides traffic and returns the
+// variant to follow: forced (the ?variant= of the trace, -1 if unset),
+// else the frozen one, else the one most redirects go to.
+func traceVariant(t *redirectTrace, data URLData, stats []variantStat, forced int) (int, error) {
+	dests := data.destinations()
+	if forced >= len(dests) {
+		return 0, fmt.Errorf("variant must be between 0 and %d", len(dests)-1)
+	}
+
+	chosen := 0
+	switch frozen := slices.Index(dests, data.Frozen); {
+	case data.Frozen != "" && frozen >= 0:
+		chosen = frozen
+		t.step("variants", "frozen", fmt.Sprintf("all traffic goes to variant %d", frozen))
+	case data.Bandit:
+		chosen = bestVariant(stats)
+		share := 1 - banditExploration + banditExploration/float64(len(dests))
+		t.step("variants", "bandit", fmt.Sprintf("variant %d converts best (%.3f smoothed) and gets %.0f%% of traffic, the others %.0f%% each",
+			chosen, stats[chosen].rate(), share*100, banditExploration/float64(len(dests))*100))
+	default:
+		t.step("variants", "split", fmt.Sprintf("each of %d variants gets %.0f%% of traffic", len(dests), 100/float64(len(dests))))
+	}
+	if forced >= 0 {
+		chosen = forced
+	}
+	t.step("variants", "chosen", fmt.Sprintf("following variant %d (%s)", chosen, dests[chosen]))
+	return chosen, nil
+}
+
+// traceVariantParam reads ?variant=, -1 when it is not set.
+func traceVariantParam(q url.Values) (int, error) {
+	raw := q.Get("variant")
+	if raw == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, errors.New("variant must be a non-negative integer")
+	}
+	return n, nil
+}
+
+func traceHandle(c *gin.Context) {
+	q := c.Request.URL.Query()
+	forced, err := traceVariantParam(q)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	r, err := traceRequest(c.Request.Context(), c.Param("code"), q)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	code := c.Param("code")
+	t := &redirectTrace{Code: code}
+
+	data, err := GetActiveURL(code)
+	if errors.Is(err, ErrNotFound) {
+		if normalized := normalizeCode(code); normalized != code {
+			t.step("normalize", "rewritten", fmt.Sprintf("%q -> %q (CODE_MATCHING=%s)", code, normalized, cmp.Or(codeMatching, "lenient")))
+			code = normalized
+			data, err = GetActiveURL(code)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		t.step("lookup", "not_found", "")
+		t.Status = http.StatusNotFound
+		c.JSON(200, t)
+		return
+	case errors.Is(err, ErrExpired):
+		t.step("lookup", "found", "")
+		t.step("expiry", "expired", "expired at "+formatUnix(data.CreatedAt+data.Expiry))
+		t.Status = http.StatusGone
+		c.JSON(200, t)
+		return
+	case errors.Is(err, ErrDisabled):
+		t.step("lookup", "found", "")
+		t.step("owner", "disabled", fmt.Sprintf("owner %s was deleted (ORPHAN_POLICY=%s)", data.Owner, orphanPolicy))
+		t.Status = http.StatusGone
+		c.JSON(200, t)
+		return
+	case errors.Is(err, ErrClickLimit):
+		t.step("lookup", "found", "")
+		t.step("max_clicks", "used_up", fmt.Sprintf("all %d clicks used", data.MaxClicks))
+		t.Status = http.StatusGone
+		c.JSON(200, t)
+		return
+	case err != nil:
+		storeError(c, err)
+		return
+	}
+
+	t.step("lookup", "found", "")
+	if data.Expiry == 0 {
+		t.step("expiry", "active", "never expires")
+	} else {
+		t.step("expiry", "active", "expires at "+formatUnix(data.CreatedAt+data.Expiry))
+	}
+	if data.MaxClicks > 0 {
+		t.step("max_clicks", "active", fmt.Sprintf("%d of %d clicks left", data.MaxClicks-data.Clicks, data.MaxClicks))
+	}
+
+	if geo.applies(data) {
+		country, source := geo.visitorCountry(r, ip)
+		if geo.blocks(data, country) {
+			t.step("geo", "blocked", fmt.Sprintf("country %s (from %s) is blocked", country, source))
+			t.Status = http.StatusUnavailableForLegalReasons
+			c.JSON(200, t)
+			return
+		}
+		t.step("geo", "allowed", fmt.Sprintf("country %s (from %s) is not blocked", country, source))
+	}
+
+	if len(data.BlockedReferrers) > 0 {
+		if referrerBlocked(data.BlockedReferrers, r.Referer()) {
+			t.step("referrer", "blocked", fmt.Sprintf("%q matches block_referrers", r.Referer()))
+			t.Status = http.StatusForbidden
+			c.JSON(200, t)
+			return
+		}
+		t.step("referrer", "allowed", fmt.Sprintf("%q matches none of %d patterns", r.Referer(), len(data.BlockedReferrers)))
+	}
+
+	if data.MinAge > 0 {
+		if ageGatePending(r, data) {
+			t.step("age_gate", "shown", fmt.Sprintf("visitor has not confirmed they are %d or older", data.MinAge))
+			t.Status = http.StatusOK
+			c.JSON(200, t)
+			return
+		}
+		t.step("age_gate", "passed", fmt.Sprintf("visitor confirmed they are %d or older", confirmedAge(r)))
+	}
+
+	if consentPending(r) {
+		t.step("consent", "shown", "visitor has not decided about click events yet")
+		t.Status = http.StatusOK
+		c.JSON(200, t)
+		return
+	}
+	if euFacing {
+		t.step("consent", cmp.Or(clickConsent(r), consentDenied), fmt.Sprintf("click events recorded: %t", recordClickEvents(r)))
+	}
+
+	if len(registeredHooks) == 0 {
+		t.step("hooks", "none", "no OnRedirect hooks registered")
+	} else if err := runRedirectHooks(r.Context(), code, data, r); err != nil {
+		t.step("hooks", "rejected", err.Error())
+		t.Status = http.StatusForbidden
+		c.JSON(200, t)
+		return
+	} else {
+		t.step("hooks", "allowed", fmt.Sprintf("%d hooks passed", len(registeredHooks)))
+	}
+
+	if len(data.Variants) > 0 {
+		var stats []variantStat
+		if data.Bandit {
+			if stats, err = VariantStats(code, len(data.Variants)+1); err != nil && !errors.Is(err, errNoRedis) {
+				c.JSON(500, gin.H{"error": "Failed to read variant stats"})
+				return
+			}
+		}
+		variant, err := traceVariant(t, data, stats, forced)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		data.LongURL = data.destinations()[variant]
+	}
+
+	if len(data.Fallbacks) > 0 {
+		if dest := healthyDestination(data); dest != data.LongURL {
+			t.step("fallbacks", "failover", fmt.Sprintf("%s is marked broken, using %s", data.LongURL, dest))
+			data.LongURL = dest
+		} else {
+			t.step("fallbacks", "primary", data.LongURL+" is healthy")
+		}
+	}
+
+	dest := data.LongURL
+	if data.Script != "" {
+		switch out, err := evalLinkScript(r.Context(), code, data.Script, r, ip); {
+		case err != nil:
+			t.step("script", "error", err.Error()+"; using the default destination")
+		case out == "":
+			t.step("script", "default", "script returned nil")
+		case !isValidURL(out):
+			t.step("script", "invalid", fmt.Sprintf("script returned %q; using the default destination", out))
+		default:
+			t.step("script", "override", "script returned "+out)
+			dest = out
+		}
+	}
+
+	t.Status = http.StatusFound
+	t.Destination = dest
+	c.JSON(200, t)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "log"
+
+// clickUniquesPrefix + code is a HyperLogLog of the hashed IPs of a
+// link's visitors. It counts unique visitors over the link's lifetime in
+// 12 KB at most, within about 1%, and keeps no addresses, so it counts
+// every visitor, consented or not.
+const clickUniquesPrefix = "click_uniques:"
+
+// recordUnique adds a visitor to code's unique count. Like recordClick it
+// only logs failures.
+func recordUnique(code, ip string) {
+	if !config.usesRedis() {
+		return
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		log.Println("Error counting unique visitor:", err)
+		return
+	}
+	if err := rdb.PFAdd(Ctx, clickUniquesPrefix+code, hashIP(ip)).Err(); err != nil {
+		log.Println("Error counting unique visitor:", err)
+	}
+}
+
+// UniqueClicks estimates how many visitors a link has had. Sampled links
+// only see 1 in sampleRate clicks, so their count is scaled up like their
+// clicks. Without Redis no visitors are counted, so it returns 0.
+func UniqueClicks(code string, sampleRate int) (int64, error) {
+	if !config.usesRedis() {
+		return 0, nil
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return 0, err
+	}
+	n, err := rdb.PFCount(Ctx, clickUniquesPrefix+code).Result()
+	return n * int64(max(sampleRate, 1)), err
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+type shortenRequest struct {
+	URL            string        `json:"url"`
+	CustomCode     string        `json:"custom_code,omitempty"`
+	ExpirySeconds  expirySeconds `json:"expiry_seconds,omitempty"`
+	Stateless      bool          `json:"stateless,omitempty"`
+	Verify         bool          `json:"verify,omitempty"`
+	Script         string        `json:"script,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	OnConflict     string        `json:"on_conflict,omitempty"`
+	Fallbacks      []string      `json:"fallbacks,omitempty"`
+	SampleRate     int           `json:"sample_rate,omitempty"`
+	Variants       []string      `json:"variants,omitempty"`
+	Bandit         bool          `json:"bandit,omitempty"`
+	BlockReferrers []string      `json:"block_referrers,omitempty"`
+	BlockCountries []string      `json:"block_countries,omitempty"`
+	MinAge         int           `json:"min_age,omitempty"`
+	Aliases        []string      `json:"aliases,omitempty"`
+	MaxClicks      int           `json:"max_clicks,omitempty"`
+	Namespace      string        `json:"namespace,omitempty"` // admins only; others create in their own
+
+	owner     string      // set from an impersonation token, never from the body
+	region    string      // data residency region of the caller's tenant
+	tenant    string      // X-Tenant of the caller, for per-tenant metrics
+	source    *linkSource // how the request arrived, set by the handler
+	namespace namespace   // the links go into, set by the handler
+}
+
+// neverExpires is the expiry_seconds of links that never expire, which
+// requests may also spell "never". Such links are stored with an Expiry
+// of 0.
+const neverExpires = -1
+
+// expirySeconds is the expiry_seconds of a request: seconds, 0 for the
+// default expiry, or neverExpires.
+type expirySeconds int64
+
+func (e *expirySeconds) UnmarshalJSON(raw []byte) error {
+	if string(raw) == `"never"` {
+		*e = neverExpires
+		return nil
+	}
+	return json.Unmarshal(raw, (*int64)(e))
+}
+
+// parseExpirySeconds reads expiry_seconds from a form or CSV field.
+func parseExpirySeconds(value string) (expirySeconds, error) {
+	if value == "never" {
+		return neverExpires, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return expirySeconds(n), err
+}
+
+const maxTags = 10
+
+// maxAliases bounds the extra codes created with a link.
+const maxAliases = 10
+
+// maxSampleRate bounds sample_rate: record 1 in N clicks, each counted N times.
+const maxSampleRate = 10000
+
+// What to do when custom_code is already taken.
+const (
+	conflictError          = "error"
+	conflictReturnExisting = "return_existing"
+	conflictSuffix         = "suffix"
+	maxConflictSuffix      = 100
+)
+
+var validTagRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// codeMatching sets how forgiving redirects are with mangled codes:
+// strict (exact only), trim (whitespace and trailing slashes) or lenient,
+// the default (also quotes, brackets, trailing punctuation and invisible
+// characters picked up when links are pasted into chat apps).
+var codeMatching = config.Codes.Matching
+
+// normalizeCode cleans a pasted code. Codes are letters, digits and '-', so
+// nothing stripped here can be part of a real code.
+func normalizeCode(raw string) string {
+	if codeMatching == "strict" {
+		return raw
+	}
+
+	code := strings.TrimRight(strings.TrimSpace(raw), "/")
+	if codeMatching != "trim" {
+		code = strings.Map(func(r rune) rune {
+			if unicode.Is(unicode.Cf, r) { // zero-width spaces, BOMs
+				return -1
+			}
+			return r
+		}, code)
+		code = strings.TrimFunc(code, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+		})
+	}
+	return code
+}
+
+// builtinReservedCodes are the first path segments of the routes, and of
+// ones likely to come, which a custom code would shadow or be shadowed
+// by. reserved_codes adds more.
+var builtinReservedCodes = []string{
+	"admin", "age", "analytics", "api", "auth", "calendar", "consent", "debug", "delete", "docs",
+	"export", "healthz", "import", "info", "links", "list", "metrics", "new", "pixel", "qr", "quota",
+	"s", "shorten", "snippet", "static", "stats", "status", "sync", "top", "variants", "webhooks",
+}
+
+// reservedCode reports whether code is a reserved word, in any case.
+func reservedCode(code string) bool {
+	match := func(word string) bool { return strings.EqualFold(word, code) }
+	return slices.ContainsFunc(builtinReservedCodes, match) || slices.ContainsFunc(config.ReservedCodes, match)
+}
+
+// foldCode is the stored form of a custom code: lowercased with
+// codes.case_insensitive, so "ABC" and "abc" are one link.
+func foldCode(code string) string {
+	if config.Codes.CaseInsensitive {
+		return strings.ToLower(code)
+	}
+	return code
+}
+
+// caseInsensitiveCodes looks up the :code of a request in lowercase when
+// codes.case_insensitive is on and no link has the code as written.
+// Generated codes keep their case, so an exact match comes first.
+func caseInsensitiveCodes() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := c.Param("code")
+		if folded := foldCode(code); folded != code {
+			if _, err := GetRedirectURL(c.Request.Context(), code); errors.Is(err, ErrNotFound) {
+				for i := range c.Params {
+					if c.Params[i].Key == "code" {
+						c.Params[i].Value = folded
+					}
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// fieldError describes one invalid field so clients can point at it.
+type fieldError struct {
+	Field      string `json:"field"`
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+// checkCodeLength holds a custom code or alias to
+// codes.custom_min_length and custom_max_length.
+func checkCodeLength(field, what, code string) *fieldError {
+	switch minLen, maxLen := config.Codes.CustomMinLength, config.Codes.CustomMaxLength; {
+	case len(code) < minLen:
+		return &fieldError{field, "min_length", fmt.Sprintf("%s must be at least %d characters", what, minLen)}
+	case maxLen > 0 && len(code) > maxLen:
+		return &fieldError{field, "max_length", fmt.Sprintf("%s must be at most %d characters", what, maxLen)}
+	}
+	return nil
+}
+
+func (req shortenRequest) validate() []fieldError {
+	var errs []fieldError
+
+	switch {
+	case req.URL == "":
+		errs = append(errs, fieldError{"url", "required", "URL is required"})
+	case !isValidURL(req.URL):
+		errs = append(errs, fieldError{"url", "scheme", "URL must start with http:// or https://"})
+	case req.Stateless && len(req.URL) > maxStatelessURL:
+		errs = append(errs, fieldError{"url", "max_length", fmt.Sprintf("URL must be at most %d bytes for a stateless link", maxStatelessURL)})
+	}
+
+	if req.CustomCode != "" {
+		if req.Stateless {
+			errs = append(errs, fieldError{"custom_code", "stateless", "Stateless links cannot use a custom code"})
+		} else if !isValidCode(req.CustomCode) {
+			errs = append(errs, fieldError{"custom_code", "alphanumeric", "Custom code may only contain letters and numbers"})
+		} else if reservedCode(req.CustomCode) {
+			errs = append(errs, fieldError{"custom_code", "reserved", fmt.Sprintf("Custom code %q is reserved", req.CustomCode)})
+		} else if fe := checkCodeLength("custom_code", "Custom code", req.CustomCode); fe != nil {
+			errs = append(errs, *fe)
+		}
+	}
+
+	if req.Script != "" {
+		if req.Stateless {
+			errs = append(errs, fieldError{"script", "stateless", "Stateless links cannot carry a script"})
+		} else if err := validateScript(req.Script); err != nil {
+			errs = append(errs, fieldError{"script", "compile", fmt.Sprintf("Script is invalid: %v", err)})
+		}
+	}
+
+	if len(req.Fallbacks) > 0 && req.Stateless {
+		errs = append(errs, fieldError{"fallbacks", "stateless", "Stateless links cannot have fallbacks"})
+	}
+	if len(req.Fallbacks) > maxFallbacks {
+		errs = append(errs, fieldError{"fallbacks", "max_items", fmt.Sprintf("At most %d fallbacks are allowed", maxFallbacks)})
+	}
+	for _, fallback := range req.Fallbacks {
+		if !isValidURL(fallback) {
+			errs = append(errs, fieldError{"fallbacks", "scheme", "Fallbacks must start with http:// or https://"})
+			break
+		}
+	}
+
+	if req.SampleRate != 0 && req.Stateless {
+		errs = append(errs, fieldError{"sample_rate", "stateless", "Stateless links have no analytics to sample"})
+	}
+	if req.SampleRate < 0 || req.SampleRate > maxSampleRate {
+		errs = append(errs, fieldError{"sample_rate", "range", fmt.Sprintf("sample_rate must be between 1 and %d", maxSampleRate)})
+	}
+
+	if len(req.Variants) > 0 && req.Stateless {
+		errs = append(errs, fieldError{"variants", "stateless", "Stateless links cannot have variants"})
+	}
+	if len(req.Variants)+1 > maxVariants {
+		errs = append(errs, fieldError{"variants", "max_items", fmt.Sprintf("At most %d variants are allowed besides url", maxVariants-1)})
+	}
+	for i, variant := range req.Variants {
+		if !isValidURL(variant) {
+			errs = append(errs, fieldError{"variants", "scheme", "Variants must start with http:// or https://"})
+			break
+		}
+		if variant == req.URL || slices.Contains(req.Variants[:i], variant) {
+			errs = append(errs, fieldError{"variants", "unique", "Variants must differ from url and from each other"})
+			break
+		}
+	}
+	if req.Bandit && len(req.Variants) == 0 {
+		errs = append(errs, fieldError{"bandit", "variants", "Bandit mode needs at least one variant"})
+	}
+
+	if len(req.BlockReferrers) > 0 && req.Stateless {
+		errs = append(errs, fieldError{"block_referrers", "stateless", "Stateless links cannot block referrers"})
+	}
+	if _, err := normalizeReferrerPatterns(req.BlockReferrers); err != nil {
+		errs = append(errs, fieldError{"block_referrers", "format", err.Error()})
+	}
+
+	if len(req.BlockCountries) > 0 && req.Stateless {
+		errs = append(errs, fieldError{"block_countries", "stateless", "Stateless links cannot block countries"})
+	}
+	if _, err := normalizeCountries(req.BlockCountries); err != nil {
+		errs = append(errs, fieldError{"block_countries", "format", err.Error()})
+	} else if len(req.BlockCountries) > 0 && !geo.configured() {
+		errs = append(errs, fieldError{"block_countries", "geoip", "Country blocking needs GEOIP_HEADER or GEOIP_DB"})
+	}
+
+	if req.MinAge != 0 && req.Stateless {
+		errs = append(errs, fieldError{"min_age", "stateless", "Stateless links cannot have an age gate"})
+	}
+	if req.MinAge != 0 && (req.MinAge < minAgeGate || req.MinAge > maxAgeGate) {
+		errs = append(errs, fieldError{"min_age", "range", fmt.Sprintf("min_age must be between %d and %d", minAgeGate, maxAgeGate)})
+	}
+
+	if req.MaxClicks != 0 {
+		switch {
+		case req.Stateless:
+			errs = append(errs, fieldError{"max_clicks", "stateless", "Stateless links cannot count clicks"})
+		case req.MaxClicks < 0:
+			errs = append(errs, fieldError{"max_clicks", "min", "max_clicks must be at least 1"})
+		case req.SampleRate > 1:
+			errs = append(errs, fieldError{"max_clicks", "sample_rate", "Links with max_clicks count every click and cannot be sampled"})
+		case len(req.Aliases) > 0:
+			errs = append(errs, fieldError{"max_clicks", "aliases", "Links with max_clicks cannot have aliases"})
+		}
+	}
+
+	if len(req.Aliases) > 0 {
+		switch {
+		case req.Stateless:
+			errs = append(errs, fieldError{"aliases", "stateless", "Stateless links cannot have aliases"})
+		case len(req.Aliases) > maxAliases:
+			errs = append(errs, fieldError{"aliases", "max_items", fmt.Sprintf("At most %d aliases are allowed", maxAliases)})
+		case req.OnConflict != "" && req.OnConflict != conflictError:
+			errs = append(errs, fieldError{"aliases", "on_conflict", "Links with aliases only support on_conflict error"})
+		}
+		for i, alias := range req.Aliases {
+			if !isValidCode(alias) {
+				errs = append(errs, fieldError{"aliases", "alphanumeric", "Aliases may only contain letters and numbers"})
+				break
+			}
+			if reservedCode(alias) {
+				errs = append(errs, fieldError{"aliases", "reserved", fmt.Sprintf("Alias %q is reserved", alias)})
+				break
+			}
+			if fe := checkCodeLength("aliases", "Aliases", alias); fe != nil {
+				errs = append(errs, *fe)
+				break
+			}
+			folded := func(code string) bool { return foldCode(code) == foldCode(alias) }
+			if folded(req.CustomCode) || slices.ContainsFunc(req.Aliases[:i], folded) {
+				errs = append(errs, fieldError{"aliases", "unique", "Aliases must differ from each other and from custom_code"})
+				break
+			}
+		}
+	}
+
+	if req.Namespace != "" {
+		if req.Stateless {
+			errs = append(errs, fieldError{"namespace", "stateless", "Stateless links cannot be in a namespace"})
+		} else if err := validateNamespaceParam(req.Namespace); err != nil {
+			errs = append(errs, fieldError{"namespace", "format", "Namespace must be 1-32 lowercase letters, numbers or '-'"})
+		}
+	}
+
+	switch req.OnConflict {
+	case "", conflictError, conflictReturnExisting, conflictSuffix:
+	default:
+		errs = append(errs, fieldError{"on_conflict", "enum", "on_conflict must be error, return_existing or suffix"})
+	}
+
+	if len(req.Tags) > maxTags {
+		errs = append(errs, fieldError{"tags", "max_items", fmt.Sprintf("At most %d tags are allowed", maxTags)})
+	}
+	for _, tag := range req.Tags {
+		if !validTagRegex.MatchString(tag) {
+			errs = append(errs, fieldError{"tags", "format", "Tags must be 1-32 letters, numbers, '-' or '_'"})
+			break
+		}
+	}
+
+	if req.ExpirySeconds < 0 && req.ExpirySeconds != neverExpires {
+		errs = append(errs, fieldError{"expiry_seconds", "min", `Expiry must be a positive number of seconds, or -1 or "never" for none`})
+	}
+	if req.ExpirySeconds == neverExpires && req.Stateless {
+		errs = append(errs, fieldError{"expiry_seconds", "stateless", "Stateless links must expire"})
+	}
+
+	return errs
+}
+
+// verifyDestination optionally checks that the URL answers before a link
+// is minted for it, using the SSRF-safe egress client.
+func (req shortenRequest) verifyDestination(ctx context.Context) []fieldError {
+	if !req.Verify {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	if err := checkReachable(ctx, req.URL); err != nil {
+		msg := "Destination is not reachable"
+		if errors.Is(err, errEgressBlocked) {
+			msg = "Destination resolves to an internal address"
+		}
+		return []fieldError{{"url", "reachable", msg}}
+	}
+	return nil
+}
+
+// bindShortenRequest accepts JSON as well as classic HTML form posts
+// (x-www-form-urlencoded and multipart/form-data).
+func bindShortenRequest(r *http.Request) (shortenRequest, error) {
+	var req shortenRequest
+
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return req, err
+		}
+		// curl -d sends JSON with the form content type by default, so only
+		// treat the body as a form when it actually has a url field.
+		if r.PostForm.Has("url") {
+			return formShortenRequest(r.PostForm)
+		}
+	}
+
+	err = json.Unmarshal(raw, &req)
+	return req, err
+}
+
+func formShortenRequest(form url.Values) (shortenRequest, error) {
+	req := shortenRequest{
+		URL:        strings.TrimSpace(form.Get("url")),
+		CustomCode: strings.TrimSpace(form.Get("custom_code")),
+		OnConflict: form.Get("on_conflict"),
+		Namespace:  form.Get("namespace"),
+	}
+
+	if v := form.Get("expiry_seconds"); v != "" {
+		expiry, err := parseExpirySeconds(v)
+		if err != nil {
+			return req, err
+		}
+		req.ExpirySeconds = expiry
+	}
+
+	req.Script = form.Get("script")
+	for _, tag := range strings.Split(form.Get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			req.Tags = append(req.Tags, tag)
+		}
+	}
+	req.Stateless = formBool(form.Get("stateless"))
+	req.Verify = formBool(form.Get("verify"))
+	return req, nil
+}
+
+func formBool(v string) bool {
+	switch v {
+	case "", "0", "false", "off":
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Split links send each redirect to one of several destinations. Plain
+// A/B links split evenly; bandit links shift traffic towards the variant
+// whose visitors convert best, as reported by the /pixel endpoint.
+
+// maxVariants caps the destinations of a split link, url included.
+const maxVariants = 5
+
+// banditExploration is the share of bandit traffic still split evenly, so
+// a variant that started badly can recover.
+const banditExploration = 0.1
+
+// variantStat counts redirects to one destination and the conversions its
+// visitors reported through the pixel.
+type variantStat struct {
+	Visits      int64 `json:"visits"`
+	Conversions int64 `json:"conversions"`
+}
+
+// rate is the conversion rate smoothed towards 1/2, so a variant nobody
+// has seen yet looks promising and gets traffic until it has results.
+func (s variantStat) rate() float64 {
+	return float64(s.Conversions+1) / float64(s.Visits+2)
+}
+
+// destinations lists the url followed by its variants; a variant is
+// identified by its index here.
+func (data URLData) destinations() []string {
+	return append([]string{data.LongURL}, data.Variants...)
+}
+
+func bestVariant(stats []variantStat) int {
+	best := 0
+	for i, s := range stats {
+		if s.rate() > stats[best].rate() {
+			best = i
+		}
+	}
+	return best
+}
+
+// chooseVariant picks the destination of one redirect: the frozen variant
+// if there is one, an even split for plain A/B links, and for bandit links
+// the best converting variant apart from a banditExploration share.
+func chooseVariant(data URLData, stats []variantStat) int {
+	dests := data.destinations()
+	if data.Frozen != "" {
+		if i := slices.Index(dests, data.Frozen); i >= 0 {
+			return i
+		}
+	}
+	if data.Bandit && mathrand.Float64() >= banditExploration {
+		return bestVariant(stats)
+	}
+	return mathrand.IntN(len(dests))
+}
+
+// variantReport is one row of the per-variant stats.
+type variantReport struct {
+	Variant        int     `json:"variant"`
+	URL            string  `json:"url"`
+	Visits         int64   `json:"visits"`
+	Conversions    int64   `json:"conversions"`
+	ConversionRate float64 `json:"conversion_rate"`
+	Frozen         bool    `json:"frozen,omitempty"`
+}
+
+func variantReports(data URLData, stats []variantStat) []variantReport {
+	reports := make([]variantReport, 0, len(stats))
+	for i, dest := range data.destinations() {
+		s := stats[i]
+		report := variantReport{Variant: i, URL: dest, Visits: s.Visits, Conversions: s.Conversions, Frozen: dest == data.Frozen}
+		if s.Visits > 0 {
+			report.ConversionRate = float64(s.Conversions) / float64(s.Visits)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// freezeRequest pins a link to one variant. Without a variant the current
+// best converting one is used.
+type freezeRequest struct {
+	Variant *int   `json:"variant"`
+	Version *int64 `json:"version"`
+}
+
+// variantCookie remembers which variant a visitor was sent to, so the pixel
+// can credit the conversion without a ?variant= parameter.
+func variantCookie(code string) string {
+	return "variant_" + code
+}
+
+// pixelGIF is a transparent 1x1 GIF.
+var pixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x01, 0x44, 0x00, 0x3b,
+}
+
+// variantStatsPrefix holds the counters of a split link as hash fields
+// "<variant>:visits" and "<variant>:conversions".
+const variantStatsPrefix = "variant_stats:"
+
+// VariantStats returns the counters of the first n variants of a link.
+func VariantStats(code string, n int) ([]variantStat, error) {
+	if counters, ok := links.(linkCounters); ok {
+		return counters.VariantStats(code, n)
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := rdb.HGetAll(Ctx, variantStatsPrefix+code).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseVariantStats(raw, n), nil
+}
+
+// parseVariantStats reads the first n variants of a variantStatsPrefix
+// hash.
+func parseVariantStats(raw map[string]string, n int) []variantStat {
+	stats := make([]variantStat, n)
+	for field, value := range raw {
+		index, counter, _ := strings.Cut(field, ":")
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= n {
+			continue
+		}
+		count, _ := strconv.ParseInt(value, 10, 64)
+		switch counter {
+		case "visits":
+			stats[i].Visits = count
+		case "conversions":
+			stats[i].Conversions = count
+		}
+	}
+	return stats
+}
+
+// RecordVariant adds n to one counter ("visits" or "conversions") of a variant.
+func RecordVariant(code string, variant int, counter string, n int) error {
+	if counters, ok := links.(linkCounters); ok {
+		return counters.RecordVariant(code, variant, counter, n)
+	}
+	if !config.usesRedis() {
+		return nil
+	}
+	rdb, err := clientForCode(code)
+	if err != nil {
+		return err
+	}
+	return rdb.HIncrBy(Ctx, variantStatsPrefix+code, fmt.Sprintf("%d:%s", variant, counter), int64(n)).Err()
+}
+
+// pickVariant chooses the destination index for a redirect of a split
+// link. Stats are only read for bandit links that are not frozen; without
+// them, as without Redis, the link splits evenly.
+func pickVariant(code string, data URLData) int {
+	var stats []variantStat
+	if data.Bandit && data.Frozen == "" {
+		var err error
+		if stats, err = VariantStats(code, len(data.Variants)+1); err != nil && !errors.Is(err, errNoRedis) {
+			log.Println("Error reading variant stats:", err)
+		}
+	}
+	return chooseVariant(data, stats)
+}
+
+// setVariantCookie scopes the cookie to the link's pixel. Browsers only
+// send it from other sites when it is SameSite=None, which needs HTTPS.
+func setVariantCookie(c *gin.Context, code string, variant int) {
+	secure := strings.HasPrefix(baseURL, "https://")
+	if secure {
+		c.SetSameSite(http.SameSiteNoneMode)
+	} else {
+		c.SetSameSite(http.SameSiteLaxMode)
+	}
+	c.SetCookie(variantCookie(code), strconv.Itoa(variant), 30*24*3600, "/pixel/"+code, "", secure, true)
+}
+
+// pixelHandle credits a conversion to the variant a visitor was sent to,
+// taken from ?variant= or the redirect cookie. Unknown variants are
+// ignored so the page embedding the pixel still gets its image.
+func pixelHandle(c *gin.Context) {
+	code := c.Param("code")
+	data, err := GetActiveURL(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	raw := c.Query("variant")
+	if raw == "" {
+		raw, _ = c.Cookie(variantCookie(code))
+	}
+	if variant, err := strconv.Atoi(raw); err == nil && variant >= 0 && variant <= len(data.Variants) {
+		if err := RecordVariant(code, variant, "conversions", 1); err != nil {
+			log.Println("Error recording conversion:", err)
+		}
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(200, "image/gif", pixelGIF)
+}
+
+func variantsHandle(c *gin.Context) {
+	code := c.Param("code")
+	data, err := GetURL(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	stats, err := VariantStats(code, len(data.Variants)+1)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"code":     code,
+		"bandit":   data.Bandit,
+		"frozen":   data.Frozen != "",
+		"variants": variantReports(data, stats),
+	})
+}
+
+// freezeVariantHandle stops a split link from shifting traffic and sends
+// every redirect to one variant until it is unfrozen. Only the link's
+// owner or an admin may freeze it, as with other edits.
+func freezeVariantHandle(c *gin.Context) {
+	code := c.Param("code")
+	var req freezeRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	data, err := GetURL(code)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	if !mayManage(c, &data) {
+		c.JSON(403, gin.H{"error": "Link belongs to another user"})
+		return
+	}
+	if len(data.Variants) == 0 {
+		c.JSON(400, gin.H{"error": "Link has no variants"})
+		return
+	}
+
+	var variant int
+	if req.Variant != nil {
+		variant = *req.Variant
+		if variant < 0 || variant > len(data.Variants) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("variant must be between 0 and %d", len(data.Variants))})
+			return
+		}
+	} else {
+		stats, err := VariantStats(code, len(data.Variants)+1)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		variant = bestVariant(stats)
+	}
+
+	dest := data.destinations()[variant]
+	updated, ok := editLink(c, "link.freeze", req.Version, func(data *URLData) ([]string, error) {
+		data.Frozen = dest
+		return []string{"frozen"}, nil
+	})
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{"code": code, "frozen": true, "variant": variant, "url": dest, "version": updated.Version})
+}
+
+// unfreezeVariantHandle resumes splitting, for the link's owner or an
+// admin.
+func unfreezeVariantHandle(c *gin.Context) {
+	code := c.Param("code")
+	updated, ok := editLink(c, "link.unfreeze", nil, func(data *URLData) ([]string, error) {
+		data.Frozen = ""
+		return []string{"frozen"}, nil
+	})
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{"code": code, "frozen": false, "version": updated.Version})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The verifier samples a few links at a time and checks state that is
+// kept in more than one place: the expiry index, click counters and the
+// ID counter. Drift is counted on /metrics and repaired when the repair
+// cannot lose data.
+
+// verifyKey is a hash holding the counter high-water mark.
+const verifyKey = "url_verify"
+
+// What the verifier checks.
+const (
+	checkExpiryIndex = "expiry_index" // url_expiry agrees with each link's expiry
+	checkClicks      = "clicks"       // click counts never go down and cover the rollups
+	checkCounter     = "counter"      // the ID counter never goes below its high-water mark
+)
+
+var verifyChecks = []string{checkExpiryIndex, checkClicks, checkCounter}
+
+type verifyCounters struct {
+	drift  atomic.Int64
+	healed atomic.Int64
+}
+
+var (
+	verifyMetrics = map[string]*verifyCounters{
+		checkExpiryIndex: {},
+		checkClicks:      {},
+		checkCounter:     {},
+	}
+	verifyRuns    atomic.Int64
+	verifySampled atomic.Int64
+	verifyLastRun atomic.Int64
+)
+
+// verifyHeal is on unless VERIFY_HEAL=false, which only reports drift.
+var verifyHeal = config.Verify.Heal
+
+// verifyPause spaces out the commands of a run so it never competes with
+// redirects for Redis.
+const verifyPause = 5 * time.Millisecond
+
+// seenClicks remembers the click count of links sampled before, to catch a
+// count that went down. It is reset when it grows past maxSeenClicks.
+var (
+	seenClicksMu sync.Mutex
+	seenClicks   = make(map[string]int)
+)
+
+const maxSeenClicks = 100_000
+
+func recordDrift(check, format string, args ...any) {
+	verifyMetrics[check].drift.Add(1)
+	log.Printf("Verify %s: "+format, append([]any{check}, args...)...)
+}
+
+func recordHealed(check string) {
+	verifyMetrics[check].healed.Add(1)
+}
+
+// verifyStore runs one pass over every backend.
+func verifyStore() error {
+	defer verifyLastRun.Store(time.Now().Unix())
+	verifyRuns.Add(1)
+
+	var errs []error
+	errs = append(errs, verifyCounter())
+	for _, rdb := range allClients() {
+		errs = append(errs, verifyLinks(rdb), verifyIndexEntries(rdb))
+	}
+	return errors.Join(errs...)
+}
+
+// verifyLinks checks randomly picked links against the expiry index and
+// their click history.
+func verifyLinks(rdb *redis.Client) error {
+	for range config.Verify.Sample {
+		time.Sleep(verifyPause)
+		code, err := rdb.RandomKey(Ctx).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := getURLFrom(Ctx, rdb, code)
+		if err != nil {
+			continue // not a link
+		}
+		verifySampled.Add(1)
+
+		if err := verifyExpiryEntry(rdb, code); err != nil {
+			return err
+		}
+		if err := verifyClicks(rdb, code, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyExpiryEntry compares the index entry of code with the link. The
+// link is the source of truth, so a wrong or missing entry is rewritten
+// from it. WATCH drops the repair if the link changes meanwhile; that
+// write fixes the entry itself.
+func verifyExpiryEntry(rdb *redis.Client, code string) error {
+	err := rdb.Watch(Ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(Ctx, code).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil // deleted since it was sampled
+		}
+		if err != nil {
+			return err
+		}
+		var data URLData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil
+		}
+
+		score, err := tx.ZScore(Ctx, expiryIndexKey, code).Result()
+		indexed := err == nil
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		switch {
+		case data.Expiry == 0 && !indexed:
+			return nil
+		case data.Expiry == 0:
+			recordDrift(checkExpiryIndex, "%s has no expiry but is indexed", code)
+		case !indexed:
+			recordDrift(checkExpiryIndex, "%s is missing from the index", code)
+		case int64(score) != data.CreatedAt+data.Expiry:
+			recordDrift(checkExpiryIndex, "%s is indexed at %d instead of %d", code, int64(score), data.CreatedAt+data.Expiry)
+		default:
+			return nil
+		}
+		if !verifyHeal {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+			indexExpiry(pipe, code, data)
+			return nil
+		})
+		if err == nil {
+			recordHealed(checkExpiryIndex)
+		}
+		return err
+	}, code)
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil
+	}
+	return err
+}
+
+// verifyIndexEntries looks for index entries whose link is gone, which
+// would otherwise sit in url_expiry forever.
+func verifyIndexEntries(rdb *redis.Client) error {
+	size, err := rdb.ZCard(Ctx, expiryIndexKey).Result()
+	if err != nil || size == 0 {
+		return err
+	}
+
+	for range min(int64(config.Verify.Sample), size) {
+		time.Sleep(verifyPause)
+		i := mathrand.Int64N(size)
+		members, err := rdb.ZRange(Ctx, expiryIndexKey, i, i).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			continue // the index shrank meanwhile
+		}
+		code := members[0]
+
+		err = rdb.Watch(Ctx, func(tx *redis.Tx) error {
+			exists, err := tx.Exists(Ctx, code).Result()
+			if err != nil || exists == 1 {
+				return err
+			}
+			recordDrift(checkExpiryIndex, "%s is indexed but does not exist", code)
+			if !verifyHeal {
+				return nil
+			}
+			_, err = tx.TxPipelined(Ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZRem(Ctx, expiryIndexKey, code)
+				return nil
+			})
+			if err == nil {
+				recordHealed(checkExpiryIndex)
+			}
+			return err
+		}, code)
+		if err != nil && !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyClicks reports a click count that went down since it was last
+// sampled, or that is below the clicks already rolled up for the link.
+// Neither is repaired: the count that is right cannot be told apart from
+// the one that drifted.
+func verifyClicks(rdb *redis.Client, code string, data URLData) error {
+	seenClicksMu.Lock()
+	last, seen := seenClicks[code]
+	if len(seenClicks) >= maxSeenClicks {
+		clear(seenClicks)
+	}
+	seenClicks[code] = data.Clicks
+	seenClicksMu.Unlock()
+
+	if seen && data.Clicks < last {
+		recordDrift(checkClicks, "%s went from %d to %d clicks", code, last, data.Clicks)
+	}
+
+	raw, err := rdb.HVals(Ctx, clickDailyPrefix+code).Result()
+	if err != nil {
+		return err
+	}
+	var rolledUp int64
+	for _, value := range raw {
+		var agg dailyClicks
+		if json.Unmarshal([]byte(value), &agg) == nil {
+			rolledUp += agg.Count
+		}
+	}
+	if rolledUp > int64(data.Clicks) {
+		recordDrift(checkClicks, "%s has %d clicks but %d rolled up", code, data.Clicks, rolledUp)
+	}
+	return nil
+}
+
+// verifyCounter compares the ID counter with the highest value seen on an
+// earlier run. A counter that went back would hand out codes that were
+// already used, so it is raised to the high-water mark again.
+func verifyCounter() error {
+	counter, err := links.Counter()
+	if err != nil {
+		return err
+	}
+	highWater, err := Rdb.HGet(Ctx, verifyKey, "counter_high_water").Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	if counter >= highWater {
+		return Rdb.HSet(Ctx, verifyKey, "counter_high_water", counter).Err()
+	}
+	recordDrift(checkCounter, "ID counter is %d, below its high-water mark %d", counter, highWater)
+	if !verifyHeal {
+		return nil
+	}
+	if err := EnsureCounterFloor(highWater); err != nil {
+		return err
+	}
+	recordHealed(checkCounter)
+	return nil
+}
+
+func startVerifier(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Replicas copy the primary, drift included; repairs made
+			// there would be overwritten.
+			if replicaMode.Load() {
+				continue
+			}
+			if err := verifyStore(); err != nil {
+				log.Println("Error verifying store:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func writeVerifyMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP urlshortener_verify_runs_total Consistency verifier runs since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_verify_runs_total counter\n")
+	fmt.Fprintf(w, "urlshortener_verify_runs_total %d\n", verifyRuns.Load())
+	fmt.Fprintf(w, "# HELP urlshortener_verify_sampled_total Links checked by the verifier since the process started.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_verify_sampled_total counter\n")
+	fmt.Fprintf(w, "urlshortener_verify_sampled_total %d\n", verifySampled.Load())
+	fmt.Fprintf(w, "# HELP urlshortener_verify_last_run_timestamp_seconds When the verifier last finished a run.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_verify_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "urlshortener_verify_last_run_timestamp_seconds %d\n", verifyLastRun.Load())
+	fmt.Fprintf(w, "# HELP urlshortener_verify_drift_total Inconsistencies found by the verifier, by check.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_verify_drift_total counter\n")
+	for _, check := range verifyChecks {
+		fmt.Fprintf(w, "urlshortener_verify_drift_total{check=%q} %d\n", check, verifyMetrics[check].drift.Load())
+	}
+	fmt.Fprintf(w, "# HELP urlshortener_verify_healed_total Inconsistencies the verifier repaired, by check.\n")
+	fmt.Fprintf(w, "# TYPE urlshortener_verify_healed_total counter\n")
+	for _, check := range verifyChecks {
+		fmt.Fprintf(w, "urlshortener_verify_healed_total{check=%q} %d\n", check, verifyMetrics[check].healed.Load())
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Webhooks POST link lifecycle events to URLs registered under /webhooks.
+// A signed-in user's webhooks hear about that user's links; the admin's
+// hear about every link. Each request carries an HMAC-SHA256 signature of
+// "<timestamp>.<body>" keyed with the webhook's secret, and failed
+// deliveries are retried with backoff. Deliveries go through the egress
+// client, so webhooks cannot reach internal addresses.
+const (
+	webhooksKey     = "url_webhooks"      // id -> webhook JSON
+	webhookQueueKey = "url_webhook_queue" // sorted set of delivery JSON scored by due time in ms
+)
+
+const (
+	eventLinkCreated = "link.created"
+	eventLinkUpdated = "link.updated"
+	eventLinkDeleted = "link.deleted"
+	eventLinkExpired = "link.expired"
+	eventLinkClicks  = "link.clicks"
+
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	maxWebhooksPerOwner = 20
+)
+
+var webhookEvents = []string{eventLinkCreated, eventLinkUpdated, eventLinkDeleted, eventLinkExpired, eventLinkClicks}
+
+// webhookRetries are the waits before each retry of a failed delivery;
+// after the last one the delivery is dropped.
+var webhookRetries = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+type webhook struct {
+	ID             string   `json:"id"`
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret"`
+	Events         []string `json:"events"`
+	ClickThreshold int      `json:"click_threshold,omitempty"` // link.clicks fires when a link's clicks reach it
+	Owner          string   `json:"owner,omitempty"`           // "" for the admin's webhooks, which hear about every link
+	CreatedAt      int64    `json:"created_at"`
+}
+
+// view leaves out the secret, which is only shown when the webhook is
+// created.
+func (h webhook) view() gin.H {
+	view := gin.H{"id": h.ID, "url": h.URL, "events": h.Events, "created_at": formatUnix(h.CreatedAt)}
+	if h.ClickThreshold > 0 {
+		view["click_threshold"] = h.ClickThreshold
+	}
+	if h.Owner != "" {
+		view["owner"] = h.Owner
+	}
+	return view
+}
+
+// hears reports whether the webhook wants event about a link of owner.
+func (h webhook) hears(event, owner string) bool {
+	return (h.Owner == "" || h.Owner == owner) && slices.Contains(h.Events, event)
+}
+
+// webhookDelivery is one event on its way to one webhook.
+type webhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Attempt   int             `json:"attempt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func SaveWebhook(h webhook) error {
+	raw, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := Rdb.HSet(Ctx, webhooksKey, h.ID, raw).Err(); err != nil {
+		return err
+	}
+	webhookCache.forget()
+	return nil
+}
+
+// DeleteWebhook deletes a webhook, or returns ErrNotFound. Its queued
+// deliveries are dropped when they come due.
+func DeleteWebhook(id string) error {
+	n, err := Rdb.HDel(Ctx, webhooksKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	webhookCache.forget()
+	return nil
+}
+
+func GetWebhook(id string) (webhook, error) {
+	var h webhook
+	raw, err := Rdb.HGet(Ctx, webhooksKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return h, ErrNotFound
+	}
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal([]byte(raw), &h)
+	return h, err
+}
+
+// Webhooks returns every webhook, oldest first.
+func Webhooks() ([]webhook, error) {
+	if !config.usesRedis() {
+		return nil, nil // registering one needs Redis
+	}
+	raw, err := Rdb.HGetAll(Ctx, webhooksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]webhook, 0, len(raw))
+	for _, value := range raw {
+		var h webhook
+		if err := json.Unmarshal([]byte(value), &h); err == nil {
+			hooks = append(hooks, h)
+		}
+	}
+	slices.SortFunc(hooks, func(a, b webhook) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return hooks, nil
+}
+
+// webhookCache keeps the registered webhooks for a few seconds, so
+// redirects can check click thresholds without a Redis read each.
+// Webhooks registered on another instance are picked up within the TTL.
+var webhookCache = &webhookList{ttl: 10 * time.Second}
+
+type webhookList struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	hooks    []webhook
+	loadedAt time.Time
+}
+
+func (l *webhookList) get() ([]webhook, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.loadedAt) < l.ttl {
+		return l.hooks, nil
+	}
+	hooks, err := Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	l.hooks, l.loadedAt = hooks, time.Now()
+	return hooks, nil
+}
+
+func (l *webhookList) forget() {
+	l.mu.Lock()
+	l.loadedAt = time.Time{}
+	l.mu.Unlock()
+}
+
+// webhookLink is the link as described in event payloads.
+func webhookLink(data URLData) gin.H {
+	link := gin.H{"long_url": data.LongURL, "clicks": data.Clicks, "created_at": formatUnix(data.CreatedAt)}
+	if data.Expiry != 0 {
+		link["expires_at"] = formatUnix(data.CreatedAt + data.Expiry)
+	}
+	if data.Owner != "" {
+		link["owner"] = data.Owner
+	}
+	if data.Tags != nil {
+		link["tags"] = data.Tags
+	}
+	return link
+}
+
+// notifyWebhooks queues event about the link code for every webhook that
+// hears it. It only logs failures, since the change it reports is made by
+// then. extra is merged into the payload.
+func notifyWebhooks(event, code string, data URLData, extra gin.H) {
+	hooks, err := webhookCache.get()
+	if err != nil {
+		log.Println("Error reading webhooks:", err)
+		return
+	}
+	for _, h := range hooks {
+		if !h.hears(event, data.Owner) {
+			continue
+		}
+		if err := queueWebhook(h, event, code, data, extra); err != nil {
+			log.Printf("Error queueing %s webhook %s: %v", event, h.ID, err)
+		}
+	}
+}
+
+func queueWebhook(h webhook, event, code string, data URLData, extra gin.H) error {
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	payload := gin.H{"id": id, "event": event, "time": time.Now().UTC().Format(time.RFC3339), "code": code, "link": webhookLink(data)}
+	for k, v := range extra {
+		payload[k] = v
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return scheduleDelivery(webhookDelivery{ID: id, WebhookID: h.ID, Event: event, Payload: raw}, time.Now())
+}
+
+func scheduleDelivery(d webhookDelivery, due time.Time) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return Rdb.ZAdd(Ctx, webhookQueueKey, redis.Z{Score: float64(due.UnixMilli()), Member: raw}).Err()
+}
+
+// notifyClickThreshold fires link.clicks for the webhooks whose threshold
+// a redirect took the link's clicks from before to after.
+func notifyClickThreshold(code string, data URLData, before, after int) {
+	hooks, err := webhookCache.get()
+	if err != nil {
+		log.Println("Error reading webhooks:", err)
+		return
+	}
+	for _, h := range hooks {
+		if h.ClickThreshold > before && h.ClickThreshold <= after && h.hears(eventLinkClicks, data.Owner) {
+			if err := queueWebhook(h, eventLinkClicks, code, data, gin.H{"threshold": h.ClickThreshold}); err != nil {
+				log.Printf("Error queueing %s webhook %s: %v", eventLinkClicks, h.ID, err)
+			}
+		}
+	}
+}
+
+// signWebhook returns the signature header of body sent at ts.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs a delivery once. Any 2xx answer counts as
+// delivered.
+func deliverWebhook(ctx context.Context, h webhook, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "url-shortener-webhooks/1.0")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, ts, d.Payload))
+
+	resp, err := egressClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deliverDue sends the deliveries that have come due. Each is claimed by
+// removing it from the queue, so several instances can share the queue
+// without sending anything twice.
+func deliverDue(ctx context.Context) {
+	now := time.Now()
+	due, err := Rdb.ZRangeByScore(Ctx, webhookQueueKey, &redis.ZRangeBy{
+		Min: "-inf", Max: strconv.FormatInt(now.UnixMilli(), 10), Count: 50,
+	}).Result()
+	if err != nil {
+		// While Redis is down, only the retries that reach for it are logged.
+		if err != errRedisDown {
+			log.Println("Error reading webhook queue:", err)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, raw := range due {
+		if claimed, err := Rdb.ZRem(Ctx, webhookQueueKey, raw).Result(); err != nil || claimed == 0 {
+			continue
+		}
+		var d webhookDelivery
+		if err := json.Unmarshal([]byte(raw), &d); err != nil {
+			continue
+		}
+		h, err := GetWebhook(d.WebhookID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			scheduleDelivery(d, now.Add(webhookRetries[0]))
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := deliverWebhook(ctx, h, d)
+			if err == nil {
+				return
+			}
+			if d.Attempt >= len(webhookRetries) {
+				log.Printf("Giving up on %s delivery %s to webhook %s: %v", d.Event, d.ID, h.ID, err)
+				return
+			}
+			log.Printf("Error delivering %s to webhook %s, retrying in %s: %v", d.Event, h.ID, webhookRetries[d.Attempt], err)
+			retry := d
+			retry.Attempt++
+			if err := scheduleDelivery(retry, time.Now().Add(webhookRetries[d.Attempt])); err != nil {
+				log.Println("Error queueing webhook retry:", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func startWebhookDeliveries(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deliverDue(context.Background())
+		case <-stop:
+			return
+		}
+	}
+}
+
+type webhookRequest struct {
+	URL            string   `json:"url"`
+	Events         []string `json:"events"`
+	ClickThreshold int      `json:"click_threshold"`
+}
+
+func (req webhookRequest) validate() []fieldError {
+	var errs []fieldError
+	if !isValidURL(req.URL) {
+		errs = append(errs, fieldError{"url", "scheme", "URL must start with http:// or https://"})
+	}
+	if len(req.Events) == 0 {
+		errs = append(errs, fieldError{"events", "required", "List the events to send: " + strings.Join(webhookEvents, ", ")})
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			errs = append(errs, fieldError{"events", "enum", fmt.Sprintf("Unknown event %q; use %s", event, strings.Join(webhookEvents, ", "))})
+			break
+		}
+	}
+	switch {
+	case slices.Contains(req.Events, eventLinkClicks) && req.ClickThreshold < 1:
+		errs = append(errs, fieldError{"click_threshold", "required", "link.clicks needs a click_threshold of at least 1"})
+	case !slices.Contains(req.Events, eventLinkClicks) && req.ClickThreshold != 0:
+		errs = append(errs, fieldError{"click_threshold", "unused", "click_threshold only applies to link.clicks"})
+	}
+	return errs
+}
+
+// webhookOwner is whose links the caller's webhooks hear about: the
+// signed-in user's, or every link ("") for admins.
+func webhookOwner(c *gin.Context) string {
+	if isAdmin(c.Request) {
+		return ""
+	}
+	return requestUser(c)
+}
+
+func createWebhookHandle(c *gin.Context) {
+	var req webhookRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	slices.Sort(req.Events)
+	req.Events = slices.Compact(req.Events)
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Validation failed", "fields": errs})
+		return
+	}
+
+	owner := webhookOwner(c)
+	hooks, err := Webhooks()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	if owner != "" && len(slices.DeleteFunc(hooks, func(h webhook) bool { return h.Owner != owner })) >= maxWebhooksPerOwner {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("At most %d webhooks are allowed per user", maxWebhooksPerOwner)})
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	h := webhook{
+		ID:             id,
+		URL:            req.URL,
+		Secret:         "whsec_" + secret,
+		Events:         req.Events,
+		ClickThreshold: req.ClickThreshold,
+		Owner:          owner,
+		CreatedAt:      time.Now().Unix(),
+	}
+	if err := SaveWebhook(h); err != nil {
+		storeError(c, err)
+		return
+	}
+	view := h.view()
+	view["secret"] = h.Secret
+	c.JSON(http.StatusCreated, view)
+}
+
+// listWebhooksHandle lists the caller's webhooks; admins see everyone's.
+func listWebhooksHandle(c *gin.Context) {
+	hooks, err := Webhooks()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	admin := isAdmin(c.Request)
+	views := []gin.H{}
+	for _, h := range hooks {
+		if admin || h.Owner == requestUser(c) {
+			views = append(views, h.view())
+		}
+	}
+	c.JSON(200, views)
+}
+
+func deleteWebhookHandle(c *gin.Context) {
+	h, err := GetWebhook(c.Param("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && !isAdmin(c.Request) && h.Owner != requestUser(c)) {
+		c.JSON(404, gin.H{"error": "Webhook not found"})
+		return
+	} else if err != nil {
+		storeError(c, err)
+		return
+	}
+	if err := DeleteWebhook(h.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		storeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}